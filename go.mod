@@ -9,8 +9,10 @@ require (
 	github.com/golang/glog v0.0.0-20160126235308-23def4e6c14b
 	github.com/gorilla/websocket v1.0.1-0.20160912153041-2d1e4548da23
 	github.com/juju/errors v1.0.0
-	github.com/lib/pq v0.0.0-20160831222520-50761b0867bd
+	github.com/lib/pq v1.10.9
+	github.com/mattn/go-sqlite3 v1.14.17
 	goji.io v1.1.1-0.20160912032033-491574a68aaf
+	golang.org/x/net v0.2.0
 	golang.org/x/oauth2 v0.0.0-20151109224455-3314c49c831b
 	gopkg.in/yaml.v2 v2.4.0
 )
@@ -18,7 +20,6 @@ require (
 require (
 	github.com/golang/protobuf v1.0.0 // indirect
 	github.com/kr/pretty v0.3.1 // indirect
-	golang.org/x/net v0.2.0 // indirect
 	golang.org/x/sync v0.5.0 // indirect
 	google.golang.org/appengine v1.0.0 // indirect
 )
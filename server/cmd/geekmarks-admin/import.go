@@ -0,0 +1,76 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+
+	gmserver "dmitryfrank.com/geekmarks/server/server"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+func cmdImport(si storage.Storage, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	username := fs.String("user", "", "Username of the user to import bookmarks for.")
+	verbose := fs.Bool("verbose", false, "Print each skipped bookmark.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: %s import -user <username> [-verbose] <bookmarks.html>
+
+Imports the Netscape bookmarks file, as exported by browsers. Folders become
+tags, and bookmarks which the user already has are skipped.
+
+Flags:
+`, os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return errors.Trace(errUsage)
+	}
+
+	if fs.NArg() != 1 || *username == "" {
+		fs.Usage()
+		return errors.Trace(errUsage)
+	}
+
+	var ud *storage.UserData
+	err := si.Tx(func(tx *sql.Tx) error {
+		var err error
+		ud, err = si.GetUser(tx, &storage.GetUserArgs{Username: username})
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return errors.Annotatef(err, "getting user %q", *username)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer f.Close()
+
+	gm, err := gmserver.New(si)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	report, err := gm.ImportNetscapeBookmarks(context.Background(), ud.ID, f)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if *verbose {
+		for _, skipped := range report.Skipped {
+			fmt.Printf("Skipped (%s): %s\n", skipped.Reason, skipped.URL)
+		}
+	}
+	fmt.Printf("%d bookmarks created, %d skipped\n", report.CreatedCnt, report.SkippedCnt)
+
+	return nil
+}
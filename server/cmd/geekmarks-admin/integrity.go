@@ -0,0 +1,57 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+func cmdIntegrity(si storage.Storage, args []string) error {
+	fs := flag.NewFlagSet("integrity", flag.ContinueOnError)
+	repair := fs.Bool("repair", false,
+		"Fix the problems which can be fixed automatically, and print each fix.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s integrity [-repair]\n\nFlags:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return errors.Trace(errUsage)
+	}
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return errors.Trace(errUsage)
+	}
+
+	if *repair {
+		fixes, err := si.RepairIntegrity()
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		for _, fix := range fixes {
+			fmt.Printf("Fixed: %s\n", fix.Descr)
+		}
+		fmt.Printf("%d problems fixed\n", len(fixes))
+	}
+
+	report, err := si.GetIntegrityReport()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if !report.OK() {
+		fmt.Printf("%s\n", report)
+		return errors.Errorf("integrity is broken")
+	}
+
+	fmt.Printf("Integrity is OK\n")
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// geekmarks-admin is a command line tool for maintenance tasks which should
+// not be performed by the running server, e.g. database migrations.
+//
+// Usage:
+//
+//	geekmarks-admin [flags] <command> [command flags] [args]
+//
+// Storage is configured with the same flags (or environment variables) as
+// the server; run with -help to see them.
+package main // import "dmitryfrank.com/geekmarks/server/cmd/geekmarks-admin"
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	storagecommon "dmitryfrank.com/geekmarks/server/storage/common"
+	"github.com/golang/glog"
+	"github.com/juju/errors"
+)
+
+type command struct {
+	descr string
+	run   func(si storage.Storage, args []string) error
+}
+
+var commands = map[string]command{
+	"import":         {"Import bookmarks from a browser bookmarks file", cmdImport},
+	"integrity":      {"Check and repair data integrity", cmdIntegrity},
+	"migrate":        {"Show, apply or revert database migrations", cmdMigrate},
+	"recanonicalize": {"Update canonical URLs of bookmarks", cmdRecanonicalize},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] <command> [command flags] [args]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+
+	names := []string{}
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-15s %s\n", name, commands[name].descr)
+	}
+
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	defer glog.Flush()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command: %q\n\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+
+	si, err := storagecommon.CreateStorage()
+	if err != nil {
+		glog.Fatalf("%s\n", errors.ErrorStack(err))
+	}
+
+	err = si.Connect()
+	if err != nil {
+		glog.Fatalf("%s\n", errors.ErrorStack(err))
+	}
+
+	err = cmd.run(si, flag.Args()[1:])
+	if err != nil {
+		if errors.Cause(err) == errUsage {
+			os.Exit(2)
+		}
+		glog.Errorf("%s\n", errors.ErrorStack(err))
+		glog.Flush()
+		os.Exit(1)
+	}
+}
+
+// errUsage is returned by commands when the arguments are wrong; the usage
+// is already printed by then.
+var errUsage = errors.New("usage error")
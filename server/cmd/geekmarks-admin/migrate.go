@@ -0,0 +1,167 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	"dmitryfrank.com/geekmarks/server/dfmigrate"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+func cmdMigrate(si storage.Storage, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false,
+		"Print the statements which would be executed, without committing them.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: %s migrate [-dry-run] <subcommand>
+
+Subcommands:
+  status    Show current and latest migration ids, and pending migrations
+  up        Apply all pending migrations
+  down      Revert the last applied migration
+  to <id>   Apply or revert migrations until the given id is reached;
+            0 reverts everything
+  accept-drift
+            Make the registered migrations the reference for the applied
+            ones, after the changes in them are reviewed
+
+Flags:
+`, os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return errors.Trace(errUsage)
+	}
+
+	usageErr := func() error {
+		fs.Usage()
+		return errors.Trace(errUsage)
+	}
+
+	if fs.NArg() == 0 {
+		return usageErr()
+	}
+
+	status, err := si.GetMigrationStatus()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var targetID int
+
+	switch fs.Arg(0) {
+	case "status":
+		if fs.NArg() != 1 {
+			return usageErr()
+		}
+		printMigrationStatus(status)
+		return nil
+
+	case "up":
+		if fs.NArg() != 1 {
+			return usageErr()
+		}
+		targetID = status.LatestID
+
+	case "down":
+		if fs.NArg() != 1 {
+			return usageErr()
+		}
+		if status.CurrentID == 0 {
+			return errors.Errorf("no applied migrations")
+		}
+		targetID = status.CurrentID - 1
+
+	case "to":
+		if fs.NArg() != 2 {
+			return usageErr()
+		}
+		targetID, err = strconv.Atoi(fs.Arg(1))
+		if err != nil {
+			return errors.Annotatef(err, "parsing migration id")
+		}
+
+	case "accept-drift":
+		if fs.NArg() != 1 {
+			return usageErr()
+		}
+		if err := si.AcceptMigrationDrift(); err != nil {
+			return errors.Trace(err)
+		}
+		fmt.Printf("Accepted\n")
+		return nil
+
+	default:
+		return usageErr()
+	}
+
+	if *dryRun {
+		steps, err := si.DryRunMigration(targetID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		printMigrationSteps(steps)
+		return nil
+	}
+
+	if targetID == status.CurrentID {
+		fmt.Printf("Already at migration %d, nothing to do\n", targetID)
+		return nil
+	}
+
+	err = si.Migrate(targetID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	fmt.Printf("Migrated from %d to %d\n", status.CurrentID, targetID)
+	return nil
+}
+
+func printMigrationStatus(status *dfmigrate.Status) {
+	fmt.Printf("Current migration: %d\n", status.CurrentID)
+	fmt.Printf("Latest migration:  %d\n", status.LatestID)
+
+	if len(status.Drifts) > 0 {
+		fmt.Printf("Applied migrations which don't match the registered ones:\n")
+		for _, d := range status.Drifts {
+			fmt.Printf("  %s\n", d)
+		}
+	}
+
+	if len(status.Pending) == 0 {
+		fmt.Printf("No pending migrations\n")
+		return
+	}
+
+	fmt.Printf("Pending migrations:\n")
+	for _, mi := range status.Pending {
+		fmt.Printf("  %3d %s\n", mi.ID, mi.Descr)
+	}
+}
+
+func printMigrationSteps(steps []dfmigrate.Step) {
+	if len(steps) == 0 {
+		fmt.Printf("Nothing to do\n")
+		return
+	}
+
+	for _, step := range steps {
+		action := "Apply"
+		if step.Down {
+			action = "Revert"
+		}
+		fmt.Printf("-- %s migration %d %q\n", action, step.ID, step.Descr)
+		for _, stmt := range step.Statements {
+			fmt.Printf("%s;\n\n", stmt)
+		}
+	}
+	fmt.Printf("-- Dry run: nothing was committed\n")
+}
@@ -0,0 +1,54 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	gmserver "dmitryfrank.com/geekmarks/server/server"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+func cmdRecanonicalize(si storage.Storage, args []string) error {
+	fs := flag.NewFlagSet("recanonicalize", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, `Usage: %s [flags] recanonicalize
+
+Updates canonical URLs of all bookmarks, which are used to find duplicates,
+as per the URL canonicalization flags (-geekmarks.url_canon_*). It should be
+run after these flags are changed, and after the database migration which
+added canonical URLs, since it uses the default rules.
+
+Flags:
+`, os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return errors.Trace(errUsage)
+	}
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		return errors.Trace(errUsage)
+	}
+
+	gm, err := gmserver.New(si)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkmsCnt, err := gm.RecanonicalizeURLs(context.Background())
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	fmt.Printf("Canonical URLs of %d bookmarks updated\n", bkmsCnt)
+
+	return nil
+}
@@ -16,6 +16,10 @@ import (
 
 var (
 	port = flag.String("geekmarks.port", "8000", "Port to listen at.")
+
+	applyMigrations = flag.Bool("geekmarks.apply_migrations", true,
+		"Apply pending database migrations on startup. If false, migrations "+
+			"should be managed with geekmarks-admin migrate.")
 )
 
 func main() {
@@ -33,9 +37,11 @@ func main() {
 		glog.Fatalf("%s\n", errors.ErrorStack(err))
 	}
 
-	err = si.ApplyMigrations()
-	if err != nil {
-		glog.Fatalf("%s\n", errors.ErrorStack(err))
+	if *applyMigrations {
+		err = si.ApplyMigrations()
+		if err != nil {
+			glog.Fatalf("%s\n", errors.ErrorStack(err))
+		}
 	}
 
 	gminstance, err := gmserver.New(si)
@@ -43,6 +49,12 @@ func main() {
 		glog.Fatalf("%s\n", errors.ErrorStack(err))
 	}
 
+	// The background jobs run for as long as the server does, so they're never
+	// stopped
+	go gminstance.RunTrashPurger(nil)
+	go gminstance.RunLinkChecker(nil)
+	go gminstance.RunPageMetaFetcher(nil)
+
 	handler, err := gminstance.CreateHandler()
 	if err != nil {
 		glog.Fatalf("%s\n", errors.ErrorStack(err))
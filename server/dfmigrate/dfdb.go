@@ -18,19 +18,17 @@ const (
 	paramCurMigrationID = "cur_migration_id"
 )
 
-func tx(db *sql.DB, fn func(*sql.Tx) error) error {
-	var tx *sql.Tx
-	var err error
-
+// retryConn calls fn which is supposed to connect to the database, and
+// retries it if the database isn't ready yet.
+func retryConn(fn func() error) error {
 	// Because of the way PostgreSQL container is designed, when it runs for the
 	// first time, it's not immediately ready to accept connections: it needs
 	// several seconds to bootstrap the database first. So here we use a timeout
 	// hack: we keep retrying to connect for 10 seconds.
 	timeoutChan := time.After(10 * time.Second)
 	for {
-		tx, err = db.Begin()
+		err := fn()
 		if err != nil {
-			err2 := errors.Annotate(err, "begin transaction")
 			pqerr, ok := err.(*net.OpError)
 			if ok {
 				if pqerr.Err.Error() == "read: connection reset by peer" ||
@@ -38,15 +36,28 @@ func tx(db *sql.DB, fn func(*sql.Tx) error) error {
 					fmt.Printf("Waiting more before connecting...\n")
 					select {
 					case <-timeoutChan:
-						return errors.Annotate(err2, "time is out")
+						return errors.Annotate(err, "time is out")
 					case <-time.After(1 * time.Second):
 						continue
 					}
 				}
 			}
-			return err2
+			return err
 		}
-		break
+		return nil
+	}
+}
+
+func tx(db *sql.DB, fn func(*sql.Tx) error) error {
+	var tx *sql.Tx
+
+	err := retryConn(func() error {
+		var err error
+		tx, err = db.Begin()
+		return err
+	})
+	if err != nil {
+		return errors.Annotate(err, "begin transaction")
 	}
 
 	err = fn(tx)
@@ -72,7 +83,23 @@ func initialize(db *sql.DB) error {
           value INTEGER NOT NULL
         )
       `)
-		return err
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		_, err = tx.Exec(`
+        CREATE TABLE IF NOT EXISTS dfmigrate_applied (
+          id INTEGER NOT NULL PRIMARY KEY,
+          descr TEXT NOT NULL,
+          checksum TEXT NOT NULL,
+          applied_ts INTEGER NOT NULL
+        )
+      `)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
 	})
 	if err != nil {
 		return errors.Trace(err)
@@ -105,20 +132,71 @@ func getCurrentMigrationID(db *sql.DB) (int, error) {
 	return curID, nil
 }
 
-func setCurrentMigrationID(db *sql.DB, curID int) error {
+func setCurrentMigrationID(tx Tx, curID int) error {
+	_, err := tx.Exec(`
+    INSERT INTO dfmigrate_state (param, value) values ($1, $2)
+    ON CONFLICT (param) DO UPDATE SET value = $2;
+  `,
+		paramCurMigrationID, curID,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// appliedMigration is a record about a migration applied to the database.
+type appliedMigration struct {
+	id       int
+	descr    string
+	checksum string
+}
+
+func getAppliedMigrations(db *sql.DB) (map[int]appliedMigration, error) {
+	ret := map[int]appliedMigration{}
+
 	err := tx(db, func(tx *sql.Tx) error {
-		_, err := tx.Exec(`
-      INSERT INTO dfmigrate_state (param, value) values ($1, $2)
-      ON CONFLICT (param) DO UPDATE SET value = $2;
-    `,
-			paramCurMigrationID, curID,
-		)
+		rows, err := tx.Query("SELECT id, descr, checksum FROM dfmigrate_applied")
 		if err != nil {
 			return errors.Trace(err)
 		}
+		defer rows.Close()
 
-		return nil
+		for rows.Next() {
+			var am appliedMigration
+			if err := rows.Scan(&am.id, &am.descr, &am.checksum); err != nil {
+				return errors.Trace(err)
+			}
+			ret[am.id] = am
+		}
+
+		return errors.Trace(rows.Err())
 	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return ret, nil
+}
+
+func setAppliedMigration(tx Tx, am *appliedMigration) error {
+	_, err := tx.Exec(`
+    INSERT INTO dfmigrate_applied (id, descr, checksum, applied_ts)
+    values ($1, $2, $3, $4)
+    ON CONFLICT (id) DO UPDATE SET descr = $2, checksum = $3, applied_ts = $4;
+  `,
+		am.id, am.descr, am.checksum, time.Now().Unix(),
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func deleteAppliedMigration(tx Tx, id int) error {
+	_, err := tx.Exec("DELETE FROM dfmigrate_applied WHERE id = $1", id)
 	if err != nil {
 		return errors.Trace(err)
 	}
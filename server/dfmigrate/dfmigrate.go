@@ -5,13 +5,22 @@ package dfmigrate // import "dmitryfrank.com/geekmarks/server/dfmigrate"
 
 import (
 	"database/sql"
+	"fmt"
+	"strings"
 
 	"github.com/golang/glog"
 	"github.com/juju/errors"
 	_ "github.com/lib/pq"
 )
 
-type MigrationFunc func(tx *sql.Tx) error
+// Tx is a subset of *sql.Tx which is available to migration functions. It
+// allows dfmigrate to see the statements a migration executes; see DryRun.
+type Tx interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+type MigrationFunc func(tx Tx) error
 
 type Migration struct {
 	id    int
@@ -22,6 +31,14 @@ type Migration struct {
 
 type Migrations struct {
 	migrations []Migration
+	locker     Locker
+	driftMode  DriftMode
+}
+
+// SetLocker sets the lock which is held during the whole migration run; by
+// default, no lock is used.
+func (m *Migrations) SetLocker(locker Locker) {
+	m.locker = locker
 }
 
 func (m *Migrations) AddMigration(
@@ -38,57 +55,309 @@ func (m *Migrations) AddMigration(
 	return nil
 }
 
+// MigrationInfo describes a single migration.
+type MigrationInfo struct {
+	ID    int
+	Descr string
+}
+
+// Status describes the state of the database migrations.
+type Status struct {
+	// CurrentID is the id of the last applied migration, 0 if none
+	CurrentID int
+	// LatestID is the id of the latest known migration
+	LatestID int
+	// Pending contains migrations which are not yet applied
+	Pending []MigrationInfo
+	// Drifts contains applied migrations which don't match the registered ones
+	Drifts []Drift
+}
+
+// Step is a single migration step which would be performed by Migrate; see
+// DryRun.
+type Step struct {
+	MigrationInfo
+	// Down is true if the migration is reverted
+	Down bool
+	// Statements contains all the statements executed by the migration
+	Statements []string
+}
+
+func (m *Migrations) LatestID() int {
+	return len(m.migrations)
+}
+
 func (m *Migrations) MigrateToLatest(db *sql.DB) error {
 	return m.Migrate(db, len(m.migrations))
 }
 
-func (m *Migrations) Migrate(db *sql.DB, targetMigrationID int) error {
-	err := initialize(db)
+// Status returns the current migration status of the database.
+func (m *Migrations) Status(db *sql.DB) (*Status, error) {
+	curID, err := m.getCurrentID(db)
 	if err != nil {
-		return errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
 
-	if targetMigrationID > len(m.migrations) {
-		return errors.Errorf("wrong target migration id %d (max: %d)",
-			targetMigrationID, len(m.migrations),
-		)
+	drifts, _, err := m.getDrifts(db, curID)
+	if err != nil {
+		return nil, errors.Trace(err)
 	}
 
-	curID, err := getCurrentMigrationID(db)
+	status := &Status{
+		CurrentID: curID,
+		LatestID:  len(m.migrations),
+		Pending:   []MigrationInfo{},
+		Drifts:    drifts,
+	}
+
+	for _, mig := range m.migrations[curID:] {
+		status.Pending = append(status.Pending, mig.info())
+	}
+
+	return status, nil
+}
+
+// Migrate migrates the database up or down to the given migration id; 0 means
+// that all migrations are reverted. Each migration step is applied in its own
+// transaction, together with saving the new current migration id. If a
+// Locker is set, it's held during the whole run.
+//
+// Before migrating, applied migrations are checked against the registered
+// ones; see SetDriftMode.
+func (m *Migrations) Migrate(db *sql.DB, targetMigrationID int) (err error) {
+	unlock, err := m.lock(db)
 	if err != nil {
 		return errors.Trace(err)
 	}
+	defer func() {
+		if err2 := unlock(); err2 != nil && err == nil {
+			err = errors.Trace(err2)
+		}
+	}()
 
-	if curID > len(m.migrations) {
-		return errors.Errorf("wrong saved current migration id %d (max: %d)",
-			curID, len(m.migrations),
-		)
+	curID, err := m.getCurrentID(db)
+	if err != nil {
+		return errors.Trace(err)
 	}
 
-	if curID < 0 {
-		return errors.Errorf("wrong saved current migration id %d", curID)
+	err = m.checkDrift(db, curID)
+	if err != nil {
+		return errors.Trace(err)
 	}
 
-	if targetMigrationID > curID {
-		// migrate up
-		for _, mig := range m.migrations[curID:] {
+	steps, err := m.getSteps(curID, targetMigrationID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, step := range steps {
+		mig := m.migrations[step.id-1]
+		if !step.down {
 			glog.Infof("Applying migration %d %q", mig.id, mig.descr)
-			err := tx(db, mig.up)
+			err := tx(db, func(tx *sql.Tx) error {
+				if err := mig.up(tx); err != nil {
+					return errors.Trace(err)
+				}
+				if err := setAppliedMigration(tx, mig.applied()); err != nil {
+					return errors.Trace(err)
+				}
+				return errors.Trace(setCurrentMigrationID(tx, mig.id))
+			})
 			if err != nil {
 				return errors.Trace(err)
 			}
-
-			err = setCurrentMigrationID(db, mig.id)
+			glog.Infof("Applied successfully")
+		} else {
+			// Migrations are reverted one by one, starting from the current one,
+			// so that if some step fails, the saved migration id still matches
+			// the actual state of the database.
+			glog.Infof("Reverting migration %d %q", mig.id, mig.descr)
+			err := tx(db, func(tx *sql.Tx) error {
+				if err := mig.down(tx); err != nil {
+					return errors.Trace(err)
+				}
+				if err := deleteAppliedMigration(tx, mig.id); err != nil {
+					return errors.Trace(err)
+				}
+				return errors.Trace(setCurrentMigrationID(tx, mig.id-1))
+			})
 			if err != nil {
-				return errors.Trace(err)
+				return errors.Annotatef(err, "reverting migration %d", mig.id)
 			}
-			glog.Infof("Applied successfully")
+			glog.Infof("Reverted successfully")
+		}
+	}
+
+	return nil
+}
+
+// DryRun performs the same steps as Migrate would, but in a single
+// transaction which is rolled back in the end, and returns all the statements
+// executed by every step. The database is left intact. Applied migrations are
+// checked for drift, like Migrate does.
+func (m *Migrations) DryRun(
+	db *sql.DB, targetMigrationID int,
+) (_ []Step, err error) {
+	unlock, err := m.lock(db)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer func() {
+		if err2 := unlock(); err2 != nil && err == nil {
+			err = errors.Trace(err2)
+		}
+	}()
+
+	curID, err := m.getCurrentID(db)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Unlike Migrate, don't record the unrecorded migrations: the database is
+	// left intact.
+	drifts, _, err := m.getDrifts(db, curID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if err := m.handleDrifts(drifts); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	steps, err := m.getSteps(curID, targetMigrationID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	sqlTx, err := db.Begin()
+	if err != nil {
+		return nil, errors.Annotate(err, "begin transaction")
+	}
+	defer func() {
+		if err := sqlTx.Rollback(); err != nil {
+			glog.Errorf("Transaction rollback failed: %+v", err)
+		}
+	}()
+
+	ret := []Step{}
+	for _, step := range steps {
+		mig := m.migrations[step.id-1]
+		fn := mig.up
+		if step.down {
+			fn = mig.down
+		}
+
+		rtx := &recordingTx{Tx: sqlTx}
+		if err := fn(rtx); err != nil {
+			return nil, errors.Annotatef(err, "migration %d", mig.id)
+		}
+
+		ret = append(ret, Step{
+			MigrationInfo: mig.info(),
+			Down:          step.down,
+			Statements:    rtx.stmts,
+		})
+	}
+
+	return ret, nil
+}
+
+type step struct {
+	id   int
+	down bool
+}
+
+// getSteps returns migration steps which are needed to get from the current
+// migration to the given one.
+func (m *Migrations) getSteps(curID, targetMigrationID int) ([]step, error) {
+	if targetMigrationID > len(m.migrations) || targetMigrationID < 0 {
+		return nil, errors.Errorf("wrong target migration id %d (max: %d)",
+			targetMigrationID, len(m.migrations),
+		)
+	}
+
+	steps := []step{}
+	if targetMigrationID > curID {
+		// migrate up
+		for _, mig := range m.migrations[curID:targetMigrationID] {
+			steps = append(steps, step{id: mig.id})
 		}
 	} else if targetMigrationID < curID {
 		// migrate down
-		// TODO
-		return errors.Errorf("migration down is not implemented")
+		for i := curID - 1; i >= targetMigrationID; i-- {
+			mig := m.migrations[i]
+			if mig.down == nil {
+				return nil, errors.Errorf(
+					"migration %d %q can't be reverted: no down function",
+					mig.id, mig.descr,
+				)
+			}
+			steps = append(steps, step{id: mig.id, down: true})
+		}
 	}
 
-	return nil
+	return steps, nil
+}
+
+// getCurrentID initializes migrations state if needed, and returns the
+// current migration id.
+func (m *Migrations) getCurrentID(db *sql.DB) (int, error) {
+	err := initialize(db)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	curID, err := getCurrentMigrationID(db)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	if curID > len(m.migrations) {
+		return 0, errors.Errorf("wrong saved current migration id %d (max: %d)",
+			curID, len(m.migrations),
+		)
+	}
+
+	if curID < 0 {
+		return 0, errors.Errorf("wrong saved current migration id %d", curID)
+	}
+
+	return curID, nil
+}
+
+func (mig *Migration) info() MigrationInfo {
+	return MigrationInfo{ID: mig.id, Descr: mig.descr}
+}
+
+// lock acquires the lock if a Locker is set, and returns the function which
+// releases it.
+func (m *Migrations) lock(db *sql.DB) (unlock func() error, err error) {
+	if m.locker == nil {
+		return func() error { return nil }, nil
+	}
+
+	unlock, err = m.locker.Lock(db)
+	if err != nil {
+		return nil, errors.Annotate(err, "acquiring migrations lock")
+	}
+
+	return unlock, nil
+}
+
+// recordingTx is a Tx which remembers all the statements executed with Exec.
+type recordingTx struct {
+	Tx
+	stmts []string
+}
+
+func (rtx *recordingTx) Exec(
+	query string, args ...interface{},
+) (sql.Result, error) {
+	stmt := strings.TrimSpace(query)
+	if len(args) > 0 {
+		stmt = fmt.Sprintf("%s\n-- args: %v", stmt, args)
+	}
+	rtx.stmts = append(rtx.stmts, stmt)
+
+	return rtx.Tx.Exec(query, args...)
 }
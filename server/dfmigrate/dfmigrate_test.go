@@ -0,0 +1,514 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests
+
+package dfmigrate
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/juju/errors"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openTestDB(t *testing.T) (db *sql.DB, cleanup func()) {
+	dir, err := ioutil.TempDir("", "dfmigrate_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = openSQLite(filepath.Join(dir, "test.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func openSQLite(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=10000")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// makeTestMigrations returns cnt migrations, each of which creates the table
+// tN on the way up and drops it on the way down.
+func makeTestMigrations(t *testing.T, cnt int) *Migrations {
+	m := &Migrations{}
+	for i := 1; i <= cnt; i++ {
+		table := fmt.Sprintf("t%d", i)
+		err := m.AddMigration(
+			i, "Create "+table,
+			func(tx Tx) error {
+				_, err := tx.Exec("CREATE TABLE " + table + " (id INTEGER)")
+				return errors.Trace(err)
+			},
+			func(tx Tx) error {
+				_, err := tx.Exec("DROP TABLE " + table)
+				return errors.Trace(err)
+			},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return m
+}
+
+func getTables(t *testing.T, db *sql.DB) []string {
+	rows, err := db.Query(`
+		SELECT name FROM sqlite_master
+		WHERE type = 'table' AND name LIKE 't%'
+		ORDER BY name
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	tables := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		tables = append(tables, name)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return tables
+}
+
+func checkState(t *testing.T, db *sql.DB, wantID int, wantTables []string) {
+	curID, err := getCurrentMigrationID(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if curID != wantID {
+		t.Errorf("current migration id: want %d, got %d", wantID, curID)
+	}
+
+	if tables := getTables(t, db); !reflect.DeepEqual(tables, wantTables) {
+		t.Errorf("tables: want %v, got %v", wantTables, tables)
+	}
+}
+
+func TestMigrateUpDown(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	m := makeTestMigrations(t, 3)
+
+	if err := m.Migrate(db, 2); err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, db, 2, []string{"t1", "t2"})
+
+	if err := m.MigrateToLatest(db); err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, db, 3, []string{"t1", "t2", "t3"})
+
+	if err := m.Migrate(db, 1); err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, db, 1, []string{"t1"})
+
+	// Migrating to the current id is a no-op
+	if err := m.Migrate(db, 1); err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, db, 1, []string{"t1"})
+
+	if err := m.Migrate(db, 0); err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, db, 0, []string{})
+
+	if err := m.Migrate(db, 4); err == nil {
+		t.Errorf("should fail to migrate to non-existing migration")
+	}
+	if err := m.Migrate(db, -1); err == nil {
+		t.Errorf("should fail to migrate to negative migration id")
+	}
+}
+
+func TestMigrateDownFailure(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	m := makeTestMigrations(t, 3)
+	if err := m.MigrateToLatest(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make the down function of the second migration fail: migration 3 should
+	// be reverted, and the current id should stay at 2.
+	m.migrations[1].down = func(tx Tx) error {
+		return errors.Errorf("test error")
+	}
+
+	if err := m.Migrate(db, 0); err == nil {
+		t.Errorf("migration down should fail")
+	}
+	checkState(t, db, 2, []string{"t1", "t2"})
+
+	// Missing down function should result in an error as well
+	m.migrations[1].down = nil
+	if err := m.Migrate(db, 0); err == nil {
+		t.Errorf("migration down should fail")
+	}
+	checkState(t, db, 2, []string{"t1", "t2"})
+}
+
+func TestStatus(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	m := makeTestMigrations(t, 3)
+	if err := m.Migrate(db, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	status, err := m.Status(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &Status{
+		CurrentID: 1,
+		LatestID:  3,
+		Pending: []MigrationInfo{
+			{ID: 2, Descr: "Create t2"},
+			{ID: 3, Descr: "Create t3"},
+		},
+		Drifts: []Drift{},
+	}
+	if !reflect.DeepEqual(status, expected) {
+		t.Errorf("status: want %+v, got %+v", expected, status)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	m := makeTestMigrations(t, 3)
+	if err := m.Migrate(db, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	steps, err := m.DryRun(db, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Step{
+		{
+			MigrationInfo: MigrationInfo{ID: 2, Descr: "Create t2"},
+			Statements:    []string{"CREATE TABLE t2 (id INTEGER)"},
+		},
+		{
+			MigrationInfo: MigrationInfo{ID: 3, Descr: "Create t3"},
+			Statements:    []string{"CREATE TABLE t3 (id INTEGER)"},
+		},
+	}
+	if !reflect.DeepEqual(steps, expected) {
+		t.Errorf("steps: want %+v, got %+v", expected, steps)
+	}
+	checkState(t, db, 1, []string{"t1"})
+
+	steps, err = m.DryRun(db, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected = []Step{
+		{
+			MigrationInfo: MigrationInfo{ID: 1, Descr: "Create t1"},
+			Down:          true,
+			Statements:    []string{"DROP TABLE t1"},
+		},
+	}
+	if !reflect.DeepEqual(steps, expected) {
+		t.Errorf("steps: want %+v, got %+v", expected, steps)
+	}
+	checkState(t, db, 1, []string{"t1"})
+}
+
+func TestMigrateUpFailure(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	m := makeTestMigrations(t, 2)
+
+	// The second migration creates the table and then fails: the table
+	// should not be created, and the current id should stay at 1.
+	m.migrations[1].up = func(tx Tx) error {
+		if _, err := tx.Exec("CREATE TABLE t2 (id INTEGER)"); err != nil {
+			return errors.Trace(err)
+		}
+		return errors.Errorf("test error")
+	}
+
+	if err := m.MigrateToLatest(db); err == nil {
+		t.Errorf("migration up should fail")
+	}
+	checkState(t, db, 1, []string{"t1"})
+}
+
+// mutexLocker is a Locker which serializes migration runs within the process,
+// and remembers whether the lock is held.
+type mutexLocker struct {
+	mu     sync.Mutex
+	locked bool
+}
+
+func (l *mutexLocker) Lock(db *sql.DB) (unlock func() error, err error) {
+	l.mu.Lock()
+	l.locked = true
+	return func() error {
+		l.locked = false
+		l.mu.Unlock()
+		return nil
+	}, nil
+}
+
+func TestMigrateConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dfmigrate_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	locker := &mutexLocker{}
+
+	m := makeTestMigrations(t, 3)
+	m.SetLocker(locker)
+	for i := range m.migrations {
+		up := m.migrations[i].up
+		m.migrations[i].up = func(tx Tx) error {
+			if !locker.locked {
+				return errors.Errorf("lock is not held")
+			}
+			return up(tx)
+		}
+	}
+
+	// Migrate the same database via several separate handles at once, like
+	// several server instances would do.
+	const cnt = 4
+	dbs := make([]*sql.DB, cnt)
+	for i := range dbs {
+		dbs[i], err = openSQLite(filepath.Join(dir, "test.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer dbs[i].Close()
+	}
+
+	errs := make(chan error, cnt)
+	for _, db := range dbs {
+		go func(db *sql.DB) {
+			errs <- m.MigrateToLatest(db)
+		}(db)
+	}
+
+	for i := 0; i < cnt; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("%s", errors.ErrorStack(err))
+		}
+	}
+
+	checkState(t, dbs[0], 3, []string{"t1", "t2", "t3"})
+}
+
+func getDrifts(t *testing.T, m *Migrations, db *sql.DB) []Drift {
+	status, err := m.Status(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return status.Drifts
+}
+
+func TestDrift(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	m := makeTestMigrations(t, 3)
+	if err := m.Migrate(db, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// Whitespace changes don't count
+	m.migrations[0].up = func(tx Tx) error {
+		_, err := tx.Exec(`
+			CREATE TABLE t1
+				(id INTEGER)
+		`)
+		return errors.Trace(err)
+	}
+	if drifts := getDrifts(t, m, db); len(drifts) != 0 {
+		t.Errorf("expected no drifts, got %v", drifts)
+	}
+
+	// Edit the already applied migration
+	m.migrations[1].up = func(tx Tx) error {
+		_, err := tx.Exec("CREATE TABLE t2 (id INTEGER, name TEXT)")
+		return errors.Trace(err)
+	}
+	m.migrations[1].descr = "Create t2 with name"
+
+	drifts := getDrifts(t, m, db)
+	if len(drifts) != 1 || drifts[0].ID != 2 ||
+		drifts[0].AppliedDescr != "Create t2" ||
+		drifts[0].Descr != "Create t2 with name" ||
+		drifts[0].AppliedChecksum == drifts[0].Checksum {
+		t.Errorf("unexpected drifts: %+v", drifts)
+	}
+
+	// By default, Migrate refuses to do anything, and so does DryRun
+	err := m.MigrateToLatest(db)
+	if _, ok := errors.Cause(err).(*DriftError); !ok {
+		t.Errorf("expected *DriftError, got %v", err)
+	}
+	checkState(t, db, 2, []string{"t1", "t2"})
+
+	_, err = m.DryRun(db, 3)
+	if _, ok := errors.Cause(err).(*DriftError); !ok {
+		t.Errorf("dry run: expected *DriftError, got %v", err)
+	}
+
+	// In warn mode, migration proceeds
+	m.SetDriftMode(DriftModeWarn)
+	if err := m.MigrateToLatest(db); err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, db, 3, []string{"t1", "t2", "t3"})
+	m.SetDriftMode(DriftModeFail)
+
+	// Once the drift is accepted, it's not reported anymore
+	if err := m.AcceptDrift(db); err != nil {
+		t.Fatal(err)
+	}
+	if drifts := getDrifts(t, m, db); len(drifts) != 0 {
+		t.Errorf("expected no drifts, got %v", drifts)
+	}
+	if err := m.Migrate(db, 1); err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, db, 1, []string{"t1"})
+}
+
+func TestDriftUnrecorded(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	m := makeTestMigrations(t, 3)
+	if err := m.Migrate(db, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// Pretend that migrations were applied before checksums were recorded
+	if _, err := db.Exec("DELETE FROM dfmigrate_applied"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.MigrateToLatest(db); err != nil {
+		t.Fatal(err)
+	}
+	checkState(t, db, 3, []string{"t1", "t2", "t3"})
+
+	var cnt int
+	err := db.QueryRow("SELECT COUNT(*) FROM dfmigrate_applied").Scan(&cnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cnt != 3 {
+		t.Errorf("expected 3 recorded migrations, got %d", cnt)
+	}
+}
+
+func TestDriftQuery(t *testing.T) {
+	db, cleanup := openTestDB(t)
+	defer cleanup()
+
+	m := makeTestMigrations(t, 2)
+
+	// The second migration copies ids from t1 one by one, like data
+	// migrations do
+	makeUp := func(where string) MigrationFunc {
+		return func(tx Tx) error {
+			if _, err := tx.Exec("CREATE TABLE t2 (id INTEGER)"); err != nil {
+				return errors.Trace(err)
+			}
+			rows, err := tx.Query("SELECT id FROM t1 " + where)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			ids := []int{}
+			for rows.Next() {
+				var id int
+				if err := rows.Scan(&id); err != nil {
+					rows.Close()
+					return errors.Trace(err)
+				}
+				ids = append(ids, id)
+			}
+			rows.Close()
+			for _, id := range ids {
+				if _, err := tx.Exec("INSERT INTO t2 (id) VALUES (?)", id); err != nil {
+					return errors.Trace(err)
+				}
+			}
+			return nil
+		}
+	}
+	m.migrations[1].up = makeUp("")
+
+	if m.migrations[1].checksum() == "" {
+		t.Fatalf("checksum of a migration with queries should be known")
+	}
+
+	if err := m.MigrateToLatest(db); err != nil {
+		t.Fatal(err)
+	}
+	if drifts := getDrifts(t, m, db); len(drifts) != 0 {
+		t.Errorf("expected no drifts, got %v", drifts)
+	}
+
+	// Pretend that the checksum was not calculated when the migration was
+	// applied: it should be recorded on the next run
+	if _, err := db.Exec("UPDATE dfmigrate_applied SET checksum = ''"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.MigrateToLatest(db); err != nil {
+		t.Fatal(err)
+	}
+
+	// Edit the query of the applied migration
+	m.migrations[1].up = makeUp("WHERE id > 0")
+
+	drifts := getDrifts(t, m, db)
+	if len(drifts) != 1 || drifts[0].ID != 2 ||
+		drifts[0].AppliedChecksum == "" ||
+		drifts[0].AppliedChecksum == drifts[0].Checksum {
+		t.Errorf("unexpected drifts: %+v", drifts)
+	}
+}
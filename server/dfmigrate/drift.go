@@ -0,0 +1,315 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package dfmigrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/juju/errors"
+)
+
+// DriftMode specifies what Migrate does when the migrations applied to the
+// database don't match the registered ones, e.g. because some migration was
+// edited after it was applied.
+type DriftMode int
+
+const (
+	// DriftModeFail makes Migrate fail with *DriftError
+	DriftModeFail DriftMode = iota
+	// DriftModeWarn makes Migrate log a warning and carry on
+	DriftModeWarn
+)
+
+// Drift describes an applied migration which doesn't match the registered
+// one. Checksums are empty if unknown.
+type Drift struct {
+	ID              int
+	AppliedDescr    string
+	Descr           string
+	AppliedChecksum string
+	Checksum        string
+}
+
+func (d Drift) String() string {
+	if d.AppliedDescr != d.Descr {
+		return fmt.Sprintf(
+			"migration %d: applied %q, registered %q", d.ID, d.AppliedDescr, d.Descr,
+		)
+	}
+	return fmt.Sprintf(
+		"migration %d %q: applied checksum %s, registered %s",
+		d.ID, d.Descr, d.AppliedChecksum, d.Checksum,
+	)
+}
+
+// DriftError is returned by Migrate when drift is detected and the drift mode
+// is DriftModeFail.
+type DriftError struct {
+	Drifts []Drift
+}
+
+func (e *DriftError) Error() string {
+	strs := make([]string, len(e.Drifts))
+	for i, d := range e.Drifts {
+		strs[i] = d.String()
+	}
+	return fmt.Sprintf(
+		"applied migrations don't match the registered ones: %s",
+		strings.Join(strs, "; "),
+	)
+}
+
+// SetDriftMode sets what Migrate does when drift is detected; by default,
+// it's DriftModeFail.
+func (m *Migrations) SetDriftMode(mode DriftMode) {
+	m.driftMode = mode
+}
+
+// AcceptDrift makes the current registered migrations the reference for the
+// applied ones, so that the drift is no longer reported. It should be used
+// after the changes in the applied migrations are reviewed.
+func (m *Migrations) AcceptDrift(db *sql.DB) (err error) {
+	unlock, err := m.lock(db)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer func() {
+		if err2 := unlock(); err2 != nil && err == nil {
+			err = errors.Trace(err2)
+		}
+	}()
+
+	curID, err := m.getCurrentID(db)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = tx(db, func(tx *sql.Tx) error {
+		for _, mig := range m.migrations[:curID] {
+			if err := setAppliedMigration(tx, mig.applied()); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// getDrifts compares applied migrations up to curID with the registered ones,
+// and returns the ones which don't match, as well as the registered ones
+// without a record about being applied (e.g. applied before dfmigrate started
+// keeping such records) or without a recorded checksum.
+func (m *Migrations) getDrifts(
+	db *sql.DB, curID int,
+) (drifts []Drift, unrecorded []*appliedMigration, err error) {
+	applied, err := getAppliedMigrations(db)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	drifts = []Drift{}
+	for _, mig := range m.migrations[:curID] {
+		am := mig.applied()
+		rec, ok := applied[mig.id]
+		if !ok {
+			unrecorded = append(unrecorded, am)
+			continue
+		}
+
+		// Checksum might be unknown if the migration fails without a real
+		// database; then, only descriptions are compared.
+		if rec.descr != am.descr ||
+			(rec.checksum != "" && am.checksum != "" && rec.checksum != am.checksum) {
+			drifts = append(drifts, Drift{
+				ID:              mig.id,
+				AppliedDescr:    rec.descr,
+				Descr:           am.descr,
+				AppliedChecksum: rec.checksum,
+				Checksum:        am.checksum,
+			})
+			continue
+		}
+
+		// Older versions of dfmigrate didn't calculate checksums of migrations
+		// which run queries; record them now.
+		if rec.checksum == "" && am.checksum != "" {
+			unrecorded = append(unrecorded, am)
+		}
+	}
+
+	return drifts, unrecorded, nil
+}
+
+// checkDrift checks applied migrations up to curID and acts according to the
+// drift mode. Missing records about applied migrations are added, assuming
+// that registered migrations are the ones which were applied.
+func (m *Migrations) checkDrift(db *sql.DB, curID int) error {
+	drifts, unrecorded, err := m.getDrifts(db, curID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(unrecorded) > 0 {
+		glog.Infof("Recording checksums of %d applied migrations", len(unrecorded))
+		err := tx(db, func(tx *sql.Tx) error {
+			for _, am := range unrecorded {
+				if err := setAppliedMigration(tx, am); err != nil {
+					return errors.Trace(err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return errors.Trace(m.handleDrifts(drifts))
+}
+
+// handleDrifts fails or logs a warning about the given drifts, depending on
+// the drift mode.
+func (m *Migrations) handleDrifts(drifts []Drift) error {
+	if len(drifts) > 0 {
+		derr := &DriftError{Drifts: drifts}
+		if m.driftMode == DriftModeFail {
+			return errors.Trace(derr)
+		}
+		glog.Warningf("%s", derr)
+	}
+
+	return nil
+}
+
+func (mig *Migration) applied() *appliedMigration {
+	return &appliedMigration{
+		id:       mig.id,
+		descr:    mig.descr,
+		checksum: mig.checksum(),
+	}
+}
+
+// checksum returns the checksum of the statements executed by the up function
+// of the migration, or an empty string if it can't be calculated. The
+// statements are not actually executed; whitespace is normalized. Queries are
+// included in the checksum too, and they always return no rows, so the
+// statements which depend on query results are not included.
+func (mig *Migration) checksum() string {
+	ctx := &checksumTx{}
+	if err := mig.up(ctx); err != nil {
+		return ""
+	}
+
+	h := sha256.New()
+	for _, stmt := range ctx.stmts {
+		fmt.Fprintf(h, "%s\n", stmt)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// checksumTx is a Tx which only remembers statements executed with Exec or
+// Query.
+type checksumTx struct {
+	stmts []string
+}
+
+func (ctx *checksumTx) Exec(
+	query string, args ...interface{},
+) (sql.Result, error) {
+	ctx.addStmt(query, args)
+	return driver.RowsAffected(0), nil
+}
+
+func (ctx *checksumTx) Query(
+	query string, args ...interface{},
+) (*sql.Rows, error) {
+	ctx.addStmt(query, args)
+	return emptyDB.Query(query)
+}
+
+func (ctx *checksumTx) addStmt(query string, args []interface{}) {
+	stmt := strings.Join(strings.Fields(query), " ")
+	if len(args) > 0 {
+		stmt = fmt.Sprintf("%s -- args: %#v", stmt, args)
+	}
+	ctx.stmts = append(ctx.stmts, stmt)
+}
+
+// emptyDB is a database which returns no rows for any query; it's used to
+// make *sql.Rows for migrations while calculating checksums.
+var emptyDB = sql.OpenDB(emptyConnector{})
+
+type emptyConnector struct{}
+
+func (emptyConnector) Connect(context.Context) (driver.Conn, error) {
+	return emptyConn{}, nil
+}
+
+func (emptyConnector) Driver() driver.Driver {
+	return emptyDriver{}
+}
+
+type emptyDriver struct{}
+
+func (emptyDriver) Open(name string) (driver.Conn, error) {
+	return emptyConn{}, nil
+}
+
+type emptyConn struct{}
+
+func (emptyConn) Prepare(query string) (driver.Stmt, error) {
+	return emptyStmt{}, nil
+}
+
+func (emptyConn) Close() error {
+	return nil
+}
+
+func (emptyConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+type emptyStmt struct{}
+
+func (emptyStmt) Close() error {
+	return nil
+}
+
+func (emptyStmt) NumInput() int {
+	return -1
+}
+
+func (emptyStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return driver.RowsAffected(0), nil
+}
+
+func (emptyStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return emptyRows{}, nil
+}
+
+type emptyRows struct{}
+
+func (emptyRows) Columns() []string {
+	return nil
+}
+
+func (emptyRows) Close() error {
+	return nil
+}
+
+func (emptyRows) Next(dest []driver.Value) error {
+	return io.EOF
+}
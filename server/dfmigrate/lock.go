@@ -0,0 +1,80 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package dfmigrate
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/golang/glog"
+	"github.com/juju/errors"
+)
+
+// Locker provides a database-level lock which is held during the whole
+// migration run, so that multiple processes migrating the same database at
+// once (e.g. several server replicas starting simultaneously) don't step on
+// each other's toes.
+type Locker interface {
+	// Lock blocks until the lock is acquired, and returns the function which
+	// releases it.
+	Lock(db *sql.DB) (unlock func() error, err error)
+}
+
+type pgAdvisoryLocker struct {
+	key int64
+}
+
+// NewPgAdvisoryLocker returns a Locker which uses a session-level Postgres
+// advisory lock with the given key. The lock is held by a dedicated
+// connection, so the database pool should allow at least two connections.
+func NewPgAdvisoryLocker(key int64) Locker {
+	return &pgAdvisoryLocker{key: key}
+}
+
+func (l *pgAdvisoryLocker) Lock(db *sql.DB) (unlock func() error, err error) {
+	ctx := context.Background()
+
+	var conn *sql.Conn
+	err = retryConn(func() error {
+		var err error
+		conn, err = db.Conn(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Annotate(err, "getting connection")
+	}
+
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+
+	locked := false
+	err = conn.QueryRowContext(
+		ctx, "SELECT pg_try_advisory_lock($1)", l.key,
+	).Scan(&locked)
+	if err != nil {
+		return nil, errors.Annotate(err, "trying to acquire advisory lock")
+	}
+
+	if !locked {
+		glog.Infof("Waiting for another process to finish migrations...")
+		_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", l.key)
+		if err != nil {
+			return nil, errors.Annotate(err, "acquiring advisory lock")
+		}
+	}
+
+	return func() error {
+		defer conn.Close()
+
+		_, err := conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", l.key)
+		if err != nil {
+			return errors.Annotate(err, "releasing advisory lock")
+		}
+
+		return nil
+	}, nil
+}
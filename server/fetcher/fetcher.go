@@ -0,0 +1,200 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// Package fetcher fetches web pages for the server's background jobs, like
+// checking whether bookmark URLs are still alive. The jobs only depend on the
+// Fetcher interface, so that tests (or deployments behind a proxy) can
+// provide their own implementation.
+package fetcher // import "dmitryfrank.com/geekmarks/server/fetcher"
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+var (
+	// ErrUnsupportedScheme is returned by HTTPFetcher for URLs other than
+	// http and https ones, including the ones redirected to.
+	ErrUnsupportedScheme = errors.New("only http and https URLs are supported")
+)
+
+const userAgent = "Mozilla/5.0 (compatible; geekmarks)"
+
+// Result is the response to the fetch request.
+type Result struct {
+	// StatusCode is the HTTP status of the final response.
+	StatusCode int
+	// URL is the final URL, after all redirects.
+	URL string
+	// ContentType is the value of the Content-Type header of the response.
+	ContentType string
+	// Body is the body of the response; the caller should close it.
+	Body io.ReadCloser
+}
+
+type Fetcher interface {
+	// Fetch requests the URL, following redirects. An error is only returned
+	// if no response could be received at all; HTTP errors like 404 are
+	// reported via the StatusCode of the result.
+	Fetch(ctx context.Context, url string) (*Result, error)
+}
+
+// HTTPFetcher is a Fetcher which does real HTTP requests.
+type HTTPFetcher struct {
+	client *http.Client
+}
+
+// NewHTTPFetcher returns a new HTTPFetcher which uses the given client; if
+// it's nil, the client made by NewRestrictedClient is used.
+func NewHTTPFetcher(client *http.Client) *HTTPFetcher {
+	if client == nil {
+		client = NewRestrictedClient()
+	}
+	return &HTTPFetcher{client: client}
+}
+
+// NewRestrictedClient returns an HTTP client which only connects to public
+// addresses: since URLs of bookmarks are given by users, the server should
+// not let them make requests to itself or to its internal network. Addresses
+// are checked after the host name is resolved, and on every redirect.
+// Proxies are not used, since the address of the proxy is all that could be
+// checked then.
+func NewRestrictedClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   checkDialAddr,
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:           dialer.DialContext,
+			MaxIdleConns:          100,
+			IdleConnTimeout:       90 * time.Second,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return errors.Trace(checkScheme(req.URL))
+		},
+	}
+}
+
+// checkDialAddr is called by the dialer right before connecting to the
+// resolved address, and fails if the address isn't a public one.
+func checkDialAddr(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return errors.Errorf("invalid IP address %q", host)
+	}
+
+	if !isPublicIP(ip) {
+		return errors.Errorf("address %s is not allowed", ip)
+	}
+
+	return nil
+}
+
+// blockedNets are the networks which pages can't be fetched from: anything
+// which is not a globally routable unicast address, and NAT64 prefixes which
+// can be used to reach such addresses via IPv6.
+var blockedNets = mustParseCIDRs(
+	// IPv4
+	"0.0.0.0/8",       // "This" network
+	"10.0.0.0/8",      // Private
+	"100.64.0.0/10",   // Shared address space (carrier-grade NAT)
+	"127.0.0.0/8",     // Loopback
+	"169.254.0.0/16",  // Link-local
+	"172.16.0.0/12",   // Private
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // Documentation (TEST-NET-1)
+	"192.88.99.0/24",  // 6to4 relay anycast
+	"192.168.0.0/16",  // Private
+	"198.18.0.0/15",   // Benchmarking
+	"198.51.100.0/24", // Documentation (TEST-NET-2)
+	"203.0.113.0/24",  // Documentation (TEST-NET-3)
+	"224.0.0.0/4",     // Multicast
+	"240.0.0.0/4",     // Reserved, including the limited broadcast
+	// IPv6 (IPv4-mapped addresses are checked as IPv4 ones)
+	"::/128",         // Unspecified
+	"::1/128",        // Loopback
+	"64:ff9b::/96",   // NAT64
+	"64:ff9b:1::/48", // Local-use NAT64
+	"100::/64",       // Discard-only
+	"2001:db8::/32",  // Documentation
+	"fc00::/7",       // Unique local
+	"fe80::/10",      // Link-local
+	"ff00::/8",       // Multicast
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// isPublicIP returns false if the address belongs to any of blockedNets.
+func isPublicIP(ip net.IP) bool {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+
+	for _, n := range blockedNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func checkScheme(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.Trace(ErrUnsupportedScheme)
+	}
+	return nil
+}
+
+func (f *HTTPFetcher) Fetch(ctx context.Context, rawURL string) (*Result, error) {
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	if err := checkScheme(req.URL); err != nil {
+		return nil, errors.Trace(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", userAgent)
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &Result{
+		StatusCode:  resp.StatusCode,
+		URL:         resp.Request.URL.String(),
+		ContentType: resp.Header.Get("Content-Type"),
+		Body:        resp.Body,
+	}, nil
+}
@@ -0,0 +1,159 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests
+
+package fetcher
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/juju/errors"
+)
+
+func TestHTTPFetcher(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("User-Agent") != userAgent {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("ok"))
+	})
+	mux.Handle("/moved", http.RedirectHandler("/ok", http.StatusMovedPermanently))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	okResult := Result{
+		StatusCode: http.StatusOK, URL: ts.URL + "/ok", ContentType: "text/plain",
+	}
+
+	cases := []struct {
+		path         string
+		expected     Result
+		expectedBody string
+	}{
+		{"/ok", okResult, "ok"},
+		{
+			"/gone",
+			Result{
+				StatusCode: http.StatusNotFound, URL: ts.URL + "/gone",
+				ContentType: "text/plain; charset=utf-8",
+			},
+			"404 page not found\n",
+		},
+		{"/moved", okResult, "ok"},
+	}
+
+	// The test server is on the loopback address, so the restrictions of the
+	// default client should be lifted
+	f := NewHTTPFetcher(http.DefaultClient)
+	for _, c := range cases {
+		res, err := f.Fetch(context.Background(), ts.URL+c.path)
+		if err != nil {
+			t.Errorf("%s: %s", c.path, err)
+			continue
+		}
+
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Errorf("%s: %s", c.path, err)
+			continue
+		}
+		if string(body) != c.expectedBody {
+			t.Errorf("%s: expected body %q, got %q", c.path, c.expectedBody, body)
+		}
+
+		res.Body = nil
+		if *res != c.expected {
+			t.Errorf("%s: expected %+v, got %+v", c.path, c.expected, *res)
+		}
+	}
+
+	ts.Close()
+	if _, err := f.Fetch(context.Background(), ts.URL+"/ok"); err == nil {
+		t.Errorf("fetching from the closed server should fail")
+	}
+}
+
+func TestHTTPFetcherRestricted(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {})
+	mux.Handle("/ftp", http.RedirectHandler("ftp://example.com/", http.StatusFound))
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	f := NewHTTPFetcher(nil)
+
+	// The test server is on the loopback address
+	_, err := f.Fetch(context.Background(), ts.URL+"/ok")
+	if err == nil || !strings.Contains(err.Error(), "is not allowed") {
+		t.Errorf("fetching from the loopback address should fail, got %v", err)
+	}
+
+	for _, u := range []string{"ftp://example.com/", "file:///etc/passwd"} {
+		_, err := f.Fetch(context.Background(), u)
+		if errors.Cause(err) != ErrUnsupportedScheme {
+			t.Errorf("%s: expected ErrUnsupportedScheme, got %v", u, err)
+		}
+	}
+
+	// Schemes of redirects are checked as well; the transport is replaced to
+	// be able to connect to the test server at all.
+	client := NewRestrictedClient()
+	client.Transport = http.DefaultTransport
+	_, err = NewHTTPFetcher(client).Fetch(context.Background(), ts.URL+"/ftp")
+	if err == nil || !strings.Contains(err.Error(), ErrUnsupportedScheme.Error()) {
+		t.Errorf("redirect to ftp should fail, got %v", err)
+	}
+}
+
+func TestIsPublicIP(t *testing.T) {
+	cases := []struct {
+		ip       string
+		expected bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1:248:1893:25c8:1946", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fc00::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"224.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:10.0.0.1", false},
+		{"::ffff:93.184.216.34", true},
+		{"0.1.2.3", false},
+		{"100.64.0.1", false},
+		{"100.127.255.255", false},
+		{"100.128.0.1", true},
+		{"198.18.0.1", false},
+		{"198.19.255.255", false},
+		{"198.20.0.1", true},
+		{"192.0.0.8", false},
+		{"255.255.255.255", false},
+		{"64:ff9b::7f00:1", false},
+		{"64:ff9b::5db8:d822", false},
+		{"ff02::1", false},
+	}
+
+	for _, c := range cases {
+		if got := isPublicIP(net.ParseIP(c.ip)); got != c.expected {
+			t.Errorf("%s: expected %v, got %v", c.ip, c.expected, got)
+		}
+	}
+}
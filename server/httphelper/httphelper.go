@@ -20,6 +20,7 @@ var (
 	unauthorizedError   error
 	forbiddenError      error
 	notImplementedError error
+	requestTimeoutError error
 )
 
 const (
@@ -31,11 +32,26 @@ func init() {
 	unauthorizedError = errors.New("unauthorized")
 	forbiddenError = errors.New("forbidden")
 	notImplementedError = errors.New("not implemented")
+	requestTimeoutError = errors.New("request timed out")
 }
 
 type ErrorResponse struct {
 	Status  int    `json:"status"`
 	Message string `json:"message"`
+	// Data is an optional error-specific payload, see ConflictError
+	Data interface{} `json:"data,omitempty"`
+}
+
+// ConflictError results in the 409 Conflict response: the request conflicts
+// with the existing data. Data, if not nil, is given to the client along with
+// the message, e.g. to point at the conflicting resource.
+type ConflictError struct {
+	Message string
+	Data    interface{}
+}
+
+func (e *ConflictError) Error() string {
+	return e.Message
 }
 
 const (
@@ -44,10 +60,16 @@ const (
 
 func GetErrorStruct(errResp error) *ErrorResponse {
 	httpErrorCode := GetHTTPErrorCode(errResp)
-	return &ErrorResponse{
+	errStruct := &ErrorResponse{
 		Status:  httpErrorCode,
 		Message: errResp.Error(),
 	}
+
+	if cerr, ok := errors.Cause(errResp).(*ConflictError); ok {
+		errStruct.Data = cerr.Data
+	}
+
+	return errStruct
 }
 
 func RespondWithError(w http.ResponseWriter, r *http.Request, errResp error) {
@@ -173,6 +195,17 @@ func MakeNotImplementedError() error {
 	return notImplementedError
 }
 
+// MakeRequestTimeoutError returns an error for requests which were not
+// handled in time; intError is the actual error which happened, it's not
+// given to the client.
+func MakeRequestTimeoutError(intError error) error {
+	if interrors.IsInternalError(intError) {
+		// Otherwise, WrapInternalError would just annotate it
+		intError = interrors.InternalErr(intError)
+	}
+	return interrors.WrapInternalError(intError, requestTimeoutError)
+}
+
 func GetHTTPErrorCode(err error) int {
 	status := http.StatusBadRequest
 
@@ -185,6 +218,12 @@ func GetHTTPErrorCode(err error) int {
 		status = http.StatusForbidden
 	case notImplementedError:
 		status = http.StatusNotAcceptable
+	case requestTimeoutError:
+		status = http.StatusServiceUnavailable
+	}
+
+	if _, ok := errors.Cause(err).(*ConflictError); ok {
+		status = http.StatusConflict
 	}
 
 	return status
@@ -0,0 +1,250 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// Package netscape reads and writes the Netscape bookmark file format, which
+// is the bookmarks.html exported (and imported) by every browser: nested <DL>
+// lists of folders (<H3>) and bookmarks (<A>), optionally followed by
+// descriptions (<DD>).
+package netscape // import "dmitryfrank.com/geekmarks/server/netscape"
+
+import (
+	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+
+	xhtml "golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+
+	"github.com/juju/errors"
+)
+
+// Folder is a folder of bookmarks given to Write.
+type Folder struct {
+	Name      string
+	Folders   []*Folder
+	Bookmarks []Bookmark
+}
+
+// GetFolder returns the subfolder with the given path, relative to f; the
+// missing folders along the path are created.
+func (f *Folder) GetFolder(path []string) *Folder {
+	if len(path) == 0 {
+		return f
+	}
+
+	for _, sub := range f.Folders {
+		if sub.Name == path[0] {
+			return sub.GetFolder(path[1:])
+		}
+	}
+
+	sub := &Folder{Name: path[0]}
+	f.Folders = append(f.Folders, sub)
+	return sub.GetFolder(path[1:])
+}
+
+type Bookmark struct {
+	URL     string
+	Title   string
+	Comment string
+	// Folders is the path of folders containing the bookmark, from the
+	// outermost one; it's empty for bookmarks at the top level. It's set by
+	// Parse, and ignored by Write.
+	Folders []string
+	// Tags are from the TAGS attribute, which is written by Firefox.
+	Tags []string
+	// AddDate is the ADD_DATE attribute, in seconds since the epoch; it's
+	// zero if missing.
+	AddDate uint64
+}
+
+// Parse reads the bookmarks file from r and returns all bookmarks in the
+// order they appear in the file.
+func Parse(r io.Reader) ([]Bookmark, error) {
+	bkms := []Bookmark{}
+
+	// Folder names of the currently open <DL> lists; the outermost list
+	// doesn't have a name.
+	folders := []string{}
+	// Name of the last <H3>, which is the name of the next <DL>
+	folderName := ""
+
+	var text strings.Builder
+	inH3, inA, inDD := false, false, false
+	// Index of the bookmark which the next <DD> describes, or -1
+	lastBkm := -1
+
+	z := xhtml.NewTokenizer(r)
+loop:
+	for {
+		tt := z.Next()
+		switch tt {
+		case xhtml.ErrorToken:
+			if z.Err() == io.EOF {
+				break loop
+			}
+			return nil, errors.Trace(z.Err())
+
+		case xhtml.TextToken:
+			if inH3 || inA || inDD {
+				text.Write(z.Text())
+			}
+
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken, xhtml.EndTagToken:
+			name, hasAttr := z.TagName()
+			a := atom.Lookup(name)
+
+			if inDD && a != atom.Br {
+				bkms[lastBkm].Comment = cleanText(text.String())
+				inDD = false
+				lastBkm = -1
+			}
+
+			if tt == xhtml.EndTagToken {
+				switch a {
+				case atom.H3:
+					if inH3 {
+						folderName = cleanText(text.String())
+						inH3 = false
+					}
+				case atom.A:
+					if inA {
+						bkms[len(bkms)-1].Title = cleanText(text.String())
+						inA = false
+						lastBkm = len(bkms) - 1
+					}
+				case atom.Dl:
+					if len(folders) > 0 {
+						folders = folders[:len(folders)-1]
+					}
+				}
+				continue
+			}
+
+			attrs := map[string]string{}
+			if hasAttr {
+				attrs = getAttrs(z)
+			}
+
+			switch a {
+			case atom.H3:
+				inH3 = true
+				text.Reset()
+				lastBkm = -1
+			case atom.Dl:
+				folders = append(folders, folderName)
+				folderName = ""
+				lastBkm = -1
+			case atom.A:
+				bkm := Bookmark{
+					URL:     strings.TrimSpace(attrs["href"]),
+					Folders: getFoldersPath(folders),
+					Tags:    parseTags(attrs["tags"]),
+				}
+				bkm.AddDate, _ = strconv.ParseUint(
+					strings.TrimSpace(attrs["add_date"]), 10, 64,
+				)
+				bkms = append(bkms, bkm)
+				inA = tt == xhtml.StartTagToken
+				text.Reset()
+			case atom.Dd:
+				if lastBkm >= 0 {
+					inDD = true
+					text.Reset()
+				}
+			}
+		}
+	}
+
+	if inDD {
+		bkms[lastBkm].Comment = cleanText(text.String())
+	}
+
+	return bkms, nil
+}
+
+func getAttrs(z *xhtml.Tokenizer) map[string]string {
+	attrs := map[string]string{}
+	for {
+		key, val, more := z.TagAttr()
+		attrs[string(key)] = string(val)
+		if !more {
+			break
+		}
+	}
+	return attrs
+}
+
+// getFoldersPath returns the names of the given folders, skipping unnamed
+// ones like the outermost list.
+func getFoldersPath(folders []string) []string {
+	ret := []string{}
+	for _, f := range folders {
+		if f != "" {
+			ret = append(ret, f)
+		}
+	}
+	return ret
+}
+
+func parseTags(s string) []string {
+	ret := []string{}
+	for _, tag := range strings.Split(s, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			ret = append(ret, tag)
+		}
+	}
+	return ret
+}
+
+func cleanText(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// Write writes the bookmarks file with the contents of the root folder, whose
+// name is used as the title. Subfolders go before bookmarks in each folder.
+func Write(w io.Writer, root *Folder) error {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, `<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<!-- This is an automatically generated file.
+     It will be read and overwritten.
+     DO NOT EDIT! -->
+<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">
+<TITLE>%[1]s</TITLE>
+<H1>%[1]s</H1>
+`, html.EscapeString(root.Name))
+
+	writeFolderContents(bw, root, "")
+
+	return errors.Trace(bw.Flush())
+}
+
+func writeFolderContents(bw *bufio.Writer, f *Folder, indent string) {
+	fmt.Fprintf(bw, "%s<DL><p>\n", indent)
+
+	for _, sub := range f.Folders {
+		fmt.Fprintf(bw, "%s    <DT><H3>%s</H3>\n", indent, html.EscapeString(sub.Name))
+		writeFolderContents(bw, sub, indent+"    ")
+	}
+
+	for _, bkm := range f.Bookmarks {
+		fmt.Fprintf(bw, "%s    <DT><A HREF=\"%s\"", indent, html.EscapeString(bkm.URL))
+		if bkm.AddDate != 0 {
+			fmt.Fprintf(bw, " ADD_DATE=\"%d\"", bkm.AddDate)
+		}
+		if len(bkm.Tags) > 0 {
+			fmt.Fprintf(bw, " TAGS=\"%s\"", html.EscapeString(strings.Join(bkm.Tags, ",")))
+		}
+		fmt.Fprintf(bw, ">%s</A>\n", html.EscapeString(bkm.Title))
+
+		if bkm.Comment != "" {
+			fmt.Fprintf(bw, "%s    <DD>%s\n", indent, html.EscapeString(bkm.Comment))
+		}
+	}
+
+	fmt.Fprintf(bw, "%s</DL><p>\n", indent)
+}
@@ -0,0 +1,127 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests
+
+package netscape
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	file := `<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<!-- This is an automatically generated file. -->
+<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">
+<TITLE>Bookmarks</TITLE>
+<H1>Bookmarks</H1>
+<DL><p>
+    <DT><H3 ADD_DATE="1500000000" PERSONAL_TOOLBAR_FOLDER="true">Bookmarks bar</H3>
+    <DD>Folder description
+    <DL><p>
+        <DT><A HREF="http://x.com/a" ADD_DATE="1500000001" TAGS="foo, bar">Page &amp; A</A>
+        <DD>Description
+          of A
+        <DT><H3>Nested</H3>
+        <DL><p>
+            <DT><A HREF="http://x.com/b">Page B</A>
+        </DL><p>
+        <DT><A HREF="http://x.com/c" ADD_DATE="invalid">Page C</A>
+    </DL><p>
+    <DT><A HREF=" http://x.com/d ">Page D</A>
+    <DD>Description of D
+</DL><p>
+`
+
+	got, err := Parse(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Bookmark{
+		{
+			URL:     "http://x.com/a",
+			Title:   "Page & A",
+			Comment: "Description of A",
+			Folders: []string{"Bookmarks bar"},
+			Tags:    []string{"foo", "bar"},
+			AddDate: 1500000001,
+		},
+		{
+			URL:     "http://x.com/b",
+			Title:   "Page B",
+			Folders: []string{"Bookmarks bar", "Nested"},
+			Tags:    []string{},
+		},
+		{
+			URL:     "http://x.com/c",
+			Title:   "Page C",
+			Folders: []string{"Bookmarks bar"},
+			Tags:    []string{},
+		},
+		{
+			URL:     "http://x.com/d",
+			Title:   "Page D",
+			Comment: "Description of D",
+			Folders: []string{},
+			Tags:    []string{},
+		},
+	}
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+}
+
+func TestWriteParse(t *testing.T) {
+	root := &Folder{Name: "Bookmarks"}
+	root.Bookmarks = append(root.Bookmarks, Bookmark{
+		URL: "http://x.com/top", Title: "Top", AddDate: 1500000000,
+	})
+	root.GetFolder([]string{"foo", "bar"}).Bookmarks = []Bookmark{
+		{URL: "http://x.com/a?b=1&c=2", Title: `A <"quoted">`, Comment: "Comment & more"},
+	}
+	root.GetFolder([]string{"foo"}).Bookmarks = []Bookmark{
+		{URL: "http://x.com/b", Title: "B", Tags: []string{"t1", "t2"}},
+	}
+
+	var buf strings.Builder
+	if err := Write(&buf, root); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Parse(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Subfolders go first
+	expected := []Bookmark{
+		{
+			URL:     "http://x.com/a?b=1&c=2",
+			Title:   `A <"quoted">`,
+			Comment: "Comment & more",
+			Folders: []string{"foo", "bar"},
+			Tags:    []string{},
+		},
+		{
+			URL:     "http://x.com/b",
+			Title:   "B",
+			Folders: []string{"foo"},
+			Tags:    []string{"t1", "t2"},
+		},
+		{
+			URL:     "http://x.com/top",
+			Title:   "Top",
+			Folders: []string{},
+			Tags:    []string{},
+			AddDate: 1500000000,
+		},
+	}
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %+v, got %+v\nfile:\n%s", expected, got, buf.String())
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// Package pagemeta extracts metadata of web pages, like title and
+// description, from the <head> of their HTML: from the OpenGraph tags if
+// present, or from the regular <title>, <meta> and <link> tags otherwise.
+package pagemeta // import "dmitryfrank.com/geekmarks/server/pagemeta"
+
+import (
+	"io"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+
+	"github.com/juju/errors"
+)
+
+type Meta struct {
+	Title       string
+	Description string
+	// CanonicalURL is the preferred URL of the page, as specified by the
+	// page itself.
+	CanonicalURL string
+	// FaviconURL is the URL of the page icon; if the page doesn't specify
+	// any, it's the /favicon.ico of the site.
+	FaviconURL string
+}
+
+// Extract reads the HTML page from r and returns its metadata. Relative URLs
+// are resolved against pageURL, which is the URL the page was fetched from.
+func Extract(r io.Reader, pageURL string) (*Meta, error) {
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var title, ogTitle, descr, ogDescr, canonical, ogURL, favicon string
+	inTitle := false
+
+	z := html.NewTokenizer(r)
+loop:
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			if z.Err() == io.EOF {
+				break loop
+			}
+			return nil, errors.Trace(z.Err())
+
+		case html.TextToken:
+			if inTitle {
+				title += string(z.Text())
+			}
+
+		case html.StartTagToken, html.SelfClosingTagToken, html.EndTagToken:
+			name, _ := z.TagName()
+			a := atom.Lookup(name)
+
+			if tt == html.EndTagToken {
+				switch a {
+				case atom.Title:
+					inTitle = false
+				case atom.Head:
+					// All the metadata is in the head
+					break loop
+				}
+				continue
+			}
+
+			attrs := getAttrs(z)
+
+			switch a {
+			case atom.Title:
+				inTitle = tt == html.StartTagToken
+			case atom.Body:
+				break loop
+			case atom.Meta:
+				content := strings.TrimSpace(attrs["content"])
+				switch strings.ToLower(attrs["property"]) {
+				case "og:title":
+					ogTitle = content
+				case "og:description":
+					ogDescr = content
+				case "og:url":
+					ogURL = content
+				}
+				if strings.ToLower(attrs["name"]) == "description" {
+					descr = content
+				}
+			case atom.Link:
+				href := strings.TrimSpace(attrs["href"])
+				for _, rel := range strings.Fields(strings.ToLower(attrs["rel"])) {
+					switch rel {
+					case "canonical":
+						canonical = href
+					case "icon":
+						// "icon" or "shortcut icon"
+						if favicon == "" {
+							favicon = href
+						}
+					}
+				}
+			}
+		}
+	}
+
+	if favicon == "" {
+		favicon = "/favicon.ico"
+	}
+
+	return &Meta{
+		Title:        firstNonEmpty(ogTitle, strings.Join(strings.Fields(title), " ")),
+		Description:  firstNonEmpty(ogDescr, descr),
+		CanonicalURL: resolveURL(base, firstNonEmpty(canonical, ogURL)),
+		FaviconURL:   resolveURL(base, favicon),
+	}, nil
+}
+
+func getAttrs(z *html.Tokenizer) map[string]string {
+	attrs := map[string]string{}
+	for {
+		key, val, more := z.TagAttr()
+		attrs[string(key)] = string(val)
+		if !more {
+			break
+		}
+	}
+	return attrs
+}
+
+func resolveURL(base *url.URL, ref string) string {
+	if ref == "" {
+		return ""
+	}
+
+	u, err := base.Parse(ref)
+	if err != nil {
+		return ""
+	}
+
+	return u.String()
+}
+
+func firstNonEmpty(vals ...string) string {
+	for _, v := range vals {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,70 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests
+
+package pagemeta
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExtract(t *testing.T) {
+	cases := []struct {
+		page     string
+		expected Meta
+	}{
+		{
+			page: `<!DOCTYPE html>
+<html><head>
+  <title>
+    Plain  title
+  </title>
+  <meta name="description" content="Plain description">
+  <link rel="canonical" href="/a/canonical">
+  <link rel="shortcut icon" href="img/icon.png">
+</head><body><title>Not a title</title></body></html>`,
+			expected: Meta{
+				Title:        "Plain title",
+				Description:  "Plain description",
+				CanonicalURL: "http://x.com/a/canonical",
+				FaviconURL:   "http://x.com/a/img/icon.png",
+			},
+		},
+		{
+			// OpenGraph tags take precedence
+			page: `<html><head>
+  <title>Plain title</title>
+  <meta property="og:title" content="OG title" />
+  <meta name="description" content="Plain description" />
+  <meta property="og:description" content=" OG description " />
+  <meta property="og:url" content="https://y.com/og" />
+  <link rel="icon" href="https://cdn.x.com/icon.svg" />
+</head></html>`,
+			expected: Meta{
+				Title:        "OG title",
+				Description:  "OG description",
+				CanonicalURL: "https://y.com/og",
+				FaviconURL:   "https://cdn.x.com/icon.svg",
+			},
+		},
+		{
+			page: `no html at all`,
+			expected: Meta{
+				FaviconURL: "http://x.com/favicon.ico",
+			},
+		},
+	}
+
+	for i, c := range cases {
+		got, err := Extract(strings.NewReader(c.page), "http://x.com/a/page")
+		if err != nil {
+			t.Errorf("case %d: %s", i, err)
+			continue
+		}
+		if *got != c.expected {
+			t.Errorf("case %d: expected %+v, got %+v", i, c.expected, *got)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package server
+
+import (
+	"flag"
+	"strings"
+
+	goji "goji.io"
+	"goji.io/pat"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+var (
+	adminUsers = flag.String(
+		"geekmarks.admin_users", "",
+		"Comma-separated list of usernames which are allowed to use the "+
+			"/api/admin endpoints.",
+	)
+)
+
+type adminIntegrityResp struct {
+	OK               bool                       `json:"ok"`
+	Users            []adminUserIntegrityData   `json:"users"`
+	OrphanedTagNames []adminOrphanedTagNameData `json:"orphanedTagNames"`
+}
+
+type adminUserIntegrityData struct {
+	UserID              int                          `json:"userID"`
+	BadRootTagIDs       []int                        `json:"badRootTagIDs"`
+	BadChildrenCnts     []adminBadChildrenCntData    `json:"badChildrenCnts"`
+	IncompleteTagPaths  []adminIncompleteTagPathData `json:"incompleteTagPaths"`
+	RootOnlyTaggableIDs []int                        `json:"rootOnlyTaggableIDs"`
+	UnknownTaggings     []adminUnknownTaggingData    `json:"unknownTaggings"`
+}
+
+type adminBadChildrenCntData struct {
+	TagID             int `json:"tagID"`
+	ChildrenCnt       int `json:"childrenCnt"`
+	ActualChildrenCnt int `json:"actualChildrenCnt"`
+}
+
+type adminIncompleteTagPathData struct {
+	TaggableID    int   `json:"taggableID"`
+	MissingTagIDs []int `json:"missingTagIDs"`
+}
+
+type adminUnknownTaggingData struct {
+	TaggableID int   `json:"taggableID"`
+	TagIDs     []int `json:"tagIDs"`
+}
+
+type adminOrphanedTagNameData struct {
+	TagID int    `json:"tagID"`
+	Name  string `json:"name"`
+}
+
+// parseAdminUsers parses the value of the -geekmarks.admin_users flag.
+func parseAdminUsers(s string) map[string]bool {
+	users := map[string]bool{}
+	for _, username := range strings.Split(s, ",") {
+		username = strings.TrimSpace(username)
+		if username != "" {
+			users[username] = true
+		}
+	}
+	return users
+}
+
+func (gm *GMServer) setupAdminAPIEndpoints(mux *goji.Mux) {
+	// Admin endpoints are not available via websocket
+	setUserEndpoint(pat.Get("/integrity"), gm.adminIntegrityGet, nil, mux, gm.getUserFromAuthn)
+}
+
+// authorizeAdmin returns a forbidden error unless the caller is one of the
+// admin users.
+func (gm *GMServer) authorizeAdmin(callerData *storage.UserData) error {
+	if callerData == nil || !gm.adminUsers[callerData.Username] {
+		return hh.MakeForbiddenError()
+	}
+
+	return nil
+}
+
+func (gm *GMServer) adminIntegrityGet(gmr *GMRequest) (resp interface{}, err error) {
+	if err := gm.authorizeAdmin(gmr.Caller); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	report, err := gm.si.GetIntegrityReport()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return makeAdminIntegrityResp(report), nil
+}
+
+func makeAdminIntegrityResp(report *storage.IntegrityReport) *adminIntegrityResp {
+	resp := &adminIntegrityResp{
+		OK:               report.OK(),
+		Users:            []adminUserIntegrityData{},
+		OrphanedTagNames: []adminOrphanedTagNameData{},
+	}
+
+	for _, ur := range report.Users {
+		ud := adminUserIntegrityData{
+			UserID:              ur.UserID,
+			BadRootTagIDs:       ur.BadRootTagIDs,
+			BadChildrenCnts:     []adminBadChildrenCntData{},
+			IncompleteTagPaths:  []adminIncompleteTagPathData{},
+			RootOnlyTaggableIDs: ur.RootOnlyTaggableIDs,
+			UnknownTaggings:     []adminUnknownTaggingData{},
+		}
+		if ud.BadRootTagIDs == nil {
+			ud.BadRootTagIDs = []int{}
+		}
+		if ud.RootOnlyTaggableIDs == nil {
+			ud.RootOnlyTaggableIDs = []int{}
+		}
+
+		for _, bc := range ur.BadChildrenCnts {
+			ud.BadChildrenCnts = append(ud.BadChildrenCnts, adminBadChildrenCntData{
+				TagID:             bc.TagID,
+				ChildrenCnt:       bc.ChildrenCnt,
+				ActualChildrenCnt: bc.ActualChildrenCnt,
+			})
+		}
+
+		for _, itp := range ur.IncompleteTagPaths {
+			ud.IncompleteTagPaths = append(ud.IncompleteTagPaths, adminIncompleteTagPathData{
+				TaggableID:    itp.TaggableID,
+				MissingTagIDs: itp.MissingTagIDs,
+			})
+		}
+
+		for _, ut := range ur.UnknownTaggings {
+			ud.UnknownTaggings = append(ud.UnknownTaggings, adminUnknownTaggingData{
+				TaggableID: ut.TaggableID,
+				TagIDs:     ut.TagIDs,
+			})
+		}
+
+		resp.Users = append(resp.Users, ud)
+	}
+
+	for _, otn := range report.OrphanedTagNames {
+		resp.OrphanedTagNames = append(resp.OrphanedTagNames, adminOrphanedTagNameData{
+			TagID: otn.TagID,
+			Name:  otn.Name,
+		})
+	}
+
+	return resp
+}
@@ -0,0 +1,116 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests integration_tests
+
+package server
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+func TestAdminIntegrity(t *testing.T) {
+	defer func(v string) { *adminUsers = v }(*adminUsers)
+	*adminUsers = "foo, test1"
+
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestAdminIntegrity)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func perUserTestAdminIntegrity(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	// Non-admin user is not allowed to get the report
+	resp, err := be.DoReq("GET", "/api/admin/integrity", u2.token, nil, false)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := expectErrorResp(resp, http.StatusForbidden, "forbidden"); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Admin user gets the report
+	resp, err = be.DoReq("GET", "/api/admin/integrity", u1.token, nil, true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	rmap, err := getRespMap(resp)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	exp := map[string]interface{}{
+		"ok":               true,
+		"users":            []interface{}{},
+		"orphanedTagNames": []interface{}{},
+	}
+	if !reflect.DeepEqual(exp, rmap) {
+		return errors.Errorf("response JSON: expected: %v, got: %v", exp, rmap)
+	}
+
+	return nil
+}
+
+func TestMakeAdminIntegrityResp(t *testing.T) {
+	report := &storage.IntegrityReport{
+		Users: []storage.UserIntegrityReport{
+			{
+				UserID: 1,
+				BadChildrenCnts: []storage.BadChildrenCnt{
+					{TagID: 2, ChildrenCnt: 0, ActualChildrenCnt: 1},
+				},
+				IncompleteTagPaths: []storage.IncompleteTagPath{
+					{TaggableID: 3, MissingTagIDs: []int{2}},
+				},
+				UnknownTaggings: []storage.UnknownTagging{
+					{TaggableID: 5, TagIDs: []int{6}},
+				},
+			},
+		},
+		OrphanedTagNames: []storage.OrphanedTagName{
+			{TagID: 4, Name: "foo"},
+		},
+	}
+
+	exp := &adminIntegrityResp{
+		OK: false,
+		Users: []adminUserIntegrityData{
+			{
+				UserID:        1,
+				BadRootTagIDs: []int{},
+				BadChildrenCnts: []adminBadChildrenCntData{
+					{TagID: 2, ChildrenCnt: 0, ActualChildrenCnt: 1},
+				},
+				IncompleteTagPaths: []adminIncompleteTagPathData{
+					{TaggableID: 3, MissingTagIDs: []int{2}},
+				},
+				RootOnlyTaggableIDs: []int{},
+				UnknownTaggings: []adminUnknownTaggingData{
+					{TaggableID: 5, TagIDs: []int{6}},
+				},
+			},
+		},
+		OrphanedTagNames: []adminOrphanedTagNameData{
+			{TagID: 4, Name: "foo"},
+		},
+	}
+
+	if got := makeAdminIntegrityResp(report); !reflect.DeepEqual(exp, got) {
+		t.Errorf("expected %+v, got %+v", exp, got)
+	}
+}
@@ -78,7 +78,7 @@ func (gm *GMServer) authnMiddleware(inner http.Handler) http.Handler {
 
 		if ok {
 			var ud *storage.UserData
-			err := gm.si.Tx(func(tx *sql.Tx) error {
+			err := gm.si.TxCtx(r.Context(), func(tx *sql.Tx) error {
 				ud2, err := gm.si.GetUserByAccessToken(tx, token)
 
 				if err != nil {
@@ -142,7 +142,7 @@ func (gm *GMServer) authenticatePost(gmr *GMRequest) (resp interface{}, err erro
 		return nil, errors.Errorf("auth provider %q is disabled (corresponding flag to the creds file was not provided)", provider)
 	}
 
-	err = gm.si.Tx(func(tx *sql.Tx) error {
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 		var err error
 		switch provider {
 		case providerGoogle:
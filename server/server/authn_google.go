@@ -109,7 +109,7 @@ func (gm *GMServer) handleOAuthGoogle(
 	}
 
 	if tresp.StatusCode != http.StatusOK {
-		return 0, nil, errors.Annotatef(err, "error getting token info: %q", *googleTokenInfo)
+		return 0, nil, errors.Errorf("error getting token info: %+v", *googleTokenInfo)
 	}
 
 	// Check if we have a record for that Google user
@@ -0,0 +1,543 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/dimonomid/interrors"
+	"github.com/juju/errors"
+)
+
+// userBackupVersion is the version of the backup format; it should be
+// incremented on incompatible changes, and restoring older versions should
+// be supported for as long as possible.
+const userBackupVersion = 1
+
+// userBackup is returned by GET /export, and taken by POST /restore: all the
+// data of the user. Ids are the ones of the exported user; on restore, new
+// ids are assigned, see userRestoreReport.
+type userBackup struct {
+	Version    int    `json:"version"`
+	ExportedAt uint64 `json:"exportedAt"`
+	// Tags are the top-level tags, with all subtags
+	Tags      []userBackupTag      `json:"tags"`
+	Bookmarks []userBackupBookmark `json:"bookmarks"`
+	Notes     []userBackupNote     `json:"notes"`
+}
+
+type userBackupTag struct {
+	ID          int                 `json:"id"`
+	Names       []userBackupTagName `json:"names"`
+	Description string              `json:"description,omitempty"`
+	Subtags     []userBackupTag     `json:"subtags"`
+}
+
+type userBackupTagName struct {
+	Name    string `json:"name"`
+	Primary bool   `json:"primary"`
+}
+
+type userBackupBookmark struct {
+	ID        int    `json:"id"`
+	URL       string `json:"url"`
+	Title     string `json:"title,omitempty"`
+	Comment   string `json:"comment,omitempty"`
+	CreatedAt uint64 `json:"createdAt"`
+	UpdatedAt uint64 `json:"updatedAt"`
+	// TagPaths are paths of leaf tags, made of primary names, like
+	// "/foo/bar"
+	TagPaths []string `json:"tagPaths"`
+}
+
+type userBackupNote struct {
+	ID        int    `json:"id"`
+	Title     string `json:"title"`
+	Body      string `json:"body,omitempty"`
+	CreatedAt uint64 `json:"createdAt"`
+	UpdatedAt uint64 `json:"updatedAt"`
+	// TagPaths are like for bookmarks
+	TagPaths []string `json:"tagPaths"`
+}
+
+// userRestoreReport is returned by POST /restore. Tags, bookmarks and notes
+// which already exist (tags with the same path, bookmarks with the same
+// canonical URL, notes with the same title and body) are not created again,
+// and the existing ones are given in the ids maps.
+type userRestoreReport struct {
+	// TagIDs maps tag ids from the backup to the ids of the restored tags
+	TagIDs map[int]int `json:"tagIDs"`
+	// BookmarkIDs maps bookmark ids from the backup to the ids of the
+	// restored bookmarks
+	BookmarkIDs map[int]int `json:"bookmarkIDs"`
+	// NoteIDs maps note ids from the backup to the ids of the restored notes
+	NoteIDs map[int]int `json:"noteIDs"`
+
+	CreatedTagsCnt      int `json:"createdTagsCnt"`
+	CreatedBookmarksCnt int `json:"createdBookmarksCnt"`
+	// SkippedBookmarksCnt is the number of bookmarks which weren't created
+	// since there are bookmarks with the same canonical URL
+	SkippedBookmarksCnt int `json:"skippedBookmarksCnt"`
+	CreatedNotesCnt     int `json:"createdNotesCnt"`
+	// SkippedNotesCnt is the number of notes which weren't created since
+	// there are notes with the same title and body
+	SkippedNotesCnt int `json:"skippedNotesCnt"`
+}
+
+// userExportGet is a GET /export handler: it returns all the data of the
+// user, which can be restored later with POST /restore.
+func (gm *GMServer) userExportGet(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var backup *userBackup
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		var err error
+		backup, err = gm.getUserBackup(tx, gmr.SubjUser.ID)
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return backup, nil
+}
+
+func (gm *GMServer) getUserBackup(tx *sql.Tx, ownerID int) (*userBackup, error) {
+	rootTagID, err := gm.si.GetRootTagID(tx, ownerID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	rootTag, err := gm.si.GetTag(tx, rootTagID, &storage.GetTagOpts{
+		GetNames:   true,
+		GetSubtags: true,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	bkms, err := gm.getAllBookmarks(tx, ownerID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	notes, err := gm.si.GetNotes(tx, &storage.GetNotesArgs{
+		OwnerID: ownerID,
+	}, &storage.TagsFetchOpts{
+		TagsFetchMode:     storage.TagsFetchModeLeafs,
+		TagNamesFetchMode: storage.TagNamesFetchModeFull,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	backup := &userBackup{
+		Version:    userBackupVersion,
+		ExportedAt: uint64(time.Now().Unix()),
+		Tags:       makeUserBackupTags(rootTag.Subtags),
+		Bookmarks:  []userBackupBookmark{},
+		Notes:      []userBackupNote{},
+	}
+
+	for _, bkm := range bkms {
+		backup.Bookmarks = append(backup.Bookmarks, userBackupBookmark{
+			ID:        bkm.ID,
+			URL:       bkm.URL,
+			Title:     bkm.Title,
+			Comment:   bkm.Comment,
+			CreatedAt: bkm.CreatedAt,
+			UpdatedAt: bkm.UpdatedAt,
+			TagPaths:  getUserBackupTagPaths(bkm.Tags),
+		})
+	}
+
+	for _, note := range notes {
+		backup.Notes = append(backup.Notes, userBackupNote{
+			ID:        note.ID,
+			Title:     note.Title,
+			Body:      note.Body,
+			CreatedAt: note.CreatedAt,
+			UpdatedAt: note.UpdatedAt,
+			TagPaths:  getUserBackupTagPaths(note.Tags),
+		})
+	}
+
+	return backup, nil
+}
+
+// getUserBackupTagPaths returns paths of the given leaf tags, made of primary
+// names.
+func getUserBackupTagPaths(tags []storage.BookmarkTagPath) []string {
+	tagPaths := []string{}
+	for _, folder := range getExportFolders(tags) {
+		tagPaths = append(tagPaths, "/"+strings.Join(folder, "/"))
+	}
+	return tagPaths
+}
+
+func makeUserBackupTags(tags []storage.TagData) []userBackupTag {
+	ret := []userBackupTag{}
+	for _, td := range tags {
+		names := []userBackupTagName{}
+		for i, name := range td.Names {
+			names = append(names, userBackupTagName{
+				Name: name,
+				// The first name is the primary one
+				Primary: i == 0,
+			})
+		}
+
+		ret = append(ret, userBackupTag{
+			ID:          td.ID,
+			Names:       names,
+			Description: *td.Description,
+			Subtags:     makeUserBackupTags(td.Subtags),
+		})
+	}
+	return ret
+}
+
+// userRestorePost is a POST /restore handler: it takes the data returned by
+// GET /export, and recreates it for the user, who might have some data
+// already.
+func (gm *GMServer) userRestorePost(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	decoder := json.NewDecoder(gmr.Body)
+	var backup userBackup
+	err = decoder.Decode(&backup)
+	if err != nil {
+		return nil, interrors.WrapInternalError(
+			err,
+			errors.Errorf("invalid data"),
+		)
+	}
+
+	if backup.Version != userBackupVersion {
+		return nil, errors.Errorf(
+			"unsupported backup version %d, only %d is supported",
+			backup.Version, userBackupVersion,
+		)
+	}
+
+	report := &userRestoreReport{
+		TagIDs:      map[int]int{},
+		BookmarkIDs: map[int]int{},
+		NoteIDs:     map[int]int{},
+	}
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		return errors.Trace(gm.restoreUserBackup(tx, gmr.SubjUser.ID, &backup, report))
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if report.CreatedTagsCnt > 0 {
+		userIDToTagsTree.DeleteCacheForUser(gmr.SubjUser.ID)
+	}
+
+	gm.wakePageMetaFetcher()
+
+	return report, nil
+}
+
+func (gm *GMServer) restoreUserBackup(
+	tx *sql.Tx, ownerID int, backup *userBackup, report *userRestoreReport,
+) error {
+	rootTagID, err := gm.si.GetRootTagID(tx, ownerID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Restored tag ids by the tag paths from the backup
+	tagIDsByPath := map[string]int{}
+
+	err = gm.restoreUserBackupTags(
+		tx, ownerID, rootTagID, "", false, backup.Tags, tagIDsByPath, report,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Bookmarks are only skipped if the user had them before the restore: the
+	// backup itself can contain duplicates, made with allow_duplicate.
+	restoredBkmIDs := map[int]bool{}
+
+	for _, bbkm := range backup.Bookmarks {
+		canonicalURL := canonicalizeURL(bbkm.URL)
+		existingID, err := gm.getExistingBookmarkID(
+			tx, ownerID, canonicalURL, restoredBkmIDs,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if existingID != 0 {
+			report.BookmarkIDs[bbkm.ID] = existingID
+			report.SkippedBookmarksCnt++
+			continue
+		}
+
+		tagIDs, err := getRestoredTagIDs(bbkm.TagPaths, tagIDsByPath)
+		if err != nil {
+			return errors.Annotatef(err, "bookmark %d", bbkm.ID)
+		}
+
+		bkmID, err := gm.si.CreateBookmark(tx, &storage.BookmarkData{
+			OwnerID:      ownerID,
+			Title:        bbkm.Title,
+			Comment:      bbkm.Comment,
+			URL:          bbkm.URL,
+			CanonicalURL: canonicalURL,
+			CreatedAt:    bbkm.CreatedAt,
+			UpdatedAt:    bbkm.UpdatedAt,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = gm.si.SetTaggings(tx, bkmID, tagIDs, storage.TaggingModeLeafs)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Setting taggings bumps the update time, so set the original one again
+		if bbkm.UpdatedAt != 0 {
+			err = gm.si.SetTaggableUpdatedAt(tx, bkmID, bbkm.UpdatedAt)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		if _, err := gm.si.SaveBookmarkRevision(tx, bkmID); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := gm.requestPageMeta(tx, bkmID); err != nil {
+			return errors.Trace(err)
+		}
+
+		restoredBkmIDs[bkmID] = true
+		report.BookmarkIDs[bbkm.ID] = bkmID
+		report.CreatedBookmarksCnt++
+	}
+
+	return errors.Trace(
+		gm.restoreUserBackupNotes(tx, ownerID, backup.Notes, tagIDsByPath, report),
+	)
+}
+
+// getExistingBookmarkID returns the id of the user's bookmark with the given
+// canonical URL which is not one of exceptBkmIDs, or 0 if there's none.
+func (gm *GMServer) getExistingBookmarkID(
+	tx *sql.Tx, ownerID int, canonicalURL string, exceptBkmIDs map[int]bool,
+) (int, error) {
+	if canonicalURL == "" {
+		return 0, nil
+	}
+
+	bkms, _, err := gm.si.GetBookmarks(tx, &storage.GetBookmarksArgs{
+		OwnerID:      ownerID,
+		CanonicalURL: canonicalURL,
+	}, &storage.TagsFetchOpts{
+		TagsFetchMode:     storage.TagsFetchModeNone,
+		TagNamesFetchMode: storage.TagNamesFetchModeNone,
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	for _, bkm := range bkms {
+		if !exceptBkmIDs[bkm.ID] {
+			return bkm.ID, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// restoreUserBackupNotes creates the notes from the backup, except the ones
+// which the user had before the restore (with the same title and body); the
+// backup itself can contain such duplicates.
+func (gm *GMServer) restoreUserBackupNotes(
+	tx *sql.Tx, ownerID int, bnotes []userBackupNote, tagIDsByPath map[string]int,
+	report *userRestoreReport,
+) error {
+	type noteKey struct {
+		title, body string
+	}
+
+	notes, err := gm.si.GetNotes(tx, &storage.GetNotesArgs{
+		OwnerID: ownerID,
+	}, &storage.TagsFetchOpts{
+		TagsFetchMode:     storage.TagsFetchModeNone,
+		TagNamesFetchMode: storage.TagNamesFetchModeNone,
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	existing := map[noteKey]int{}
+	for _, note := range notes {
+		existing[noteKey{note.Title, note.Body}] = note.ID
+	}
+
+	for _, bnote := range bnotes {
+		key := noteKey{bnote.Title, bnote.Body}
+		if noteID, ok := existing[key]; ok {
+			report.NoteIDs[bnote.ID] = noteID
+			report.SkippedNotesCnt++
+			continue
+		}
+
+		tagIDs, err := getRestoredTagIDs(bnote.TagPaths, tagIDsByPath)
+		if err != nil {
+			return errors.Annotatef(err, "note %d", bnote.ID)
+		}
+
+		noteID, err := gm.si.CreateNote(tx, &storage.NoteData{
+			OwnerID:   ownerID,
+			Title:     bnote.Title,
+			Body:      bnote.Body,
+			CreatedAt: bnote.CreatedAt,
+			UpdatedAt: bnote.UpdatedAt,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = gm.si.SetTaggings(tx, noteID, tagIDs, storage.TaggingModeLeafs)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Setting taggings bumps the update time, so set the original one again
+		if bnote.UpdatedAt != 0 {
+			err = gm.si.SetTaggableUpdatedAt(tx, noteID, bnote.UpdatedAt)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		report.NoteIDs[bnote.ID] = noteID
+		report.CreatedNotesCnt++
+	}
+
+	return nil
+}
+
+// getRestoredTagIDs returns ids of the restored tags with the given paths
+// from the backup.
+func getRestoredTagIDs(tagPaths []string, tagIDsByPath map[string]int) ([]int, error) {
+	tagIDs := []int{}
+	for _, tagPath := range tagPaths {
+		tagID, ok := tagIDsByPath[tagPath]
+		if !ok {
+			return nil, errors.Errorf("tag %q is not in the backup", tagPath)
+		}
+		tagIDs = append(tagIDs, tagID)
+	}
+	return tagIDs, nil
+}
+
+// restoreUserBackupTags restores the given tags from the backup under the
+// given parent, which is created by the same restore if parentCreated is
+// true. A tag whose primary name matches any name of an existing tag is not
+// created; its subtags are restored under the existing one.
+func (gm *GMServer) restoreUserBackupTags(
+	tx *sql.Tx, ownerID, parentTagID int, parentPath string, parentCreated bool,
+	btags []userBackupTag, tagIDsByPath map[string]int, report *userRestoreReport,
+) error {
+	for _, btag := range btags {
+		names := getUserBackupTagNames(&btag)
+		if len(names) == 0 {
+			return errors.Errorf("tag %d has no names", btag.ID)
+		}
+
+		created := false
+		tagID, err := gm.si.GetTagIDByName(tx, parentTagID, names[0])
+		if err != nil {
+			if errors.Cause(err) != storage.ErrTagDoesNotExist {
+				return errors.Trace(err)
+			}
+
+			// Aliases which are taken by other tags are dropped
+			freeNames := names[:1]
+			for _, name := range names[1:] {
+				_, err := gm.si.GetTagIDByName(tx, parentTagID, name)
+				if err == nil {
+					continue
+				}
+				if errors.Cause(err) != storage.ErrTagDoesNotExist {
+					return errors.Trace(err)
+				}
+				freeNames = append(freeNames, name)
+			}
+
+			description := btag.Description
+			tagID, err = gm.si.CreateTag(tx, &storage.TagData{
+				OwnerID:     ownerID,
+				ParentTagID: &parentTagID,
+				Description: &description,
+				Names:       freeNames,
+			})
+			if err != nil {
+				return errors.Annotatef(err, "creating tag %d", btag.ID)
+			}
+
+			// Undoing the creation of the topmost tag deletes the rest as well
+			if !parentCreated {
+				err = gm.saveTagOperation(tx, ownerID, &storage.TagOperationData{
+					Kind:  storage.TagOperationCreate,
+					TagID: tagID,
+				})
+				if err != nil {
+					return errors.Trace(err)
+				}
+			}
+
+			created = true
+			report.CreatedTagsCnt++
+		}
+
+		tagPath := parentPath + "/" + names[0]
+		tagIDsByPath[tagPath] = tagID
+		report.TagIDs[btag.ID] = tagID
+
+		err = gm.restoreUserBackupTags(
+			tx, ownerID, tagID, tagPath, created, btag.Subtags, tagIDsByPath, report,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// getUserBackupTagNames returns names of the tag from the backup, the primary
+// one first.
+func getUserBackupTagNames(btag *userBackupTag) []string {
+	names := []string{}
+	for _, n := range btag.Names {
+		if n.Primary {
+			names = append([]string{n.Name}, names...)
+		} else {
+			names = append(names, n.Name)
+		}
+	}
+	return names
+}
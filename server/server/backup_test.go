@@ -0,0 +1,333 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests integration_tests
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+func TestBackup(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestBackup)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func perUserTestBackup(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	tagIDs, err := makeTestTagsHierarchy(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkmAID, err := addBookmark(be, u1.id, &bkmData{
+		URL:     "http://x.com/a",
+		Title:   "title_a",
+		Comment: "comment_a",
+		TagIDs:  []int{tagIDs.tag8ID, tagIDs.tag4ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkmBID, err := addBookmark(be, u1.id, &bkmData{URL: "http://x.com/b"})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	noteID, err := addNote(be, u1.id, &noteData{
+		Title:  "title_n",
+		Body:   "body_n",
+		TagIDs: []int{tagIDs.tag4ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	backup1, err := getBackup(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if backup1.Version != userBackupVersion || len(backup1.Tags) != 3 {
+		return errors.Errorf("unexpected backup: %+v", backup1)
+	}
+
+	expectedTag3 := userBackupTag{
+		ID: tagIDs.tag3ID,
+		Names: []userBackupTagName{
+			{Name: "tag3_alias", Primary: true},
+			{Name: "tag3", Primary: false},
+		},
+		Description: "test tag",
+	}
+	tag3 := backup1.Tags[0].Subtags[0]
+	tag3.Subtags = nil
+	if !reflect.DeepEqual(tag3, expectedTag3) {
+		return errors.Errorf("expected tag %+v, got %+v", expectedTag3, tag3)
+	}
+
+	if len(backup1.Bookmarks) != 2 {
+		return errors.Errorf("expected 2 bookmarks, got %+v", backup1.Bookmarks)
+	}
+
+	bkmA := backup1.Bookmarks[0]
+	expectedPaths := []string{"/tag1/tag3_alias/tag4", "/tag7/tag8"}
+	if bkmA.ID != bkmAID || bkmA.URL != "http://x.com/a" || bkmA.Title != "title_a" ||
+		bkmA.Comment != "comment_a" || bkmA.CreatedAt == 0 ||
+		!reflect.DeepEqual(bkmA.TagPaths, expectedPaths) {
+		return errors.Errorf("unexpected bookmark: %+v", bkmA)
+	}
+
+	if len(backup1.Notes) != 1 {
+		return errors.Errorf("expected 1 note, got %+v", backup1.Notes)
+	}
+
+	note := backup1.Notes[0]
+	if note.ID != noteID || note.Title != "title_n" || note.Body != "body_n" ||
+		note.CreatedAt == 0 || note.UpdatedAt == 0 ||
+		!reflect.DeepEqual(note.TagPaths, []string{"/tag1/tag3_alias/tag4"}) {
+		return errors.Errorf("unexpected note: %+v", note)
+	}
+
+	// Make all the times different from the current one, so that they're
+	// checked to be restored
+	for i := range backup1.Bookmarks {
+		backup1.Bookmarks[i].CreatedAt = uint64(1262304000 + i)
+		backup1.Bookmarks[i].UpdatedAt = uint64(1262390400 + i)
+	}
+	backup1.Notes[0].CreatedAt = 1262304100
+	backup1.Notes[0].UpdatedAt = 1262390500
+
+	// Restore into the empty account of another user
+	report, err := restoreBackup(be, u2.id, backup1)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if report.CreatedTagsCnt != 8 || report.CreatedBookmarksCnt != 2 ||
+		report.SkippedBookmarksCnt != 0 || len(report.TagIDs) != 8 ||
+		len(report.BookmarkIDs) != 2 || report.CreatedNotesCnt != 1 ||
+		report.SkippedNotesCnt != 0 || len(report.NoteIDs) != 1 {
+		return errors.Errorf("unexpected report: %+v", report)
+	}
+
+	backup2, err := getBackup(be, u2.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// After remapping the ids, the data should be the same
+	remapUserBackup(backup1, report)
+	backup1.ExportedAt = backup2.ExportedAt
+	if !reflect.DeepEqual(backup1, backup2) {
+		return errors.Errorf("expected restored data %+v, got %+v", backup1, backup2)
+	}
+
+	// Restoring into the account with the same data creates nothing, and
+	// refers to the existing data
+	report2, err := restoreBackup(be, u2.id, backup2)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	identity := func(ids map[int]int) map[int]int {
+		ret := map[int]int{}
+		for _, id := range ids {
+			ret[id] = id
+		}
+		return ret
+	}
+
+	expectedReport2 := &userRestoreReport{
+		TagIDs:              identity(report.TagIDs),
+		BookmarkIDs:         identity(report.BookmarkIDs),
+		NoteIDs:             identity(report.NoteIDs),
+		SkippedBookmarksCnt: 2,
+		SkippedNotesCnt:     1,
+	}
+	if !reflect.DeepEqual(report2, expectedReport2) {
+		return errors.Errorf("expected report %+v, got %+v", expectedReport2, report2)
+	}
+
+	// Existing tags are reused, and only the missing ones are created
+	if err := deleteTag(be, "/tags/tag7/tag8", u1.id, QSArgNewLeafPolicyKeep); err != nil {
+		return errors.Trace(err)
+	}
+	if err := deleteBookmark(be, u1.id, bkmBID); err != nil {
+		return errors.Trace(err)
+	}
+
+	report3, err := restoreBackup(be, u1.id, backup2)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if report3.CreatedTagsCnt != 1 || report3.CreatedBookmarksCnt != 1 ||
+		report3.SkippedBookmarksCnt != 1 || report3.TagIDs[report.TagIDs[tagIDs.tag4ID]] != tagIDs.tag4ID ||
+		report3.SkippedNotesCnt != 1 || report3.NoteIDs[report.NoteIDs[noteID]] != noteID {
+		return errors.Errorf("unexpected report: %+v", report3)
+	}
+
+	// Unsupported version
+	backup2.Version = userBackupVersion + 1
+	resp, err := be.DoUserReq("POST", "/restore", u2.id, backup2, false)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := expectHTTPCode(resp, 400); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// TestBackupDuplicates checks that bookmarks with the same URL (created with
+// allow_duplicate) and identical notes survive the round trip.
+func TestBackupDuplicates(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestBackupDuplicates)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func perUserTestBackupDuplicates(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	for _, comment := range []string{"first", "second"} {
+		_, err := be.DoUserReq(
+			"POST", "/bookmarks?"+QSArgAllowDuplicate+"=1", u1.id,
+			H{"url": "http://x.com/a", "comment": comment}, true,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if _, err := addNote(be, u1.id, &noteData{Title: "title_n"}); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	backup1, err := getBackup(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(backup1.Bookmarks) != 2 || len(backup1.Notes) != 2 {
+		return errors.Errorf("unexpected backup: %+v", backup1)
+	}
+
+	report, err := restoreBackup(be, u2.id, backup1)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if report.CreatedBookmarksCnt != 2 || report.SkippedBookmarksCnt != 0 ||
+		report.CreatedNotesCnt != 2 || report.SkippedNotesCnt != 0 {
+		return errors.Errorf("unexpected report: %+v", report)
+	}
+
+	backup2, err := getBackup(be, u2.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	remapUserBackup(backup1, report)
+	backup1.ExportedAt = backup2.ExportedAt
+	if !reflect.DeepEqual(backup1, backup2) {
+		return errors.Errorf("expected restored data %+v, got %+v", backup1, backup2)
+	}
+
+	// Restoring again creates nothing
+	report2, err := restoreBackup(be, u2.id, backup2)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if report2.CreatedBookmarksCnt != 0 || report2.SkippedBookmarksCnt != 2 ||
+		report2.CreatedNotesCnt != 0 || report2.SkippedNotesCnt != 2 {
+		return errors.Errorf("unexpected report: %+v", report2)
+	}
+
+	return nil
+}
+
+// remapUserBackup replaces ids in the backup according to the restore report
+func remapUserBackup(backup *userBackup, report *userRestoreReport) {
+	var remapTags func(tags []userBackupTag)
+	remapTags = func(tags []userBackupTag) {
+		for i := range tags {
+			tags[i].ID = report.TagIDs[tags[i].ID]
+			remapTags(tags[i].Subtags)
+		}
+	}
+	remapTags(backup.Tags)
+
+	for i := range backup.Bookmarks {
+		backup.Bookmarks[i].ID = report.BookmarkIDs[backup.Bookmarks[i].ID]
+	}
+
+	for i := range backup.Notes {
+		backup.Notes[i].ID = report.NoteIDs[backup.Notes[i].ID]
+	}
+}
+
+func getBackup(be testBackend, userID int) (*userBackup, error) {
+	resp, err := be.DoUserReq("GET", "/export", userID, nil, true)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	v := &userBackup{}
+	if err := json.Unmarshal(body, v); err != nil {
+		return nil, errors.Annotatef(err, "body: %q", body)
+	}
+
+	return v, nil
+}
+
+func restoreBackup(
+	be testBackend, userID int, backup *userBackup,
+) (*userRestoreReport, error) {
+	resp, err := be.DoUserReq("POST", "/restore", userID, backup, true)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	v := &userRestoreReport{}
+	if err := json.Unmarshal(body, v); err != nil {
+		return nil, errors.Annotatef(err, "body: %q", body)
+	}
+
+	return v, nil
+}
@@ -5,14 +5,16 @@ package server
 
 import (
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"sort"
 	"strconv"
 
 	"goji.io/pat"
 
-	"dmitryfrank.com/geekmarks/server/cptr"
 	"github.com/dimonomid/interrors"
 	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/tagexpr"
 
 	"github.com/juju/errors"
 )
@@ -20,6 +22,30 @@ import (
 const (
 	QSArgBkmGetArgTagID = "tag_id"
 	QSArgBkmGetArgURL   = "url"
+	QSArgBkmGetArgQuery = "q"
+	// Boolean expression over tags, see tagexpr package
+	QSArgBkmGetArgTagExpr = "tag_expr"
+
+	QSArgBkmGetArgView = "view"
+	// Only bookmarks tagged with the given tag_id(s) as leaf tags, i.e. not
+	// with any of their subtags
+	QSArgBkmGetArgViewDirect = "direct"
+	// Only bookmarks without any tags (except the root one)
+	QSArgBkmGetArgViewUntagged = "untagged"
+
+	// Only bookmarks whose URL was found broken or redirected by the link
+	// checker, see RunLinkChecker
+	QSArgBkmGetArgLinkStatus = "link_status"
+
+	QSArgBkmGetArgSort   = "sort"
+	QSArgBkmGetArgLimit  = "limit"
+	QSArgBkmGetArgCursor = "cursor"
+
+	// Type of the tagged items to return, see getTaggedTaggables
+	QSArgBkmGetArgType         = "type"
+	QSArgBkmGetArgTypeBookmark = "bookmark"
+	QSArgBkmGetArgTypeNote     = "note"
+	QSArgBkmGetArgTypeAll      = "all"
 )
 
 type userBookmarkTag struct {
@@ -36,8 +62,29 @@ type userBookmarkData struct {
 	URL       string            `json:"url"`
 	Title     string            `json:"title,omitempty"`
 	Comment   string            `json:"comment,omitempty"`
+	CreatedAt uint64            `json:"createdAt"`
 	UpdatedAt uint64            `json:"updatedAt"`
 	Tags      []userBookmarkTag `json:"tags,omitempty"`
+	// LinkCheck is nil until the URL is checked by the link checker
+	LinkCheck *userBookmarkLinkCheck `json:"linkCheck,omitempty"`
+	// PageMeta is nil until the page metadata is fetched, see
+	// RunPageMetaFetcher
+	PageMeta *userBookmarkPageMeta `json:"pageMeta,omitempty"`
+}
+
+// userTaggableData is an item of the GET /bookmarks?type=all response: only
+// the field of the given type is set.
+type userTaggableData struct {
+	Type     storage.TaggableType `json:"type"`
+	Bookmark *userBookmarkData    `json:"bookmark,omitempty"`
+	Note     *userNoteData        `json:"note,omitempty"`
+}
+
+// userBookmarksPage is returned by GET /bookmarks instead of the plain list
+// of bookmarks if the limit is given. NextCursor is empty on the last page.
+type userBookmarksPage struct {
+	Bookmarks  []userBookmarkData `json:"bookmarks"`
+	NextCursor string             `json:"nextCursor,omitempty"`
 }
 
 type userBookmarkPostArgs struct {
@@ -63,10 +110,33 @@ func (gm *GMServer) userBookmarksGet(gmr *GMRequest) (resp interface{}, err erro
 		return nil, errors.Trace(err)
 	}
 
-	// Check if both tag_id and url are given (it's an error)
-	if len(gmr.Values[QSArgBkmGetArgTagID]) > 0 && len(gmr.Values[QSArgBkmGetArgURL]) > 0 {
+	// Check if both tag_id (or any other search or paging argument) and url are
+	// given (it's an error)
+	if len(gmr.Values[QSArgBkmGetArgURL]) > 0 {
+		for _, arg := range []string{
+			QSArgBkmGetArgTagID, QSArgBkmGetArgQuery, QSArgBkmGetArgTagExpr,
+			QSArgBkmGetArgView, QSArgBkmGetArgLinkStatus,
+			QSArgBkmGetArgSort, QSArgBkmGetArgLimit, QSArgBkmGetArgCursor,
+			QSArgBkmGetArgType,
+		} {
+			if len(gmr.Values[arg]) > 0 {
+				return nil, errors.Errorf(
+					"%q and %q cannot be given both", arg, QSArgBkmGetArgURL,
+				)
+			}
+		}
+	}
+
+	switch ttype := gmr.FormValue(QSArgBkmGetArgType); ttype {
+	case "", QSArgBkmGetArgTypeBookmark:
+		// Just bookmarks
+	case QSArgBkmGetArgTypeNote, QSArgBkmGetArgTypeAll:
+		return gm.getTaggedTaggables(gmr, ttype)
+	default:
 		return nil, errors.Errorf(
-			"%q and %q cannot be given both", QSArgBkmGetArgTagID, QSArgBkmGetArgURL,
+			"invalid %s: %q; valid values are: %q, %q, %q",
+			QSArgBkmGetArgType, ttype,
+			QSArgBkmGetArgTypeBookmark, QSArgBkmGetArgTypeNote, QSArgBkmGetArgTypeAll,
 		)
 	}
 
@@ -76,15 +146,26 @@ func (gm *GMServer) userBookmarksGet(gmr *GMRequest) (resp interface{}, err erro
 	}
 
 	var bkms []storage.BookmarkDataWTags
+	var args storage.GetBookmarksArgs
+	var next *storage.BookmarksCursor
+	var lcs map[int]storage.LinkCheckData
+	var pms map[int]storage.PageMetaData
 
 	if len(gmr.Values[QSArgBkmGetArgURL]) > 0 {
-		// get bookmarks by URL
+		// get bookmarks by URL: all the bookmarks with the same canonical URL
+		// are returned
 
-		err = gm.si.Tx(func(tx *sql.Tx) error {
+		err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 			var err error
-			bkms, err = gm.si.GetBookmarksByURL(
-				tx, gmr.Values[QSArgBkmGetArgURL][0], gmr.SubjUser.ID, &tagsFetchOpts,
-			)
+			bkms, _, err = gm.si.GetBookmarks(tx, &storage.GetBookmarksArgs{
+				OwnerID:      gmr.SubjUser.ID,
+				CanonicalURL: canonicalizeURL(gmr.Values[QSArgBkmGetArgURL][0]),
+			}, &tagsFetchOpts)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			lcs, pms, err = gm.getBookmarksExtras(tx, bkms)
 			if err != nil {
 				return errors.Trace(err)
 			}
@@ -95,7 +176,7 @@ func (gm *GMServer) userBookmarksGet(gmr *GMRequest) (resp interface{}, err erro
 			return nil, errors.Trace(err)
 		}
 	} else {
-		// get tagged bookmarks
+		// get tagged bookmarks, possibly matching the full-text query
 
 		tagIDs := []int{}
 		for _, stid := range gmr.Values[QSArgBkmGetArgTagID] {
@@ -106,11 +187,105 @@ func (gm *GMServer) userBookmarksGet(gmr *GMRequest) (resp interface{}, err erro
 			tagIDs = append(tagIDs, v)
 		}
 
-		err = gm.si.Tx(func(tx *sql.Tx) error {
-			var err error
-			bkms, err = gm.si.GetTaggedBookmarks(
-				tx, tagIDs, cptr.Int(gmr.SubjUser.ID), &tagsFetchOpts,
+		query := gmr.FormValue(QSArgBkmGetArgQuery)
+
+		var tagExpr *tagexpr.Expr
+		if s := gmr.FormValue(QSArgBkmGetArgTagExpr); s != "" {
+			tagExpr, err = tagexpr.Parse(s)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+
+		linkStatus := storage.LinkStatus(gmr.FormValue(QSArgBkmGetArgLinkStatus))
+		switch linkStatus {
+		case storage.LinkStatusAny, storage.LinkStatusBroken, storage.LinkStatusRedirected:
+			// Valid
+		default:
+			return nil, errors.Errorf(
+				"invalid %s: %q; valid values are: %q, %q",
+				QSArgBkmGetArgLinkStatus, linkStatus,
+				storage.LinkStatusBroken, storage.LinkStatusRedirected,
+			)
+		}
+
+		args = storage.GetBookmarksArgs{
+			OwnerID: gmr.SubjUser.ID,
+			TagIDs:  tagIDs,
+			Query:   query,
+			// Unlike the plain tag search, the full-text search, tag expression
+			// or link status without tags look through all bookmarks, not just
+			// untagged ones
+			Untagged: len(tagIDs) == 0 && query == "" && tagExpr == nil &&
+				linkStatus == storage.LinkStatusAny,
+			LinkStatus: linkStatus,
+			Sort:       storage.BookmarksSort(gmr.FormValue(QSArgBkmGetArgSort)),
+		}
+
+		switch view := gmr.FormValue(QSArgBkmGetArgView); view {
+		case "":
+			// Nothing special
+		case QSArgBkmGetArgViewDirect:
+			if len(tagIDs) == 0 {
+				return nil, errors.Errorf(
+					"%s %q requires %q", QSArgBkmGetArgView, view, QSArgBkmGetArgTagID,
+				)
+			}
+			args.DirectlyTagged = true
+		case QSArgBkmGetArgViewUntagged:
+			if len(tagIDs) > 0 || tagExpr != nil {
+				return nil, errors.Errorf(
+					"%s %q cannot be used with %q or %q",
+					QSArgBkmGetArgView, view, QSArgBkmGetArgTagID, QSArgBkmGetArgTagExpr,
+				)
+			}
+			args.Untagged = true
+		default:
+			return nil, errors.Errorf(
+				"invalid %s: %q; valid values are: %q, %q",
+				QSArgBkmGetArgView, view, QSArgBkmGetArgViewDirect, QSArgBkmGetArgViewUntagged,
 			)
+		}
+
+		if limitStr := gmr.FormValue(QSArgBkmGetArgLimit); limitStr != "" {
+			args.Limit, err = strconv.Atoi(limitStr)
+			if err != nil || args.Limit <= 0 {
+				return nil, interrors.WrapInternalError(
+					err,
+					errors.Errorf("%q should be a positive number, got %q", QSArgBkmGetArgLimit, limitStr),
+				)
+			}
+		}
+
+		if cursorStr := gmr.FormValue(QSArgBkmGetArgCursor); cursorStr != "" {
+			if args.Limit == 0 {
+				return nil, errors.Errorf(
+					"%q requires %q to be given", QSArgBkmGetArgCursor, QSArgBkmGetArgLimit,
+				)
+			}
+
+			args.After, err = parseBookmarksCursor(cursorStr)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+
+		err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+			var err error
+
+			if tagExpr != nil {
+				args.TagExpr, err = gm.resolveTagExpr(tx, gmr.SubjUser.ID, tagExpr)
+				if err != nil {
+					return errors.Trace(err)
+				}
+			}
+
+			bkms, next, err = gm.si.GetBookmarks(tx, &args, &tagsFetchOpts)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			lcs, pms, err = gm.getBookmarksExtras(tx, bkms)
 			if err != nil {
 				return errors.Trace(err)
 			}
@@ -125,19 +300,229 @@ func (gm *GMServer) userBookmarksGet(gmr *GMRequest) (resp interface{}, err erro
 	bkmsUser := []userBookmarkData{}
 
 	for _, bkm := range bkms {
-		bkmsUser = append(bkmsUser, userBookmarkData{
-			ID:        bkm.ID,
-			URL:       bkm.URL,
-			Title:     bkm.Title,
-			Comment:   bkm.Comment,
-			UpdatedAt: bkm.UpdatedAt,
-			Tags:      getUserBookmarkTags(bkm.Tags),
-		})
+		bkmsUser = append(bkmsUser, makeUserBookmarkData(&bkm, lcs, pms))
+	}
+
+	if args.Limit > 0 {
+		// Paginated response: WebSocket responses have no headers, so the
+		// cursor of the next page goes to the body
+		page := userBookmarksPage{
+			Bookmarks: bkmsUser,
+		}
+
+		if next != nil {
+			page.NextCursor, err = makeBookmarksCursorString(next)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+
+		return page, nil
 	}
 
 	return bkmsUser, nil
 }
 
+// getTaggedTaggables handles GET /bookmarks with the type other than
+// bookmark: type=note returns the notes tagged with all the tag_id tags, like
+// GET /notes does, and type=all returns both bookmarks and notes, as a list of
+// userTaggableData sorted by id. Only tag_id can be given then.
+func (gm *GMServer) getTaggedTaggables(
+	gmr *GMRequest, ttype string,
+) (resp interface{}, err error) {
+	for _, arg := range []string{
+		QSArgBkmGetArgQuery, QSArgBkmGetArgTagExpr, QSArgBkmGetArgView,
+		QSArgBkmGetArgLinkStatus, QSArgBkmGetArgSort, QSArgBkmGetArgLimit,
+		QSArgBkmGetArgCursor,
+	} {
+		if len(gmr.Values[arg]) > 0 {
+			return nil, errors.Errorf(
+				"%q cannot be given with %s %q", arg, QSArgBkmGetArgType, ttype,
+			)
+		}
+	}
+
+	tagIDs := []int{}
+	for _, stid := range gmr.Values[QSArgBkmGetArgTagID] {
+		v, err := strconv.Atoi(stid)
+		if err != nil {
+			return nil, errors.Annotatef(err, "wrong tag id %q", stid)
+		}
+		tagIDs = append(tagIDs, v)
+	}
+
+	if len(tagIDs) == 0 {
+		return nil, errors.Errorf(
+			"%s %q requires %q", QSArgBkmGetArgType, ttype, QSArgBkmGetArgTagID,
+		)
+	}
+
+	var ttypes []storage.TaggableType
+	if ttype == QSArgBkmGetArgTypeNote {
+		ttypes = []storage.TaggableType{storage.TaggableTypeNote}
+	}
+
+	tagsFetchOpts := storage.TagsFetchOpts{
+		TagsFetchMode:     storage.TagsFetchModeLeafs,
+		TagNamesFetchMode: storage.TagNamesFetchModeFull,
+	}
+
+	var taggableIDs []int
+	bkms := map[int]*storage.BookmarkDataWTags{}
+	notes := map[int]*storage.NoteDataWTags{}
+	var lcs map[int]storage.LinkCheckData
+	var pms map[int]storage.PageMetaData
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		var err error
+
+		taggableIDs, err = gm.si.GetTaggedTaggableIDs(
+			tx, tagIDs, &gmr.SubjUser.ID, ttypes,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if ttype == QSArgBkmGetArgTypeAll {
+			bkmsList, _, err := gm.si.GetBookmarks(tx, &storage.GetBookmarksArgs{
+				OwnerID: gmr.SubjUser.ID,
+				TagIDs:  tagIDs,
+			}, &tagsFetchOpts)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			for i := range bkmsList {
+				bkms[bkmsList[i].ID] = &bkmsList[i]
+			}
+
+			lcs, pms, err = gm.getBookmarksExtras(tx, bkmsList)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		notesList, err := gm.si.GetNotes(tx, &storage.GetNotesArgs{
+			OwnerID: gmr.SubjUser.ID,
+			TagIDs:  tagIDs,
+		}, &tagsFetchOpts)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		for i := range notesList {
+			notes[notesList[i].ID] = &notesList[i]
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	sort.Ints(taggableIDs)
+
+	if ttype == QSArgBkmGetArgTypeNote {
+		notesUser := []userNoteData{}
+		for _, id := range taggableIDs {
+			if note, ok := notes[id]; ok {
+				notesUser = append(notesUser, makeUserNoteData(note))
+			}
+		}
+
+		return notesUser, nil
+	}
+
+	taggablesUser := []userTaggableData{}
+	for _, id := range taggableIDs {
+		if bkm, ok := bkms[id]; ok {
+			bkmUser := makeUserBookmarkData(bkm, lcs, pms)
+			taggablesUser = append(taggablesUser, userTaggableData{
+				Type:     storage.TaggableTypeBookmark,
+				Bookmark: &bkmUser,
+			})
+		} else if note, ok := notes[id]; ok {
+			noteUser := makeUserNoteData(note)
+			taggablesUser = append(taggablesUser, userTaggableData{
+				Type: storage.TaggableTypeNote,
+				Note: &noteUser,
+			})
+		}
+	}
+
+	return taggablesUser, nil
+}
+
+func makeUserBookmarkData(
+	bkm *storage.BookmarkDataWTags,
+	lcs map[int]storage.LinkCheckData, pms map[int]storage.PageMetaData,
+) userBookmarkData {
+	return userBookmarkData{
+		ID:        bkm.ID,
+		URL:       bkm.URL,
+		Title:     bkm.Title,
+		Comment:   bkm.Comment,
+		CreatedAt: bkm.CreatedAt,
+		UpdatedAt: bkm.UpdatedAt,
+		Tags:      getUserBookmarkTags(bkm.Tags),
+		LinkCheck: getUserBookmarkLinkCheck(lcs, bkm.ID),
+		PageMeta:  getUserBookmarkPageMeta(pms, bkm.ID),
+	}
+}
+
+// getBookmarksExtras returns the data of the given bookmarks which is
+// maintained by the background jobs: link checks and page metadata, keyed by
+// bookmark id.
+func (gm *GMServer) getBookmarksExtras(
+	tx *sql.Tx, bkms []storage.BookmarkDataWTags,
+) (map[int]storage.LinkCheckData, map[int]storage.PageMetaData, error) {
+	bkmIDs := make([]int, 0, len(bkms))
+	for _, bkm := range bkms {
+		bkmIDs = append(bkmIDs, bkm.ID)
+	}
+
+	lcs, err := gm.si.GetLinkChecks(tx, bkmIDs)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	pms, err := gm.si.GetPageMeta(tx, bkmIDs)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	return lcs, pms, nil
+}
+
+// makeBookmarksCursorString and parseBookmarksCursor convert the storage
+// cursor to the opaque string given to the client and back.
+func makeBookmarksCursorString(cursor *storage.BookmarksCursor) (string, error) {
+	data, err := json.Marshal(cursor)
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func parseBookmarksCursor(s string) (*storage.BookmarksCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, interrors.WrapInternalError(
+			err, errors.Errorf("invalid cursor %q", s),
+		)
+	}
+
+	var cursor storage.BookmarksCursor
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return nil, interrors.WrapInternalError(
+			err, errors.Errorf("invalid cursor %q", s),
+		)
+	}
+
+	return &cursor, nil
+}
+
 func (gm *GMServer) userBookmarkGet(gmr *GMRequest) (resp interface{}, err error) {
 	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
 	if err != nil {
@@ -150,8 +535,10 @@ func (gm *GMServer) userBookmarkGet(gmr *GMRequest) (resp interface{}, err error
 	}
 
 	var bkm *storage.BookmarkDataWTags
+	var lcs map[int]storage.LinkCheckData
+	var pms map[int]storage.PageMetaData
 
-	err = gm.si.Tx(func(tx *sql.Tx) error {
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 		var err error
 		bkm, err = gm.si.GetBookmarkByID(
 			tx, bkmID, &storage.TagsFetchOpts{
@@ -163,22 +550,20 @@ func (gm *GMServer) userBookmarkGet(gmr *GMRequest) (resp interface{}, err error
 			return errors.Trace(err)
 		}
 
+		lcs, pms, err = gm.getBookmarksExtras(
+			tx, []storage.BookmarkDataWTags{*bkm},
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
 		return nil
 	})
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
-	bkmUser := userBookmarkData{
-		ID:        bkm.ID,
-		URL:       bkm.URL,
-		Title:     bkm.Title,
-		Comment:   bkm.Comment,
-		UpdatedAt: bkm.UpdatedAt,
-		Tags:      getUserBookmarkTags(bkm.Tags),
-	}
-
-	return bkmUser, nil
+	return makeUserBookmarkData(bkm, lcs, pms), nil
 }
 
 func (gm *GMServer) userBookmarksPost(gmr *GMRequest) (resp interface{}, err error) {
@@ -199,14 +584,24 @@ func (gm *GMServer) userBookmarksPost(gmr *GMRequest) (resp interface{}, err err
 	}
 
 	bkmID := 0
+	canonicalURL := canonicalizeURL(args.URL)
 
-	err = gm.si.Tx(func(tx *sql.Tx) error {
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 		var err error
+
+		if gmr.FormValue(QSArgAllowDuplicate) != "1" {
+			err := gm.checkDuplicateBookmark(tx, gmr.SubjUser.ID, canonicalURL, 0)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+
 		bkmID, err = gm.si.CreateBookmark(tx, &storage.BookmarkData{
-			OwnerID: gmr.SubjUser.ID,
-			Title:   args.Title,
-			Comment: args.Comment,
-			URL:     args.URL,
+			OwnerID:      gmr.SubjUser.ID,
+			Title:        args.Title,
+			Comment:      args.Comment,
+			URL:          args.URL,
+			CanonicalURL: canonicalURL,
 		})
 		if err != nil {
 			return errors.Trace(err)
@@ -219,12 +614,22 @@ func (gm *GMServer) userBookmarksPost(gmr *GMRequest) (resp interface{}, err err
 			return errors.Trace(err)
 		}
 
+		if _, err := gm.si.SaveBookmarkRevision(tx, bkmID); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := gm.requestPageMeta(tx, bkmID); err != nil {
+			return errors.Trace(err)
+		}
+
 		return nil
 	})
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
 
+	gm.wakePageMetaFetcher()
+
 	resp = userBookmarkPostResp{
 		BookmarkID: bkmID,
 	}
@@ -253,16 +658,31 @@ func (gm *GMServer) userBookmarkPut(gmr *GMRequest) (resp interface{}, err error
 		)
 	}
 
-	err = gm.si.Tx(func(tx *sql.Tx) error {
+	canonicalURL := canonicalizeURL(args.URL)
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 		var err error
+
+		if gmr.FormValue(QSArgAllowDuplicate) != "1" {
+			err := gm.checkDuplicateBookmark(tx, gmr.SubjUser.ID, canonicalURL, bkmID)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		// Bookmarks created before revisions were introduced don't have any,
+		// so save the state before the update first
+		if err := gm.saveInitialBookmarkRevision(tx, bkmID); err != nil {
+			return errors.Trace(err)
+		}
+
 		err = gm.si.UpdateBookmark(tx, &storage.BookmarkData{
-			ID:      bkmID,
-			Title:   args.Title,
-			Comment: args.Comment,
-			URL:     args.URL,
-			// NOTE: we need to pass OwnerID since it's used to check whether this
-			// owner already has the bookmark with the same URL
-			OwnerID: gmr.SubjUser.ID,
+			ID:           bkmID,
+			Title:        args.Title,
+			Comment:      args.Comment,
+			URL:          args.URL,
+			CanonicalURL: canonicalURL,
+			OwnerID:      gmr.SubjUser.ID,
 		})
 		if err != nil {
 			return errors.Trace(err)
@@ -275,6 +695,10 @@ func (gm *GMServer) userBookmarkPut(gmr *GMRequest) (resp interface{}, err error
 			return errors.Trace(err)
 		}
 
+		if _, err := gm.si.SaveBookmarkRevision(tx, bkmID); err != nil {
+			return errors.Trace(err)
+		}
+
 		return nil
 	})
 	if err != nil {
@@ -296,8 +720,10 @@ func (gm *GMServer) userBookmarkDelete(gmr *GMRequest) (resp interface{}, err er
 		return nil, errors.Trace(err)
 	}
 
-	err = gm.si.Tx(func(tx *sql.Tx) error {
-		if err := gm.si.DeleteTaggable(tx, bkmID); err != nil {
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		// The bookmark is not deleted right away, but moved to the trash, from
+		// where it can be restored
+		if _, err := gm.si.TrashBookmark(tx, bkmID); err != nil {
 			return errors.Trace(err)
 		}
 
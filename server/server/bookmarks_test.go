@@ -6,10 +6,12 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"reflect"
 	"sort"
@@ -17,6 +19,7 @@ import (
 	"testing"
 
 	"dmitryfrank.com/geekmarks/server/cptr"
+	"dmitryfrank.com/geekmarks/server/fetcher"
 	"dmitryfrank.com/geekmarks/server/storage"
 	"github.com/juju/errors"
 )
@@ -378,6 +381,744 @@ func perUserTestBookmarks(
 
 // }}}
 
+// Test full-text search of bookmarks {{{
+func TestBookmarksSearch(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestBookmarksSearch)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func perUserTestBookmarksSearch(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	tagIDs, err := makeTestTagsHierarchy(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkm1ID, err := addBookmark(be, u1.id, &bkmData{
+		URL:    "http://golang.org/doc/effective_go",
+		Title:  "Effective Go",
+		TagIDs: []int{tagIDs.tag4ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkm2ID, err := addBookmark(be, u1.id, &bkmData{
+		URL:     "http://example.com/testing",
+		Title:   "Testing tips",
+		Comment: "Tests written in Go",
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = addBookmark(be, u2.id, &bkmData{
+		URL:   "http://example.com/go",
+		Title: "Go for user 2",
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Without tags, all bookmarks are looked through, including untagged ones;
+	// the match in the title goes first
+	resp, err := be.DoUserReq("GET", "/bookmarks?q=go", u1.id, nil, true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var got bkms
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(got) != 2 || got[0].ID != bkm1ID || got[1].ID != bkm2ID {
+		return errors.Errorf("expected bookmarks %d, %d in that order, got %+v", bkm1ID, bkm2ID, got)
+	}
+
+	// Words are stemmed
+	if _, err := checkBkmGet(be, u1.id, &bkmGetArg{query: "test"}, []int{bkm2ID}); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Search is combined with tags
+	_, err = checkBkmGet(
+		be, u1.id, &bkmGetArg{query: "go", tagIDs: []int{tagIDs.tag3ID}}, []int{bkm1ID},
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Updated bookmark is found by the new title
+	err = updateBookmark(be, u1.id, &bkmData{
+		ID:    bkm2ID,
+		URL:   "http://example.com/testing",
+		Title: "Benchmarks",
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if _, err := checkBkmGet(be, u1.id, &bkmGetArg{query: "benchmark"}, []int{bkm2ID}); err != nil {
+		return errors.Trace(err)
+	}
+
+	if _, err := checkBkmGet(be, u1.id, &bkmGetArg{query: "tips"}, []int{}); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Query can't be combined with url
+	resp, err = be.DoUserReq("GET", "/bookmarks?q=go&url=foo", u1.id, nil, false)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := expectHTTPCode(resp, http.StatusBadRequest); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// }}}
+
+// Test pagination of bookmarks {{{
+func TestBookmarksPagination(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestBookmarksPagination)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+type bkmsPage struct {
+	Bookmarks  bkms   `json:"bookmarks"`
+	NextCursor string `json:"nextCursor"`
+}
+
+func perUserTestBookmarksPagination(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	tagIDs, err := makeTestTagsHierarchy(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkmIDs := []int{}
+	for _, title := range []string{"charlie", "alpha", "delta", "bravo"} {
+		bkmID, err := addBookmark(be, u1.id, &bkmData{
+			URL:    "http://example.com/" + title,
+			Title:  title,
+			TagIDs: []int{tagIDs.tag4ID},
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		bkmIDs = append(bkmIDs, bkmID)
+	}
+
+	// Fetch all bookmarks under tag1, sorted by title, two at a time
+	gotIDs := []int{}
+	pagesCnt := 0
+	cursor := ""
+	for {
+		qs := fmt.Sprintf("tag_id=%d&sort=title&limit=2", tagIDs.tag1ID)
+		if cursor != "" {
+			qs += "&cursor=" + url.QueryEscape(cursor)
+		}
+
+		page, err := getBookmarksPage(be, u1.id, qs)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		pagesCnt++
+
+		for _, bkm := range page.Bookmarks {
+			gotIDs = append(gotIDs, bkm.ID)
+		}
+
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+
+		if pagesCnt > len(bkmIDs) {
+			return errors.Errorf("too many pages, got %v so far", gotIDs)
+		}
+	}
+
+	expected := []int{bkmIDs[1], bkmIDs[3], bkmIDs[0], bkmIDs[2]}
+	if !reflect.DeepEqual(gotIDs, expected) || pagesCnt != 2 {
+		return errors.Errorf(
+			"expected %v in 2 pages, got %v in %d pages", expected, gotIDs, pagesCnt,
+		)
+	}
+
+	// Without the limit, the plain list is returned, in the given order
+	resp, err := be.DoUserReq(
+		"GET", fmt.Sprintf("/bookmarks?tag_id=%d&sort=url", tagIDs.tag3ID),
+		u1.id, nil, true,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var got bkms
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		return errors.Trace(err)
+	}
+
+	gotIDs = []int{}
+	for _, bkm := range got {
+		gotIDs = append(gotIDs, bkm.ID)
+	}
+	if !reflect.DeepEqual(gotIDs, expected) {
+		return errors.Errorf("expected %v, got %v", expected, gotIDs)
+	}
+
+	// Invalid arguments
+	for _, qs := range []string{
+		"sort=foo",
+		"limit=0",
+		"limit=foo",
+		"limit=2&cursor=foo",
+		"cursor=" + url.QueryEscape(cursor),
+		"limit=2&sort=url&cursor=" + url.QueryEscape(cursor),
+		"url=foo&limit=2",
+	} {
+		resp, err := be.DoUserReq("GET", "/bookmarks?"+qs, u1.id, nil, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := expectHTTPCode(resp, http.StatusBadRequest); err != nil {
+			return errors.Annotatef(err, "query string %q", qs)
+		}
+	}
+
+	return nil
+}
+
+func getBookmarksPage(be testBackend, userID int, qs string) (*bkmsPage, error) {
+	resp, err := be.DoUserReq("GET", "/bookmarks?"+qs, userID, nil, true)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var page bkmsPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &page, nil
+}
+
+// }}}
+
+// Test tag expressions {{{
+func TestBookmarksTagExpr(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestBookmarksTagExpr)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func perUserTestBookmarksTagExpr(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	tagIDs, err := makeTestTagsHierarchy(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	ids, err := makeTestBookmarks(be, u1.id, tagIDs)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	cases := []struct {
+		args     bkmGetArg
+		expected []int
+	}{
+		{
+			bkmGetArg{tagExpr: "tag4 | tag8"},
+			[]int{ids.bkm4ID, ids.bkm8ID, ids.bkm4_5ID},
+		},
+		// Aliases can be used in paths, and subtags match too
+		{
+			bkmGetArg{tagExpr: "(tag1/tag3 | /tag7) & !tag5"},
+			[]int{ids.bkm3ID, ids.bkm4ID, ids.bkm7ID, ids.bkm8ID},
+		},
+		// Negation matches untagged bookmarks too
+		{
+			bkmGetArg{tagExpr: "!tag1 & !tag7"},
+			[]int{ids.bkm2ID, ids.bkm_untagged_ID},
+		},
+		// Combined with tag_id
+		{
+			bkmGetArg{tagIDs: []int{tagIDs.tag3ID}, tagExpr: "tag5"},
+			[]int{ids.bkm5ID, ids.bkm6ID, ids.bkm2_5ID, ids.bkm4_5ID},
+		},
+	}
+
+	for _, c := range cases {
+		if _, err := checkBkmGet(be, u1.id, &c.args, c.expected); err != nil {
+			return errors.Annotatef(err, "tag expression %q", c.args.tagExpr)
+		}
+	}
+
+	// Invalid expressions, or the ones with unknown tags (tags of another user
+	// are unknown as well)
+	for _, expr := range []string{"tag1 &", "(tag1", "/tag3", "tag1/tag9", "foo"} {
+		resp, err := be.DoUserReq(
+			"GET", "/bookmarks?tag_expr="+url.QueryEscape(expr), u1.id, nil, false,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := expectHTTPCode(resp, http.StatusBadRequest); err != nil {
+			return errors.Annotatef(err, "tag expression %q", expr)
+		}
+	}
+
+	resp, err := be.DoUserReq("GET", "/bookmarks?tag_expr=tag1", u2.id, nil, false)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := expectHTTPCode(resp, http.StatusBadRequest); err != nil {
+		return errors.Annotatef(err, "tags of another user")
+	}
+
+	return nil
+}
+
+// }}}
+
+// Test "direct" and "untagged" views {{{
+func TestBookmarksViews(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestBookmarksViews)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func perUserTestBookmarksViews(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	tagIDs, err := makeTestTagsHierarchy(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	ids, err := makeTestBookmarks(be, u1.id, tagIDs)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	cases := []struct {
+		args     bkmGetArg
+		expected []int
+	}{
+		{
+			bkmGetArg{tagIDs: []int{tagIDs.tag3ID}, view: QSArgBkmGetArgViewDirect},
+			[]int{ids.bkm3ID},
+		},
+		{
+			bkmGetArg{tagIDs: []int{tagIDs.tag5ID}, view: QSArgBkmGetArgViewDirect},
+			[]int{ids.bkm5ID, ids.bkm2_5ID, ids.bkm4_5ID},
+		},
+		{
+			bkmGetArg{tagIDs: []int{tagIDs.tag2ID, tagIDs.tag5ID}, view: QSArgBkmGetArgViewDirect},
+			[]int{ids.bkm2_5ID},
+		},
+		{
+			bkmGetArg{view: QSArgBkmGetArgViewUntagged},
+			[]int{ids.bkm_untagged_ID},
+		},
+		{
+			bkmGetArg{query: "comment_tag_1", view: QSArgBkmGetArgViewUntagged},
+			[]int{},
+		},
+	}
+
+	for _, c := range cases {
+		if _, err := checkBkmGet(be, u1.id, &c.args, c.expected); err != nil {
+			return errors.Annotatef(err, "view %q, tags %v", c.args.view, c.args.tagIDs)
+		}
+	}
+
+	for _, qs := range []string{
+		"view=direct",
+		"view=foo",
+		fmt.Sprintf("view=untagged&tag_id=%d", tagIDs.tag1ID),
+		"view=untagged&tag_expr=tag1",
+	} {
+		resp, err := be.DoUserReq("GET", "/bookmarks?"+qs, u1.id, nil, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := expectHTTPCode(resp, http.StatusBadRequest); err != nil {
+			return errors.Annotatef(err, "query string %q", qs)
+		}
+	}
+
+	return nil
+}
+
+// }}}
+
+// Test duplicate bookmarks {{{
+func TestBookmarksDuplicates(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestBookmarksDuplicates)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func perUserTestBookmarksDuplicates(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	bkm1ID, err := addBookmark(be, u1.id, &bkmData{URL: "http://example.com/a"})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkm2ID, err := addBookmark(be, u1.id, &bkmData{URL: "http://example.com/b"})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// The same URL of another user is not a duplicate
+	if _, err := addBookmark(be, u2.id, &bkmData{URL: "http://example.com/a"}); err != nil {
+		return errors.Trace(err)
+	}
+
+	expectConflict := func(resp *genericResp, bkmID int) error {
+		if err := expectHTTPCode(resp, http.StatusConflict); err != nil {
+			return errors.Trace(err)
+		}
+
+		rmap, err := getRespMap(resp)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		exp := map[string]interface{}{
+			"status":  float64(http.StatusConflict),
+			"message": "bookmark with the same URL already exists",
+			"data": map[string]interface{}{
+				"bookmarkID": float64(bkmID),
+			},
+		}
+		if !reflect.DeepEqual(exp, rmap) {
+			return errors.Errorf("response JSON: expected: %v, got: %v", exp, rmap)
+		}
+
+		return nil
+	}
+
+	for _, url := range []string{
+		"http://example.com/a",
+		"https://example.com/a/",
+		"HTTP://Example.com:80/a?utm_source=foo",
+	} {
+		resp, err := be.DoUserReq("POST", "/bookmarks", u1.id, H{"url": url}, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectConflict(resp, bkm1ID); err != nil {
+			return errors.Annotatef(err, "url %q", url)
+		}
+	}
+
+	// Changing the URL of the second bookmark to the one of the first bookmark
+	// should fail as well
+	resp, err := be.DoUserReq(
+		"PUT", fmt.Sprintf("/bookmarks/%d", bkm2ID), u1.id,
+		H{"url": "https://example.com/a"}, false,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := expectConflict(resp, bkm1ID); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Changing the URL to an equivalent one is not a duplicate
+	err = updateBookmark(be, u1.id, &bkmData{ID: bkm1ID, URL: "https://example.com/a"})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Duplicates are allowed explicitly
+	resp, err = be.DoUserReq(
+		"POST", "/bookmarks?"+QSArgAllowDuplicate+"=1", u1.id,
+		H{"url": "http://example.com/a/?utm_medium=bar"}, true,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	rmap, err := getRespMap(resp)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	bkm3ID := int(rmap["bookmarkID"].(float64))
+
+	// Equivalent URLs are found as well
+	url := "https://example.com/a?fbclid=foo"
+	if _, err := checkBkmGet(be, u1.id, &bkmGetArg{url: &url}, []int{bkm1ID, bkm3ID}); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// }}}
+
+// Test recanonicalization of URLs {{{
+func TestRecanonicalizeURLs(t *testing.T) {
+	defer func(v bool) { *urlCanonIgnoreScheme = v }(*urlCanonIgnoreScheme)
+
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestRecanonicalizeURLs)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func perUserTestRecanonicalizeURLs(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	*urlCanonIgnoreScheme = true
+
+	if _, err := addBookmark(be, u1.id, &bkmData{URL: "https://example.com/a"}); err != nil {
+		return errors.Trace(err)
+	}
+	if _, err := addBookmark(be, u2.id, &bkmData{URL: "https://example.com/b"}); err != nil {
+		return errors.Trace(err)
+	}
+
+	// After the rules are changed, stored canonical URLs are stale, so the
+	// duplicate is not detected
+	*urlCanonIgnoreScheme = false
+
+	addDuplicate := func() (*genericResp, error) {
+		return be.DoUserReq("POST", "/bookmarks", u1.id, H{"url": "https://example.com/a"}, false)
+	}
+
+	resp, err := addDuplicate()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := expectHTTPCode(resp, http.StatusOK); err != nil {
+		return errors.Trace(err)
+	}
+
+	gm, err := New(si)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Bookmarks of both users are updated
+	bkmsCnt, err := gm.RecanonicalizeURLs(context.Background())
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if bkmsCnt != 3 {
+		return errors.Errorf("expected 3 bookmarks, got %d", bkmsCnt)
+	}
+
+	resp, err = addDuplicate()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := expectHTTPCode(resp, http.StatusConflict); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// }}}
+
+// Test link checks {{{
+func TestBookmarksLinkChecks(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestBookmarksLinkChecks)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func perUserTestBookmarksLinkChecks(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	// Stand-in for the web, which the link checker fetches bookmark URLs from
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {})
+	mux.Handle("/moved", http.RedirectHandler("/ok", http.StatusMovedPermanently))
+	web := httptest.NewServer(mux)
+	defer web.Close()
+
+	bkmIDs := []int{}
+	for _, u := range []string{
+		web.URL + "/ok",
+		web.URL + "/gone",
+		web.URL + "/moved",
+		// Non-http URLs are not checked
+		"mailto:foo@example.com",
+	} {
+		bkmID, err := addBookmark(be, u1.id, &bkmData{URL: u})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		bkmIDs = append(bkmIDs, bkmID)
+	}
+
+	gm, err := New(si)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// By default, only public addresses can be fetched, but the test server
+	// is on the loopback one
+	gm.SetFetcher(fetcher.NewHTTPFetcher(http.DefaultClient))
+
+	checkedCnt, err := gm.CheckLinks()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if checkedCnt != 3 {
+		return errors.Errorf("expected 3 URLs to be checked, got %d", checkedCnt)
+	}
+
+	// Recently checked URLs are not checked again
+	checkedCnt, err = gm.CheckLinks()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if checkedCnt != 0 {
+		return errors.Errorf("expected no URLs to be checked, got %d", checkedCnt)
+	}
+
+	cases := []struct {
+		args       bkmGetArg
+		expected   []int
+		linkChecks []*bkmLinkCheckData
+	}{
+		{
+			bkmGetArg{linkStatus: "broken"},
+			[]int{bkmIDs[1]},
+			[]*bkmLinkCheckData{{StatusCode: http.StatusNotFound}},
+		},
+		{
+			bkmGetArg{linkStatus: "redirected"},
+			[]int{bkmIDs[2]},
+			[]*bkmLinkCheckData{
+				{StatusCode: http.StatusOK, RedirectURL: web.URL + "/ok"},
+			},
+		},
+		{
+			bkmGetArg{view: QSArgBkmGetArgViewUntagged},
+			bkmIDs,
+			[]*bkmLinkCheckData{
+				{StatusCode: http.StatusOK},
+				{StatusCode: http.StatusNotFound},
+				{StatusCode: http.StatusOK, RedirectURL: web.URL + "/ok"},
+				nil,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		got, err := checkBkmGet(be, u1.id, &c.args, c.expected)
+		if err != nil {
+			return errors.Annotatef(err, "link status %q", c.args.linkStatus)
+		}
+
+		for i, bkm := range got {
+			if bkm.LinkCheck != nil {
+				if bkm.LinkCheck.CheckedAt == 0 {
+					return errors.Errorf("bookmark %d: checkedAt is not set", bkm.ID)
+				}
+				bkm.LinkCheck.CheckedAt = 0
+			}
+
+			if !reflect.DeepEqual(bkm.LinkCheck, c.linkChecks[i]) {
+				return errors.Errorf(
+					"bookmark %d: expected link check %+v, got %+v",
+					bkm.ID, c.linkChecks[i], bkm.LinkCheck,
+				)
+			}
+		}
+	}
+
+	// Bookmarks of other users are not returned
+	if _, err := checkBkmGet(be, u2.id, &bkmGetArg{linkStatus: "broken"}, []int{}); err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, qs := range []string{
+		"link_status=foo",
+		"link_status=broken&url=" + url.QueryEscape(web.URL+"/gone"),
+	} {
+		resp, err := be.DoUserReq("GET", "/bookmarks?"+qs, u1.id, nil, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := expectHTTPCode(resp, http.StatusBadRequest); err != nil {
+			return errors.Annotatef(err, "query string %q", qs)
+		}
+	}
+
+	return nil
+}
+
+// }}}
+
 // Test deletion of bookmarks {{{
 func TestDeleteBookmarks(t *testing.T) {
 	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
@@ -478,9 +1219,28 @@ type bkmData struct {
 	URL       string       `json:"url"`
 	Title     string       `json:"title,omitempty"`
 	Comment   string       `json:"comment,omitempty"`
+	CreatedAt uint64       `json:"createdAt,omitempty"`
 	UpdatedAt uint64       `json:"updatedAt"`
 	TagIDs    []int        `json:"tagIDs"`
 	Tags      []bkmTagData `json:"tags,omitempty"`
+
+	LinkCheck *bkmLinkCheckData `json:"linkCheck,omitempty"`
+	PageMeta  *bkmPageMetaData  `json:"pageMeta,omitempty"`
+}
+
+type bkmPageMetaData struct {
+	Description  string `json:"description,omitempty"`
+	CanonicalURL string `json:"canonicalURL,omitempty"`
+	FaviconURL   string `json:"faviconURL,omitempty"`
+	Error        string `json:"error,omitempty"`
+	FetchedAt    uint64 `json:"fetchedAt"`
+}
+
+type bkmLinkCheckData struct {
+	StatusCode  int    `json:"statusCode"`
+	RedirectURL string `json:"redirectURL,omitempty"`
+	Error       string `json:"error,omitempty"`
+	CheckedAt   uint64 `json:"checkedAt"`
 }
 
 // bkmTagsByID implements sorting by the last tag item ID
@@ -591,8 +1351,12 @@ func deleteBookmark(be testBackend, userID, bkmID int) (err error) {
 }
 
 type bkmGetArg struct {
-	tagIDs []int
-	url    *string
+	tagIDs     []int
+	url        *string
+	query      string
+	tagExpr    string
+	view       string
+	linkStatus string
 }
 
 func checkBkmGet(
@@ -611,6 +1375,18 @@ func checkBkmGet(
 		for _, tagID := range args.tagIDs {
 			qsVals.Add("tag_id", strconv.Itoa(tagID))
 		}
+		if args.query != "" {
+			qsVals.Add("q", args.query)
+		}
+		if args.tagExpr != "" {
+			qsVals.Add("tag_expr", args.tagExpr)
+		}
+		if args.view != "" {
+			qsVals.Add("view", args.view)
+		}
+		if args.linkStatus != "" {
+			qsVals.Add("link_status", args.linkStatus)
+		}
 	}
 
 	resp, err := be.DoUserReq(
@@ -669,7 +1445,8 @@ func checkBkmGetByID(be testBackend, userID int, bkmID int, expectedBkm *bkmData
 		return errors.Trace(err)
 	}
 
-	// don't compare UpdatedAt
+	// don't compare timestamps
+	v.CreatedAt = 0
 	v.UpdatedAt = 0
 
 	sort.Sort(bkmTagsByID(v.Tags))
@@ -0,0 +1,178 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"dmitryfrank.com/geekmarks/server/netscape"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+const (
+	// Where to put bookmarks with several leaf tags in the exported file
+	QSArgExportPlacement = "placement"
+	// Only to the folder of the first leaf tag, in the order of tag paths
+	QSArgExportPlacementPrimary = "primary"
+	// To the folder of each leaf tag, so that the bookmark is duplicated
+	QSArgExportPlacementLeafs = "leafs"
+)
+
+// userBookmarksExportGet is a GET /bookmarks/export handler, which responds
+// with the Netscape bookmarks file which browsers can import. Unlike other
+// handlers, it writes the response itself, since the response is not JSON;
+// so it's not available via websocket.
+func (gm *GMServer) userBookmarksExportGet(
+	w http.ResponseWriter, r *http.Request, gsu getSubjUser,
+) error {
+	ctx, cancel := withRequestTimeout(r.Context())
+	defer cancel()
+
+	gmr, err := makeGMRequestFromHttpRequest(r.WithContext(ctx), gsu)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	placement := gmr.FormValue(QSArgExportPlacement)
+	if placement == "" {
+		placement = QSArgExportPlacementPrimary
+	}
+
+	// The file is built in memory, so that we can still respond with an error
+	// if something goes wrong
+	var buf bytes.Buffer
+	err = gm.ExportNetscapeBookmarks(gmr.Context(), gmr.SubjUser.ID, placement, &buf)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="bookmarks.html"`)
+	w.Write(buf.Bytes())
+
+	return nil
+}
+
+// ExportNetscapeBookmarks writes all bookmarks of the given user as the
+// Netscape bookmarks file. Tags become folders: a bookmark tagged with
+// "/foo/bar" goes to the folder "foo/bar", and untagged bookmarks go to the
+// top level. placement specifies where bookmarks with several leaf tags go,
+// see QSArgExportPlacement.
+func (gm *GMServer) ExportNetscapeBookmarks(
+	ctx context.Context, ownerID int, placement string, w io.Writer,
+) error {
+	if placement != QSArgExportPlacementPrimary && placement != QSArgExportPlacementLeafs {
+		return errors.Errorf(
+			"invalid %s: %q; valid values are: %q, %q",
+			QSArgExportPlacement, placement,
+			QSArgExportPlacementPrimary, QSArgExportPlacementLeafs,
+		)
+	}
+
+	var bkms []storage.BookmarkDataWTags
+
+	err := gm.si.TxCtx(ctx, func(tx *sql.Tx) error {
+		var err error
+		bkms, err = gm.getAllBookmarks(tx, ownerID)
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	root := &netscape.Folder{Name: "Bookmarks"}
+
+	for _, bkm := range bkms {
+		nbkm := netscape.Bookmark{
+			URL:     bkm.URL,
+			Title:   bkm.Title,
+			Comment: bkm.Comment,
+			AddDate: bkm.CreatedAt,
+		}
+
+		folders := getExportFolders(bkm.Tags)
+		if len(folders) == 0 {
+			root.Bookmarks = append(root.Bookmarks, nbkm)
+			continue
+		}
+
+		if placement == QSArgExportPlacementPrimary {
+			folders = folders[:1]
+		}
+
+		for _, folder := range folders {
+			f := root.GetFolder(folder)
+			f.Bookmarks = append(f.Bookmarks, nbkm)
+		}
+	}
+
+	return errors.Trace(netscape.Write(w, root))
+}
+
+// getAllBookmarks returns all bookmarks of the user with the paths of their
+// leaf tags, sorted by id.
+func (gm *GMServer) getAllBookmarks(
+	tx *sql.Tx, ownerID int,
+) ([]storage.BookmarkDataWTags, error) {
+	rootTagID, err := gm.si.GetRootTagID(tx, ownerID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	tagsFetchOpts := &storage.TagsFetchOpts{
+		TagsFetchMode:     storage.TagsFetchModeLeafs,
+		TagNamesFetchMode: storage.TagNamesFetchModeFull,
+	}
+
+	// All tagged bookmarks are tagged with the root tag
+	tagged, err := gm.si.GetTaggedBookmarks(tx, []int{rootTagID}, &ownerID, tagsFetchOpts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	untagged, err := gm.si.GetTaggedBookmarks(tx, nil, &ownerID, tagsFetchOpts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	bkms := append(tagged, untagged...)
+	sort.Slice(bkms, func(i, j int) bool {
+		return bkms[i].ID < bkms[j].ID
+	})
+
+	return bkms, nil
+}
+
+// getExportFolders returns folder paths for the given leaf tags of the
+// bookmark, sorted by path.
+func getExportFolders(tags []storage.BookmarkTagPath) [][]string {
+	folders := [][]string{}
+	for _, tag := range tags {
+		names := []string{}
+		for _, item := range tag.TagItems[ /*skip root tag*/ 1:] {
+			names = append(names, item.Name)
+		}
+		if len(names) > 0 {
+			folders = append(folders, names)
+		}
+	}
+
+	sort.Slice(folders, func(i, j int) bool {
+		return strings.Join(folders[i], "/") < strings.Join(folders[j], "/")
+	})
+
+	return folders
+}
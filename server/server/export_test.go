@@ -0,0 +1,133 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests integration_tests
+
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/netscape"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+func TestExport(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestExport)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func perUserTestExport(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	tagIDs, err := makeTestTagsHierarchy(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = addBookmark(be, u1.id, &bkmData{
+		URL:     "http://x.com/a",
+		Title:   "title_a",
+		Comment: "comment_a",
+		TagIDs:  []int{tagIDs.tag8ID, tagIDs.tag4ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = addBookmark(be, u1.id, &bkmData{URL: "http://x.com/b"})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkmA := netscape.Bookmark{
+		URL:     "http://x.com/a",
+		Title:   "title_a",
+		Comment: "comment_a",
+		Tags:    []string{},
+	}
+	bkmB := netscape.Bookmark{
+		URL:     "http://x.com/b",
+		Folders: []string{},
+		Tags:    []string{},
+	}
+
+	folder := func(bkm netscape.Bookmark, folders ...string) netscape.Bookmark {
+		bkm.Folders = folders
+		return bkm
+	}
+
+	cases := []struct {
+		placement string
+		expected  []netscape.Bookmark
+	}{
+		{
+			// Only the first tag path is used
+			placement: "",
+			expected: []netscape.Bookmark{
+				folder(bkmA, "tag1", "tag3_alias", "tag4"),
+				bkmB,
+			},
+		},
+		{
+			placement: QSArgExportPlacementLeafs,
+			expected: []netscape.Bookmark{
+				folder(bkmA, "tag1", "tag3_alias", "tag4"),
+				folder(bkmA, "tag7", "tag8"),
+				bkmB,
+			},
+		},
+	}
+
+	for _, c := range cases {
+		resp, err := be.DoReq(
+			"GET", "/api/my/bookmarks/export?"+QSArgExportPlacement+"="+c.placement,
+			u1.token, nil, true,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		got, err := netscape.Parse(resp.Body)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		for i := range got {
+			// Bookmarks are created by the test, so we don't know the exact time
+			if got[i].AddDate == 0 {
+				return errors.Errorf("ADD_DATE is missing: %+v", got[i])
+			}
+			got[i].AddDate = 0
+		}
+
+		if !reflect.DeepEqual(got, c.expected) {
+			return errors.Errorf(
+				"placement %q: expected %+v, got %+v", c.placement, c.expected, got,
+			)
+		}
+	}
+
+	resp, err := be.DoReq(
+		"GET", "/api/my/bookmarks/export?"+QSArgExportPlacement+"=foo",
+		u1.token, nil, false,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := expectHTTPCode(resp, 400); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,217 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"strings"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/netscape"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/dimonomid/interrors"
+	"github.com/juju/errors"
+)
+
+// ImportReport is returned by ImportNetscapeBookmarks and by the
+// POST /bookmarks/import handler.
+type ImportReport struct {
+	CreatedCnt int                     `json:"createdCnt"`
+	SkippedCnt int                     `json:"skippedCnt"`
+	Skipped    []ImportSkippedBookmark `json:"skipped"`
+}
+
+type userBookmarksImportPostArgs struct {
+	// HTML is the contents of the Netscape bookmarks file
+	HTML string `json:"html"`
+}
+
+type ImportSkippedBookmark struct {
+	URL    string `json:"url"`
+	Reason string `json:"reason"`
+	// BookmarkID is the id of the existing bookmark with the same URL, if
+	// that's why the bookmark is skipped.
+	BookmarkID int `json:"bookmarkID,omitempty"`
+}
+
+// userBookmarksImportPost is a POST /bookmarks/import handler, which imports
+// the Netscape bookmarks file, as exported by browsers.
+func (gm *GMServer) userBookmarksImportPost(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	decoder := json.NewDecoder(gmr.Body)
+	var args userBookmarksImportPostArgs
+	err = decoder.Decode(&args)
+	if err != nil {
+		return nil, interrors.WrapInternalError(
+			err,
+			errors.Errorf("invalid data"),
+		)
+	}
+
+	report, err := gm.ImportNetscapeBookmarks(
+		gmr.Context(), gmr.SubjUser.ID, strings.NewReader(args.HTML),
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return report, nil
+}
+
+// ImportNetscapeBookmarks reads the Netscape bookmarks file from r and
+// creates its bookmarks for the given user. Folders are mapped onto tags: a
+// bookmark in the folder "Foo/Bar" is tagged with "/Foo/Bar", and
+// non-existing tags are created. Tags from the TAGS attribute are added as
+// top-level tags. Bookmarks which duplicate existing ones are skipped.
+//
+// Everything is done in a single transaction, so either all the bookmarks
+// are imported, or none.
+func (gm *GMServer) ImportNetscapeBookmarks(
+	ctx context.Context, ownerID int, r io.Reader,
+) (*ImportReport, error) {
+	nbkms, err := netscape.Parse(r)
+	if err != nil {
+		return nil, errors.Annotatef(err, "parsing bookmarks file")
+	}
+
+	report := &ImportReport{
+		Skipped: []ImportSkippedBookmark{},
+	}
+	tagsCreated := false
+
+	skip := func(url, reason string, bkmID int) {
+		report.SkippedCnt++
+		report.Skipped = append(report.Skipped, ImportSkippedBookmark{
+			URL:        url,
+			Reason:     reason,
+			BookmarkID: bkmID,
+		})
+	}
+
+	err = gm.si.TxCtx(ctx, func(tx *sql.Tx) error {
+		// Tag ids by clean tag paths, so that every path is looked up once
+		tagIDs := map[string]int{}
+		createdTagIDs := map[int]bool{}
+
+		getTagID := func(tagPath string) (int, error) {
+			if tagID, ok := tagIDs[tagPath]; ok {
+				return tagID, nil
+			}
+
+			tagID, created, err := gm.getOrCreateTagByPath(tx, ownerID, tagPath, createdTagIDs)
+			if err != nil {
+				return 0, errors.Annotatef(err, "creating tag %q", tagPath)
+			}
+
+			tagIDs[tagPath] = tagID
+			tagsCreated = tagsCreated || created
+			return tagID, nil
+		}
+
+		for _, nbkm := range nbkms {
+			if nbkm.URL == "" {
+				skip(nbkm.URL, "empty URL", 0)
+				continue
+			}
+
+			// Firefox exports its smart folders as "place:" bookmarks
+			if strings.HasPrefix(strings.ToLower(nbkm.URL), "place:") {
+				skip(nbkm.URL, "not a bookmark", 0)
+				continue
+			}
+
+			canonicalURL := canonicalizeURL(nbkm.URL)
+			err := gm.checkDuplicateBookmark(tx, ownerID, canonicalURL, 0)
+			if err != nil {
+				if cerr, ok := errors.Cause(err).(*hh.ConflictError); ok {
+					data, _ := cerr.Data.(userBookmarkConflictData)
+					skip(nbkm.URL, "duplicate", data.BookmarkID)
+					continue
+				}
+				return errors.Trace(err)
+			}
+
+			bkmTagIDs := []int{}
+			for _, tagPath := range getImportTagPaths(&nbkm) {
+				tagID, err := getTagID(tagPath)
+				if err != nil {
+					return errors.Trace(err)
+				}
+				bkmTagIDs = append(bkmTagIDs, tagID)
+			}
+
+			bkmID, err := gm.si.CreateBookmark(tx, &storage.BookmarkData{
+				OwnerID:      ownerID,
+				Title:        nbkm.Title,
+				Comment:      nbkm.Comment,
+				URL:          nbkm.URL,
+				CanonicalURL: canonicalURL,
+				CreatedAt:    nbkm.AddDate,
+			})
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			err = gm.si.SetTaggings(tx, bkmID, bkmTagIDs, storage.TaggingModeLeafs)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := gm.si.SaveBookmarkRevision(tx, bkmID); err != nil {
+				return errors.Trace(err)
+			}
+
+			if err := gm.requestPageMeta(tx, bkmID); err != nil {
+				return errors.Trace(err)
+			}
+
+			report.CreatedCnt++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if tagsCreated {
+		userIDToTagsTree.DeleteCacheForUser(ownerID)
+	}
+
+	gm.wakePageMetaFetcher()
+
+	return report, nil
+}
+
+// getImportTagPaths returns clean paths of tags for the imported bookmark:
+// the path of its folder, and the tags from the TAGS attribute. Names which
+// can't be used as tag names (like numbers) are dropped.
+func getImportTagPaths(nbkm *netscape.Bookmark) []string {
+	ret := []string{}
+
+	folderNames := []string{}
+	for _, folder := range nbkm.Folders {
+		if err, name := storage.CleanupTagName(folder, false); err == nil {
+			folderNames = append(folderNames, name)
+		}
+	}
+	if len(folderNames) > 0 {
+		ret = append(ret, "/"+strings.Join(folderNames, "/"))
+	}
+
+	for _, tag := range nbkm.Tags {
+		if err, name := storage.CleanupTagName(tag, false); err == nil {
+			ret = append(ret, "/"+name)
+		}
+	}
+
+	return ret
+}
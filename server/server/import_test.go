@@ -0,0 +1,241 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+//go:build all_tests || integration_tests
+// +build all_tests integration_tests
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+func TestImport(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestImport)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+const testImportHTML = `<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">
+<TITLE>Bookmarks</TITLE>
+<H1>Bookmarks</H1>
+<DL><p>
+    <DT><H3 PERSONAL_TOOLBAR_FOLDER="true">Bookmarks bar</H3>
+    <DL><p>
+        <DT><A HREF="http://x.com/a" ADD_DATE="1500000000" TAGS="foo,bar">Page A</A>
+        <DD>Comment A
+        <DT><H3>Dev stuff</H3>
+        <DL><p>
+            <DT><A HREF="http://x.com/b">Page B</A>
+            <DT><A HREF="https://x.com/existing/">Existing</A>
+        </DL><p>
+        <DT><A HREF="place:sort=8&maxResults=10">Recent tags</A>
+    </DL><p>
+    <DT><A HREF="http://x.com/c">Page C</A>
+    <DT><A HREF="http://x.com/a/">Page A again</A>
+</DL><p>
+`
+
+type importReportData struct {
+	CreatedCnt int                    `json:"createdCnt"`
+	SkippedCnt int                    `json:"skippedCnt"`
+	Skipped    []importSkippedBkmData `json:"skipped"`
+}
+
+type importSkippedBkmData struct {
+	URL        string `json:"url"`
+	Reason     string `json:"reason"`
+	BookmarkID int    `json:"bookmarkID,omitempty"`
+}
+
+func perUserTestImport(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	existingID, err := addBookmark(be, u1.id, &bkmData{URL: "http://x.com/existing"})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	report, err := importBookmarks(be, u1.id, testImportHTML)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	expectedReport := &importReportData{
+		CreatedCnt: 3,
+		SkippedCnt: 3,
+		Skipped: []importSkippedBkmData{
+			{URL: "https://x.com/existing/", Reason: "duplicate", BookmarkID: existingID},
+			{URL: "place:sort=8&maxResults=10", Reason: "not a bookmark"},
+			{URL: "http://x.com/a/", Reason: "duplicate"},
+		},
+	}
+
+	// The id of the bookmark created from the same file isn't known in advance
+	if len(report.Skipped) == 3 {
+		expectedReport.Skipped[2].BookmarkID = report.Skipped[2].BookmarkID
+	}
+
+	if !reflect.DeepEqual(report, expectedReport) {
+		return errors.Errorf("expected report %+v, got %+v", expectedReport, report)
+	}
+
+	// Folders become tags, and tags from the TAGS attribute become top-level
+	// tags
+	tagIDs := map[string]int{}
+	err = si.Tx(func(tx *sql.Tx) error {
+		for _, tagPath := range []string{
+			"/Bookmarks-bar", "/Bookmarks-bar/Dev-stuff", "/foo", "/bar",
+		} {
+			tagID, err := si.GetTagIDByPath(tx, u1.id, tagPath)
+			if err != nil {
+				return errors.Annotatef(err, "tag %q", tagPath)
+			}
+			tagIDs[tagPath] = tagID
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// The bookmark A is found by the duplicate skipped above
+	bkmAID := report.Skipped[2].BookmarkID
+	bkms, err := checkBkmGet(
+		be, u1.id, &bkmGetArg{tagIDs: []int{tagIDs["/foo"]}}, []int{bkmAID},
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkmA := bkms[0]
+	if bkmA.URL != "http://x.com/a" || bkmA.Title != "Page A" ||
+		bkmA.Comment != "Comment A" || bkmA.CreatedAt != 1500000000 {
+		return errors.Errorf("unexpected bookmark A: %+v", bkmA)
+	}
+
+	cases := []struct {
+		tagIDs       []int
+		expectedURLs []string
+	}{
+		{[]int{tagIDs["/bar"]}, []string{"http://x.com/a"}},
+		{[]int{tagIDs["/Bookmarks-bar"]}, []string{"http://x.com/a", "http://x.com/b"}},
+		{[]int{tagIDs["/Bookmarks-bar/Dev-stuff"]}, []string{"http://x.com/b"}},
+		// Bookmarks at the top level are untagged
+		{[]int{}, []string{"http://x.com/c", "http://x.com/existing"}},
+	}
+
+	for _, c := range cases {
+		urls, err := getBookmarkURLs(be, u1.id, c.tagIDs)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !reflect.DeepEqual(urls, c.expectedURLs) {
+			return errors.Errorf(
+				"tags %v: expected %v, got %v", c.tagIDs, c.expectedURLs, urls,
+			)
+		}
+	}
+
+	// Importing the same file again creates nothing
+	report, err = importBookmarks(be, u1.id, testImportHTML)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if report.CreatedCnt != 0 || report.SkippedCnt != 6 {
+		return errors.Errorf("unexpected report of the second import: %+v", report)
+	}
+
+	// Only the creation of the top-level tags gets to the undo log, and undoing
+	// it deletes all the imported tags
+	if err := undoTags(be, u1.id, 10, 3); err != nil {
+		return errors.Trace(err)
+	}
+
+	resp, err := be.DoUserReq("GET", "/tags", u1.id, nil, true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	var td userTagData
+	if err := json.NewDecoder(resp.Body).Decode(&td); err != nil {
+		return errors.Trace(err)
+	}
+	if len(td.Subtags) != 0 {
+		return errors.Errorf("expected no tags after undo, got %+v", td.Subtags)
+	}
+
+	return nil
+}
+
+// getBookmarkURLs returns sorted URLs of the bookmarks tagged with all the
+// given tags, or untagged ones if tagIDs is empty.
+func getBookmarkURLs(be testBackend, userID int, tagIDs []int) ([]string, error) {
+	qsVals := url.Values{}
+	for _, tagID := range tagIDs {
+		qsVals.Add("tag_id", strconv.Itoa(tagID))
+	}
+
+	resp, err := be.DoUserReq(
+		"GET", "/bookmarks?"+qsVals.Encode(), userID, nil, true,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	v := bkms{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil, errors.Annotatef(err, "body: %q", body)
+	}
+
+	urls := []string{}
+	for _, bkm := range v {
+		urls = append(urls, bkm.URL)
+	}
+	sort.Strings(urls)
+
+	return urls, nil
+}
+
+func importBookmarks(be testBackend, userID int, html string) (*importReportData, error) {
+	resp, err := be.DoUserReq(
+		"POST", "/bookmarks/import", userID, map[string]string{"html": html}, true,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	v := &importReportData{}
+	if err := json.Unmarshal(body, v); err != nil {
+		return nil, errors.Annotatef(err, "body: %q", body)
+	}
+
+	return v, nil
+}
@@ -0,0 +1,150 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"time"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/dimonomid/interrors"
+	"github.com/golang/glog"
+	"github.com/juju/errors"
+)
+
+var (
+	linkCheckInterval = flag.Duration(
+		"geekmarks.link_check_interval", 10*time.Minute,
+		"How often the next batch of bookmark URLs is checked for being "+
+			"broken or redirected; 0 disables the link checker.",
+	)
+	linkCheckMaxAge = flag.Duration(
+		"geekmarks.link_check_max_age", 7*24*time.Hour,
+		"How long the result of a bookmark URL check is valid; after that, the "+
+			"URL is checked again.",
+	)
+	linkCheckBatchSize = flag.Int(
+		"geekmarks.link_check_batch_size", 100,
+		"Max number of bookmark URLs checked at a time.",
+	)
+	linkCheckTimeout = flag.Duration(
+		"geekmarks.link_check_timeout", 30*time.Second,
+		"Timeout of fetching a single bookmark URL by the link checker.",
+	)
+)
+
+// userBookmarkLinkCheck is the result of the last check of the bookmark URL;
+// StatusCode is 0 if the URL couldn't be fetched at all, see Error then.
+type userBookmarkLinkCheck struct {
+	StatusCode  int    `json:"statusCode"`
+	RedirectURL string `json:"redirectURL,omitempty"`
+	Error       string `json:"error,omitempty"`
+	CheckedAt   uint64 `json:"checkedAt"`
+}
+
+// CheckLinks fetches URLs of the next batch of bookmarks which were never
+// checked, or were checked too long ago (see the -geekmarks.link_check_max_age
+// flag), for all users, and saves the results. Returns the number of URLs
+// checked.
+func (gm *GMServer) CheckLinks() (checkedCnt int, err error) {
+	var bkms []storage.BookmarkData
+
+	err = gm.si.Tx(func(tx *sql.Tx) error {
+		var err error
+		bkms, err = gm.si.GetBookmarksToCheck(
+			tx, time.Now().Add(-*linkCheckMaxAge), *linkCheckBatchSize,
+		)
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	// URLs are fetched outside of transactions, since it might take a while
+	for _, bkm := range bkms {
+		lc := gm.checkLink(&bkm)
+
+		err = gm.si.Tx(func(tx *sql.Tx) error {
+			return errors.Trace(gm.si.SetLinkCheck(tx, lc))
+		})
+		if err != nil {
+			return checkedCnt, errors.Trace(err)
+		}
+
+		checkedCnt++
+	}
+
+	return checkedCnt, nil
+}
+
+func (gm *GMServer) checkLink(bkm *storage.BookmarkData) *storage.LinkCheckData {
+	lc := &storage.LinkCheckData{
+		BookmarkID: bkm.ID,
+		URL:        bkm.URL,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *linkCheckTimeout)
+	defer cancel()
+
+	res, err := gm.fetcher.Fetch(ctx, bkm.URL)
+	if err != nil {
+		lc.Error = errors.Cause(err).Error()
+		return lc
+	}
+	// The body is not needed, so it's closed without reading
+	res.Body.Close()
+
+	lc.StatusCode = res.StatusCode
+	if res.URL != bkm.URL {
+		lc.RedirectURL = res.URL
+	}
+
+	return lc
+}
+
+// RunLinkChecker calls CheckLinks periodically (see the
+// -geekmarks.link_check_interval flag), until stop is closed.
+func (gm *GMServer) RunLinkChecker(stop <-chan struct{}) {
+	if *linkCheckInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(*linkCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		checkedCnt, err := gm.CheckLinks()
+		if err != nil {
+			glog.Errorf("Failed to check links: %s", interrors.ErrorStack(err))
+		} else if checkedCnt > 0 {
+			glog.Infof("Checked %d bookmark URLs", checkedCnt)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// getUserBookmarkLinkCheck returns the link check of the bookmark for the
+// response, or nil if the URL wasn't checked yet.
+func getUserBookmarkLinkCheck(
+	lcs map[int]storage.LinkCheckData, bkmID int,
+) *userBookmarkLinkCheck {
+	lc, ok := lcs[bkmID]
+	if !ok {
+		return nil
+	}
+
+	return &userBookmarkLinkCheck{
+		StatusCode:  lc.StatusCode,
+		RedirectURL: lc.RedirectURL,
+		Error:       lc.Error,
+		CheckedAt:   lc.CheckedAt,
+	}
+}
@@ -0,0 +1,327 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strconv"
+
+	"goji.io/pat"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/tagexpr"
+	"github.com/dimonomid/interrors"
+
+	"github.com/juju/errors"
+)
+
+const (
+	NoteID = "noteid"
+
+	QSArgNoteGetArgTagID = "tag_id"
+	// Boolean expression over tags, see tagexpr package
+	QSArgNoteGetArgTagExpr = "tag_expr"
+)
+
+type userNoteData struct {
+	ID        int    `json:"id"`
+	Title     string `json:"title"`
+	Body      string `json:"body,omitempty"`
+	UpdatedAt uint64 `json:"updatedAt"`
+	// Tags are the same as the ones of bookmarks
+	Tags []userBookmarkTag `json:"tags,omitempty"`
+}
+
+type userNotePostArgs struct {
+	Title  string `json:"title"`
+	Body   string `json:"body,omitempty"`
+	TagIDs []int  `json:"tagIDs"`
+}
+
+type userNotePostResp struct {
+	NoteID int `json:"noteID"`
+}
+
+type userNotePutResp struct {
+}
+
+type userNoteDeleteResp struct {
+}
+
+// userNotesGet is a GET /notes handler: unlike bookmarks, without any tags
+// given, all the notes are returned, not only untagged ones.
+func (gm *GMServer) userNotesGet(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	args := storage.GetNotesArgs{
+		OwnerID: gmr.SubjUser.ID,
+	}
+
+	for _, stid := range gmr.Values[QSArgNoteGetArgTagID] {
+		v, err := strconv.Atoi(stid)
+		if err != nil {
+			return nil, errors.Annotatef(err, "wrong tag id %q", stid)
+		}
+		args.TagIDs = append(args.TagIDs, v)
+	}
+
+	var tagExpr *tagexpr.Expr
+	if s := gmr.FormValue(QSArgNoteGetArgTagExpr); s != "" {
+		tagExpr, err = tagexpr.Parse(s)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	var notes []storage.NoteDataWTags
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		var err error
+
+		if tagExpr != nil {
+			args.TagExpr, err = gm.resolveTagExpr(tx, gmr.SubjUser.ID, tagExpr)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		notes, err = gm.si.GetNotes(tx, &args, &storage.TagsFetchOpts{
+			TagsFetchMode:     storage.TagsFetchModeLeafs,
+			TagNamesFetchMode: storage.TagNamesFetchModeFull,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	notesUser := []userNoteData{}
+	for _, note := range notes {
+		notesUser = append(notesUser, makeUserNoteData(&note))
+	}
+
+	return notesUser, nil
+}
+
+func (gm *GMServer) userNoteGet(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	noteID, err := getNoteIDFromQueryString(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var note *storage.NoteDataWTags
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		var err error
+		note, err = gm.getUserNote(gmr, tx, noteID, &storage.TagsFetchOpts{
+			TagsFetchMode:     storage.TagsFetchModeLeafs,
+			TagNamesFetchMode: storage.TagNamesFetchModeFull,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return makeUserNoteData(note), nil
+}
+
+func (gm *GMServer) userNotesPost(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	decoder := json.NewDecoder(gmr.Body)
+	var args userNotePostArgs
+	err = decoder.Decode(&args)
+	if err != nil {
+		return nil, interrors.WrapInternalError(
+			err,
+			errors.Errorf("invalid data"),
+		)
+	}
+
+	noteID := 0
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		var err error
+
+		noteID, err = gm.si.CreateNote(tx, &storage.NoteData{
+			OwnerID: gmr.SubjUser.ID,
+			Title:   args.Title,
+			Body:    args.Body,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = gm.si.SetTaggings(
+			tx, noteID, args.TagIDs, storage.TaggingModeLeafs,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resp = userNotePostResp{
+		NoteID: noteID,
+	}
+	return resp, nil
+}
+
+func (gm *GMServer) userNotePut(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	noteID, err := getNoteIDFromQueryString(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	decoder := json.NewDecoder(gmr.Body)
+	var args userNotePostArgs
+	err = decoder.Decode(&args)
+	if err != nil {
+		return nil, interrors.WrapInternalError(
+			err,
+			errors.Errorf("invalid data"),
+		)
+	}
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		if _, err := gm.getUserNote(gmr, tx, noteID, nil); err != nil {
+			return errors.Trace(err)
+		}
+
+		err := gm.si.UpdateNote(tx, &storage.NoteData{
+			ID:      noteID,
+			OwnerID: gmr.SubjUser.ID,
+			Title:   args.Title,
+			Body:    args.Body,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = gm.si.SetTaggings(
+			tx, noteID, args.TagIDs, storage.TaggingModeLeafs,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resp = userNotePutResp{}
+	return resp, nil
+}
+
+func (gm *GMServer) userNoteDelete(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	noteID, err := getNoteIDFromQueryString(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		if _, err := gm.getUserNote(gmr, tx, noteID, nil); err != nil {
+			return errors.Trace(err)
+		}
+
+		// Unlike bookmarks, notes are deleted right away, there's no trash for
+		// them
+		if err := gm.si.DeleteTaggable(tx, noteID); err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resp = userNoteDeleteResp{}
+	return resp, nil
+}
+
+// getUserNote returns the note with the given id, if only it belongs to the
+// subject user.
+func (gm *GMServer) getUserNote(
+	gmr *GMRequest, tx *sql.Tx, noteID int, tagsFetchOpts *storage.TagsFetchOpts,
+) (*storage.NoteDataWTags, error) {
+	if tagsFetchOpts == nil {
+		tagsFetchOpts = &storage.TagsFetchOpts{
+			TagsFetchMode: storage.TagsFetchModeNone,
+		}
+	}
+
+	note, err := gm.si.GetNoteByID(tx, noteID, tagsFetchOpts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if note.OwnerID != gmr.SubjUser.ID {
+		// Pretend the note doesn't exist
+		return nil, errors.Annotatef(
+			storage.ErrNoteDoesNotExist, "id %d", noteID,
+		)
+	}
+
+	return note, nil
+}
+
+func getNoteIDFromQueryString(gmr *GMRequest) (int, error) {
+	noteIDStr := pat.Param(gmr.HttpReq, NoteID)
+	noteID, err := strconv.Atoi(noteIDStr)
+	if err != nil {
+		return 0, interrors.WrapInternalError(
+			err,
+			errors.Errorf("wrong note id %q", noteIDStr),
+		)
+	}
+	return noteID, nil
+}
+
+func makeUserNoteData(note *storage.NoteDataWTags) userNoteData {
+	return userNoteData{
+		ID:        note.ID,
+		Title:     note.Title,
+		Body:      note.Body,
+		UpdatedAt: note.UpdatedAt,
+		Tags:      getUserBookmarkTags(note.Tags),
+	}
+}
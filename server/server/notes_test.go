@@ -0,0 +1,398 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests integration_tests
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+func TestNotes(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestNotes)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func TestTaggedTaggableTypes(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestTaggedTaggableTypes)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+type noteData struct {
+	ID        int          `json:"id"`
+	Title     string       `json:"title"`
+	Body      string       `json:"body,omitempty"`
+	UpdatedAt uint64       `json:"updatedAt"`
+	TagIDs    []int        `json:"tagIDs"`
+	Tags      []bkmTagData `json:"tags,omitempty"`
+}
+
+func perUserTestNotes(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	tagIDs, err := makeTestTagsHierarchy(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkmIDs, err := makeTestBookmarks(be, u1.id, tagIDs)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	note1ID, err := addNote(be, u1.id, &noteData{
+		Title:  "note_1",
+		Body:   "# Note 1\n\n*markdown*",
+		TagIDs: []int{tagIDs.tag4ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	note2ID, err := addNote(be, u1.id, &noteData{
+		Title:  "note_2",
+		TagIDs: []int{tagIDs.tag8ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = checkNoteGet(be, u1.id, note1ID, &noteData{
+		ID:    note1ID,
+		Title: "note_1",
+		Body:  "# Note 1\n\n*markdown*",
+		Tags: []bkmTagData{
+			{Items: []bkmTagDataItem{
+				{ID: tagIDs.tag1ID, Name: "tag1"},
+				{ID: tagIDs.tag3ID, Name: "tag3_alias"},
+				{ID: tagIDs.tag4ID, Name: "tag4"},
+			}},
+		},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	cases := []struct {
+		qs       url.Values
+		expected []int
+	}{
+		{url.Values{}, []int{note1ID, note2ID}},
+		{url.Values{"tag_id": {fmt.Sprint(tagIDs.tag3ID)}}, []int{note1ID}},
+		{url.Values{"tag_id": {fmt.Sprint(tagIDs.tag2ID)}}, []int{}},
+		{url.Values{"tag_expr": {"tag4 | tag8"}}, []int{note1ID, note2ID}},
+		{url.Values{"tag_expr": {"!tag1"}}, []int{note2ID}},
+	}
+
+	for _, c := range cases {
+		if err := checkNotesGet(be, u1.id, c.qs, c.expected); err != nil {
+			return errors.Annotatef(err, "query string %q", c.qs.Encode())
+		}
+	}
+
+	// Notes are not returned as bookmarks
+	_, err = checkBkmGet(
+		be, u1.id, &bkmGetArg{tagIDs: []int{tagIDs.tag4ID}},
+		[]int{bkmIDs.bkm4ID, bkmIDs.bkm4_5ID},
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Update the note
+	err = updateNote(be, u1.id, &noteData{
+		ID:     note1ID,
+		Title:  "note_1_upd",
+		TagIDs: []int{tagIDs.tag2ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = checkNoteGet(be, u1.id, note1ID, &noteData{
+		ID:    note1ID,
+		Title: "note_1_upd",
+		Tags: []bkmTagData{
+			{Items: []bkmTagDataItem{
+				{ID: tagIDs.tag2ID, Name: "tag2"},
+			}},
+		},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := checkNotesGet(be, u1.id, url.Values{"tag_id": {fmt.Sprint(tagIDs.tag2ID)}}, []int{note1ID}); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Another user can't access the note
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		resp, err := be.DoUserReq(
+			method, fmt.Sprintf("/notes/%d", note1ID), u2.id, H{"title": "foo"}, false,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := expectHTTPCode(resp, 400); err != nil {
+			return errors.Annotatef(err, "%s", method)
+		}
+	}
+
+	if err := checkNotesGet(be, u2.id, url.Values{}, []int{}); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Bookmarks are not notes and vice versa
+	resp, err := be.DoUserReq("GET", fmt.Sprintf("/notes/%d", bkmIDs.bkm1ID), u1.id, nil, false)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := expectHTTPCode(resp, 400); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Delete the note
+	if _, err := be.DoUserReq("DELETE", fmt.Sprintf("/notes/%d", note1ID), u1.id, nil, true); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := checkNotesGet(be, u1.id, url.Values{}, []int{note2ID}); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func addNote(be testBackend, userID int, data *noteData) (noteID int, err error) {
+	resp, err := be.DoUserReq("POST", "/notes", userID, makeNoteReqData(data), true)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	v := map[string]int{}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return v["noteID"], nil
+}
+
+func updateNote(be testBackend, userID int, data *noteData) error {
+	_, err := be.DoUserReq(
+		"PUT", fmt.Sprintf("/notes/%d", data.ID), userID, makeNoteReqData(data), true,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func makeNoteReqData(data *noteData) H {
+	tagIDs := A{}
+	for _, id := range data.TagIDs {
+		tagIDs = append(tagIDs, id)
+	}
+
+	return H{
+		"title":  data.Title,
+		"body":   data.Body,
+		"tagIDs": tagIDs,
+	}
+}
+
+func checkNoteGet(be testBackend, userID, noteID int, expected *noteData) error {
+	resp, err := be.DoUserReq("GET", fmt.Sprintf("/notes/%d", noteID), userID, nil, true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var got noteData
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Ignore the timestamp
+	got.UpdatedAt = 0
+
+	if !reflect.DeepEqual(&got, expected) {
+		return errors.Errorf("note %d: expected %+v, got %+v", noteID, expected, got)
+	}
+
+	return nil
+}
+
+func checkNotesGet(be testBackend, userID int, qs url.Values, expectedIDs []int) error {
+	resp, err := be.DoUserReq("GET", "/notes?"+qs.Encode(), userID, nil, true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	notes := []noteData{}
+	if err := json.NewDecoder(resp.Body).Decode(&notes); err != nil {
+		return errors.Trace(err)
+	}
+
+	gotIDs := []int{}
+	for _, note := range notes {
+		gotIDs = append(gotIDs, note.ID)
+	}
+
+	sort.Ints(gotIDs)
+	sort.Ints(expectedIDs)
+
+	if !reflect.DeepEqual(gotIDs, expectedIDs) {
+		return errors.Errorf("notes: expected %v, got %v", expectedIDs, gotIDs)
+	}
+
+	return nil
+}
+
+type taggableData struct {
+	Type     string    `json:"type"`
+	Bookmark *bkmData  `json:"bookmark,omitempty"`
+	Note     *noteData `json:"note,omitempty"`
+}
+
+func perUserTestTaggedTaggableTypes(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	tagIDs, err := makeTestTagsHierarchy(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// A bookmark and a note with the same tag, and a note with another tag
+	bkmID, err := addBookmark(be, u1.id, &bkmData{
+		URL:    "url_1",
+		TagIDs: []int{tagIDs.tag4ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	noteID, err := addNote(be, u1.id, &noteData{
+		Title:  "note_1",
+		TagIDs: []int{tagIDs.tag4ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if _, err := addNote(be, u1.id, &noteData{
+		Title:  "note_2",
+		TagIDs: []int{tagIDs.tag8ID},
+	}); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Bookmarks only by default
+	for _, ttype := range []string{"", "bookmark"} {
+		qs := url.Values{"tag_id": {fmt.Sprint(tagIDs.tag4ID)}}
+		if ttype != "" {
+			qs.Set("type", ttype)
+		}
+
+		bkms := []bkmData{}
+		if err := getTaggedJSON(be, u1.id, qs, &bkms); err != nil {
+			return errors.Trace(err)
+		}
+		if len(bkms) != 1 || bkms[0].ID != bkmID {
+			return errors.Errorf("type %q: expected bookmark %d, got %+v", ttype, bkmID, bkms)
+		}
+	}
+
+	notes := []noteData{}
+	err = getTaggedJSON(be, u1.id, url.Values{
+		"tag_id": {fmt.Sprint(tagIDs.tag4ID)}, "type": {"note"},
+	}, &notes)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(notes) != 1 || notes[0].ID != noteID || notes[0].Title != "note_1" {
+		return errors.Errorf("expected note %d, got %+v", noteID, notes)
+	}
+
+	// Tagged with the supertag too
+	taggables := []taggableData{}
+	err = getTaggedJSON(be, u1.id, url.Values{
+		"tag_id": {fmt.Sprint(tagIDs.tag3ID)}, "type": {"all"},
+	}, &taggables)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(taggables) != 2 ||
+		taggables[0].Type != "bookmark" || taggables[0].Bookmark == nil ||
+		taggables[0].Bookmark.ID != bkmID || taggables[0].Note != nil ||
+		taggables[1].Type != "note" || taggables[1].Note == nil ||
+		taggables[1].Note.ID != noteID || taggables[1].Bookmark != nil {
+		return errors.Errorf(
+			"expected bookmark %d and note %d, got %+v", bkmID, noteID, taggables,
+		)
+	}
+
+	// Another user doesn't get anything
+	err = getTaggedJSON(be, u2.id, url.Values{
+		"tag_id": {fmt.Sprint(tagIDs.tag4ID)}, "type": {"all"},
+	}, &taggables)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(taggables) != 0 {
+		return errors.Errorf("user2 should get nothing, got %+v", taggables)
+	}
+
+	// Invalid arguments
+	for _, qs := range []string{
+		"type=foo",
+		"type=note",
+		fmt.Sprintf("type=all&tag_id=%d&sort=title", tagIDs.tag4ID),
+		fmt.Sprintf("type=note&tag_id=%d&limit=1", tagIDs.tag4ID),
+		"type=all&url=url_1",
+	} {
+		resp, err := be.DoUserReq("GET", "/bookmarks?"+qs, u1.id, nil, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := expectHTTPCode(resp, 400); err != nil {
+			return errors.Annotatef(err, "%s", qs)
+		}
+	}
+
+	return nil
+}
+
+func getTaggedJSON(be testBackend, userID int, qs url.Values, v interface{}) error {
+	resp, err := be.DoUserReq("GET", "/bookmarks?"+qs.Encode(), userID, nil, true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(json.NewDecoder(resp.Body).Decode(v))
+}
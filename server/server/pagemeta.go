@@ -0,0 +1,249 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"time"
+
+	"dmitryfrank.com/geekmarks/server/pagemeta"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/dimonomid/interrors"
+	"github.com/golang/glog"
+	"github.com/juju/errors"
+)
+
+var (
+	pageMetaEnabled = flag.Bool(
+		"geekmarks.page_meta", false,
+		"Whether the title, description, canonical link and favicon of pages "+
+			"are fetched in the background for new bookmarks; the title is only "+
+			"set if the bookmark has none. Only pages on public addresses are "+
+			"fetched.",
+	)
+	pageMetaInterval = flag.Duration(
+		"geekmarks.page_meta_interval", time.Minute,
+		"How often the requested page metadata is fetched, in case the "+
+			"fetcher wasn't woken up by new bookmarks.",
+	)
+	pageMetaTimeout = flag.Duration(
+		"geekmarks.page_meta_timeout", 30*time.Second,
+		"Timeout of fetching a single page for its metadata.",
+	)
+)
+
+const (
+	// pageMetaBatchSize is the max number of pages fetched by FetchPageMeta at
+	// a time
+	pageMetaBatchSize = 100
+	// pageMetaMaxSize is the max number of bytes of the page which are parsed
+	// for metadata
+	pageMetaMaxSize = 1 << 20
+)
+
+// userBookmarkPageMeta is the metadata of the bookmarked page; the title
+// isn't here, since it goes to the bookmark itself.
+type userBookmarkPageMeta struct {
+	Description  string `json:"description,omitempty"`
+	CanonicalURL string `json:"canonicalURL,omitempty"`
+	FaviconURL   string `json:"faviconURL,omitempty"`
+	Error        string `json:"error,omitempty"`
+	FetchedAt    uint64 `json:"fetchedAt"`
+}
+
+// requestPageMeta schedules fetching of the page metadata of the new bookmark
+// if it's enabled (see the -geekmarks.page_meta flag). Once the transaction
+// is committed, the fetcher should be woken up with wakePageMetaFetcher.
+func (gm *GMServer) requestPageMeta(tx *sql.Tx, bkmID int) error {
+	if !*pageMetaEnabled {
+		return nil
+	}
+
+	return errors.Trace(gm.si.RequestPageMeta(tx, bkmID))
+}
+
+// wakePageMetaFetcher makes RunPageMetaFetcher fetch the requested page
+// metadata right away, without waiting for the next tick.
+func (gm *GMServer) wakePageMetaFetcher() {
+	select {
+	case gm.pageMetaWake <- struct{}{}:
+	default:
+		// The fetcher is going to run anyway
+	}
+}
+
+// FetchPageMeta fetches the next batch of the requested page metadata, for
+// all users, and saves it. Returns the number of pages fetched.
+func (gm *GMServer) FetchPageMeta() (fetchedCnt int, err error) {
+	var bkms []storage.BookmarkData
+
+	err = gm.si.Tx(func(tx *sql.Tx) error {
+		var err error
+		bkms, err = gm.si.GetPendingPageMeta(tx, pageMetaBatchSize)
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	// Pages are fetched outside of transactions, since it might take a while
+	for _, bkm := range bkms {
+		pm := gm.fetchPageMeta(&bkm)
+
+		err = gm.si.Tx(func(tx *sql.Tx) error {
+			return errors.Trace(gm.savePageMeta(tx, pm))
+		})
+		if err != nil {
+			return fetchedCnt, errors.Trace(err)
+		}
+
+		fetchedCnt++
+	}
+
+	return fetchedCnt, nil
+}
+
+func (gm *GMServer) fetchPageMeta(bkm *storage.BookmarkData) *storage.PageMetaData {
+	pm := &storage.PageMetaData{
+		BookmarkID: bkm.ID,
+		URL:        bkm.URL,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *pageMetaTimeout)
+	defer cancel()
+
+	res, err := gm.fetcher.Fetch(ctx, bkm.URL)
+	if err != nil {
+		pm.Error = errors.Cause(err).Error()
+		return pm
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		pm.Error = fmt.Sprintf("HTTP status %d", res.StatusCode)
+		return pm
+	}
+
+	if res.ContentType != "" {
+		mediaType, _, _ := mime.ParseMediaType(res.ContentType)
+		if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+			pm.Error = fmt.Sprintf("not an HTML page: %q", res.ContentType)
+			return pm
+		}
+	}
+
+	meta, err := pagemeta.Extract(io.LimitReader(res.Body, pageMetaMaxSize), res.URL)
+	if err != nil {
+		pm.Error = errors.Cause(err).Error()
+		return pm
+	}
+
+	pm.Title = meta.Title
+	pm.Description = meta.Description
+	pm.CanonicalURL = meta.CanonicalURL
+	pm.FaviconURL = meta.FaviconURL
+
+	return pm
+}
+
+// savePageMeta saves the fetched page metadata, and sets the title of the
+// bookmark unless it already has one (the user might have set it while the
+// page was being fetched).
+func (gm *GMServer) savePageMeta(tx *sql.Tx, pm *storage.PageMetaData) error {
+	if err := gm.si.SetPageMeta(tx, pm); err != nil {
+		return errors.Trace(err)
+	}
+
+	if pm.Title == "" {
+		return nil
+	}
+
+	bkm, err := gm.si.GetBookmarkByID(tx, pm.BookmarkID, &storage.TagsFetchOpts{
+		TagsFetchMode:     storage.TagsFetchModeNone,
+		TagNamesFetchMode: storage.TagNamesFetchModeNone,
+	})
+	if err != nil {
+		if errors.Cause(err) == storage.ErrBookmarkDoesNotExist {
+			// The bookmark was deleted while the page was being fetched
+			return nil
+		}
+		return errors.Trace(err)
+	}
+
+	if bkm.Title != "" || bkm.URL != pm.URL {
+		return nil
+	}
+
+	if err := gm.saveInitialBookmarkRevision(tx, bkm.ID); err != nil {
+		return errors.Trace(err)
+	}
+
+	bkm.Title = pm.Title
+	bkm.CanonicalURL = canonicalizeURL(bkm.URL)
+	if err := gm.si.UpdateBookmark(tx, &bkm.BookmarkData); err != nil {
+		return errors.Trace(err)
+	}
+
+	if _, err := gm.si.SaveBookmarkRevision(tx, bkm.ID); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// RunPageMetaFetcher calls FetchPageMeta whenever new bookmarks are created,
+// and periodically (see the -geekmarks.page_meta_interval flag), until stop
+// is closed. It returns right away if fetching of page metadata is disabled.
+func (gm *GMServer) RunPageMetaFetcher(stop <-chan struct{}) {
+	if !*pageMetaEnabled || *pageMetaInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(*pageMetaInterval)
+	defer ticker.Stop()
+
+	for {
+		fetchedCnt, err := gm.FetchPageMeta()
+		if err != nil {
+			glog.Errorf("Failed to fetch page metadata: %s", interrors.ErrorStack(err))
+		} else if fetchedCnt > 0 {
+			glog.Infof("Fetched metadata of %d pages", fetchedCnt)
+		}
+
+		if fetchedCnt == pageMetaBatchSize {
+			// There might be more pages to fetch
+			continue
+		}
+
+		select {
+		case <-ticker.C:
+		case <-gm.pageMetaWake:
+		case <-stop:
+			return
+		}
+	}
+}
+
+func getUserBookmarkPageMeta(
+	pms map[int]storage.PageMetaData, bkmID int,
+) *userBookmarkPageMeta {
+	pm, ok := pms[bkmID]
+	if !ok {
+		return nil
+	}
+
+	return &userBookmarkPageMeta{
+		Description:  pm.Description,
+		CanonicalURL: pm.CanonicalURL,
+		FaviconURL:   pm.FaviconURL,
+		Error:        pm.Error,
+		FetchedAt:    pm.FetchedAt,
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests integration_tests
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/fetcher"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+// testFetcher serves the given HTML pages, keyed by URL; other URLs can't be
+// fetched at all.
+type testFetcher map[string]string
+
+func (f testFetcher) Fetch(ctx context.Context, url string) (*fetcher.Result, error) {
+	page, ok := f[url]
+	if !ok {
+		return nil, errors.Errorf("no such host")
+	}
+
+	return &fetcher.Result{
+		StatusCode:  200,
+		URL:         url,
+		ContentType: "text/html; charset=utf-8",
+		Body:        ioutil.NopCloser(strings.NewReader(page)),
+	}, nil
+}
+
+func TestPageMeta(t *testing.T) {
+	defer func(enabled bool) { *pageMetaEnabled = enabled }(*pageMetaEnabled)
+	*pageMetaEnabled = true
+
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestPageMeta)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func perUserTestPageMeta(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	page := `<html><head>
+  <title>Page title</title>
+  <meta name="description" content="Page description">
+  <link rel="canonical" href="/canonical">
+</head><body></body></html>`
+
+	gm, err := New(si)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	gm.SetFetcher(testFetcher{
+		"http://example.com/page":  page,
+		"http://example.com/page2": page,
+		"http://example.com/page3": page,
+	})
+
+	bkms := []bkmData{
+		{URL: "http://example.com/page"},
+		// The title given by the user is kept
+		{URL: "http://example.com/page2", Title: "My title"},
+		{URL: "http://example.com/missing"},
+	}
+	for i := range bkms {
+		bkms[i].ID, err = addBookmark(be, u1.id, &bkms[i])
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	// Page metadata is not fetched if it's disabled
+	*pageMetaEnabled = false
+	disabledBkm := bkmData{URL: "http://example.com/page3"}
+	disabledBkm.ID, err = addBookmark(be, u1.id, &disabledBkm)
+	*pageMetaEnabled = true
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Nothing is fetched yet
+	for _, bkm := range append(bkms, disabledBkm) {
+		if err := checkBkmPageMeta(be, u1.id, bkm.ID, bkm.Title, nil); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	fetchedCnt, err := gm.FetchPageMeta()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if fetchedCnt != len(bkms) {
+		return errors.Errorf("expected %d pages to be fetched, got %d", len(bkms), fetchedCnt)
+	}
+
+	fetchedCnt, err = gm.FetchPageMeta()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if fetchedCnt != 0 {
+		return errors.Errorf("expected no pages to be fetched, got %d", fetchedCnt)
+	}
+
+	pageMeta := &bkmPageMetaData{
+		Description:  "Page description",
+		CanonicalURL: "http://example.com/canonical",
+		FaviconURL:   "http://example.com/favicon.ico",
+	}
+
+	cases := []struct {
+		bkmID    int
+		title    string
+		expected *bkmPageMetaData
+	}{
+		{bkms[0].ID, "Page title", pageMeta},
+		{bkms[1].ID, "My title", pageMeta},
+		{bkms[2].ID, "", &bkmPageMetaData{Error: "no such host"}},
+		{disabledBkm.ID, "", nil},
+	}
+
+	for _, c := range cases {
+		if err := checkBkmPageMeta(be, u1.id, c.bkmID, c.title, c.expected); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// TestPageMetaPrivateAddress checks that pages on private addresses are not
+// fetched by default, so that users can't make the server fetch internal
+// pages and show their contents as bookmark titles and descriptions.
+func TestPageMetaPrivateAddress(t *testing.T) {
+	defer func(enabled bool) { *pageMetaEnabled = enabled }(*pageMetaEnabled)
+	*pageMetaEnabled = true
+
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestPageMetaPrivateAddress)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func perUserTestPageMetaPrivateAddress(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	web := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html><head><title>Internal page</title></head></html>"))
+	}))
+	defer web.Close()
+
+	gm, err := New(si)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkm := bkmData{URL: web.URL + "/"}
+	bkm.ID, err = addBookmark(be, u1.id, &bkm)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	fetchedCnt, err := gm.FetchPageMeta()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if fetchedCnt != 1 {
+		return errors.Errorf("expected 1 page to be fetched, got %d", fetchedCnt)
+	}
+
+	// The test server is on the loopback address
+	expected := &bkmPageMetaData{
+		Error: fmt.Sprintf(
+			"Get %q: dial tcp %s: address 127.0.0.1 is not allowed",
+			bkm.URL, web.Listener.Addr(),
+		),
+	}
+
+	return errors.Trace(checkBkmPageMeta(be, u1.id, bkm.ID, "", expected))
+}
+
+func checkBkmPageMeta(
+	be testBackend, userID, bkmID int, expectedTitle string, expected *bkmPageMetaData,
+) error {
+	resp, err := be.DoUserReq("GET", fmt.Sprintf("/bookmarks/%d", bkmID), userID, nil, true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var got bkmData
+	if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+		return errors.Trace(err)
+	}
+
+	if got.Title != expectedTitle {
+		return errors.Errorf(
+			"bookmark %d: expected title %q, got %q", bkmID, expectedTitle, got.Title,
+		)
+	}
+
+	if got.PageMeta != nil {
+		if got.PageMeta.FetchedAt == 0 {
+			return errors.Errorf("bookmark %d: fetchedAt is not set", bkmID)
+		}
+		got.PageMeta.FetchedAt = 0
+	}
+
+	if !reflect.DeepEqual(got.PageMeta, expected) {
+		return errors.Errorf(
+			"bookmark %d: expected page meta %+v, got %+v", bkmID, expected, got.PageMeta,
+		)
+	}
+
+	return nil
+}
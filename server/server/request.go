@@ -28,6 +28,13 @@ type GMRequest struct {
 	Body   io.ReadCloser
 }
 
+// Context returns the context of the request: it's done when the client goes
+// away, or when the request deadline is exceeded. All the database work
+// should be done with this context, see storage.Storage.TxCtx.
+func (gmr *GMRequest) Context() context.Context {
+	return gmr.HttpReq.Context()
+}
+
 func (gmr *GMRequest) FormValue(key string) string {
 	if vs := gmr.Values[key]; len(vs) > 0 {
 		return vs[0]
@@ -66,6 +73,7 @@ func makeGMRequestFromHttpRequest(
 }
 
 func makeGMRequestFromWebSocketRequest(
+	ctx context.Context,
 	wsr *WebSocketRequest, caller *storage.UserData, subjUser *storage.UserData,
 ) (*GMRequest, error) {
 	values := map[string][]string{}
@@ -102,7 +110,6 @@ func makeGMRequestFromWebSocketRequest(
 		return nil, errors.Trace(err)
 	}
 
-	ctx := context.Background()
 	ctx = pattern.SetPath(ctx, httpReq.URL.EscapedPath())
 	httpReq = httpReq.WithContext(ctx)
 
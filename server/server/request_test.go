@@ -7,11 +7,14 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
 	"dmitryfrank.com/geekmarks/server/storage"
 	//"github.com/juju/errors"
 )
@@ -46,7 +49,7 @@ func TestFromWebSocketRequest(t *testing.T) {
 	caller := &storage.UserData{}
 	subjUser := &storage.UserData{}
 
-	gmr, err := makeGMRequestFromWebSocketRequest(wsr, caller, subjUser)
+	gmr, err := makeGMRequestFromWebSocketRequest(context.Background(), wsr, caller, subjUser)
 	if err != nil {
 		t.Errorf("error making GMRequest from WebSocketRequest: %s", err)
 	}
@@ -105,7 +108,7 @@ func shouldFail(t *testing.T, str string) {
 	caller := &storage.UserData{}
 	subjUser := &storage.UserData{}
 
-	_, err = makeGMRequestFromWebSocketRequest(wsr, caller, subjUser)
+	_, err = makeGMRequestFromWebSocketRequest(context.Background(), wsr, caller, subjUser)
 	if err == nil {
 		t.Errorf("should not be able to convert %s", str)
 	}
@@ -174,3 +177,35 @@ func TestFromHttpRequest(t *testing.T) {
 		t.Errorf("%s", err)
 	}
 }
+
+func TestHandleWithContext(t *testing.T) {
+	gmr, err := makeGMRequestFromWebSocketRequest(
+		context.Background(),
+		&WebSocketRequest{Method: "GET", Path: "/tags"}, nil, nil,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(gmr.Context(), time.Millisecond)
+	defer cancel()
+	gmr.HttpReq = gmr.HttpReq.WithContext(ctx)
+
+	// Handler which fails because of the deadline, like a query would
+	_, err = handleWithContext(gmr, func(gmr *GMRequest) (interface{}, error) {
+		<-gmr.Context().Done()
+		return nil, hh.MakeInternalServerError(gmr.Context().Err())
+	})
+	if code := hh.GetHTTPErrorCode(err); code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got %d (err: %v)", http.StatusServiceUnavailable, code, err)
+	}
+
+	// Other errors should be left intact
+	gmr.HttpReq = gmr.HttpReq.WithContext(context.Background())
+	_, err = handleWithContext(gmr, func(gmr *GMRequest) (interface{}, error) {
+		return nil, hh.MakeForbiddenError()
+	})
+	if code := hh.GetHTTPErrorCode(err); code != http.StatusForbidden {
+		t.Errorf("expected status %d, got %d (err: %v)", http.StatusForbidden, code, err)
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package server
+
+import (
+	"database/sql"
+	"strconv"
+
+	"goji.io/pat"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/dimonomid/interrors"
+	"github.com/juju/errors"
+)
+
+const (
+	BookmarkRevisionID = "revid"
+)
+
+type userBookmarkRevisionData struct {
+	ID        int    `json:"id"`
+	URL       string `json:"url"`
+	Title     string `json:"title,omitempty"`
+	Comment   string `json:"comment,omitempty"`
+	UpdatedAt uint64 `json:"updatedAt"`
+	TagIDs    []int  `json:"tagIDs"`
+}
+
+type userBookmarkRevertResp struct {
+	RevisionID int `json:"revisionID"`
+}
+
+// userBookmarkHistoryGet is a GET /bookmarks/:bkmid/history handler
+func (gm *GMServer) userBookmarkHistoryGet(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	bkmID, err := getBookmarkIDFromQueryString(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var revs []storage.BookmarkRevisionData
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		if err := gm.checkBookmarkOwner(gmr, tx, bkmID); err != nil {
+			return errors.Trace(err)
+		}
+
+		var err error
+		revs, err = gm.si.GetBookmarkRevisions(tx, bkmID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	revsUser := []userBookmarkRevisionData{}
+	for _, rev := range revs {
+		revsUser = append(revsUser, userBookmarkRevisionData{
+			ID:        rev.ID,
+			URL:       rev.URL,
+			Title:     rev.Title,
+			Comment:   rev.Comment,
+			UpdatedAt: rev.CreatedAt,
+			TagIDs:    rev.TagIDs,
+		})
+	}
+
+	return revsUser, nil
+}
+
+// userBookmarkRevertPost is a POST /bookmarks/:bkmid/history/:revid/revert
+// handler: it brings the bookmark to the state of the given revision, which
+// results in a new revision. Tags of the revision which don't exist anymore
+// are ignored.
+func (gm *GMServer) userBookmarkRevertPost(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	bkmID, err := getBookmarkIDFromQueryString(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	revIDStr := pat.Param(gmr.HttpReq, BookmarkRevisionID)
+	revID, err := strconv.Atoi(revIDStr)
+	if err != nil {
+		return nil, interrors.WrapInternalError(
+			err,
+			errors.Errorf("wrong revision id %q", revIDStr),
+		)
+	}
+
+	newRevID := 0
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		if err := gm.checkBookmarkOwner(gmr, tx, bkmID); err != nil {
+			return errors.Trace(err)
+		}
+
+		rev, err := gm.si.GetBookmarkRevision(tx, revID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if rev.BookmarkID != bkmID {
+			return errors.Annotatef(
+				storage.ErrBookmarkRevisionDoesNotExist,
+				"bookmark %d: id %d", bkmID, revID,
+			)
+		}
+
+		tagIDs := []int{}
+		for _, tagID := range rev.TagIDs {
+			if _, err := gm.si.GetTag(tx, tagID, &storage.GetTagOpts{}); err != nil {
+				if errors.Cause(err) == storage.ErrTagDoesNotExist {
+					continue
+				}
+				return errors.Trace(err)
+			}
+			tagIDs = append(tagIDs, tagID)
+		}
+
+		canonicalURL := canonicalizeURL(rev.URL)
+		err = gm.checkDuplicateBookmark(tx, gmr.SubjUser.ID, canonicalURL, bkmID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = gm.si.UpdateBookmark(tx, &storage.BookmarkData{
+			ID:           bkmID,
+			OwnerID:      gmr.SubjUser.ID,
+			URL:          rev.URL,
+			CanonicalURL: canonicalURL,
+			Title:        rev.Title,
+			Comment:      rev.Comment,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = gm.si.SetTaggings(tx, bkmID, tagIDs, storage.TaggingModeLeafs)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		newRevID, err = gm.si.SaveBookmarkRevision(tx, bkmID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resp = userBookmarkRevertResp{
+		RevisionID: newRevID,
+	}
+	return resp, nil
+}
+
+// checkBookmarkOwner returns an error unless the bookmark with the given id
+// exists and belongs to the subject user.
+func (gm *GMServer) checkBookmarkOwner(gmr *GMRequest, tx *sql.Tx, bkmID int) error {
+	bkm, err := gm.si.GetBookmarkByID(tx, bkmID, &storage.TagsFetchOpts{
+		TagsFetchMode:     storage.TagsFetchModeNone,
+		TagNamesFetchMode: storage.TagNamesFetchModeNone,
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = gm.authorizeOperation(gmr.SubjUser, &authzArgs{OwnerID: bkm.OwnerID})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// saveInitialBookmarkRevision saves the current state of the bookmark as a
+// revision, if only the bookmark has no revisions yet.
+func (gm *GMServer) saveInitialBookmarkRevision(tx *sql.Tx, bkmID int) error {
+	revs, err := gm.si.GetBookmarkRevisions(tx, bkmID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(revs) == 0 {
+		if _, err := gm.si.SaveBookmarkRevision(tx, bkmID); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,198 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests integration_tests
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+func TestBookmarkHistory(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestBookmarkHistory)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+type bkmRevisionData struct {
+	ID        int    `json:"id"`
+	URL       string `json:"url"`
+	Title     string `json:"title,omitempty"`
+	Comment   string `json:"comment,omitempty"`
+	UpdatedAt uint64 `json:"updatedAt"`
+	TagIDs    []int  `json:"tagIDs"`
+}
+
+func perUserTestBookmarkHistory(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	tagIDs, err := makeTestTagsHierarchy(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkmID, err := addBookmark(be, u1.id, &bkmData{
+		URL:     "url_1",
+		Title:   "title_1",
+		Comment: "comment_1",
+		TagIDs:  []int{tagIDs.tag4ID, tagIDs.tag8ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = updateBookmark(be, u1.id, &bkmData{
+		ID:     bkmID,
+		URL:    "url_2",
+		Title:  "title_2",
+		TagIDs: []int{tagIDs.tag2ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	revs, err := getBookmarkHistory(be, u1.id, bkmID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	expected := []bkmRevisionData{
+		{URL: "url_2", Title: "title_2", TagIDs: []int{tagIDs.tag2ID}},
+		{URL: "url_1", Title: "title_1", Comment: "comment_1", TagIDs: []int{tagIDs.tag4ID, tagIDs.tag8ID}},
+	}
+	if err := checkBkmRevisions(revs, expected); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Another user can't see the history
+	{
+		resp, err := be.DoReq(
+			"GET", fmt.Sprintf("/api/users/%d/bookmarks/%d/history", u1.id, bkmID), u2.token,
+			nil, false,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := expectErrorResp(resp, http.StatusForbidden, "forbidden"); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	// Delete tag8, and revert to the first revision: the bookmark should be
+	// tagged with tag4 only
+	if err := deleteTag(be, "/tags/tag7/tag8", u1.id, QSArgNewLeafPolicyKeep); err != nil {
+		return errors.Trace(err)
+	}
+
+	_, err = be.DoUserReq(
+		"POST", fmt.Sprintf("/bookmarks/%d/history/%d/revert", bkmID, revs[1].ID),
+		u1.id, nil, true,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = checkBkmGetByID(be, u1.id, bkmID, &bkmData{
+		ID:      bkmID,
+		URL:     "url_1",
+		Title:   "title_1",
+		Comment: "comment_1",
+		Tags: []bkmTagData{
+			{Items: []bkmTagDataItem{
+				{ID: tagIDs.tag1ID, Name: "tag1"},
+				{ID: tagIDs.tag3ID, Name: "tag3_alias"},
+				{ID: tagIDs.tag4ID, Name: "tag4"},
+			}},
+		},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	revs, err = getBookmarkHistory(be, u1.id, bkmID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	expected = append([]bkmRevisionData{
+		{URL: "url_1", Title: "title_1", Comment: "comment_1", TagIDs: []int{tagIDs.tag4ID}},
+	}, expected...)
+	if err := checkBkmRevisions(revs, expected); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Revision of another bookmark can't be used
+	bkm2ID, err := addBookmark(be, u1.id, &bkmData{URL: "url_3"})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	resp, err := be.DoUserReq(
+		"POST", fmt.Sprintf("/bookmarks/%d/history/%d/revert", bkm2ID, revs[1].ID),
+		u1.id, nil, false,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := expectHTTPCode(resp, http.StatusBadRequest); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func getBookmarkHistory(be testBackend, userID, bkmID int) ([]bkmRevisionData, error) {
+	resp, err := be.DoUserReq(
+		"GET", fmt.Sprintf("/bookmarks/%d/history", bkmID), userID, nil, true,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	v := []bkmRevisionData{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil, errors.Annotatef(err, "body: %q", body)
+	}
+
+	return v, nil
+}
+
+// checkBkmRevisions compares revisions, ignoring ids and update times
+func checkBkmRevisions(got, expected []bkmRevisionData) error {
+	stripped := []bkmRevisionData{}
+	for _, rev := range got {
+		if rev.ID == 0 || rev.UpdatedAt == 0 {
+			return errors.Errorf("revision id or update time is not set: %+v", rev)
+		}
+		rev.ID = 0
+		rev.UpdatedAt = 0
+		stripped = append(stripped, rev)
+	}
+
+	if !reflect.DeepEqual(stripped, expected) {
+		return errors.Errorf("revisions: expected %+v, got %+v", expected, stripped)
+	}
+
+	return nil
+}
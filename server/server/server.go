@@ -6,6 +6,7 @@
 package server // import "dmitryfrank.com/geekmarks/server/server"
 
 import (
+	"context"
 	"database/sql"
 	"flag"
 	"fmt"
@@ -13,11 +14,13 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	goji "goji.io"
 	"goji.io/pat"
 
 	"dmitryfrank.com/geekmarks/server/cptr"
+	"dmitryfrank.com/geekmarks/server/fetcher"
 	hh "dmitryfrank.com/geekmarks/server/httphelper"
 	"dmitryfrank.com/geekmarks/server/middleware"
 	"dmitryfrank.com/geekmarks/server/storage"
@@ -26,9 +29,16 @@ import (
 	"github.com/juju/errors"
 )
 
-var googleOAuthCredsFile = flag.String(
-	"google_oauth_creds_file", "",
-	"Path to the file with Google app ID and secret.",
+var (
+	googleOAuthCredsFile = flag.String(
+		"google_oauth_creds_file", "",
+		"Path to the file with Google app ID and secret.",
+	)
+	requestTimeout = flag.Duration(
+		"geekmarks.request_timeout", 30*time.Second,
+		"Deadline for handling a single API request, including the ones made "+
+			"via websocket; 0 means no deadline.",
+	)
 )
 
 const (
@@ -41,6 +51,9 @@ type GMServer struct {
 	si             storage.Storage
 	wsMux          *WebSocketMux
 	oauthProviders map[string]*OAuthCreds
+	adminUsers     map[string]bool
+	fetcher        fetcher.Fetcher
+	pageMetaWake   chan struct{}
 }
 
 func New(si storage.Storage) (*GMServer, error) {
@@ -62,10 +75,20 @@ func New(si storage.Storage) (*GMServer, error) {
 		si:             si,
 		wsMux:          &WebSocketMux{},
 		oauthProviders: oauthProviders,
+		adminUsers:     parseAdminUsers(*adminUsers),
+		fetcher:        fetcher.NewHTTPFetcher(nil),
+		pageMetaWake:   make(chan struct{}, 1),
 	}
 	return &gm, nil
 }
 
+// SetFetcher replaces the fetcher used by the background jobs like the link
+// checker and the page metadata fetcher; by default, real HTTP requests are
+// made, to public addresses only (see fetcher.NewRestrictedClient).
+func (gm *GMServer) SetFetcher(f fetcher.Fetcher) {
+	gm.fetcher = f
+}
+
 func setUserEndpoint(
 	pattern *pat.Pattern, gmh GMHandler, wsMux *WebSocketMux, mux *goji.Mux, gsu getSubjUser,
 ) {
@@ -74,11 +97,14 @@ func setUserEndpoint(
 		gsu getSubjUser,
 	) func(r *http.Request) (resp interface{}, err error) {
 		return func(r *http.Request) (resp interface{}, err error) {
-			gmr, err := makeGMRequestFromHttpRequest(r, gsu)
+			ctx, cancel := withRequestTimeout(r.Context())
+			defer cancel()
+
+			gmr, err := makeGMRequestFromHttpRequest(r.WithContext(ctx), gsu)
 			if err != nil {
 				return nil, errors.Trace(err)
 			}
-			return uh(gmr)
+			return handleWithContext(gmr, uh)
 		}
 	}
 
@@ -92,6 +118,30 @@ func setUserEndpoint(
 
 type GMHandler func(gmr *GMRequest) (resp interface{}, err error)
 
+// withRequestTimeout returns a context which is done after the configured
+// request timeout (see the -geekmarks.request_timeout flag).
+func withRequestTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if *requestTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, *requestTimeout)
+}
+
+// handleWithContext calls the handler, and if it fails because the request
+// deadline was exceeded, returns a request timeout error instead of whatever
+// (most likely, internal) error the handler returned.
+func handleWithContext(gmr *GMRequest, gmh GMHandler) (resp interface{}, err error) {
+	resp, err = gmh(gmr)
+	if err != nil {
+		if gmr.Context().Err() == context.DeadlineExceeded {
+			return nil, hh.MakeRequestTimeoutError(err)
+		}
+		return nil, errors.Trace(err)
+	}
+
+	return resp, nil
+}
+
 func (gm *GMServer) CreateHandler() (http.Handler, error) {
 	rRoot := goji.NewMux()
 	rRoot.Use(middleware.MakeLogger())
@@ -120,6 +170,14 @@ func (gm *GMServer) CreateHandler() (http.Handler, error) {
 			gm.setupUserAPIEndpoints(rAPIMy, gm.getUserFromAuthn)
 		}
 
+		rAPIAdmin := goji.SubMux()
+		rAPI.Handle(pat.New("/admin/*"), rAPIAdmin)
+		{
+			rAPIAdmin.Use(gm.authnRequiredMiddleware)
+
+			gm.setupAdminAPIEndpoints(rAPIAdmin)
+		}
+
 		rAPIAuth := goji.SubMux()
 		rAPI.Handle(pat.New("/auth/:provider/*"), rAPIAuth)
 		{
@@ -194,14 +252,56 @@ func (gm *GMServer) setupUserAPIEndpoints(mux *goji.Mux, gsu getSubjUser) {
 	setUserEndpoint(pat.Put("/tags/*"), gm.userTagPut, gm.wsMux, mux, gsu)
 	mux.HandleFunc(pat.Options("/tags"), gm.createOptionsHandler("GET", "POST", "PUT", "DELETE"))
 	mux.HandleFunc(pat.Options("/tags/*"), gm.createOptionsHandler("GET", "POST", "PUT", "DELETE"))
+	setUserEndpoint(pat.Post("/tags_undo"), gm.userTagsUndoPost, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/tags_undo"), gm.createOptionsHandler("POST"))
 
 	setUserEndpoint(pat.Get("/bookmarks"), gm.userBookmarksGet, gm.wsMux, mux, gsu)
 	setUserEndpoint(pat.Post("/bookmarks"), gm.userBookmarksPost, gm.wsMux, mux, gsu)
 	mux.HandleFunc(pat.Options("/bookmarks"), gm.createOptionsHandler("GET", "POST"))
+	setUserEndpoint(pat.Post("/bookmarks/import"), gm.userBookmarksImportPost, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/bookmarks/import"), gm.createOptionsHandler("POST"))
+	{
+		handler := hh.MakeAPIHandlerWWriter(func(w http.ResponseWriter, r *http.Request) error {
+			return gm.userBookmarksExportGet(w, r, gsu)
+		})
+		mux.HandleFunc(pat.Get("/bookmarks/export"), handler)
+		mux.HandleFunc(pat.Options("/bookmarks/export"), gm.createOptionsHandler("GET"))
+	}
 	setUserEndpoint(pat.Get("/bookmarks/:"+BookmarkID), gm.userBookmarkGet, gm.wsMux, mux, gsu)
 	setUserEndpoint(pat.Put("/bookmarks/:"+BookmarkID), gm.userBookmarkPut, gm.wsMux, mux, gsu)
 	setUserEndpoint(pat.Delete("/bookmarks/:"+BookmarkID), gm.userBookmarkDelete, gm.wsMux, mux, gsu)
 	mux.HandleFunc(pat.Options("/bookmarks/:"+BookmarkID), gm.createOptionsHandler("GET", "PUT", "DELETE"))
+	setUserEndpoint(pat.Get("/bookmarks/:"+BookmarkID+"/history"), gm.userBookmarkHistoryGet, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/bookmarks/:"+BookmarkID+"/history"), gm.createOptionsHandler("GET"))
+	setUserEndpoint(
+		pat.Post("/bookmarks/:"+BookmarkID+"/history/:"+BookmarkRevisionID+"/revert"),
+		gm.userBookmarkRevertPost, gm.wsMux, mux, gsu,
+	)
+	mux.HandleFunc(
+		pat.Options("/bookmarks/:"+BookmarkID+"/history/:"+BookmarkRevisionID+"/revert"),
+		gm.createOptionsHandler("POST"),
+	)
+
+	setUserEndpoint(pat.Get("/notes"), gm.userNotesGet, gm.wsMux, mux, gsu)
+	setUserEndpoint(pat.Post("/notes"), gm.userNotesPost, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/notes"), gm.createOptionsHandler("GET", "POST"))
+	setUserEndpoint(pat.Get("/notes/:"+NoteID), gm.userNoteGet, gm.wsMux, mux, gsu)
+	setUserEndpoint(pat.Put("/notes/:"+NoteID), gm.userNotePut, gm.wsMux, mux, gsu)
+	setUserEndpoint(pat.Delete("/notes/:"+NoteID), gm.userNoteDelete, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/notes/:"+NoteID), gm.createOptionsHandler("GET", "PUT", "DELETE"))
+
+	setUserEndpoint(pat.Get("/trash"), gm.userTrashGet, gm.wsMux, mux, gsu)
+	setUserEndpoint(pat.Delete("/trash"), gm.userTrashDelete, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/trash"), gm.createOptionsHandler("GET", "DELETE"))
+	setUserEndpoint(pat.Delete("/trash/:"+TrashedBookmarkID), gm.userTrashedBookmarkDelete, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/trash/:"+TrashedBookmarkID), gm.createOptionsHandler("DELETE"))
+	setUserEndpoint(pat.Post("/trash/:"+TrashedBookmarkID+"/restore"), gm.userTrashRestorePost, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/trash/:"+TrashedBookmarkID+"/restore"), gm.createOptionsHandler("POST"))
+
+	setUserEndpoint(pat.Get("/export"), gm.userExportGet, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/export"), gm.createOptionsHandler("GET"))
+	setUserEndpoint(pat.Post("/restore"), gm.userRestorePost, gm.wsMux, mux, gsu)
+	mux.HandleFunc(pat.Options("/restore"), gm.createOptionsHandler("POST"))
 
 	setUserEndpoint(pat.Get("/add_test_tags_tree"), gm.addTestTagsTree, gm.wsMux, mux, gsu)
 
@@ -225,7 +325,7 @@ func (gm *GMServer) getUserFromURLParam(r *http.Request) (*storage.UserData, err
 	}
 
 	var ud *storage.UserData
-	err = gm.si.Tx(func(tx *sql.Tx) error {
+	err = gm.si.TxCtx(r.Context(), func(tx *sql.Tx) error {
 		var err error
 		ud, err = gm.si.GetUser(tx, &storage.GetUserArgs{
 			ID: cptr.Int(userid),
@@ -33,7 +33,7 @@ func (gm *GMServer) testUserDelete(gmr *GMRequest) (resp interface{}, err error)
 		return nil, errors.Trace(err)
 	}
 
-	err = gm.si.Tx(func(tx *sql.Tx) error {
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 		err = gm.si.DeleteUser(tx, gmr.SubjUser.ID)
 		if err != nil {
 			return errors.Trace(err)
@@ -0,0 +1,123 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package server
+
+import (
+	"database/sql"
+	"strings"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/tagexpr"
+	"github.com/juju/errors"
+)
+
+// resolveTagExpr converts the parsed tag expression to the one which can be
+// given to the storage, resolving the tags of the expression against the
+// tags of the given user.
+//
+// A tag starting with "/" is an absolute path, like "/work/go". Otherwise,
+// it matches all tags whose paths end with it: "archived" matches any tag
+// with that name, and "work/go" matches both "/work/go" and "/old/work/go".
+// Aliases can be used in place of the primary names. If several tags match,
+// a bookmark tagged with any of them matches.
+func (gm *GMServer) resolveTagExpr(
+	tx *sql.Tx, ownerID int, e *tagexpr.Expr,
+) (*storage.TagExpr, error) {
+	rootTagID, err := gm.si.GetRootTagID(tx, ownerID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	rootTag, err := gm.si.GetTag(tx, rootTagID, &storage.GetTagOpts{
+		GetNames:   true,
+		GetSubtags: true,
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	tagsFlat := gm.createTagDataFlatInternal(rootTag, nil, nil)
+
+	tagIDs := map[string][]int{}
+	for _, tag := range e.Tags() {
+		ids := findTagsByPath(tagsFlat, tag)
+		if len(ids) == 0 {
+			return nil, errors.Errorf("no tag matches %q", tag)
+		}
+		tagIDs[tag] = ids
+	}
+
+	return makeStorageTagExpr(e, tagIDs), nil
+}
+
+// findTagsByPath returns ids of the tags matching the path from the tag
+// expression; see resolveTagExpr.
+func findTagsByPath(tagsFlat []*tagDataFlatInternal, path string) []int {
+	absolute := strings.HasPrefix(path, "/")
+	names := strings.Split(strings.Trim(path, "/"), "/")
+
+	ids := []int{}
+
+Tags:
+	for _, tag := range tagsFlat {
+		// Skip the root tag
+		pathItems := tag.pathItems[1:]
+
+		if len(pathItems) < len(names) || (absolute && len(pathItems) != len(names)) {
+			continue
+		}
+
+		pathItems = pathItems[len(pathItems)-len(names):]
+		for i, name := range names {
+			if !containsString(pathItems[i], name) {
+				continue Tags
+			}
+		}
+
+		ids = append(ids, tag.id)
+	}
+
+	return ids
+}
+
+func containsString(items []string, s string) bool {
+	for _, item := range items {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func makeStorageTagExpr(e *tagexpr.Expr, tagIDs map[string][]int) *storage.TagExpr {
+	var op storage.TagExprOp
+
+	switch e.Op {
+	case tagexpr.OpTag:
+		ids := tagIDs[e.Tag]
+		if len(ids) == 1 {
+			return &storage.TagExpr{Op: storage.TagExprOpTag, TagID: ids[0]}
+		}
+
+		se := &storage.TagExpr{Op: storage.TagExprOpOr}
+		for _, id := range ids {
+			se.Args = append(se.Args, storage.TagExpr{Op: storage.TagExprOpTag, TagID: id})
+		}
+		return se
+
+	case tagexpr.OpAnd:
+		op = storage.TagExprOpAnd
+	case tagexpr.OpOr:
+		op = storage.TagExprOpOr
+	case tagexpr.OpNot:
+		op = storage.TagExprOpNot
+	}
+
+	se := &storage.TagExpr{Op: op}
+	for _, arg := range e.Args {
+		se.Args = append(se.Args, *makeStorageTagExpr(arg, tagIDs))
+	}
+
+	return se
+}
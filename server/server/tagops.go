@@ -0,0 +1,225 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package server
+
+import (
+	"database/sql"
+	"flag"
+	"strconv"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/dimonomid/interrors"
+	"github.com/juju/errors"
+)
+
+var (
+	tagUndoDepth = flag.Int(
+		"geekmarks.tag_undo_depth", 50,
+		"How many latest tag operations of each user are kept for undo; "+
+			"0 disables undo.",
+	)
+)
+
+const (
+	QSArgTagsUndoCnt = "n"
+)
+
+type userTagsUndoResp struct {
+	UndoneCnt int `json:"undoneCnt"`
+}
+
+// saveTagOperation records the tag operation of the user, so that it can be
+// undone later, and forgets the operations which are too old.
+func (gm *GMServer) saveTagOperation(
+	tx *sql.Tx, ownerID int, op *storage.TagOperationData,
+) error {
+	if *tagUndoDepth <= 0 {
+		return nil
+	}
+
+	op.OwnerID = ownerID
+
+	if _, err := gm.si.SaveTagOperation(tx, op); err != nil {
+		return errors.Trace(err)
+	}
+
+	if _, err := gm.si.PurgeTagOperations(tx, op.OwnerID, *tagUndoDepth); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// getTaggingsSnapshot returns all taggings of the taggables which are tagged
+// with the given tag (and thus might be affected if the tag is moved or
+// deleted), keyed by taggable id.
+func (gm *GMServer) getTaggingsSnapshot(
+	tx *sql.Tx, tagID int,
+) (map[int][]int, error) {
+	taggableIDs, err := gm.si.GetTaggedTaggableIDs(tx, []int{tagID}, nil, nil)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	taggings := map[int][]int{}
+	for _, taggableID := range taggableIDs {
+		tagIDs, err := gm.si.GetTaggings(tx, taggableID, storage.TaggingModeAll)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if tagIDs == nil {
+			tagIDs = []int{}
+		}
+		taggings[taggableID] = tagIDs
+	}
+
+	return taggings, nil
+}
+
+// userTagsUndoPost is a POST /tags_undo handler: it undoes the last n tag
+// operations of the user (1 by default), most recent first.
+func (gm *GMServer) userTagsUndoPost(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	n := 1
+	if nStr := gmr.FormValue(QSArgTagsUndoCnt); nStr != "" {
+		n, err = strconv.Atoi(nStr)
+		if err != nil || n <= 0 {
+			return nil, interrors.WrapInternalError(
+				err,
+				errors.Errorf("%q should be a positive number, got %q", QSArgTagsUndoCnt, nStr),
+			)
+		}
+	}
+
+	undoneCnt := 0
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		ops, err := gm.si.GetTagOperations(tx, gmr.SubjUser.ID, n)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		for i := range ops {
+			if err := gm.undoTagOperation(tx, &ops[i]); err != nil {
+				return errors.Annotatef(err, "undoing %s of tag %d", ops[i].Kind, ops[i].TagID)
+			}
+
+			if err := gm.si.DeleteTagOperation(tx, ops[i].ID); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		undoneCnt = len(ops)
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	// Invalidate tree cache for the user
+	userIDToTagsTree.DeleteCacheForUser(gmr.SubjUser.ID)
+
+	resp = userTagsUndoResp{
+		UndoneCnt: undoneCnt,
+	}
+	return resp, nil
+}
+
+func (gm *GMServer) undoTagOperation(tx *sql.Tx, op *storage.TagOperationData) error {
+	switch op.Kind {
+	case storage.TagOperationCreate:
+		_, err := gm.si.GetTag(tx, op.TagID, &storage.GetTagOpts{})
+		if err != nil {
+			if errors.Cause(err) == storage.ErrTagDoesNotExist {
+				// The tag is gone already, nothing to undo
+				return nil
+			}
+			return errors.Trace(err)
+		}
+
+		err = gm.si.DeleteTag(tx, op.TagID, storage.TaggableLeafPolicyKeep)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+	case storage.TagOperationUpdate:
+		cur, err := gm.si.GetTag(tx, op.TagID, &storage.GetTagOpts{})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		td := &storage.TagData{
+			ID:          op.TagID,
+			Names:       op.Tag.Names,
+			Description: op.Tag.Description,
+		}
+		if cur.ParentTagID != nil && op.Tag.ParentTagID != nil &&
+			*cur.ParentTagID != *op.Tag.ParentTagID {
+			td.ParentTagID = op.Tag.ParentTagID
+		}
+
+		// Taggings changed by the move are restored from the snapshot below, so
+		// the leaf policy only matters for the taggables tagged after the move.
+		err = gm.si.UpdateTag(tx, td, storage.TaggableLeafPolicyKeep)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+	case storage.TagOperationDelete:
+		if err := gm.si.RestoreTag(tx, op.Tag); err != nil {
+			return errors.Trace(err)
+		}
+
+	default:
+		return errors.Errorf("unknown tag operation kind %q", op.Kind)
+	}
+
+	for taggableID, tagIDs := range op.Taggings {
+		// Skip taggables which were deleted since then
+		exists, err := gm.taggableExists(tx, taggableID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !exists {
+			continue
+		}
+
+		err = gm.si.SetTaggings(tx, taggableID, tagIDs, storage.TaggingModeAll)
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	return nil
+}
+
+// taggableExists returns whether the taggable of any type (a bookmark or a
+// note) with the given id exists.
+func (gm *GMServer) taggableExists(tx *sql.Tx, taggableID int) (bool, error) {
+	tagsFetchOpts := &storage.TagsFetchOpts{
+		TagsFetchMode: storage.TagsFetchModeNone,
+	}
+
+	_, err := gm.si.GetBookmarkByID(tx, taggableID, tagsFetchOpts)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Cause(err) != storage.ErrBookmarkDoesNotExist {
+		return false, errors.Trace(err)
+	}
+
+	_, err = gm.si.GetNoteByID(tx, taggableID, tagsFetchOpts)
+	if err == nil {
+		return true, nil
+	}
+	if errors.Cause(err) != storage.ErrNoteDoesNotExist {
+		return false, errors.Trace(err)
+	}
+
+	return false, nil
+}
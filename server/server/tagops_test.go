@@ -0,0 +1,216 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests integration_tests
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+func TestTagsUndo(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestTagsUndo)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func perUserTestTagsUndo(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	tagIDs, err := makeTestTagsHierarchy(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkmIDs, err := makeTestBookmarks(be, u1.id, tagIDs)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	tagged3 := []int{
+		bkmIDs.bkm3ID, bkmIDs.bkm4ID, bkmIDs.bkm5ID, bkmIDs.bkm6ID,
+		bkmIDs.bkm2_5ID, bkmIDs.bkm4_5ID,
+	}
+	tagged7 := []int{bkmIDs.bkm7ID, bkmIDs.bkm8ID}
+
+	// Notes are affected by tag operations as well
+	noteID, err := addNote(be, u1.id, &noteData{Title: "note", TagIDs: []int{tagIDs.tag5ID}})
+	if err != nil {
+		return errors.Trace(err)
+	}
+	tag3QS := url.Values{"tag_id": {fmt.Sprint(tagIDs.tag3ID)}}
+
+	// Move tag5 under tag7, deleting new leafs: bookmarks tagged with tag5 are
+	// not tagged with tag3 anymore
+	err = updateTag(
+		be, "/tags/tag1/tag3/tag5", u1.id, nil, nil,
+		&tagIDs.tag7ID, cptr.String(QSArgNewLeafPolicyDel),
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := checkNotesGet(be, u1.id, tag3QS, []int{}); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Delete tag7 together with the moved tag5
+	if err := deleteTag(be, "/tags/tag7", u1.id, QSArgNewLeafPolicyKeep); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Rename tag2
+	err = updateTag(be, "/tags/tag2", u1.id, []string{"tag2_new"}, nil, nil, nil)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Another user can't undo
+	{
+		resp, err := be.DoReq(
+			"POST", fmt.Sprintf("/api/users/%d/tags_undo", u1.id), u2.token,
+			nil, false,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := expectErrorResp(resp, http.StatusForbidden, "forbidden"); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	// Invalid number of operations
+	{
+		resp, err := be.DoUserReq("POST", "/tags_undo?n=0", u1.id, nil, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := expectHTTPCode(resp, http.StatusBadRequest); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	// Undo the renaming and the deletion
+	if err := undoTags(be, u1.id, 2, 2); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := si.CheckIntegrity(); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Tag7 is back with the same id, together with tag5 and the taggings
+	_, err = checkBkmGet(
+		be, u1.id, &bkmGetArg{tagIDs: []int{tagIDs.tag7ID}}, []int{
+			bkmIDs.bkm7ID,
+			bkmIDs.bkm5ID,
+			bkmIDs.bkm6ID,
+			bkmIDs.bkm2_5ID,
+			bkmIDs.bkm4_5ID,
+			bkmIDs.bkm8ID,
+		},
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if _, err := be.DoUserReq("GET", "/tags/tag2?shape=single", u1.id, nil, true); err != nil {
+		return errors.Annotatef(err, "tag2 should be renamed back")
+	}
+
+	// Undo the move: all the taggings stripped by it are restored
+	if err := undoTags(be, u1.id, 1, 1); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := si.CheckIntegrity(); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := checkTagsTree(be, u1.id, getTestTagsHierarchy()); err != nil {
+		return errors.Trace(err)
+	}
+
+	if _, err := checkBkmGet(be, u1.id, &bkmGetArg{tagIDs: []int{tagIDs.tag3ID}}, tagged3); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := checkNotesGet(be, u1.id, tag3QS, []int{noteID}); err != nil {
+		return errors.Trace(err)
+	}
+
+	if _, err := checkBkmGet(be, u1.id, &bkmGetArg{tagIDs: []int{tagIDs.tag7ID}}, tagged7); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Undo the creation of tag8
+	if err := undoTags(be, u1.id, 1, 1); err != nil {
+		return errors.Trace(err)
+	}
+
+	if _, err := checkBkmGet(be, u1.id, &bkmGetArg{tagIDs: []int{tagIDs.tag7ID}}, tagged7); err != nil {
+		return errors.Trace(err)
+	}
+
+	resp, err := be.DoUserReq("GET", "/tags/tag7/tag8?shape=single", u1.id, nil, false)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if err := expectHTTPCode(resp, http.StatusBadRequest); err != nil {
+		return errors.Annotatef(err, "tag8 should be deleted")
+	}
+
+	return nil
+}
+
+func undoTags(be testBackend, userID, n, expectedUndoneCnt int) error {
+	resp, err := be.DoUserReq(
+		"POST", fmt.Sprintf("/tags_undo?n=%d", n), userID, nil, true,
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var v userTagsUndoResp
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return errors.Trace(err)
+	}
+
+	if v.UndoneCnt != expectedUndoneCnt {
+		return errors.Errorf(
+			"undone count: expected %d, got %d", expectedUndoneCnt, v.UndoneCnt,
+		)
+	}
+
+	return nil
+}
+
+func checkTagsTree(be testBackend, userID int, tdExpected *userTagData) error {
+	resp, err := be.DoUserReq("GET", "/tags", userID, nil, true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var tdGot userTagData
+	if err := json.NewDecoder(resp.Body).Decode(&tdGot); err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Trace(tagDataEqual(tdExpected, &tdGot, false))
+}
@@ -34,6 +34,8 @@ const (
 
 	QSArgTagsAllowNew = "allow_new"
 
+	QSArgTagsCounts = "counts"
+
 	QSArgNewLeafPolicy     = "new_leaf_policy"
 	QSArgNewLeafPolicyKeep = "keep"
 	QSArgNewLeafPolicyDel  = "del"
@@ -62,6 +64,8 @@ type userTagData struct {
 	Description string        `json:"description,omitempty"`
 	Names       []string      `json:"names"`
 	Subtags     []userTagData `json:"subtags,omitempty"`
+	// Only if QSArgTagsCounts was equal to "1"
+	BookmarksCnt *userTagBookmarksCnt `json:"bookmarksCnt,omitempty"`
 }
 
 type userTagDataFlat struct {
@@ -72,6 +76,17 @@ type userTagDataFlat struct {
 	// Only for new tags (i.e. when ID is -1): indicates how many tags the Path
 	// actually includes
 	NewTagsCnt int `json:"newTagsCnt,omitempty"`
+	// Only for existing tags, if QSArgTagsCounts was equal to "1"
+	BookmarksCnt *userTagBookmarksCnt `json:"bookmarksCnt,omitempty"`
+}
+
+// userTagBookmarksCnt contains numbers of bookmarks of the tag: Total
+// includes bookmarks of all the subtags, Direct only includes bookmarks
+// tagged with the tag itself and not with any of its subtags. For the root
+// tag, Direct is the number of untagged bookmarks.
+type userTagBookmarksCnt struct {
+	Direct int `json:"direct"`
+	Total  int `json:"total"`
 }
 
 type matchDetails struct {
@@ -207,30 +222,10 @@ func (gm *GMServer) getTagIDFromPath(
 	if parentTagID == 0 {
 		var err error
 		if createNonExisting && tagPath != "" && tagPath != "/" {
-			det, err := gm.getNewTagDetails(gmr, tx, tagPath)
+			parentTagID, _, err = gm.getOrCreateTagByPath(tx, ownerID, tagPath, nil)
 			if err != nil {
 				return 0, errors.Trace(err)
 			}
-
-			// Refuse to create tag if the given name needs to be cleaned up
-			// (even though the cleanup was successful)
-			if det.CleanPath != tagPath {
-				return 0, errors.Errorf("invalid tag tagPath %q (the valid one would be: %q)", tagPath, det.CleanPath)
-			}
-
-			curTagID := det.ParentTagID
-			for _, curName := range det.NonExistingNames {
-				var err error
-				curTagID, err = gm.si.CreateTag(tx, &storage.TagData{
-					OwnerID:     gmr.SubjUser.ID,
-					ParentTagID: cptr.Int(curTagID),
-					Names:       []string{curName},
-				})
-				if err != nil {
-					return 0, errors.Trace(err)
-				}
-			}
-			parentTagID = curTagID
 		} else {
 			parentTagID, err = gm.si.GetTagIDByPath(tx, ownerID, tagPath)
 			if err != nil {
@@ -242,6 +237,61 @@ func (gm *GMServer) getTagIDFromPath(
 	return parentTagID, nil
 }
 
+// getOrCreateTagByPath returns the id of the tag with the given path like
+// "/foo/bar"; all the non-existing tags along the path are created. The path
+// should be clean, i.e. contain valid tag names only.
+//
+// If createdTagIDs is not nil, the ids of the created tags are added to it;
+// when several paths are created by a single operation, the same map should
+// be given for all of them, so that the undo log gets only the creation of
+// the topmost tags, and isn't flooded by a single operation.
+func (gm *GMServer) getOrCreateTagByPath(
+	tx *sql.Tx, ownerID int, tagPath string, createdTagIDs map[int]bool,
+) (tagID int, created bool, err error) {
+	det, err := gm.getNewTagDetails(tx, ownerID, tagPath)
+	if err != nil {
+		return 0, false, errors.Trace(err)
+	}
+
+	// Refuse to create tag if the given name needs to be cleaned up
+	// (even though the cleanup was successful)
+	if det.CleanPath != tagPath {
+		return 0, false, errors.Errorf("invalid tag tagPath %q (the valid one would be: %q)", tagPath, det.CleanPath)
+	}
+
+	tagID = det.ParentTagID
+	parentCreated := createdTagIDs[tagID]
+	for _, name := range det.NonExistingNames {
+		tagID, err = gm.si.CreateTag(tx, &storage.TagData{
+			OwnerID:     ownerID,
+			ParentTagID: cptr.Int(tagID),
+			Names:       []string{name},
+		})
+		if err != nil {
+			return 0, false, errors.Trace(err)
+		}
+
+		// Undoing the creation of the topmost tag deletes the rest as well
+		if !parentCreated {
+			err = gm.saveTagOperation(tx, ownerID, &storage.TagOperationData{
+				Kind:  storage.TagOperationCreate,
+				TagID: tagID,
+			})
+			if err != nil {
+				return 0, false, errors.Trace(err)
+			}
+		}
+
+		if createdTagIDs != nil {
+			createdTagIDs[tagID] = true
+		}
+		parentCreated = true
+		created = true
+	}
+
+	return tagID, created, nil
+}
+
 // userTagsGet is a GET /tags and /tags/* handler
 func (gm *GMServer) userTagsGet(gmr *GMRequest) (resp interface{}, err error) {
 	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
@@ -250,6 +300,7 @@ func (gm *GMServer) userTagsGet(gmr *GMRequest) (resp interface{}, err error) {
 	}
 
 	allowNew := gmr.FormValue(QSArgTagsAllowNew) == "1"
+	withCounts := gmr.FormValue(QSArgTagsCounts) == "1"
 
 	// By default, use shape "tree"
 	shape := QSArgTagsShapeTree
@@ -305,7 +356,7 @@ func (gm *GMServer) userTagsGet(gmr *GMRequest) (resp interface{}, err error) {
 			"No tree data cache for user %d, path=%q, withSubtags=%v, creating",
 			gmr.SubjUser.ID, tagPath, withSubtags,
 		)
-		err = gm.si.Tx(func(tx *sql.Tx) error {
+		err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 			var parentTagID int
 			var err error
 
@@ -336,11 +387,29 @@ func (gm *GMServer) userTagsGet(gmr *GMRequest) (resp interface{}, err error) {
 		)
 	}
 
+	// Bookmark counts change much more often than tags, so they are never
+	// cached
+	var counts map[int]storage.TagBookmarkCounts
+	if withCounts {
+		err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+			var err error
+			counts, err = gm.si.GetTagBookmarkCounts(tx, gmr.SubjUser.ID)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
 	// Convert internal tags tree into the requested shape
 	switch shape {
 
 	case QSArgTagsShapeTree, QSArgTagsShapeSingle:
-		resp = gm.createUserTagData(tagData)
+		resp = gm.createUserTagData(tagData, counts)
 
 	case QSArgTagsShapeFlat:
 		tagsFlat := gm.createTagDataFlatInternal(tagData, nil, nil)
@@ -395,9 +464,10 @@ func (gm *GMServer) userTagsGet(gmr *GMRequest) (resp interface{}, err error) {
 				userTagsFlat = append(userTagsFlat, *newTag)
 			}
 			userTagsFlat = append(userTagsFlat, userTagDataFlat{
-				Path:        v.Path(),
-				ID:          v.id,
-				Description: v.description,
+				Path:         v.Path(),
+				ID:           v.id,
+				Description:  v.description,
+				BookmarksCnt: createUserTagBookmarksCnt(counts, v.id),
 			})
 		}
 
@@ -429,10 +499,10 @@ type newTagDetails struct {
 }
 
 // getNewTagDetails takes a string pattern and returns details of the matching
-// existing tag, and names of the non-existing tags which could be created
-// (see newTagDetails)
+// existing tag of the user, and names of the non-existing tags which could be
+// created (see newTagDetails)
 func (gm *GMServer) getNewTagDetails(
-	gmr *GMRequest, tx *sql.Tx, pattern string,
+	tx *sql.Tx, ownerID int, pattern string,
 ) (*newTagDetails, error) {
 	// Sanitize input pattern
 	n := strings.Split(pattern, "/")
@@ -463,7 +533,7 @@ func (gm *GMServer) getNewTagDetails(
 		// Try to get ID of the current tag
 		parentTagID, err = gm.si.GetTagIDByPath(
 			tx,
-			gmr.SubjUser.ID,
+			ownerID,
 			strings.Join(names[:len(names)-i], "/"),
 		)
 		if err != nil {
@@ -483,7 +553,7 @@ func (gm *GMServer) getNewTagDetails(
 	// parentTagID: let's get root tag ID then.
 	if parentTagID == 0 {
 		var err error
-		parentTagID, err = gm.si.GetRootTagID(tx, gmr.SubjUser.ID)
+		parentTagID, err = gm.si.GetRootTagID(tx, ownerID)
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
@@ -508,9 +578,9 @@ func (gm *GMServer) getNewTagSuggestion(
 ) (*userTagDataFlat, error) {
 	var newTagDetails *newTagDetails
 
-	err := gm.si.Tx(func(tx *sql.Tx) error {
+	err := gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 		var err error
-		newTagDetails, err = gm.getNewTagDetails(gmr, tx, pattern)
+		newTagDetails, err = gm.getNewTagDetails(tx, gmr.SubjUser.ID, pattern)
 		if err != nil {
 			return errors.Trace(err)
 		}
@@ -539,24 +609,45 @@ func (gm *GMServer) getNewTagSuggestion(
 	}, nil
 }
 
-func (gm *GMServer) createUserTagData(in *storage.TagData) *userTagData {
+// createUserTagData converts the tags tree into the response data; counts
+// might be nil, in which case bookmark counts are omitted.
+func (gm *GMServer) createUserTagData(
+	in *storage.TagData, counts map[int]storage.TagBookmarkCounts,
+) *userTagData {
 	if in == nil {
 		return nil
 	}
 
 	res := userTagData{
-		ID:          in.ID,
-		Description: *in.Description,
-		Names:       in.Names,
+		ID:           in.ID,
+		Description:  *in.Description,
+		Names:        in.Names,
+		BookmarksCnt: createUserTagBookmarksCnt(counts, in.ID),
 	}
 
 	for _, td := range in.Subtags {
-		res.Subtags = append(res.Subtags, *gm.createUserTagData(&td))
+		res.Subtags = append(res.Subtags, *gm.createUserTagData(&td, counts))
 	}
 
 	return &res
 }
 
+// createUserTagBookmarksCnt returns bookmark counts of the tag, or nil if
+// counts is nil (i.e. counts weren't requested).
+func createUserTagBookmarksCnt(
+	counts map[int]storage.TagBookmarkCounts, tagID int,
+) *userTagBookmarksCnt {
+	if counts == nil {
+		return nil
+	}
+
+	cnt := counts[tagID]
+	return &userTagBookmarksCnt{
+		Direct: cnt.Direct,
+		Total:  cnt.Total,
+	}
+}
+
 func (gm *GMServer) createTagDataFlatInternal(
 	in *storage.TagData,
 	result []*tagDataFlatInternal,
@@ -607,7 +698,7 @@ func (gm *GMServer) userTagsPost(gmr *GMRequest) (resp interface{}, err error) {
 
 	tagID := 0
 
-	err = gm.si.Tx(func(tx *sql.Tx) error {
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 		parentTagID, err := gm.getTagIDFromPath(
 			gmr, tx, gmr.SubjUser.ID, args.CreateIntermediary,
 		)
@@ -625,6 +716,14 @@ func (gm *GMServer) userTagsPost(gmr *GMRequest) (resp interface{}, err error) {
 			return errors.Trace(err)
 		}
 
+		err = gm.saveTagOperation(tx, gmr.SubjUser.ID, &storage.TagOperationData{
+			Kind:  storage.TagOperationCreate,
+			TagID: tagID,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
 		return nil
 	})
 	if err != nil {
@@ -658,7 +757,7 @@ func (gm *GMServer) userTagPut(gmr *GMRequest) (resp interface{}, err error) {
 		)
 	}
 
-	err = gm.si.Tx(func(tx *sql.Tx) error {
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 		tagID, err := gm.getTagIDFromPath(
 			gmr, tx, gmr.SubjUser.ID, false,
 		)
@@ -696,6 +795,23 @@ func (gm *GMServer) userTagPut(gmr *GMRequest) (resp interface{}, err error) {
 			}
 		}
 
+		// Remember the current state of the tag and, if it's going to be moved,
+		// all the taggings which might be changed, so that it can be undone
+		op := &storage.TagOperationData{
+			Kind:  storage.TagOperationUpdate,
+			TagID: tagID,
+		}
+		op.Tag, err = gm.si.GetTag(tx, tagID, &storage.GetTagOpts{GetNames: true})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if args.ParentTagID != nil {
+			op.Taggings, err = gm.getTaggingsSnapshot(tx, tagID)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+
 		err = gm.si.UpdateTag(tx, &storage.TagData{
 			ID:          tagID,
 			Names:       args.Names,
@@ -706,6 +822,10 @@ func (gm *GMServer) userTagPut(gmr *GMRequest) (resp interface{}, err error) {
 			return errors.Trace(err)
 		}
 
+		if err := gm.saveTagOperation(tx, gmr.SubjUser.ID, op); err != nil {
+			return errors.Trace(err)
+		}
+
 		return nil
 	})
 	if err != nil {
@@ -745,7 +865,7 @@ func (gm *GMServer) userTagDelete(gmr *GMRequest) (resp interface{}, err error)
 		)
 	}
 
-	err = gm.si.Tx(func(tx *sql.Tx) error {
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 		tagID, err := gm.getTagIDFromPath(
 			gmr, tx, gmr.SubjUser.ID, false,
 		)
@@ -753,11 +873,33 @@ func (gm *GMServer) userTagDelete(gmr *GMRequest) (resp interface{}, err error)
 			return errors.Trace(err)
 		}
 
+		// Remember the whole subtree and all the affected taggings, so that the
+		// deletion can be undone
+		op := &storage.TagOperationData{
+			Kind:  storage.TagOperationDelete,
+			TagID: tagID,
+		}
+		op.Tag, err = gm.si.GetTag(tx, tagID, &storage.GetTagOpts{
+			GetNames:   true,
+			GetSubtags: true,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		op.Taggings, err = gm.getTaggingsSnapshot(tx, tagID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
 		err = gm.si.DeleteTag(tx, tagID, leafPolicy)
 		if err != nil {
 			return errors.Trace(err)
 		}
 
+		if err := gm.saveTagOperation(tx, gmr.SubjUser.ID, op); err != nil {
+			return errors.Trace(err)
+		}
+
 		return nil
 	})
 	if err != nil {
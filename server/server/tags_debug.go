@@ -30,11 +30,13 @@ func (gm *GMServer) addBookmark(
 	}
 
 	if gmr.FormValue(skipBkm) == "" {
+		url := fmt.Sprintf("https://google.com?q=%s", title)
 		bkmID, err := gm.si.CreateBookmark(tx, &storage.BookmarkData{
-			OwnerID: gmr.SubjUser.ID,
-			URL:     fmt.Sprintf("https://google.com?q=%s", title),
-			Title:   title,
-			Comment: comment,
+			OwnerID:      gmr.SubjUser.ID,
+			URL:          url,
+			CanonicalURL: canonicalizeURL(url),
+			Title:        title,
+			Comment:      comment,
 		})
 		if err != nil {
 			return 0, errors.Trace(err)
@@ -58,7 +60,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 	var tagIDProgC, tagIDUdev, tagIDKernel, tagIDProgGo, tagIDBike, tagIDKayak int
 
 	{
-		err = gm.si.Tx(func(tx *sql.Tx) error {
+		err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 			parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "")
 			if err != nil {
 				return errors.Trace(err)
@@ -80,7 +82,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 		}
 
 		{
-			err = gm.si.Tx(func(tx *sql.Tx) error {
+			err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 				parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "computer")
 				if err != nil {
 					return errors.Trace(err)
@@ -102,7 +104,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 			}
 
 			{
-				err = gm.si.Tx(func(tx *sql.Tx) error {
+				err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 					parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "computer/programming")
 					if err != nil {
 						return errors.Trace(err)
@@ -126,7 +128,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 			}
 
 			{
-				err = gm.si.Tx(func(tx *sql.Tx) error {
+				err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 					parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "computer/programming")
 					if err != nil {
 						return errors.Trace(err)
@@ -149,7 +151,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 			}
 
 			{
-				err = gm.si.Tx(func(tx *sql.Tx) error {
+				err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 					parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "computer/programming")
 					if err != nil {
 						return errors.Trace(err)
@@ -172,7 +174,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 			}
 
 			{
-				err = gm.si.Tx(func(tx *sql.Tx) error {
+				err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 					parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "computer/programming")
 					if err != nil {
 						return errors.Trace(err)
@@ -195,7 +197,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 			}
 
 			{
-				err = gm.si.Tx(func(tx *sql.Tx) error {
+				err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 					parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "computer/programming")
 					if err != nil {
 						return errors.Trace(err)
@@ -219,7 +221,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 		}
 
 		{
-			err = gm.si.Tx(func(tx *sql.Tx) error {
+			err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 				parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "computer")
 				if err != nil {
 					return errors.Trace(err)
@@ -241,7 +243,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 			}
 
 			{
-				err = gm.si.Tx(func(tx *sql.Tx) error {
+				err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 					parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "computer/linux")
 					if err != nil {
 						return errors.Trace(err)
@@ -264,7 +266,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 			}
 
 			{
-				err = gm.si.Tx(func(tx *sql.Tx) error {
+				err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 					parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "computer/linux")
 					if err != nil {
 						return errors.Trace(err)
@@ -287,7 +289,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 			}
 
 			{
-				err = gm.si.Tx(func(tx *sql.Tx) error {
+				err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 					parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "computer/linux")
 					if err != nil {
 						return errors.Trace(err)
@@ -313,7 +315,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 	}
 
 	{
-		err = gm.si.Tx(func(tx *sql.Tx) error {
+		err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 			parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "")
 			if err != nil {
 				return errors.Trace(err)
@@ -335,7 +337,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 		}
 
 		{
-			err = gm.si.Tx(func(tx *sql.Tx) error {
+			err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 				parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "life")
 				if err != nil {
 					return errors.Trace(err)
@@ -357,7 +359,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 			}
 
 			{
-				err = gm.si.Tx(func(tx *sql.Tx) error {
+				err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 					parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "life/sports")
 					if err != nil {
 						return errors.Trace(err)
@@ -380,7 +382,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 			}
 
 			{
-				err = gm.si.Tx(func(tx *sql.Tx) error {
+				err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 					parentTagID, err := gm.si.GetTagIDByPath(tx, gmr.SubjUser.ID, "life/sports")
 					if err != nil {
 						return errors.Trace(err)
@@ -405,7 +407,7 @@ func (gm *GMServer) addTestTagsTree(gmr *GMRequest) (resp interface{}, err error
 
 	}
 
-	err = gm.si.Tx(func(tx *sql.Tx) error {
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
 		var err error
 		_, err = gm.addBookmark(gmr, tx, "Something about C", "", []int{tagIDProgC})
 		if err != nil {
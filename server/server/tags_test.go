@@ -199,7 +199,7 @@ func tagDataEqual(tdExpected, tdGot *userTagData, checkDescrs bool) error {
 
 	if len(tdExpected.Subtags) != len(tdGot.Subtags) {
 		return errors.Errorf(
-			"expected subtags len %d, got %d (expected: %q, got: %q)",
+			"expected subtags len %d, got %d (expected: %+v, got: %+v)",
 			len(tdExpected.Subtags), len(tdGot.Subtags),
 			tdExpected.Subtags, tdGot.Subtags,
 		)
@@ -1065,6 +1065,170 @@ func perUserTestTagsByPattern(
 
 // }}}
 
+// Test bookmark counts of tags {{{
+func TestTagsBookmarkCounts(t *testing.T) {
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestTagsBookmarkCounts)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+func perUserTestTagsBookmarkCounts(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	tagIDs, err := makeTestTagsHierarchy(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	ids, err := makeTestBookmarks(be, u1.id, tagIDs)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Without the counts requested, they should be omitted
+	counts, rootTagID, err := getTagsTreeCounts(be, u1.id, "", false)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(counts) != 0 {
+		return errors.Errorf("counts should be omitted, got %v", counts)
+	}
+
+	expected := map[int]userTagBookmarksCnt{
+		rootTagID:     {Direct: 1, Total: 11},
+		tagIDs.tag1ID: {Direct: 1, Total: 7},
+		tagIDs.tag2ID: {Direct: 2, Total: 2},
+		tagIDs.tag3ID: {Direct: 1, Total: 6},
+		tagIDs.tag4ID: {Direct: 2, Total: 2},
+		tagIDs.tag5ID: {Direct: 3, Total: 4},
+		tagIDs.tag6ID: {Direct: 1, Total: 1},
+		tagIDs.tag7ID: {Direct: 1, Total: 2},
+		tagIDs.tag8ID: {Direct: 1, Total: 1},
+	}
+
+	checkCounts := func(expected map[int]userTagBookmarksCnt) error {
+		counts, _, err := getTagsTreeCounts(be, u1.id, "", true)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !reflect.DeepEqual(counts, expected) {
+			return errors.Errorf("tree: expected counts %v, got %v", expected, counts)
+		}
+
+		counts, err = getTagsFlatCounts(be, u1.id)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !reflect.DeepEqual(counts, expected) {
+			return errors.Errorf("flat: expected counts %v, got %v", expected, counts)
+		}
+
+		return nil
+	}
+
+	if err := checkCounts(expected); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Counts should be updated once bookmarks change
+	if err := deleteBookmark(be, u1.id, ids.bkm4_5ID); err != nil {
+		return errors.Trace(err)
+	}
+
+	expected[rootTagID] = userTagBookmarksCnt{Direct: 1, Total: 10}
+	expected[tagIDs.tag1ID] = userTagBookmarksCnt{Direct: 1, Total: 6}
+	expected[tagIDs.tag3ID] = userTagBookmarksCnt{Direct: 1, Total: 5}
+	expected[tagIDs.tag4ID] = userTagBookmarksCnt{Direct: 1, Total: 1}
+	expected[tagIDs.tag5ID] = userTagBookmarksCnt{Direct: 2, Total: 3}
+
+	if err := checkCounts(expected); err != nil {
+		return errors.Trace(err)
+	}
+
+	// Subtree only
+	counts, _, err = getTagsTreeCounts(be, u1.id, "/tag7", true)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	expected = map[int]userTagBookmarksCnt{
+		tagIDs.tag7ID: {Direct: 1, Total: 2},
+		tagIDs.tag8ID: {Direct: 1, Total: 1},
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		return errors.Errorf("subtree: expected counts %v, got %v", expected, counts)
+	}
+
+	return nil
+}
+
+// getTagsTreeCounts gets the tags tree under the given path, and returns
+// bookmark counts of all the tags which have them, and the ID of the topmost
+// tag.
+func getTagsTreeCounts(
+	be testBackend, userID int, path string, withCounts bool,
+) (counts map[int]userTagBookmarksCnt, topTagID int, err error) {
+	qs := ""
+	if withCounts {
+		qs = "?counts=1"
+	}
+
+	resp, err := be.DoUserReq("GET", "/tags"+path+qs, userID, nil, true)
+	if err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+
+	var td userTagData
+	if err := json.NewDecoder(resp.Body).Decode(&td); err != nil {
+		return nil, 0, errors.Trace(err)
+	}
+
+	counts = map[int]userTagBookmarksCnt{}
+	var walk func(td *userTagData)
+	walk = func(td *userTagData) {
+		if td.BookmarksCnt != nil {
+			counts[td.ID] = *td.BookmarksCnt
+		}
+		for i := range td.Subtags {
+			walk(&td.Subtags[i])
+		}
+	}
+	walk(&td)
+
+	return counts, td.ID, nil
+}
+
+func getTagsFlatCounts(
+	be testBackend, userID int,
+) (counts map[int]userTagBookmarksCnt, err error) {
+	resp, err := be.DoUserReq("GET", "/tags?shape=flat&counts=1", userID, nil, true)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	tags := []userTagDataFlat{}
+	if err := json.NewDecoder(resp.Body).Decode(&tags); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	counts = map[int]userTagBookmarksCnt{}
+	for _, td := range tags {
+		if td.BookmarksCnt != nil {
+			counts[td.ID] = *td.BookmarksCnt
+		}
+	}
+
+	return counts, nil
+}
+
+// }}}
+
 // Test tags moving {{{
 func TestTagsMoving(t *testing.T) {
 	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
@@ -0,0 +1,358 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package server
+
+import (
+	"database/sql"
+	"flag"
+	"strconv"
+	"time"
+
+	"goji.io/pat"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/dimonomid/interrors"
+	"github.com/golang/glog"
+	"github.com/juju/errors"
+)
+
+var (
+	trashRetention = flag.Duration(
+		"geekmarks.trash_retention", 30*24*time.Hour,
+		"How long deleted bookmarks are kept in the trash before they are "+
+			"purged; 0 means forever.",
+	)
+	trashPurgeInterval = flag.Duration(
+		"geekmarks.trash_purge_interval", time.Hour,
+		"How often the expired bookmarks are purged from the trash.",
+	)
+)
+
+const (
+	TrashedBookmarkID = "trashid"
+)
+
+type userTrashedBookmarkData struct {
+	ID         int      `json:"id"`
+	BookmarkID int      `json:"bookmarkID"`
+	URL        string   `json:"url"`
+	Title      string   `json:"title,omitempty"`
+	Comment    string   `json:"comment,omitempty"`
+	UpdatedAt  uint64   `json:"updatedAt"`
+	DeletedAt  uint64   `json:"deletedAt"`
+	TagPaths   []string `json:"tagPaths"`
+}
+
+type userTrashRestoreResp struct {
+	BookmarkID int `json:"bookmarkID"`
+}
+
+type userTrashDeleteResp struct {
+	PurgedCnt int `json:"purgedCnt"`
+}
+
+// trashDeletedBefore returns the time such that all bookmarks deleted before
+// it should be purged from the trash, or zero time if bookmarks should be
+// kept forever.
+func trashDeletedBefore() time.Time {
+	if *trashRetention <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(-*trashRetention)
+}
+
+// PurgeExpiredTrash deletes bookmarks which have been in the trash for longer
+// than the retention period (see the -geekmarks.trash_retention flag), for
+// all users.
+func (gm *GMServer) PurgeExpiredTrash() (purgedCnt int, err error) {
+	deletedBefore := trashDeletedBefore()
+	if deletedBefore.IsZero() {
+		return 0, nil
+	}
+
+	err = gm.si.Tx(func(tx *sql.Tx) error {
+		var err error
+		purgedCnt, err = gm.si.PurgeTrash(tx, nil, deletedBefore)
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return purgedCnt, nil
+}
+
+// RunTrashPurger calls PurgeExpiredTrash periodically (see the
+// -geekmarks.trash_purge_interval flag), until stop is closed.
+func (gm *GMServer) RunTrashPurger(stop <-chan struct{}) {
+	if *trashPurgeInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(*trashPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		purgedCnt, err := gm.PurgeExpiredTrash()
+		if err != nil {
+			glog.Errorf("Failed to purge trash: %s", interrors.ErrorStack(err))
+		} else if purgedCnt > 0 {
+			glog.Infof("Purged %d bookmarks from the trash", purgedCnt)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// userTrashGet is a GET /trash handler
+func (gm *GMServer) userTrashGet(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var tbkms []storage.TrashedBookmarkData
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		// Purge expired bookmarks first, so that they don't show up even if the
+		// purger hasn't got to them yet
+		if deletedBefore := trashDeletedBefore(); !deletedBefore.IsZero() {
+			_, err := gm.si.PurgeTrash(tx, cptr.Int(gmr.SubjUser.ID), deletedBefore)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		var err error
+		tbkms, err = gm.si.GetTrashedBookmarks(tx, gmr.SubjUser.ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	tbkmsUser := []userTrashedBookmarkData{}
+	for _, tbkm := range tbkms {
+		tbkmsUser = append(tbkmsUser, userTrashedBookmarkData{
+			ID:         tbkm.ID,
+			BookmarkID: tbkm.BookmarkID,
+			URL:        tbkm.URL,
+			Title:      tbkm.Title,
+			Comment:    tbkm.Comment,
+			UpdatedAt:  tbkm.UpdatedAt,
+			DeletedAt:  tbkm.DeletedAt,
+			TagPaths:   tbkm.TagPaths,
+		})
+	}
+
+	return tbkmsUser, nil
+}
+
+// userTrashRestorePost is a POST /trash/:trashid/restore handler: it creates
+// a new bookmark from the trashed one, with the same creation and update
+// times, and removes the latter from the trash. Tags which don't exist
+// anymore are created again.
+func (gm *GMServer) userTrashRestorePost(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	trashedBkmID, err := getTrashedBookmarkIDFromQueryString(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	bkmID := 0
+	tagsCreated := false
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		tbkm, err := gm.getUserTrashedBookmark(gmr, tx, trashedBkmID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		tagIDs := []int{}
+		createdTagIDs := map[int]bool{}
+		for _, tagPath := range tbkm.TagPaths {
+			tagID, created, err := gm.getOrCreateTagByPath(
+				tx, gmr.SubjUser.ID, tagPath, createdTagIDs,
+			)
+			if err != nil {
+				return errors.Annotatef(err, "restoring tag %q", tagPath)
+			}
+
+			tagIDs = append(tagIDs, tagID)
+			tagsCreated = tagsCreated || created
+		}
+
+		canonicalURL := canonicalizeURL(tbkm.URL)
+		err = gm.checkDuplicateBookmark(tx, gmr.SubjUser.ID, canonicalURL, 0)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkmID, err = gm.si.CreateBookmark(tx, &storage.BookmarkData{
+			OwnerID:      gmr.SubjUser.ID,
+			URL:          tbkm.URL,
+			CanonicalURL: canonicalURL,
+			Title:        tbkm.Title,
+			Comment:      tbkm.Comment,
+			CreatedAt:    tbkm.CreatedAt,
+			UpdatedAt:    tbkm.UpdatedAt,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = gm.si.SetTaggings(tx, bkmID, tagIDs, storage.TaggingModeLeafs)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Setting taggings bumps the update time, so set the original one again
+		err = gm.si.SetTaggableUpdatedAt(tx, bkmID, tbkm.UpdatedAt)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if _, err := gm.si.SaveBookmarkRevision(tx, bkmID); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := gm.requestPageMeta(tx, bkmID); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := gm.si.DeleteTrashedBookmark(tx, trashedBkmID); err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	gm.wakePageMetaFetcher()
+
+	if tagsCreated {
+		// Invalidate tree cache for the user
+		userIDToTagsTree.DeleteCacheForUser(gmr.SubjUser.ID)
+	}
+
+	resp = userTrashRestoreResp{
+		BookmarkID: bkmID,
+	}
+	return resp, nil
+}
+
+// userTrashDelete is a DELETE /trash handler: it empties the trash.
+func (gm *GMServer) userTrashDelete(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	purgedCnt := 0
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		tbkms, err := gm.si.GetTrashedBookmarks(tx, gmr.SubjUser.ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		for _, tbkm := range tbkms {
+			if err := gm.si.DeleteTrashedBookmark(tx, tbkm.ID); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		purgedCnt = len(tbkms)
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resp = userTrashDeleteResp{
+		PurgedCnt: purgedCnt,
+	}
+	return resp, nil
+}
+
+// userTrashedBookmarkDelete is a DELETE /trash/:trashid handler: it purges
+// a single bookmark from the trash.
+func (gm *GMServer) userTrashedBookmarkDelete(gmr *GMRequest) (resp interface{}, err error) {
+	err = gm.authorizeOperation(gmr.Caller, &authzArgs{OwnerID: gmr.SubjUser.ID})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	trashedBkmID, err := getTrashedBookmarkIDFromQueryString(gmr)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	err = gm.si.TxCtx(gmr.Context(), func(tx *sql.Tx) error {
+		if _, err := gm.getUserTrashedBookmark(gmr, tx, trashedBkmID); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := gm.si.DeleteTrashedBookmark(tx, trashedBkmID); err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	resp = userTrashDeleteResp{
+		PurgedCnt: 1,
+	}
+	return resp, nil
+}
+
+// getUserTrashedBookmark returns the trashed bookmark with the given id, if
+// only it belongs to the subject user.
+func (gm *GMServer) getUserTrashedBookmark(
+	gmr *GMRequest, tx *sql.Tx, trashedBkmID int,
+) (*storage.TrashedBookmarkData, error) {
+	tbkm, err := gm.si.GetTrashedBookmark(tx, trashedBkmID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if tbkm.OwnerID != gmr.SubjUser.ID {
+		// Pretend the bookmark doesn't exist, as if the trash was per-user
+		return nil, errors.Annotatef(
+			storage.ErrTrashedBookmarkDoesNotExist, "id %d", trashedBkmID,
+		)
+	}
+
+	return tbkm, nil
+}
+
+func getTrashedBookmarkIDFromQueryString(gmr *GMRequest) (int, error) {
+	idStr := pat.Param(gmr.HttpReq, TrashedBookmarkID)
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return 0, interrors.WrapInternalError(
+			err,
+			errors.Errorf("wrong trashed bookmark id %q", idStr),
+		)
+	}
+	return id, nil
+}
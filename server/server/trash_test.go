@@ -0,0 +1,274 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests integration_tests
+
+package server
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+func TestTrash(t *testing.T) {
+	defer func(enabled bool) { *pageMetaEnabled = enabled }(*pageMetaEnabled)
+	*pageMetaEnabled = true
+
+	runWithRealDB(t, func(si storage.Storage, be testBackend) error {
+		var err error
+
+		err = runPerUserTest(si, be, "test1", "1@1.1", "test2", "2@1.1", perUserTestTrash)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
+
+type trashedBkmData struct {
+	ID         int      `json:"id"`
+	BookmarkID int      `json:"bookmarkID"`
+	URL        string   `json:"url"`
+	Title      string   `json:"title,omitempty"`
+	Comment    string   `json:"comment,omitempty"`
+	UpdatedAt  uint64   `json:"updatedAt"`
+	DeletedAt  uint64   `json:"deletedAt"`
+	TagPaths   []string `json:"tagPaths"`
+}
+
+func perUserTestTrash(
+	si storage.Storage, be testBackend, u1, u2 *perUserData,
+) error {
+	tagIDs, err := makeTestTagsHierarchy(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// The first bookmark is created with old timestamps, which should survive
+	// the trash
+	var bkm1ID int
+	err = si.Tx(func(tx *sql.Tx) error {
+		var err error
+		bkm1ID, err = si.CreateBookmark(tx, &storage.BookmarkData{
+			OwnerID:   u1.id,
+			URL:       "url_1",
+			Title:     "title_1",
+			Comment:   "comment_1",
+			CreatedAt: 1262304000,
+			UpdatedAt: 1262390400,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = si.SetTaggings(
+			tx, bkm1ID, []int{tagIDs.tag4ID, tagIDs.tag8ID}, storage.TaggingModeLeafs,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return errors.Trace(si.SetTaggableUpdatedAt(tx, bkm1ID, 1262390400))
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkm2ID, err := addBookmark(be, u1.id, &bkmData{
+		URL:    "url_2",
+		TagIDs: []int{tagIDs.tag2ID},
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := deleteBookmark(be, u1.id, bkm1ID); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := deleteBookmark(be, u1.id, bkm2ID); err != nil {
+		return errors.Trace(err)
+	}
+
+	if _, err := checkBkmGet(be, u1.id, &bkmGetArg{tagIDs: []int{}}, []int{}); err != nil {
+		return errors.Trace(err)
+	}
+
+	tbkms, err := getTrash(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(tbkms) != 2 {
+		return errors.Errorf("trash should contain 2 bookmarks, got %v", tbkms)
+	}
+
+	// Most recently deleted bookmark goes first
+	tbkm1 := tbkms[1]
+	if tbkm1.BookmarkID != bkm1ID || tbkm1.URL != "url_1" ||
+		tbkm1.Title != "title_1" || tbkm1.Comment != "comment_1" ||
+		tbkm1.UpdatedAt != 1262390400 || tbkm1.DeletedAt == 0 {
+		return errors.Errorf("unexpected trashed bookmark: %+v", tbkm1)
+	}
+
+	expectedPaths := []string{"/tag1/tag3_alias/tag4", "/tag7/tag8"}
+	if !reflect.DeepEqual(tbkm1.TagPaths, expectedPaths) {
+		return errors.Errorf("tag paths: expected %v, got %v", expectedPaths, tbkm1.TagPaths)
+	}
+
+	// Trash of another user is empty
+	tbkms2, err := getTrash(be, u2.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(tbkms2) != 0 {
+		return errors.Errorf("trash of user2 should be empty, got %v", tbkms2)
+	}
+
+	// Another user can't restore or purge the bookmark
+	for _, method := range []string{"POST", "DELETE"} {
+		rawURL := fmt.Sprintf("/trash/%d", tbkm1.ID)
+		if method == "POST" {
+			rawURL += "/restore"
+		}
+		resp, err := be.DoUserReq(method, rawURL, u2.id, nil, false)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := expectHTTPCode(resp, 400); err != nil {
+			return errors.Annotatef(err, "%s %s", method, rawURL)
+		}
+	}
+
+	// Delete tag8, so that it has to be created again on restore
+	if err := deleteTag(be, "/tags/tag7/tag8", u1.id, QSArgNewLeafPolicyKeep); err != nil {
+		return errors.Trace(err)
+	}
+
+	newBkm1ID, err := restoreTrashedBookmark(be, u1.id, tbkm1.ID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	bkms, err := checkBkmGet(be, u1.id, &bkmGetArg{tagIDs: []int{tagIDs.tag4ID}}, []int{newBkm1ID})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if bkms[0].CreatedAt != 1262304000 || bkms[0].UpdatedAt != 1262390400 {
+		return errors.Errorf(
+			"restored bookmark should keep its timestamps, got created %d, updated %d",
+			bkms[0].CreatedAt, bkms[0].UpdatedAt,
+		)
+	}
+
+	// The restored bookmark gets a revision, and its page metadata is fetched
+	revs, err := getBookmarkHistory(be, u1.id, newBkm1ID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(revs) != 1 {
+		return errors.Errorf("restored bookmark should have 1 revision, got %+v", revs)
+	}
+
+	gm, err := New(si)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	gm.SetFetcher(testFetcher{})
+
+	if _, err := gm.FetchPageMeta(); err != nil {
+		return errors.Trace(err)
+	}
+
+	err = checkBkmPageMeta(
+		be, u1.id, newBkm1ID, "title_1", &bkmPageMetaData{Error: "no such host"},
+	)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	tagNames := []string{}
+	for _, tag := range bkms[0].Tags {
+		names := []string{}
+		for _, item := range tag.Items {
+			names = append(names, item.Name)
+		}
+		tagNames = append(tagNames, "/"+strings.Join(names, "/"))
+	}
+	if len(tagNames) != 2 || (tagNames[0] != "/tag7/tag8" && tagNames[1] != "/tag7/tag8") {
+		return errors.Errorf("restored bookmark should be tagged with /tag7/tag8, got %v", tagNames)
+	}
+
+	tbkms, err = getTrash(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(tbkms) != 1 || tbkms[0].BookmarkID != bkm2ID {
+		return errors.Errorf("trash should contain bookmark %d only, got %v", bkm2ID, tbkms)
+	}
+
+	// Empty the trash
+	if _, err := be.DoUserReq("DELETE", "/trash", u1.id, nil, true); err != nil {
+		return errors.Trace(err)
+	}
+
+	tbkms, err = getTrash(be, u1.id)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(tbkms) != 0 {
+		return errors.Errorf("trash should be empty, got %v", tbkms)
+	}
+
+	return nil
+}
+
+func getTrash(be testBackend, userID int) ([]trashedBkmData, error) {
+	resp, err := be.DoUserReq("GET", "/trash", userID, nil, true)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	v := []trashedBkmData{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil, errors.Annotatef(err, "body: %q", body)
+	}
+
+	return v, nil
+}
+
+func restoreTrashedBookmark(be testBackend, userID, trashedBkmID int) (int, error) {
+	resp, err := be.DoUserReq(
+		"POST", fmt.Sprintf("/trash/%d/restore", trashedBkmID), userID, nil, true,
+	)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	v := map[string]int{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return 0, errors.Annotatef(err, "body: %q", body)
+	}
+
+	return v["bookmarkID"], nil
+}
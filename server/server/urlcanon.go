@@ -0,0 +1,146 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package server
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"strings"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/urlcanon"
+	"github.com/juju/errors"
+)
+
+var (
+	urlCanonIgnoreScheme = flag.Bool(
+		"geekmarks.url_canon_ignore_scheme", urlcanon.DefaultRules().IgnoreScheme,
+		"Whether http and https URLs of bookmarks are considered the same.",
+	)
+	urlCanonStripWWW = flag.Bool(
+		"geekmarks.url_canon_strip_www", urlcanon.DefaultRules().StripWWW,
+		"Whether the leading \"www.\" of the host is ignored when comparing "+
+			"URLs of bookmarks.",
+	)
+	urlCanonStripFragment = flag.Bool(
+		"geekmarks.url_canon_strip_fragment", urlcanon.DefaultRules().StripFragment,
+		"Whether the fragment (the part after \"#\") is ignored when comparing "+
+			"URLs of bookmarks.",
+	)
+	urlCanonStripParams = flag.String(
+		"geekmarks.url_canon_strip_params",
+		strings.Join(urlcanon.DefaultRules().StripParams, ","),
+		"Comma-separated list of query parameters which are ignored when "+
+			"comparing URLs of bookmarks; a trailing \"*\" matches any suffix.",
+	)
+)
+
+const (
+	QSArgAllowDuplicate = "allow_duplicate"
+)
+
+// userBookmarkConflictData is given in the "data" field of the 409 response
+// when the bookmark with the same canonical URL already exists.
+type userBookmarkConflictData struct {
+	BookmarkID int `json:"bookmarkID"`
+}
+
+func getURLCanonRules() *urlcanon.Rules {
+	rules := &urlcanon.Rules{
+		IgnoreScheme:  *urlCanonIgnoreScheme,
+		StripWWW:      *urlCanonStripWWW,
+		StripFragment: *urlCanonStripFragment,
+	}
+
+	for _, param := range strings.Split(*urlCanonStripParams, ",") {
+		if param = strings.TrimSpace(param); param != "" {
+			rules.StripParams = append(rules.StripParams, param)
+		}
+	}
+
+	return rules
+}
+
+func canonicalizeURL(rawURL string) string {
+	return urlcanon.Canonicalize(rawURL, getURLCanonRules())
+}
+
+// RecanonicalizeURLs updates canonical URLs of all bookmarks of all users as
+// per the currently configured rules, and returns the number of bookmarks.
+// It's needed after the rules are changed, since the stored canonical URLs
+// are used to find duplicates; also, database migrations canonicalize
+// existing URLs with the default rules.
+func (gm *GMServer) RecanonicalizeURLs(ctx context.Context) (bkmsCnt int, err error) {
+	err = gm.si.TxCtx(ctx, func(tx *sql.Tx) error {
+		bkmsCnt = 0
+
+		users, err := gm.si.GetUsers(tx)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		for _, user := range users {
+			bkms, _, err := gm.si.GetBookmarks(tx, &storage.GetBookmarksArgs{
+				OwnerID: user.ID,
+			}, &storage.TagsFetchOpts{
+				TagsFetchMode:     storage.TagsFetchModeNone,
+				TagNamesFetchMode: storage.TagNamesFetchModeNone,
+			})
+			if err != nil {
+				return errors.Annotatef(err, "user %d", user.ID)
+			}
+
+			for _, bkm := range bkms {
+				bd := bkm.BookmarkData
+				bd.CanonicalURL = canonicalizeURL(bkm.URL)
+				if err := gm.si.UpdateBookmark(tx, &bd); err != nil {
+					return errors.Annotatef(err, "bookmark %d", bkm.ID)
+				}
+			}
+			bkmsCnt += len(bkms)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return bkmsCnt, nil
+}
+
+// checkDuplicateBookmark returns a conflict error pointing at the existing
+// bookmark if the user already has a bookmark (other than exceptBkmID) with
+// the given canonical URL.
+func (gm *GMServer) checkDuplicateBookmark(
+	tx *sql.Tx, ownerID int, canonicalURL string, exceptBkmID int,
+) error {
+	if canonicalURL == "" {
+		return nil
+	}
+
+	bkms, _, err := gm.si.GetBookmarks(tx, &storage.GetBookmarksArgs{
+		OwnerID:      ownerID,
+		CanonicalURL: canonicalURL,
+	}, &storage.TagsFetchOpts{
+		TagsFetchMode:     storage.TagsFetchModeNone,
+		TagNamesFetchMode: storage.TagNamesFetchModeNone,
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, bkm := range bkms {
+		if bkm.ID != exceptBkmID {
+			return errors.Trace(&hh.ConflictError{
+				Message: "bookmark with the same URL already exists",
+				Data:    userBookmarkConflictData{BookmarkID: bkm.ID},
+			})
+		}
+	}
+
+	return nil
+}
@@ -5,6 +5,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -42,6 +43,11 @@ type WebSocketResponse struct {
 	Body   interface{}            `json:"body"`
 }
 
+type wsMessage struct {
+	messageType int
+	data        []byte
+}
+
 type route struct {
 	pattern *pat.Pattern
 	handler GMHandler
@@ -151,6 +157,33 @@ func (gm *GMServer) webSocketConnect(
 		return errors.Trace(err)
 	}
 
+	// Messages are read in a separate goroutine, so that we notice when the
+	// client goes away while a request is being handled: in this case, the
+	// connection context is cancelled, and so is the database work of the
+	// request.
+	connCtx, cancelConn := context.WithCancel(context.Background())
+	msgs := make(chan wsMessage)
+	var readErr error
+
+	go func() {
+		defer close(msgs)
+		defer cancelConn()
+
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				readErr = err
+				return
+			}
+
+			select {
+			case msgs <- wsMessage{messageType: messageType, data: data}:
+			case <-connCtx.Done():
+				return
+			}
+		}
+	}()
+
 	go func() (err error) {
 		defer func() {
 			glog.Infof(
@@ -158,12 +191,10 @@ func (gm *GMServer) webSocketConnect(
 				subjUser.Email, err,
 			)
 		}()
-		for {
-			messageType, reader, err := conn.NextReader()
-			if err != nil {
-				return errors.Trace(err)
-			}
+		defer conn.Close()
+		defer cancelConn()
 
+		for msg := range msgs {
 			// Start timer
 			start := time.Now()
 
@@ -173,19 +204,22 @@ func (gm *GMServer) webSocketConnect(
 			// which happens there is not considered fatal: instead, it is reported
 			// back to the client.
 			resp, wsr, err := func() (resp interface{}, wsr *WebSocketRequest, err error) {
-				wsr, err = parseWebSocketRequest(reader)
+				wsr, err = parseWebSocketRequest(bytes.NewReader(msg.data))
 				if err != nil {
 					return nil, wsr, errors.Trace(err)
 				}
 
+				ctx, cancel := withRequestTimeout(connCtx)
+				defer cancel()
+
 				gmr, err := makeGMRequestFromWebSocketRequest(
-					wsr, caller, subjUser,
+					ctx, wsr, caller, subjUser,
 				)
 				if err != nil {
 					return nil, wsr, errors.Trace(err)
 				}
 
-				resp, err = wsMux(gmr)
+				resp, err = handleWithContext(gmr, wsMux)
 				if err != nil {
 					return nil, wsr, errors.Trace(err)
 				}
@@ -215,7 +249,7 @@ func (gm *GMServer) webSocketConnect(
 			end := time.Now()
 			latency := end.Sub(start)
 
-			w, err := conn.NextWriter(messageType)
+			w, err := conn.NextWriter(msg.messageType)
 			if err != nil {
 				return errors.Trace(err)
 			}
@@ -231,6 +265,9 @@ func (gm *GMServer) webSocketConnect(
 
 			glog.Infof("%v: %13v", wsr, latency)
 		}
+
+		// msgs is closed after readErr is set, so it's safe to access it here
+		return errors.Trace(readErr)
 	}()
 
 	return nil
@@ -7,30 +7,74 @@ import (
 	"flag"
 	"os"
 
+	"dmitryfrank.com/geekmarks/server/dfmigrate"
 	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/storage/memory"
 	"dmitryfrank.com/geekmarks/server/storage/postgres"
+	"dmitryfrank.com/geekmarks/server/storage/sqlite"
 
 	"github.com/juju/errors"
 	_ "github.com/lib/pq"
 )
 
 var (
-	dbType = flag.String("geekmarks.dbtype", "postgres",
-		"Database type. So far, only postgres is supported.")
+	dbType = flag.String("geekmarks.dbtype", "",
+		"Database type: postgres, sqlite or memory. Alternatively, can be "+
+			"given in an environment variable GM_DBTYPE. Default: postgres.")
 	postgresURL = flag.String("geekmarks.postgres.url", "",
 		"Data source name pointing to the Postgres database. Alternatively, can be "+
 			"given in an environment variable GM_POSTGRES_URL.")
+	sqlitePath = flag.String("geekmarks.sqlite.path", "",
+		"Path to the SQLite database file; used if only dbtype is sqlite. "+
+			"Alternatively, can be given in an environment variable GM_SQLITE_PATH.")
+	migrationDrift = flag.String("geekmarks.migrations.drift", "fail",
+		"What to do if applied database migrations don't match the registered "+
+			"ones: fail or warn.")
 )
 
 func CreateStorage() (storage.Storage, error) {
-	switch *dbType {
+	si, err := createStorage()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	switch *migrationDrift {
+	case "fail":
+		si.SetMigrationDriftMode(dfmigrate.DriftModeFail)
+	case "warn":
+		si.SetMigrationDriftMode(dfmigrate.DriftModeWarn)
+	default:
+		return nil, errors.Errorf("Invalid migration drift mode: %q", *migrationDrift)
+	}
+
+	return si, nil
+}
+
+func createStorage() (storage.Storage, error) {
+	typ := *dbType
+	if typ == "" {
+		typ = os.Getenv("GM_DBTYPE")
+	}
+	if typ == "" {
+		typ = "postgres"
+	}
+
+	switch typ {
 	case "postgres":
 		pgURL := *postgresURL
 		if pgURL == "" {
 			pgURL = os.Getenv("GM_POSTGRES_URL")
 		}
 		return postgres.New(pgURL)
+	case "sqlite":
+		path := *sqlitePath
+		if path == "" {
+			path = os.Getenv("GM_SQLITE_PATH")
+		}
+		return sqlite.New(path)
+	case "memory":
+		return memory.New()
 	default:
-		return nil, errors.Errorf("Invalid database type: %q", *dbType)
+		return nil, errors.Errorf("Invalid database type: %q", typ)
 	}
 }
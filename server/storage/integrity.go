@@ -0,0 +1,154 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package storage
+
+import (
+	"fmt"
+	"strings"
+)
+
+// IntegrityReport lists the problems found by the integrity check. Only the
+// users with problems are included, so the report of a healthy database is
+// empty.
+type IntegrityReport struct {
+	Users []UserIntegrityReport
+	// OrphanedTagNames are names of tags which don't exist. They can't be
+	// attributed to any user, since the tag was the only link to its owner.
+	OrphanedTagNames []OrphanedTagName
+}
+
+// UserIntegrityReport lists the problems with the data of a single user.
+type UserIntegrityReport struct {
+	UserID int
+	// BadRootTagIDs is set if the user doesn't have exactly one root tag
+	BadRootTagIDs []int
+	// BadChildrenCnts are tags with the wrong cached children count
+	BadChildrenCnts []BadChildrenCnt
+	// IncompleteTagPaths are taggables tagged with some tags, but not with all
+	// their supertags
+	IncompleteTagPaths []IncompleteTagPath
+	// RootOnlyTaggableIDs are taggables tagged with the root tag only, which
+	// is illegal: they should be untagged instead
+	RootOnlyTaggableIDs []int
+	// UnknownTaggings are taggings of the user's taggables with tags which
+	// don't belong to the user (either non-existing or foreign ones)
+	UnknownTaggings []UnknownTagging
+}
+
+type BadChildrenCnt struct {
+	TagID             int
+	ChildrenCnt       int
+	ActualChildrenCnt int
+}
+
+type IncompleteTagPath struct {
+	TaggableID    int
+	MissingTagIDs []int
+}
+
+type UnknownTagging struct {
+	TaggableID int
+	TagIDs     []int
+}
+
+type OrphanedTagName struct {
+	TagID int
+	Name  string
+}
+
+// IntegrityFixKind is the kind of problem fixed by RepairIntegrity.
+type IntegrityFixKind string
+
+const (
+	// Cached children count of the tag was wrong
+	IntegrityFixKindChildrenCnt IntegrityFixKind = "children_cnt"
+	// Taggable was tagged with some tag, but not with all its supertags
+	IntegrityFixKindMissingTaggings IntegrityFixKind = "missing_taggings"
+	// Taggable was tagged with the root tag only
+	IntegrityFixKindRootOnlyTagging IntegrityFixKind = "root_only_tagging"
+	// Taggable was tagged with a tag not belonging to the taggable's owner
+	IntegrityFixKindUnknownTagging IntegrityFixKind = "unknown_tagging"
+	// Tag name of a non-existing tag was deleted
+	IntegrityFixKindOrphanedTagName IntegrityFixKind = "orphaned_tag_name"
+)
+
+// IntegrityFix describes a single fix made by RepairIntegrity.
+type IntegrityFix struct {
+	Kind IntegrityFixKind
+	// TagID is the tag whose children count or name was fixed, or the root
+	// or unknown tag which was removed from the taggable
+	TagID int
+	// TaggableID is the taggable whose taggings were fixed
+	TaggableID int
+	// TagIDs are the tags which were added to the taggable
+	TagIDs []int
+	// Descr is a human-readable description of the fix
+	Descr string
+}
+
+// OK returns whether no problems were found.
+func (r *IntegrityReport) OK() bool {
+	return len(r.Users) == 0 && len(r.OrphanedTagNames) == 0
+}
+
+// AddUser adds the user report if it contains any problems.
+func (r *IntegrityReport) AddUser(ur *UserIntegrityReport) {
+	if len(ur.BadRootTagIDs) == 0 && len(ur.BadChildrenCnts) == 0 &&
+		len(ur.IncompleteTagPaths) == 0 && len(ur.RootOnlyTaggableIDs) == 0 &&
+		len(ur.UnknownTaggings) == 0 {
+		return
+	}
+
+	r.Users = append(r.Users, *ur)
+}
+
+// String returns a human-readable list of the problems, one per line.
+func (r *IntegrityReport) String() string {
+	lines := []string{}
+
+	for _, ur := range r.Users {
+		if len(ur.BadRootTagIDs) > 0 {
+			lines = append(lines, fmt.Sprintf(
+				"user %d: tag roots count is %d (should be 1), roots: %v",
+				ur.UserID, len(ur.BadRootTagIDs), ur.BadRootTagIDs,
+			))
+		}
+
+		for _, bc := range ur.BadChildrenCnts {
+			lines = append(lines, fmt.Sprintf(
+				"user %d: tag %d: children count is %d, actual: %d",
+				ur.UserID, bc.TagID, bc.ChildrenCnt, bc.ActualChildrenCnt,
+			))
+		}
+
+		for _, itp := range ur.IncompleteTagPaths {
+			lines = append(lines, fmt.Sprintf(
+				"user %d: taggable %d: missing taggings with tags %v",
+				ur.UserID, itp.TaggableID, itp.MissingTagIDs,
+			))
+		}
+
+		if len(ur.RootOnlyTaggableIDs) > 0 {
+			lines = append(lines, fmt.Sprintf(
+				"user %d: taggables tagged with the root tag only: %v",
+				ur.UserID, ur.RootOnlyTaggableIDs,
+			))
+		}
+
+		for _, ut := range ur.UnknownTaggings {
+			lines = append(lines, fmt.Sprintf(
+				"user %d: taggable %d: tagged with unknown tags %v",
+				ur.UserID, ut.TaggableID, ut.TagIDs,
+			))
+		}
+	}
+
+	for _, otn := range r.OrphanedTagNames {
+		lines = append(lines, fmt.Sprintf(
+			"name %q of non-existing tag %d", otn.Name, otn.TagID,
+		))
+	}
+
+	return strings.Join(lines, "\n")
+}
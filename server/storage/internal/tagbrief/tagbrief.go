@@ -0,0 +1,105 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// Package tagbrief parses "tag brief data" which storage backends fetch
+// together with each taggable: a JSON map from a tag id to the object with
+// the id, parent_id and name of the tag. Both Postgres and SQLite backends
+// build this JSON right in the database, and then use Parse to turn it into
+// tag paths.
+package tagbrief // import "dmitryfrank.com/geekmarks/server/storage/internal/tagbrief"
+
+import (
+	"encoding/json"
+	"strconv"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/storage/internal/taghier"
+	"github.com/juju/errors"
+)
+
+type tagBrief struct {
+	ID       int    `json:"id"`
+	ParentID int    `json:"parent_id"`
+	Name     string `json:"name"`
+}
+
+type tagBriefMap map[string]tagBrief
+
+func (tm tagBriefMap) GetParent(id int) (int, error) {
+	t, ok := tm[strconv.Itoa(id)]
+	if !ok {
+		return 0, hh.MakeInternalServerError(errors.Errorf("no tag with id %d", id))
+	}
+	return t.ParentID, nil
+}
+
+func (tm tagBriefMap) GetPath(id int) ([]storage.BookmarkTagPathItem, error) {
+	t, ok := tm[strconv.Itoa(id)]
+	if !ok {
+		return nil, hh.MakeInternalServerError(errors.Errorf("no tag with id %d", id))
+	}
+
+	var ret []storage.BookmarkTagPathItem
+	if t.ParentID != 0 {
+		var err error
+		ret, err = tm.GetPath(t.ParentID)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+	}
+
+	return append(ret, storage.BookmarkTagPathItem{
+		ID:   t.ID,
+		Name: t.Name,
+	}), nil
+}
+
+// Parse takes "tag brief data", and converts it to an array of
+// storage.BookmarkTagPath.
+//
+// "tag brief data" is the following JSON data: a map from a tag id to JSON
+// object which has the fields id, parent_id and name.
+func Parse(
+	tagBriefData []byte, tagsFetchOpts *storage.TagsFetchOpts,
+) (bmTags []storage.BookmarkTagPath, err error) {
+	if len(tagBriefData) == 0 {
+		tagBriefData = []byte("{}")
+	}
+
+	var tagBriefMap tagBriefMap
+	if err := json.Unmarshal(tagBriefData, &tagBriefMap); err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	thier := taghier.New(tagBriefMap)
+	for _, t := range tagBriefMap {
+		thier.Add(t.ID)
+	}
+
+	var bkmTagIDs []int
+	switch tagsFetchOpts.TagsFetchMode {
+	case storage.TagsFetchModeLeafs:
+		bkmTagIDs = thier.GetLeafs()
+
+	case storage.TagsFetchModeAll:
+		bkmTagIDs = thier.GetAll()
+	}
+
+	for _, tagID := range bkmTagIDs {
+		var tagPathItems []storage.BookmarkTagPathItem
+		if tagsFetchOpts.TagNamesFetchMode == storage.TagNamesFetchModeFull {
+			var err error
+			tagPathItems, err = tagBriefMap.GetPath(tagID)
+			if err != nil {
+				return nil, errors.Trace(err)
+			}
+		}
+
+		bmTags = append(bmTags, storage.BookmarkTagPath{
+			TagItems: tagPathItems,
+		})
+	}
+
+	return bmTags, nil
+}
@@ -1,7 +1,7 @@
 // Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
 // Licensed under the BSD, see LICENSE file for details.
 
-package taghier // import "dmitryfrank.com/geekmarks/server/storage/postgres/internal/taghier"
+package taghier // import "dmitryfrank.com/geekmarks/server/storage/internal/taghier"
 
 import (
 	"sort"
@@ -14,6 +14,18 @@ type Registry interface {
 	GetParent(id int) (int, error)
 }
 
+// MapRegistry is a Registry backed by a map from tag id to its parent id (0
+// for the root); useful when all the needed tags are fetched at once.
+type MapRegistry map[int]int
+
+func (r MapRegistry) GetParent(id int) (int, error) {
+	parentID, ok := r[id]
+	if !ok {
+		return 0, errors.Errorf("tag %d not found", id)
+	}
+	return parentID, nil
+}
+
 type tagHierItem struct {
 	id          int
 	parentID    int
@@ -239,6 +239,29 @@ func TestPath(t *testing.T) {
 	}
 }
 
+func TestMapRegistry(t *testing.T) {
+	// 1 is the root, 2 and 3 are its children, 4 is the child of 3
+	reg := MapRegistry{1: 0, 2: 1, 3: 1, 4: 3}
+
+	hier := New(reg)
+	if err := hier.Add(4); err != nil {
+		t.Fatalf("%s", errors.ErrorStack(err))
+	}
+	if err := hier.Add(2); err != nil {
+		t.Fatalf("%s", errors.ErrorStack(err))
+	}
+
+	all := hier.GetAll()
+	sort.Ints(all)
+	if expected := []int{1, 2, 3, 4}; !reflect.DeepEqual(all, expected) {
+		t.Errorf("expected %v, got %v", expected, all)
+	}
+
+	if err := hier.Add(5); err == nil {
+		t.Errorf("adding unknown tag should fail")
+	}
+}
+
 func TestMoveRemoveNewLeafs(t *testing.T) {
 	reg := tmpRegistry{}
 	hier := New(&reg)
@@ -0,0 +1,61 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// Package txctx keeps track of contexts which transactions were started
+// with. storage.Storage methods take just a *sql.Tx, so in order for their
+// queries to be cancelled together with the transaction, storage backends
+// register every transaction here, and use the context returned by Get for
+// each query.
+package txctx // import "dmitryfrank.com/geekmarks/server/storage/internal/txctx"
+
+import (
+	"context"
+	"database/sql"
+	"sync"
+)
+
+type Registry struct {
+	mtx  sync.RWMutex
+	ctxs map[*sql.Tx]context.Context
+}
+
+// Add registers the context for the transaction; it should be called right
+// after the transaction is started, and the returned function should be
+// called once it's committed or rolled back.
+func (r *Registry) Add(tx *sql.Tx, ctx context.Context) (remove func()) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.ctxs == nil {
+		r.ctxs = make(map[*sql.Tx]context.Context)
+	}
+	r.ctxs[tx] = ctx
+
+	return func() {
+		r.mtx.Lock()
+		defer r.mtx.Unlock()
+		delete(r.ctxs, tx)
+	}
+}
+
+// Len returns the number of registered transactions; once all transactions
+// are finished, it should be zero, otherwise their contexts are leaked.
+func (r *Registry) Len() int {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	return len(r.ctxs)
+}
+
+// Get returns the context of the given transaction, or
+// context.Background() if the transaction is not registered.
+func (r *Registry) Get(tx *sql.Tx) context.Context {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+
+	if ctx, ok := r.ctxs[tx]; ok {
+		return ctx
+	}
+
+	return context.Background()
+}
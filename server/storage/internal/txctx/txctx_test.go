@@ -0,0 +1,47 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests
+
+package txctx
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+)
+
+type ctxKey string
+
+func TestRegistry(t *testing.T) {
+	var r Registry
+
+	tx1, tx2 := &sql.Tx{}, &sql.Tx{}
+	ctx1 := context.WithValue(context.Background(), ctxKey("k"), "v1")
+
+	if r.Get(tx1) != context.Background() {
+		t.Errorf("unregistered tx should get background context")
+	}
+
+	remove := r.Add(tx1, ctx1)
+
+	if r.Get(tx1) != ctx1 {
+		t.Errorf("tx1 should get ctx1")
+	}
+	if r.Get(tx2) != context.Background() {
+		t.Errorf("tx2 should get background context")
+	}
+
+	if r.Len() != 1 {
+		t.Errorf("expected 1 registered tx, got %d", r.Len())
+	}
+
+	remove()
+
+	if r.Get(tx1) != context.Background() {
+		t.Errorf("removed tx should get background context")
+	}
+	if r.Len() != 0 {
+		t.Errorf("expected no registered txs, got %d", r.Len())
+	}
+}
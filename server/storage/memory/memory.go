@@ -0,0 +1,62 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// Package memory implements storage.Storage which keeps all the data in
+// memory, so that nothing survives the process. It's handy for tests and
+// demos: there's no need for a database server, and every storage instance
+// starts empty.
+//
+// Under the hood it's an in-memory SQLite database, so it shares all the
+// semantics (transactions, leaf policies, integrity checks) with the sqlite
+// backend.
+package memory // import "dmitryfrank.com/geekmarks/server/storage/memory"
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"dmitryfrank.com/geekmarks/server/storage/sqlite"
+
+	"github.com/juju/errors"
+)
+
+// Every instance gets a database with a unique name, so that instances
+// don't see each other's data.
+var lastInstanceID int64
+
+// Implements storage.Storage
+type StorageMemory struct {
+	*sqlite.StorageSQLite
+}
+
+func New() (*StorageMemory, error) {
+	id := atomic.AddInt64(&lastInstanceID, 1)
+
+	// The database lives as long as there is at least one connection to it;
+	// sqlite backend keeps a single connection open, so the data is there
+	// until Close is called.
+	si, err := sqlite.New(
+		fmt.Sprintf("file:geekmarks_memory_%d?mode=memory&cache=shared", id),
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &StorageMemory{
+		StorageSQLite: si,
+	}, nil
+}
+
+// Reset drops all the data, including the schema; after that, migrations
+// should be applied again.
+func (s *StorageMemory) Reset() error {
+	if err := s.Close(); err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := s.Connect(); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests
+
+package memory
+
+import (
+	"database/sql"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/storage/storagetest"
+	"dmitryfrank.com/geekmarks/server/testutils"
+	"github.com/dimonomid/interrors"
+
+	"github.com/juju/errors"
+)
+
+func newTestStorage(t *testing.T) *StorageMemory {
+	si, err := New()
+	if err != nil {
+		t.Fatalf("%s", interrors.ErrorStack(err))
+	}
+
+	if err := si.Connect(); err != nil {
+		t.Fatalf("%s", interrors.ErrorStack(err))
+	}
+
+	if err := testutils.PrepareTestDB(t, si); err != nil {
+		t.Fatalf("%s", interrors.ErrorStack(err))
+	}
+
+	return si
+}
+
+func getUsersCnt(si *StorageMemory) (int, error) {
+	var cnt int
+	err := si.Tx(func(tx *sql.Tx) error {
+		return errors.Trace(tx.QueryRow("SELECT COUNT(id) FROM users").Scan(&cnt))
+	})
+	return cnt, errors.Trace(err)
+}
+
+func TestInstancesAndReset(t *testing.T) {
+	si1 := newTestStorage(t)
+	defer si1.Close()
+
+	si2 := newTestStorage(t)
+	defer si2.Close()
+
+	if _, _, err := testutils.CreateTestUser(si1, "test1", "1@1.1"); err != nil {
+		t.Fatalf("%s", interrors.ErrorStack(err))
+	}
+
+	if cnt, err := getUsersCnt(si1); err != nil || cnt != 1 {
+		t.Errorf("instance 1: expected 1 user, got %d (err: %v)", cnt, err)
+	}
+
+	if cnt, err := getUsersCnt(si2); err != nil || cnt != 0 {
+		t.Errorf("instance 2: expected 0 users, got %d (err: %v)", cnt, err)
+	}
+
+	if err := testutils.PrepareTestDB(t, si1); err != nil {
+		t.Fatalf("%s", interrors.ErrorStack(err))
+	}
+
+	if cnt, err := getUsersCnt(si1); err != nil || cnt != 0 {
+		t.Errorf("instance 1 after reset: expected 0 users, got %d (err: %v)", cnt, err)
+	}
+
+	if err := si1.CheckIntegrity(); err != nil {
+		t.Errorf("%s", interrors.ErrorStack(err))
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) (storage.Storage, func()) {
+		si := newTestStorage(t)
+		return si, func() { si.Close() }
+	})
+}
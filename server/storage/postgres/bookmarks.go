@@ -7,41 +7,33 @@ import (
 	"database/sql"
 	"fmt"
 	"strconv"
+	"strings"
 
 	hh "dmitryfrank.com/geekmarks/server/httphelper"
 	"github.com/dimonomid/interrors"
 	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/storage/internal/tagbrief"
 	"github.com/juju/errors"
 	_ "github.com/lib/pq"
 )
 
 func (s *StoragePostgres) CreateBookmark(tx *sql.Tx, bd *storage.BookmarkData) (bkmID int, err error) {
-	// If URL is not empty, check whether the bookmark with the same URL already exists
-	if bd.URL != "" {
-		existingBkms, err := s.GetBookmarksByURL(tx, bd.URL, bd.OwnerID, &storage.TagsFetchOpts{
-			TagsFetchMode:     storage.TagsFetchModeNone,
-			TagNamesFetchMode: storage.TagNamesFetchModeNone,
-		})
-		if err != nil {
-			return 0, errors.Trace(err)
-		}
-
-		if len(existingBkms) > 0 {
-			return 0, errors.Errorf("bookmark with the url %q already exists", bd.URL)
-		}
-	}
-
 	bkmID, err = s.CreateTaggable(tx, &storage.TaggableData{
-		OwnerID: bd.OwnerID,
-		Type:    storage.TaggableTypeBookmark,
+		OwnerID:   bd.OwnerID,
+		Type:      storage.TaggableTypeBookmark,
+		CreatedAt: bd.CreatedAt,
+		UpdatedAt: bd.UpdatedAt,
 	})
 	if err != nil {
 		return 0, errors.Trace(err)
 	}
 
-	_, err = tx.Exec(
-		"INSERT INTO bookmarks (id, url, title, comment) VALUES ($1, $2, $3, $4)",
-		bkmID, bd.URL, bd.Title, bd.Comment,
+	_, err = tx.ExecContext(
+		s.ctx(tx), `
+INSERT INTO bookmarks (id, url, title, comment, canonical_url, search_vector)
+  VALUES ($1, $2, $3, $4, $5, `+bookmarkSearchVector("$2", "$3", "$4")+`)
+		`,
+		bkmID, bd.URL, bd.Title, bd.Comment, bd.GetCanonicalURL(),
 	)
 	if err != nil {
 		return 0, errors.Trace(err)
@@ -51,32 +43,38 @@ func (s *StoragePostgres) CreateBookmark(tx *sql.Tx, bd *storage.BookmarkData) (
 }
 
 func (s *StoragePostgres) UpdateBookmark(tx *sql.Tx, bd *storage.BookmarkData) (err error) {
-	// If URL is not empty, check whether the bookmark with the same URL already exists
-	if bd.URL != "" {
-		existingBkms, err := s.GetBookmarksByURL(tx, bd.URL, bd.OwnerID, &storage.TagsFetchOpts{
-			TagsFetchMode:     storage.TagsFetchModeNone,
-			TagNamesFetchMode: storage.TagNamesFetchModeNone,
-		})
-		if err != nil {
-			return errors.Trace(err)
-		}
-
-		if len(existingBkms) > 0 && existingBkms[0].ID != bd.ID {
-			return errors.Errorf("bookmark with the url %q already exists", bd.URL)
-		}
-	}
-
-	_, err = tx.Exec(
-		"UPDATE bookmarks SET url = $1, title = $2, comment = $3 WHERE id = $4",
-		bd.URL, bd.Title, bd.Comment, bd.ID,
+	_, err = tx.ExecContext(
+		s.ctx(tx), `
+UPDATE bookmarks
+  SET url = $1, title = $2, comment = $3, canonical_url = $5,
+      search_vector = `+bookmarkSearchVector("$1", "$2", "$3")+`
+  WHERE id = $4
+		`,
+		bd.URL, bd.Title, bd.Comment, bd.ID, bd.GetCanonicalURL(),
 	)
 	if err != nil {
 		return errors.Trace(err)
 	}
 
+	if err := s.SetTaggableUpdatedAt(tx, bd.ID, 0); err != nil {
+		return errors.Trace(err)
+	}
+
 	return nil
 }
 
+// bookmarkSearchVector returns the SQL expression which calculates the
+// full-text search vector of the bookmark from the given url, title and
+// comment expressions. Words of the URL are separated by any punctuation.
+func bookmarkSearchVector(url, title, comment string) string {
+	return fmt.Sprintf(`
+  setweight(to_tsvector('english', CAST(%s AS TEXT)), 'A') ||
+  setweight(to_tsvector('english', CAST(%s AS TEXT)), 'B') ||
+  setweight(to_tsvector('english', regexp_replace(CAST(%s AS TEXT), '[^[:alnum:]]+', ' ', 'g')), 'C')`,
+		title, comment, url,
+	)
+}
+
 func setDefaultTagFetchOpts(tagsFetchOpts *storage.TagsFetchOpts) *storage.TagsFetchOpts {
 	if tagsFetchOpts == nil {
 		tagsFetchOpts = &storage.TagsFetchOpts{}
@@ -121,7 +119,7 @@ func (s *StoragePostgres) GetTaggedBookmarks(
 			return nil, hh.MakeInternalServerError(err)
 		}
 
-		rows, err := tx.Query(fmt.Sprintf(`
+		rows, err := tx.QueryContext(s.ctx(tx), fmt.Sprintf(`
 SELECT t.id, b.url, b.title, b.comment, t.owner_id,
        CAST(EXTRACT(EPOCH FROM t.created_ts) AS INTEGER),
        CAST(EXTRACT(EPOCH FROM t.updated_ts) AS INTEGER),
@@ -153,7 +151,7 @@ func (s *StoragePostgres) GetBookmarksByURL(
 		return nil, hh.MakeInternalServerError(err)
 	}
 
-	rows, err := tx.Query(fmt.Sprintf(`
+	rows, err := tx.QueryContext(s.ctx(tx), fmt.Sprintf(`
 SELECT t.id, b.url, b.title, b.comment, t.owner_id,
        CAST(EXTRACT(EPOCH FROM t.created_ts) AS INTEGER),
        CAST(EXTRACT(EPOCH FROM t.updated_ts) AS INTEGER),
@@ -170,6 +168,224 @@ SELECT t.id, b.url, b.title, b.comment, t.owner_id,
 	return rowsToBookmarks(rows, tagsFetchOpts)
 }
 
+func (s *StoragePostgres) GetBookmarks(
+	tx *sql.Tx, args *storage.GetBookmarksArgs, tagsFetchOpts *storage.TagsFetchOpts,
+) (bookmarks []storage.BookmarkDataWTags, next *storage.BookmarksCursor, err error) {
+	tagsFetchOpts = setDefaultTagFetchOpts(tagsFetchOpts)
+
+	bkmsSort, err := args.GetSort()
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	tagsJsonFieldQuery, err := getTagsJsonFieldQuery(tagsFetchOpts, "t")
+	if err != nil {
+		return nil, nil, hh.MakeInternalServerError(err)
+	}
+
+	qargs := []interface{}{}
+	addArg := func(v interface{}) string {
+		qargs = append(qargs, v)
+		return fmt.Sprintf("$%d", len(qargs))
+	}
+
+	where := "t.owner_id = " + addArg(args.OwnerID)
+
+	for _, tagID := range args.TagIDs {
+		where += "\n    AND " + getTaggedCond(addArg(tagID))
+		if args.DirectlyTagged {
+			where += `
+    AND NOT EXISTS (
+      SELECT 1 FROM taggings tg JOIN tags ON tags.id = tg.tag_id
+        WHERE tg.taggable_id = t.id AND tags.parent_id = ` + addArg(tagID) + `
+    )`
+		}
+	}
+
+	if args.TagExpr != nil {
+		cond, err := getTagExprCond(args.TagExpr, addArg)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		where += "\n    AND " + cond
+	}
+
+	if args.CanonicalURL != "" {
+		where += " AND b.canonical_url = " + addArg(args.CanonicalURL)
+	}
+
+	if args.LinkStatus != storage.LinkStatusAny {
+		cond, err := getLinkStatusCond(args.LinkStatus)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		where += " AND " + cond
+	}
+
+	if args.Untagged {
+		where += `
+    AND NOT EXISTS (
+      SELECT 1 FROM taggings tg JOIN tags ON tags.id = tg.tag_id
+        WHERE tg.taggable_id = t.id AND tags.parent_id IS NOT NULL
+    )`
+	}
+
+	var orderBy string
+	if args.Query != "" {
+		tsquery := "plainto_tsquery('english', " + addArg(args.Query) + ")"
+		where += " AND b.search_vector @@ " + tsquery
+		if bkmsSort == storage.BookmarksSortRelevance {
+			orderBy = "ts_rank(b.search_vector, " + tsquery + ") DESC, t.id"
+		}
+	}
+
+	if orderBy == "" {
+		var afterCond string
+		orderBy, afterCond = getBookmarksOrder(bkmsSort, args.After, addArg)
+		if afterCond != "" {
+			where += " AND " + afterCond
+		}
+	}
+
+	limitOffset := ""
+	if args.Limit > 0 {
+		// Fetch one more bookmark to find out whether there are more pages
+		limitOffset = "LIMIT " + addArg(args.Limit+1)
+	}
+	if bkmsSort == storage.BookmarksSortRelevance && args.After != nil {
+		limitOffset += " OFFSET " + addArg(args.After.Offset)
+	}
+
+	rows, err := tx.QueryContext(s.ctx(tx), fmt.Sprintf(`
+SELECT t.id, b.url, b.title, b.comment, t.owner_id,
+       CAST(EXTRACT(EPOCH FROM t.created_ts) AS INTEGER),
+       CAST(EXTRACT(EPOCH FROM t.updated_ts) AS INTEGER),
+       %s as tagsjson
+  FROM taggables t
+  JOIN bookmarks b ON t.id = b.id
+  WHERE %s
+  ORDER BY %s
+  %s
+	`, tagsJsonFieldQuery, where, orderBy, limitOffset), qargs...,
+	)
+	if err != nil {
+		return nil, nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	bookmarks, err = rowsToBookmarks(rows, tagsFetchOpts)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	if args.Limit > 0 && len(bookmarks) > args.Limit {
+		bookmarks = bookmarks[:args.Limit]
+		next = storage.GetNextBookmarksCursor(args, bkmsSort, bookmarks)
+	}
+
+	return bookmarks, next, nil
+}
+
+// getTaggedCond returns the condition which is true if the taggable t is
+// tagged with the tag given by the placeholder.
+func getTaggedCond(tagIDPlaceholder string) string {
+	return fmt.Sprintf(
+		"EXISTS (SELECT 1 FROM taggings tg WHERE tg.taggable_id = t.id AND tg.tag_id = %s)",
+		tagIDPlaceholder,
+	)
+}
+
+// getTagExprCond returns the condition which is true if the taggable t
+// matches the tag expression.
+func getTagExprCond(
+	e *storage.TagExpr, addArg func(v interface{}) string,
+) (string, error) {
+	switch e.Op {
+	case storage.TagExprOpTag:
+		return getTaggedCond(addArg(e.TagID)), nil
+
+	case storage.TagExprOpNot:
+		if len(e.Args) != 1 {
+			return "", errors.Errorf("%q should have 1 operand, got %d", e.Op, len(e.Args))
+		}
+		cond, err := getTagExprCond(&e.Args[0], addArg)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		return "(NOT " + cond + ")", nil
+
+	case storage.TagExprOpAnd, storage.TagExprOpOr:
+		if len(e.Args) == 0 {
+			return "", errors.Errorf("%q should have operands", e.Op)
+		}
+		conds := []string{}
+		for i := range e.Args {
+			cond, err := getTagExprCond(&e.Args[i], addArg)
+			if err != nil {
+				return "", errors.Trace(err)
+			}
+			conds = append(conds, cond)
+		}
+		return "(" + strings.Join(conds, " "+strings.ToUpper(string(e.Op))+" ") + ")", nil
+	}
+
+	return "", errors.Errorf("invalid tag expression operation %q", e.Op)
+}
+
+// getBookmarksOrder returns the ORDER BY clause for the given sort order
+// (other than relevance), and the condition which selects the bookmarks after
+// the cursor (empty if the cursor is nil). addArg should add the query
+// argument and return its placeholder.
+func getBookmarksOrder(
+	bkmsSort storage.BookmarksSort, after *storage.BookmarksCursor,
+	addArg func(v interface{}) string,
+) (orderBy, afterCond string) {
+	var key string
+	var keyArg interface{}
+	desc := false
+
+	switch bkmsSort {
+	case storage.BookmarksSortUpdated:
+		key, desc = "CAST(EXTRACT(EPOCH FROM t.updated_ts) AS INTEGER)", true
+	case storage.BookmarksSortCreated:
+		key, desc = "CAST(EXTRACT(EPOCH FROM t.created_ts) AS INTEGER)", true
+	case storage.BookmarksSortTitle:
+		key = "b.title"
+	case storage.BookmarksSortURL:
+		key = "b.url"
+	}
+
+	if after != nil {
+		keyArg = after.Str
+		if desc {
+			keyArg = after.Time
+		}
+	}
+
+	op, dir := ">", ""
+	if desc {
+		op, dir = "<", " DESC"
+	}
+
+	if key == "" {
+		orderBy = "t.id" + dir
+		if after != nil {
+			afterCond = "t.id " + op + " " + addArg(after.ID)
+		}
+		return orderBy, afterCond
+	}
+
+	orderBy = key + dir + ", t.id" + dir
+	if after != nil {
+		afterCond = fmt.Sprintf(
+			"(%s %s %s OR (%s = %s AND t.id %s %s))",
+			key, op, addArg(keyArg), key, addArg(keyArg), op, addArg(after.ID),
+		)
+	}
+
+	return orderBy, afterCond
+}
+
 func (s *StoragePostgres) GetBookmarkByID(
 	tx *sql.Tx, bookmarkID int, tagsFetchOpts *storage.TagsFetchOpts,
 ) (bookmark *storage.BookmarkDataWTags, err error) {
@@ -183,7 +399,7 @@ func (s *StoragePostgres) GetBookmarkByID(
 		return nil, hh.MakeInternalServerError(err)
 	}
 
-	err = tx.QueryRow(fmt.Sprintf(`
+	err = tx.QueryRowContext(s.ctx(tx), fmt.Sprintf(`
 SELECT t.id, b.url, b.title, b.comment, t.owner_id,
        CAST(EXTRACT(EPOCH FROM t.created_ts) AS INTEGER),
        CAST(EXTRACT(EPOCH FROM t.updated_ts) AS INTEGER),
@@ -211,7 +427,7 @@ SELECT t.id, b.url, b.title, b.comment, t.owner_id,
 		return nil, hh.MakeInternalServerError(err)
 	}
 
-	bkm.Tags, err = parseTagBrief(tagBriefData, tagsFetchOpts)
+	bkm.Tags, err = tagbrief.Parse(tagBriefData, tagsFetchOpts)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
@@ -236,7 +452,7 @@ func getPlaceholdersString(start, cnt int) string {
 // order:
 //
 // id, url, title, comment, owner_id, created_time, updated_time, tags_data.
-// For some details on what is tags_data, see parseTagBrief().
+// For some details on what is tags_data, see tagbrief.Parse().
 func rowsToBookmarks(
 	rows *sql.Rows, tagsFetchOpts *storage.TagsFetchOpts,
 ) (bookmarks []storage.BookmarkDataWTags, err error) {
@@ -253,7 +469,7 @@ func rowsToBookmarks(
 			return nil, hh.MakeInternalServerError(err)
 		}
 
-		bkm.Tags, err = parseTagBrief(tagBriefData, tagsFetchOpts)
+		bkm.Tags, err = tagbrief.Parse(tagBriefData, tagsFetchOpts)
 		if err != nil {
 			return nil, errors.Trace(err)
 		}
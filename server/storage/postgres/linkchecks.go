@@ -0,0 +1,134 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package postgres
+
+import (
+	"database/sql"
+	"time"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+func (s *StoragePostgres) GetBookmarksToCheck(
+	tx *sql.Tx, checkedBefore time.Time, limit int,
+) ([]storage.BookmarkData, error) {
+	rows, err := tx.QueryContext(s.ctx(tx), `
+SELECT t.id, t.owner_id, b.url
+  FROM taggables t
+  JOIN bookmarks b ON t.id = b.id
+  LEFT JOIN link_checks lc ON lc.bookmark_id = b.id AND lc.url = b.url
+  WHERE (LOWER(b.url) LIKE 'http://%' OR LOWER(b.url) LIKE 'https://%')
+    AND (lc.bookmark_id IS NULL OR lc.checked_ts < to_timestamp($1))
+  ORDER BY lc.bookmark_id IS NOT NULL, lc.checked_ts, t.id
+  LIMIT $2
+	`, checkedBefore.Unix(), limit)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	bkms := []storage.BookmarkData{}
+	for rows.Next() {
+		var bkm storage.BookmarkData
+		if err := rows.Scan(&bkm.ID, &bkm.OwnerID, &bkm.URL); err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+		bkms = append(bkms, bkm)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	return bkms, nil
+}
+
+func (s *StoragePostgres) SetLinkCheck(tx *sql.Tx, lc *storage.LinkCheckData) error {
+	_, err := tx.ExecContext(s.ctx(tx), `
+DELETE FROM link_checks WHERE bookmark_id = $1
+	`, lc.BookmarkID)
+	if err != nil {
+		return hh.MakeInternalServerError(
+			errors.Annotatef(err, "deleting link check of bookmark %d", lc.BookmarkID),
+		)
+	}
+
+	// The bookmark might have been deleted while its URL was being checked,
+	// so the check is only inserted if the bookmark still exists
+	_, err = tx.ExecContext(s.ctx(tx), `
+INSERT INTO link_checks
+  (bookmark_id, url, status_code, redirect_url, error)
+  SELECT id, $2, $3, $4, $5 FROM bookmarks WHERE id = $1
+	`, lc.BookmarkID, lc.URL, lc.StatusCode, lc.RedirectURL, lc.Error)
+	if err != nil {
+		return hh.MakeInternalServerError(
+			errors.Annotatef(err, "saving link check of bookmark %d", lc.BookmarkID),
+		)
+	}
+
+	return nil
+}
+
+func (s *StoragePostgres) GetLinkChecks(
+	tx *sql.Tx, bookmarkIDs []int,
+) (map[int]storage.LinkCheckData, error) {
+	lcs := map[int]storage.LinkCheckData{}
+	if len(bookmarkIDs) == 0 {
+		return lcs, nil
+	}
+
+	args := []interface{}{}
+	for _, id := range bookmarkIDs {
+		args = append(args, id)
+	}
+
+	rows, err := tx.QueryContext(s.ctx(tx), `
+SELECT lc.bookmark_id, lc.url, lc.status_code, lc.redirect_url, lc.error,
+       CAST(EXTRACT(EPOCH FROM lc.checked_ts) AS INTEGER)
+  FROM link_checks lc
+  JOIN bookmarks b ON b.id = lc.bookmark_id AND b.url = lc.url
+  WHERE lc.bookmark_id IN (`+getPlaceholdersString(1, len(bookmarkIDs))+`)
+	`, args...)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var lc storage.LinkCheckData
+		err := rows.Scan(
+			&lc.BookmarkID, &lc.URL, &lc.StatusCode, &lc.RedirectURL, &lc.Error,
+			&lc.CheckedAt,
+		)
+		if err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+		lcs[lc.BookmarkID] = lc
+	}
+	if err := rows.Err(); err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	return lcs, nil
+}
+
+// getLinkStatusCond returns the condition which is true if the URL of the
+// bookmark b had the given status as of the last (not outdated) check.
+func getLinkStatusCond(ls storage.LinkStatus) (string, error) {
+	var statusCond string
+	switch ls {
+	case storage.LinkStatusBroken:
+		statusCond = "(lc.status_code = 0 OR lc.status_code >= 400)"
+	case storage.LinkStatusRedirected:
+		statusCond = "lc.redirect_url != ''"
+	default:
+		return "", errors.Errorf("invalid link status %q", ls)
+	}
+
+	return `EXISTS (
+  SELECT 1 FROM link_checks lc
+    WHERE lc.bookmark_id = b.id AND lc.url = b.url AND ` + statusCond + `
+)`, nil
+}
@@ -8,295 +8,424 @@ import (
 	"fmt"
 
 	"dmitryfrank.com/geekmarks/server/storage"
-	"dmitryfrank.com/geekmarks/server/storage/postgres/internal/taghier"
+	"dmitryfrank.com/geekmarks/server/storage/internal/taghier"
 
 	"github.com/juju/errors"
 	_ "github.com/lib/pq"
 )
 
-type childrenCheck struct {
-	id                int
-	childrenCnt       int
-	childrenCntActual int
-}
+func (s *StoragePostgres) CheckIntegrity() error {
+	report, err := s.GetIntegrityReport()
+	if err != nil {
+		return errors.Trace(err)
+	}
 
-func (cc *childrenCheck) String() string {
-	return fmt.Sprintf("id=%d, childrenCnt=%d, childrenCntActual=%d",
-		cc.id, cc.childrenCnt, cc.childrenCntActual,
-	)
+	if !report.OK() {
+		return errors.Errorf("integrity is broken:\n%s", report)
+	}
+
+	return nil
 }
 
-func (s *StoragePostgres) CheckIntegrity() error {
-	err := s.TxOpt(
+func (s *StoragePostgres) GetIntegrityReport() (report *storage.IntegrityReport, err error) {
+	err = s.TxOpt(
 		storage.TxILevelRepeatableRead, storage.TxModeReadOnly,
 		func(tx *sql.Tx) error {
-			err := s.checkChildrenCnt(tx)
-			if err != nil {
-				return errors.Trace(err)
-			}
-
-			err = s.checkTaggings(tx)
-			if err != nil {
-				return errors.Trace(err)
-			}
-
-			err = s.checkOnlyRootTagging(tx)
-			if err != nil {
-				return errors.Trace(err)
-			}
-
-			return nil
+			var err error
+			report, err = s.getIntegrityReport(tx)
+			return errors.Trace(err)
 		})
 	if err != nil {
-		return errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
 
-	return nil
+	return report, nil
 }
 
-func (s *StoragePostgres) checkTaggings(tx *sql.Tx) error {
+func (s *StoragePostgres) getIntegrityReport(tx *sql.Tx) (*storage.IntegrityReport, error) {
+	report := &storage.IntegrityReport{}
 
-	// Get all users, for each of them:
-	// - Get all user's tags
-	// - Feed all of them to taghier
-	// - Make sure that the taghier contains just a single root
-	// - For each of the tag, theck that all taggings contain the full path to
-	//   the tag
+	badChildrenCnts, err := s.getBadChildrenCnts(tx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
 
-	// Check all users
 	users, err := s.GetUsers(tx)
 	if err != nil {
-		return errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
 
 	for _, user := range users {
-		reg := thReg{
-			s:  s,
-			tx: tx,
+		ur := &storage.UserIntegrityReport{
+			UserID:          user.ID,
+			BadChildrenCnts: badChildrenCnts[user.ID],
 		}
-		th := taghier.New(&reg)
 
-		// Get all user's tags and feed them to the taghier
-		rows, err := tx.Query("SELECT id FROM tags WHERE owner_id = $1", user.ID)
-		if err != nil {
-			return errors.Trace(err)
+		if err := s.checkUserTaggings(tx, ur); err != nil {
+			return nil, errors.Annotatef(err, "user %d", user.ID)
 		}
 
-		var tagIDs []int
+		report.AddUser(ur)
+	}
 
-		defer rows.Close()
-		for rows.Next() {
-			var curID int
+	report.OrphanedTagNames, err = s.getOrphanedTagNames(tx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
 
-			err := rows.Scan(&curID)
-			if err != nil {
-				return errors.Trace(err)
-			}
+	return report, nil
+}
 
-			// NOTE: we can't call th.Add() right here, because it will also hit a
-			// database, and iterating through more than one Rows at a time is an
-			// error
-			tagIDs = append(tagIDs, curID)
-		}
+// checkUserTaggings feeds all user's tags to taghier, makes sure that there
+// is just a single root, and that each taggable is tagged with full paths to
+// all its tags, but not with the root tag only. Tags which don't belong to
+// the user are reported separately and ignored by the other checks.
+func (s *StoragePostgres) checkUserTaggings(
+	tx *sql.Tx, ur *storage.UserIntegrityReport,
+) error {
+	reg, rootTagIDs, err := s.getTagsRegistry(tx, ur.UserID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(rootTagIDs) != 1 {
+		ur.BadRootTagIDs = rootTagIDs
+	}
+
+	taggings, taggableIDs, err := s.getUserTaggings(tx, ur.UserID)
+	if err != nil {
+		return errors.Trace(err)
+	}
 
-		for _, curID := range tagIDs {
-			th.Add(curID)
+	for _, taggableID := range taggableIDs {
+		tagIDs := []int{}
+		unknownTagIDs := []int{}
+		for _, tagID := range taggings[taggableID] {
+			if _, ok := reg[tagID]; ok {
+				tagIDs = append(tagIDs, tagID)
+			} else {
+				unknownTagIDs = append(unknownTagIDs, tagID)
+			}
 		}
 
-		// Now, th contains all tags for the current user
+		if len(unknownTagIDs) > 0 {
+			ur.UnknownTaggings = append(ur.UnknownTaggings, storage.UnknownTagging{
+				TaggableID: taggableID,
+				TagIDs:     unknownTagIDs,
+			})
+		}
 
-		// Make sure taghier contains just a single root
-		roots := th.GetRoots()
-		if rootsCnt := len(roots); rootsCnt != 1 {
-			return errors.Errorf(
-				"user %d: tag roots count is %d (should be 1). tag roots: %q",
-				user.ID, rootsCnt, roots,
-			)
+		if len(tagIDs) == 1 && reg[tagIDs[0]] == 0 {
+			ur.RootOnlyTaggableIDs = append(ur.RootOnlyTaggableIDs, taggableID)
+			continue
 		}
 
-		// For each of the tags, make sure that there is a tagging for each
-		// tag in the current tag's path
-		for _, tag := range th.GetAll() {
-			path := th.GetPath(tag)
-
-			// This commented code intentionally breaks integrity, so that I can be
-			// sure that checkFullTaggingsPath works. I'm leaving it here for now.
-
-			//if len(path) >= 4 {
-			//_, err := tx.Exec(
-			//"DELETE FROM taggings WHERE tag_id = $1", path[2],
-			//)
-			//if err != nil {
-			//return errors.Trace(err)
-			//}
-			//}
-
-			if err := s.checkFullTaggingsPath(tx, path); err != nil {
-				return errors.Annotatef(err, "user %d", user.ID)
+		th := taghier.New(reg)
+		for _, tagID := range tagIDs {
+			if err := th.Add(tagID); err != nil {
+				return errors.Annotatef(err, "taggable %d", taggableID)
 			}
 		}
+
+		diff := taghier.GetDiff(tagIDs, th.GetAll())
+		if len(diff.Add) > 0 {
+			ur.IncompleteTagPaths = append(ur.IncompleteTagPaths, storage.IncompleteTagPath{
+				TaggableID:    taggableID,
+				MissingTagIDs: diff.Add,
+			})
+		}
 	}
 
 	return nil
 }
 
-func (s *StoragePostgres) checkFullTaggingsPath(tx *sql.Tx, path []int) error {
-	var taggableIDs []int
-
-	// If there is less than 2 items in the path, there's no need to check
-	// anything
-	if len(path) < 2 {
-		return nil
-	}
-
-	// Reverse path so that it goes from the leaf to the root
-	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
-		path[i], path[j] = path[j], path[i]
+// getBadChildrenCnts returns tags whose children_cnt doesn't match the
+// actual number of children, grouped by the owner.
+func (s *StoragePostgres) getBadChildrenCnts(
+	tx *sql.Tx,
+) (map[int][]storage.BadChildrenCnt, error) {
+	rows, err := tx.QueryContext(s.ctx(tx), `
+SELECT id, owner_id, children_cnt, children_cnt_actual
+  FROM
+    (SELECT id, owner_id, children_cnt,
+            (SELECT COUNT(id) FROM tags WHERE parent_id = t.id) AS children_cnt_actual
+          FROM tags t) T
+  WHERE children_cnt != children_cnt_actual
+  ORDER BY id
+`,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
 	}
 
-	// Build query which finds taggable_ids which are tagged with path[0], but
-	// not tagged with any of the other path items.
-	//
-	// E.g. if path is {300, 200, 100}, the query will be:
-	//
-	// SELECT t.taggable_id FROM taggings t
-	//   FULL OUTER JOIN taggings t1 ON
-	//     (t1.taggable_id=t.taggable_id AND t1.tag_id=200)
-	//   FULL OUTER JOIN taggings t2 ON
-	//     (t2.taggable_id=t.taggable_id AND t2.tag_id=100)
-	//   WHERE t.tag_id=300 AND (t1.taggable_id IS NULL OR t2.taggable_id IS NULL)
-	//
-	// So if the result is not empty, it means that the integrity is broken.
-	phNum := 1
-	args := []interface{}{}
-	query := "SELECT t.taggable_id FROM taggings t "
-
-	subq := ""
-
-	for k, tagID := range path {
-		// First tag is a leaf, its id will be in a WHERE clause later
-		if k == 0 {
-			continue
-		}
+	ret := map[int][]storage.BadChildrenCnt{}
 
-		query += fmt.Sprintf(` FULL OUTER JOIN taggings t%d
-        ON (t%d.taggable_id=t.taggable_id AND t%d.tag_id=$%d) `,
-			k, k, k,
-			phNum,
-		)
-		phNum++
-
-		if subq != "" {
-			subq += " OR "
+	defer rows.Close()
+	for rows.Next() {
+		var cur storage.BadChildrenCnt
+		var ownerID int
+		err := rows.Scan(&cur.TagID, &ownerID, &cur.ChildrenCnt, &cur.ActualChildrenCnt)
+		if err != nil {
+			return nil, errors.Trace(err)
 		}
-		subq += fmt.Sprintf("t%d.taggable_id IS NULL", k)
 
-		args = append(args, tagID)
+		ret[ownerID] = append(ret[ownerID], cur)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, errors.Annotatef(err, "closing rows")
 	}
 
-	query += fmt.Sprintf("WHERE t.tag_id=$%d AND (%s)", phNum, subq)
-	phNum++
-	args = append(args, path[0])
+	return ret, nil
+}
 
-	// Execute it
-	rows, err := tx.Query(query, args...)
+func (s *StoragePostgres) getOrphanedTagNames(
+	tx *sql.Tx,
+) ([]storage.OrphanedTagName, error) {
+	rows, err := tx.QueryContext(s.ctx(tx), `
+SELECT tn.tag_id, tn.name FROM tag_names tn
+  LEFT JOIN tags t ON t.id = tn.tag_id
+  WHERE t.id IS NULL
+  ORDER BY tn.tag_id, tn.name
+`,
+	)
 	if err != nil {
-		return errors.Trace(err)
+		return nil, errors.Trace(err)
 	}
 
+	var ret []storage.OrphanedTagName
+
 	defer rows.Close()
 	for rows.Next() {
-		var taggableID int
-		err := rows.Scan(&taggableID)
-		if err != nil {
-			return errors.Trace(err)
+		var cur storage.OrphanedTagName
+		if err := rows.Scan(&cur.TagID, &cur.Name); err != nil {
+			return nil, errors.Trace(err)
 		}
-		taggableIDs = append(taggableIDs, taggableID)
+		ret = append(ret, cur)
 	}
 	if err := rows.Close(); err != nil {
-		return errors.Annotatef(err, "closing rows")
+		return nil, errors.Annotatef(err, "closing rows")
 	}
 
-	if len(taggableIDs) > 0 {
-		return errors.Errorf(
-			"for the tag %d (full path: %v) some intermediate taggings are missing for the following tags: %v",
-			path[0], path, taggableIDs,
-		)
+	return ret, nil
+}
+
+// RepairIntegrity fixes everything reported by GetIntegrityReport, except
+// for the wrong number of root tags, which results in an error.
+func (s *StoragePostgres) RepairIntegrity() (fixes []storage.IntegrityFix, err error) {
+	// Read-write transactions are only supported with "Read Committed", so
+	// instead of a higher isolation level, all the tables the report is based
+	// on are locked against concurrent modifications until the repair is done.
+	err = s.TxOpt(
+		storage.TxILevelReadCommitted, storage.TxModeReadWrite,
+		func(tx *sql.Tx) error {
+			_, err := tx.ExecContext(s.ctx(tx), `
+LOCK TABLE tags, tag_names, taggables, taggings IN SHARE ROW EXCLUSIVE MODE
+`,
+			)
+			if err != nil {
+				return errors.Annotatef(err, "locking tables")
+			}
+
+			report, err := s.getIntegrityReport(tx)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			fixes = []storage.IntegrityFix{}
+
+			for _, ur := range report.Users {
+				if len(ur.BadRootTagIDs) > 0 {
+					return errors.Errorf(
+						"user %d: tag roots count is %d (should be 1), can't repair",
+						ur.UserID, len(ur.BadRootTagIDs),
+					)
+				}
+
+				curFixes, err := s.repairUser(tx, &ur)
+				if err != nil {
+					return errors.Annotatef(err, "user %d", ur.UserID)
+				}
+				fixes = append(fixes, curFixes...)
+			}
+
+			for _, otn := range report.OrphanedTagNames {
+				_, err := tx.ExecContext(
+					s.ctx(tx), "DELETE FROM tag_names WHERE tag_id = $1 AND name = $2",
+					otn.TagID, otn.Name,
+				)
+				if err != nil {
+					return errors.Trace(err)
+				}
+
+				fixes = append(fixes, storage.IntegrityFix{
+					Kind:  storage.IntegrityFixKindOrphanedTagName,
+					TagID: otn.TagID,
+					Descr: fmt.Sprintf(
+						"deleted name %q of non-existing tag %d", otn.Name, otn.TagID,
+					),
+				})
+			}
+
+			return nil
+		})
+	if err != nil {
+		return nil, errors.Trace(err)
 	}
 
-	return nil
+	return fixes, nil
 }
 
-// It's illegal for the taggable to be tagged with the root tag only,
-// so checkOnlyRootTagging checks for these cases
-func (s *StoragePostgres) checkOnlyRootTagging(tx *sql.Tx) error {
-	// Get all root tags
-	rootTagIDs := []int{}
-	rows, err := tx.Query("SELECT id FROM tags WHERE parent_id IS NULL")
-	if err != nil {
-		return errors.Trace(err)
+func (s *StoragePostgres) repairUser(
+	tx *sql.Tx, ur *storage.UserIntegrityReport,
+) ([]storage.IntegrityFix, error) {
+	fixes := []storage.IntegrityFix{}
+
+	// Unknown taggings go first, so that only the root tagging is left on the
+	// root-only taggables
+	for _, ut := range ur.UnknownTaggings {
+		if err := s.deleteTaggings(tx, ut.TaggableID, ut.TagIDs); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		for _, tagID := range ut.TagIDs {
+			fixes = append(fixes, storage.IntegrityFix{
+				Kind:       storage.IntegrityFixKindUnknownTagging,
+				TagID:      tagID,
+				TaggableID: ut.TaggableID,
+				Descr: fmt.Sprintf(
+					"user %d, taggable %d: removed tagging with unknown tag %d",
+					ur.UserID, ut.TaggableID, tagID,
+				),
+			})
+		}
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var cur int
-		err := rows.Scan(&cur)
+
+	for _, bc := range ur.BadChildrenCnts {
+		_, err := tx.ExecContext(
+			s.ctx(tx), "UPDATE tags SET children_cnt = $1 WHERE id = $2",
+			bc.ActualChildrenCnt, bc.TagID,
+		)
 		if err != nil {
-			return errors.Trace(err)
+			return nil, errors.Trace(err)
 		}
-		rootTagIDs = append(rootTagIDs, cur)
+
+		fixes = append(fixes, storage.IntegrityFix{
+			Kind:  storage.IntegrityFixKindChildrenCnt,
+			TagID: bc.TagID,
+			Descr: fmt.Sprintf(
+				"tag %d: children count changed from %d to %d",
+				bc.TagID, bc.ChildrenCnt, bc.ActualChildrenCnt,
+			),
+		})
 	}
-	rows.Close()
 
-	// For each of the root tags, make sure there's no taggables tagged only
-	// with this one tag
-	for _, rootTagID := range rootTagIDs {
-		badIDs, err := s.getTaggablesTaggedWithOnlyOneTag(tx, rootTagID)
+	for _, itp := range ur.IncompleteTagPaths {
+		if err := s.addTaggings(tx, itp.TaggableID, itp.MissingTagIDs); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		fixes = append(fixes, storage.IntegrityFix{
+			Kind:       storage.IntegrityFixKindMissingTaggings,
+			TaggableID: itp.TaggableID,
+			TagIDs:     itp.MissingTagIDs,
+			Descr: fmt.Sprintf(
+				"user %d, taggable %d: added missing taggings with tags %v",
+				ur.UserID, itp.TaggableID, itp.MissingTagIDs,
+			),
+		})
+	}
+
+	for _, taggableID := range ur.RootOnlyTaggableIDs {
+		rootTagIDs, err := s.GetTaggings(tx, taggableID, storage.TaggingModeAll)
 		if err != nil {
-			return errors.Trace(err)
+			return nil, errors.Trace(err)
 		}
-		if len(badIDs) > 0 {
-			return errors.Errorf(
-				"some taggables (ids: %v) are tagged with root tag only (id: %d), this is illegal",
-				badIDs, rootTagID,
-			)
+
+		if err := s.deleteTaggings(tx, taggableID, rootTagIDs); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		for _, rootTagID := range rootTagIDs {
+			fixes = append(fixes, storage.IntegrityFix{
+				Kind:       storage.IntegrityFixKindRootOnlyTagging,
+				TagID:      rootTagID,
+				TaggableID: taggableID,
+				Descr: fmt.Sprintf(
+					"taggable %d: removed the only tagging with the root tag %d",
+					taggableID, rootTagID,
+				),
+			})
 		}
 	}
 
-	return nil
+	return fixes, nil
 }
 
-func (s *StoragePostgres) checkChildrenCnt(tx *sql.Tx) error {
-	rows, err := tx.Query(`
-SELECT id, children_cnt, children_cnt_actual
-  FROM
-    (SELECT id, children_cnt,
-            (SELECT COUNT(id) FROM tags WHERE parent_id = t.id) AS children_cnt_actual
-          FROM tags t) T
-  WHERE children_cnt != children_cnt_actual
-`,
+// getTagsRegistry returns a taghier registry with all the tags of the given
+// user, and the ids of the root tags (there should be exactly one).
+func (s *StoragePostgres) getTagsRegistry(
+	tx *sql.Tx, userID int,
+) (reg taghier.MapRegistry, rootTagIDs []int, err error) {
+	rows, err := tx.QueryContext(
+		s.ctx(tx), "SELECT id, parent_id FROM tags WHERE owner_id = $1 ORDER BY id", userID,
 	)
 	if err != nil {
-		return errors.Trace(err)
+		return nil, nil, errors.Trace(err)
 	}
+	defer rows.Close()
 
-	failures := []childrenCheck{}
-	str := ""
+	reg = taghier.MapRegistry{}
+	for rows.Next() {
+		var id int
+		var parentID sql.NullInt64
+		if err := rows.Scan(&id, &parentID); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
 
+		reg[id] = int(parentID.Int64)
+		if !parentID.Valid {
+			rootTagIDs = append(rootTagIDs, id)
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return nil, nil, errors.Annotatef(err, "closing rows")
+	}
+
+	return reg, rootTagIDs, nil
+}
+
+// getUserTaggings returns all taggings of the user's taggables, as well as
+// sorted ids of the taggables which have any taggings.
+func (s *StoragePostgres) getUserTaggings(
+	tx *sql.Tx, userID int,
+) (taggings map[int][]int, taggableIDs []int, err error) {
+	rows, err := tx.QueryContext(s.ctx(tx), `
+SELECT tg.taggable_id, tg.tag_id FROM taggings tg
+  JOIN taggables t ON t.id = tg.taggable_id
+  WHERE t.owner_id = $1
+  ORDER BY tg.taggable_id, tg.tag_id
+`, userID,
+	)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
 	defer rows.Close()
+
+	taggings = map[int][]int{}
 	for rows.Next() {
-		var cur childrenCheck
-		err := rows.Scan(&cur.id, &cur.childrenCnt, &cur.childrenCntActual)
-		if err != nil {
-			return errors.Trace(err)
+		var taggableID, tagID int
+		if err := rows.Scan(&taggableID, &tagID); err != nil {
+			return nil, nil, errors.Trace(err)
 		}
 
-		failures = append(failures, cur)
-		str += cur.String() + "\n"
+		if _, ok := taggings[taggableID]; !ok {
+			taggableIDs = append(taggableIDs, taggableID)
+		}
+		taggings[taggableID] = append(taggings[taggableID], tagID)
 	}
-
-	if len(str) > 0 {
-		return errors.Errorf("children count integrity is broken: %s", str)
+	if err := rows.Close(); err != nil {
+		return nil, nil, errors.Annotatef(err, "closing rows")
 	}
 
-	return nil
+	return taggings, taggableIDs, nil
 }
@@ -4,15 +4,22 @@
 package postgres
 
 import (
-	"database/sql"
+	"fmt"
 
 	"github.com/juju/errors"
 
 	"dmitryfrank.com/geekmarks/server/dfmigrate"
+	"dmitryfrank.com/geekmarks/server/urlcanon"
 )
 
+// migrationsLockKey is the key of the advisory lock which is held while
+// migrations are applied, so that several server instances starting at once
+// don't apply the same migrations concurrently.
+const migrationsLockKey = 0x6765656b6d61726b // "geekmark" in ASCII
+
 func initMigrations() (*dfmigrate.Migrations, error) {
 	mig := &dfmigrate.Migrations{}
+	mig.SetLocker(dfmigrate.NewPgAdvisoryLocker(migrationsLockKey))
 	var err error
 
 	// 001: Initial structure {{{
@@ -20,7 +27,7 @@ func initMigrations() (*dfmigrate.Migrations, error) {
 		1, "Initial structure",
 
 		// ---------- UP ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			if _, err := tx.Exec(`
 				CREATE TABLE users (
 					id SERIAL NOT NULL PRIMARY KEY,
@@ -93,7 +100,7 @@ func initMigrations() (*dfmigrate.Migrations, error) {
 		},
 
 		// ---------- DOWN ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			if _, err := tx.Exec(`DROP TABLE users`); err != nil {
 				return errors.Trace(err)
 			}
@@ -126,7 +133,7 @@ func initMigrations() (*dfmigrate.Migrations, error) {
 		2, "Drop parent_id NOT NULL",
 
 		// ---------- UP ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			_, err := tx.Exec(`
 				ALTER TABLE "tags" ALTER COLUMN "parent_id" DROP NOT NULL
 			`)
@@ -134,7 +141,7 @@ func initMigrations() (*dfmigrate.Migrations, error) {
 		},
 
 		// ---------- DOWN ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			_, err := tx.Exec(`
 				ALTER TABLE "tags" ALTER COLUMN "parent_id" SET NOT NULL
 			`)
@@ -150,7 +157,7 @@ func initMigrations() (*dfmigrate.Migrations, error) {
 		3, "Move owner_id to taggables",
 
 		// ---------- UP ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			var err error
 			_, err = tx.Exec(`
 				ALTER TABLE "bookmarks" DROP COLUMN "owner_id" RESTRICT
@@ -178,7 +185,7 @@ func initMigrations() (*dfmigrate.Migrations, error) {
 		},
 
 		// ---------- DOWN ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			var err error
 			_, err = tx.Exec(`
 				ALTER TABLE "taggables" DROP COLUMN "owner_id" RESTRICT
@@ -214,7 +221,7 @@ func initMigrations() (*dfmigrate.Migrations, error) {
 		4, "Add ON DELETE",
 
 		// ---------- UP ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			var err error
 			_, err = tx.Exec(`
 ALTER TABLE "tags" DROP CONSTRAINT "tags_parent_id_fkey"
@@ -310,8 +317,29 @@ ALTER TABLE "taggings" ADD
 		},
 
 		// ---------- DOWN ----------
-		func(tx *sql.Tx) error {
-			//TODO
+		func(tx dfmigrate.Tx) error {
+			// Recreate foreign keys without ON DELETE
+			for _, fk := range []struct{ table, constraint, def string }{
+				{"tags", "tags_parent_id_fkey", "FOREIGN KEY (parent_id) REFERENCES tags(id)"},
+				{"tags", "tags_owner_id_fkey", "FOREIGN KEY (owner_id) REFERENCES users(id)"},
+				{"tag_names", "tag_names_tag_id_fkey", "FOREIGN KEY (tag_id) REFERENCES tags(id)"},
+				{"bookmarks", "bookmarks_id_fkey", "FOREIGN KEY (id) REFERENCES taggables(id)"},
+				{"taggings", "taggings_taggable_id_fkey", "FOREIGN KEY (taggable_id) REFERENCES taggables(id)"},
+				{"taggings", "taggings_tag_id_fkey", "FOREIGN KEY (tag_id) REFERENCES tags(id)"},
+			} {
+				_, err := tx.Exec(fmt.Sprintf(
+					`ALTER TABLE "%s" DROP CONSTRAINT "%s"`, fk.table, fk.constraint,
+				))
+				if err != nil {
+					return errors.Trace(err)
+				}
+
+				_, err = tx.Exec(fmt.Sprintf(`ALTER TABLE "%s" ADD %s`, fk.table, fk.def))
+				if err != nil {
+					return errors.Trace(err)
+				}
+			}
+
 			return nil
 		},
 	)
@@ -324,7 +352,7 @@ ALTER TABLE "taggings" ADD
 		5, "Use natural key for tag names",
 
 		// ---------- UP ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			var err error
 			_, err = tx.Exec(`
 ALTER TABLE "tag_names" DROP CONSTRAINT "tag_names_pkey";
@@ -351,7 +379,7 @@ ALTER TABLE "tag_names" DROP COLUMN "id" RESTRICT;
 		},
 
 		// ---------- DOWN ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			var err error
 			_, err = tx.Exec(`
 ALTER TABLE "tag_names" DROP CONSTRAINT "tag_names_pkey";
@@ -386,7 +414,7 @@ ALTER TABLE "tag_names" ADD PRIMARY KEY (id);
 		6, "Add tag description",
 
 		// ---------- UP ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			var err error
 			_, err = tx.Exec(`
 ALTER TABLE "tags" ADD COLUMN "descr" TEXT NOT NULL DEFAULT '';
@@ -399,7 +427,7 @@ ALTER TABLE "tags" ADD COLUMN "descr" TEXT NOT NULL DEFAULT '';
 		},
 
 		// ---------- DOWN ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			var err error
 			_, err = tx.Exec(`
 ALTER TABLE "tags" DROP COLUMN "descr";
@@ -420,7 +448,7 @@ ALTER TABLE "tags" DROP COLUMN "descr";
 		7, "Allow only one tag with NULL parent",
 
 		// ---------- UP ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			var err error
 			// NOTE: this function is wrong; see the migration 16 which fixes it
 			//       (it raises an exception on a legitimate update of an item with
@@ -457,9 +485,12 @@ CREATE TRIGGER check_dup_null BEFORE INSERT OR UPDATE ON tags
 		},
 
 		// ---------- DOWN ----------
-		func(tx *sql.Tx) error {
-			// TODO
-			return nil
+		func(tx dfmigrate.Tx) error {
+			_, err := tx.Exec(`
+DROP TRIGGER check_dup_null ON tags;
+DROP FUNCTION check_dup_null();
+			`)
+			return errors.Trace(err)
 		},
 	)
 	if err != nil {
@@ -471,7 +502,7 @@ CREATE TRIGGER check_dup_null BEFORE INSERT OR UPDATE ON tags
 		8, "Use enum for taggable type",
 
 		// ---------- UP ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			var err error
 			_, err = tx.Exec(`
 CREATE TYPE taggable_type AS ENUM ('bookmark');
@@ -498,7 +529,7 @@ ALTER TABLE taggables ADD COLUMN "type" taggable_type NOT NULL;
 		},
 
 		// ---------- DOWN ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			_, err = tx.Exec(`
 ALTER TABLE taggables DROP COLUMN "type";
 			`)
@@ -532,7 +563,7 @@ DROP TYPE taggable_type;
 		9, "Add auto-updating timestamps to taggables",
 
 		// ---------- UP ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			var err error
 			_, err = tx.Exec(`
 ALTER TABLE taggables
@@ -596,9 +627,16 @@ ALTER TABLE taggables
 		},
 
 		// ---------- DOWN ----------
-		func(tx *sql.Tx) error {
-			//TODO
-			return nil
+		func(tx dfmigrate.Tx) error {
+			_, err := tx.Exec(`
+DROP TRIGGER "trg_set_updated_ts" ON taggables;
+DROP TRIGGER "trg_set_created_ts" ON taggables;
+DROP FUNCTION set_updated_ts();
+DROP FUNCTION set_created_ts();
+ALTER TABLE taggables DROP COLUMN "updated_ts";
+ALTER TABLE taggables DROP COLUMN "created_ts";
+			`)
+			return errors.Trace(err)
 		},
 	)
 	if err != nil {
@@ -610,7 +648,7 @@ ALTER TABLE taggables
 		10, "Use natural key for taggings",
 
 		// ---------- UP ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			var err error
 			_, err = tx.Exec(`
 ALTER TABLE "taggings" DROP CONSTRAINT "taggings_pkey";
@@ -637,7 +675,7 @@ ALTER TABLE "taggings" DROP COLUMN "id" RESTRICT;
 		},
 
 		// ---------- DOWN ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			var err error
 			_, err = tx.Exec(`
 ALTER TABLE "taggings" DROP CONSTRAINT "taggings_pkey";
@@ -672,7 +710,7 @@ ALTER TABLE "taggings" ADD PRIMARY KEY (id);
 		11, "Add title to bookmarks",
 
 		// ---------- UP ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			var err error
 			_, err = tx.Exec(`
 ALTER TABLE "bookmarks" ADD COLUMN "title" TEXT NOT NULL;
@@ -685,7 +723,7 @@ ALTER TABLE "bookmarks" ADD COLUMN "title" TEXT NOT NULL;
 		},
 
 		// ---------- DOWN ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			var err error
 			_, err = tx.Exec(`
 ALTER TABLE "bookmarks" DROP COLUMN "title" RESTRICT;
@@ -706,7 +744,7 @@ ALTER TABLE "bookmarks" DROP COLUMN "title" RESTRICT;
 		12, "Add indexes",
 
 		// ---------- UP ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			var err error
 			_, err = tx.Exec(`
 CREATE INDEX ON "taggings" ("taggable_id")
@@ -761,10 +799,19 @@ CREATE INDEX ON "tags" ("owner_id")
 		},
 
 		// ---------- DOWN ----------
-		func(tx *sql.Tx) error {
-			//TODO
-
-			return nil
+		func(tx dfmigrate.Tx) error {
+			// Indexes were created without explicit names, so they have the
+			// default ones generated by Postgres.
+			_, err := tx.Exec(`
+DROP INDEX "taggings_taggable_id_idx";
+DROP INDEX "taggings_tag_id_idx";
+DROP INDEX "tag_names_tag_id_idx";
+DROP INDEX "taggables_owner_id_idx";
+DROP INDEX "taggables_type_idx";
+DROP INDEX "tags_parent_id_idx";
+DROP INDEX "tags_owner_id_idx";
+			`)
+			return errors.Trace(err)
 		},
 	)
 	if err != nil {
@@ -776,7 +823,7 @@ CREATE INDEX ON "tags" ("owner_id")
 		13, "Add primary flag to tag names",
 
 		// ---------- UP ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			_, err = tx.Exec(`
 ALTER TABLE "tag_names" ADD COLUMN "primary" BOOLEAN NOT NULL DEFAULT 'false'
 			`)
@@ -796,7 +843,7 @@ UPDATE tag_names SET "primary" = 'true' WHERE name IN
 		},
 
 		// ---------- DOWN ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			_, err = tx.Exec(`
 ALTER TABLE "tag_names" DROP COLUMN "primary"
 			`)
@@ -816,7 +863,7 @@ ALTER TABLE "tag_names" DROP COLUMN "primary"
 		14, "Add gm_tag_brief type",
 
 		// ---------- UP ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			_, err = tx.Exec(`
 CREATE TYPE gm_tag_brief AS (id int, parent_id int, name text);
 			`)
@@ -828,7 +875,7 @@ CREATE TYPE gm_tag_brief AS (id int, parent_id int, name text);
 		},
 
 		// ---------- DOWN ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			_, err = tx.Exec(`
 DROP TYPE gm_tag_brief
 			`)
@@ -848,7 +895,7 @@ DROP TYPE gm_tag_brief
 		15, "Fix check_dup_null()",
 
 		// ---------- UP ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			var err error
 			_, err = tx.Exec(`
 CREATE OR REPLACE FUNCTION check_dup_null() RETURNS trigger AS $check_dup_null$
@@ -873,9 +920,24 @@ $check_dup_null$ LANGUAGE plpgsql;
 		},
 
 		// ---------- DOWN ----------
-		func(tx *sql.Tx) error {
-			// TODO
-			return nil
+		func(tx dfmigrate.Tx) error {
+			// Restore the function from the migration 7
+			_, err := tx.Exec(`
+CREATE OR REPLACE FUNCTION check_dup_null() RETURNS trigger AS $check_dup_null$
+  DECLARE
+    cnt INTEGER;
+  BEGIN
+    IF NEW.parent_id IS NULL THEN
+      SELECT COUNT(id) INTO cnt FROM "tags" WHERE "parent_id" IS NULL and "owner_id" = NEW.owner_id;
+      IF cnt > 0 THEN
+        RAISE EXCEPTION 'duplicate tag with null parent_id for this owner_id';
+      END IF;
+    END IF;
+    RETURN NEW;
+  END;
+$check_dup_null$ LANGUAGE plpgsql;
+			`)
+			return errors.Trace(err)
 		},
 	)
 	if err != nil {
@@ -887,7 +949,7 @@ $check_dup_null$ LANGUAGE plpgsql;
 		16, "Add children column to tags table",
 
 		// ---------- UP ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			_, err = tx.Exec(`
 ALTER TABLE "tags" ADD COLUMN "children_cnt" INTEGER NOT NULL DEFAULT 0
 			`)
@@ -906,7 +968,7 @@ UPDATE tags t SET children_cnt=(SELECT COUNT(id) FROM tags WHERE parent_id = t.i
 		},
 
 		// ---------- DOWN ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			_, err = tx.Exec(`
 ALTER TABLE "tags" DROP COLUMN "children_cnt"
 			`)
@@ -926,7 +988,7 @@ ALTER TABLE "tags" DROP COLUMN "children_cnt"
 		17, "Add access_tokens table",
 
 		// ---------- UP ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			_, err = tx.Exec(`
 				CREATE TABLE access_tokens (
 					token VARCHAR(32) NOT NULL PRIMARY KEY,
@@ -943,7 +1005,7 @@ ALTER TABLE "tags" DROP COLUMN "children_cnt"
 		},
 
 		// ---------- DOWN ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			_, err = tx.Exec(`
 DROP TABLE "access_tokens"
 			`)
@@ -963,7 +1025,7 @@ DROP TABLE "access_tokens"
 		18, "Add google_auth table",
 
 		// ---------- UP ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			_, err = tx.Exec(`
 				CREATE TABLE google_auth (
 					google_user_id TEXT NOT NULL PRIMARY KEY,
@@ -981,7 +1043,7 @@ DROP TABLE "access_tokens"
 		},
 
 		// ---------- DOWN ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			_, err = tx.Exec(`
 DROP TABLE "google_auth"
 			`)
@@ -1001,7 +1063,7 @@ DROP TABLE "google_auth"
 		19, "Add description to tokens",
 
 		// ---------- UP ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			_, err = tx.Exec(`
 				ALTER TABLE "access_tokens" ADD COLUMN "descr" TEXT NOT NULL DEFAULT '';
 			`)
@@ -1013,7 +1075,7 @@ DROP TABLE "google_auth"
 		},
 
 		// ---------- DOWN ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			_, err = tx.Exec(`
 				ALTER TABLE "access_tokens" DROP COLUMN "descr"
 			`)
@@ -1033,7 +1095,7 @@ DROP TABLE "google_auth"
 		20, "Add description to tokens",
 
 		// ---------- UP ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			_, err = tx.Exec(`
 				ALTER TABLE "users" ADD CONSTRAINT users_username_unique UNIQUE (username);
 			`)
@@ -1052,7 +1114,7 @@ DROP TABLE "google_auth"
 		},
 
 		// ---------- DOWN ----------
-		func(tx *sql.Tx) error {
+		func(tx dfmigrate.Tx) error {
 			_, err = tx.Exec(`
 				ALTER TABLE "users" DROP CONSTRAINT "users_username_unique"
 			`)
@@ -1074,6 +1136,596 @@ DROP TABLE "google_auth"
 		return nil, errors.Trace(err)
 	}
 	// }}}
+	// 021: Add trashed_bookmarks table {{{
+	err = mig.AddMigration(
+		21, "Add trashed_bookmarks table",
+
+		// ---------- UP ----------
+		func(tx dfmigrate.Tx) error {
+			_, err = tx.Exec(`
+				CREATE TABLE trashed_bookmarks (
+					id SERIAL NOT NULL PRIMARY KEY,
+					owner_id INTEGER NOT NULL,
+					bookmark_id INTEGER NOT NULL,
+					url TEXT NOT NULL,
+					title TEXT NOT NULL,
+					comment TEXT NOT NULL,
+					tag_paths TEXT NOT NULL DEFAULT '',
+					created_ts TIMESTAMPTZ NOT NULL,
+					updated_ts TIMESTAMPTZ NOT NULL,
+					deleted_ts TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+					FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+				)
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+CREATE INDEX ON "trashed_bookmarks" ("owner_id")
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+CREATE INDEX ON "trashed_bookmarks" ("deleted_ts")
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx dfmigrate.Tx) error {
+			_, err = tx.Exec(`
+DROP TABLE "trashed_bookmarks"
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+	// 022: Add bookmark_revisions table {{{
+	err = mig.AddMigration(
+		22, "Add bookmark_revisions table",
+
+		// ---------- UP ----------
+		func(tx dfmigrate.Tx) error {
+			_, err = tx.Exec(`
+				CREATE TABLE bookmark_revisions (
+					id SERIAL NOT NULL PRIMARY KEY,
+					bookmark_id INTEGER NOT NULL,
+					url TEXT NOT NULL,
+					title TEXT NOT NULL,
+					comment TEXT NOT NULL,
+					tag_ids TEXT NOT NULL DEFAULT '',
+					created_ts TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+					FOREIGN KEY (bookmark_id) REFERENCES taggables(id) ON DELETE CASCADE
+				)
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+CREATE INDEX ON "bookmark_revisions" ("bookmark_id")
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx dfmigrate.Tx) error {
+			_, err = tx.Exec(`
+DROP TABLE "bookmark_revisions"
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 023: Add tag_operations table {{{
+	err = mig.AddMigration(
+		23, "Add tag_operations table",
+
+		// ---------- UP ----------
+		func(tx dfmigrate.Tx) error {
+			_, err = tx.Exec(`
+				CREATE TABLE tag_operations (
+					id SERIAL NOT NULL PRIMARY KEY,
+					owner_id INTEGER NOT NULL,
+					kind VARCHAR(16) NOT NULL,
+					tag_id INTEGER NOT NULL,
+					tag TEXT NOT NULL DEFAULT '',
+					taggings TEXT NOT NULL DEFAULT '',
+					created_ts TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+					FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+				)
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+CREATE INDEX ON "tag_operations" ("owner_id")
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx dfmigrate.Tx) error {
+			_, err = tx.Exec(`
+DROP TABLE "tag_operations"
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 024: Add full-text search vector to bookmarks {{{
+	err = mig.AddMigration(
+		24, "Add full-text search vector to bookmarks",
+
+		// ---------- UP ----------
+		func(tx dfmigrate.Tx) error {
+			_, err = tx.Exec(`
+ALTER TABLE bookmarks ADD COLUMN search_vector TSVECTOR NOT NULL DEFAULT ''
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+UPDATE bookmarks SET search_vector =
+  setweight(to_tsvector('english', title), 'A') ||
+  setweight(to_tsvector('english', comment), 'B') ||
+  setweight(to_tsvector('english', regexp_replace(url, '[^[:alnum:]]+', ' ', 'g')), 'C')
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+CREATE INDEX ON "bookmarks" USING GIN ("search_vector")
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx dfmigrate.Tx) error {
+			_, err = tx.Exec(`
+ALTER TABLE bookmarks DROP COLUMN search_vector
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 025: Add canonical URLs of bookmarks {{{
+	err = mig.AddMigration(
+		25, "Add canonical URLs of bookmarks",
+
+		// ---------- UP ----------
+		func(tx dfmigrate.Tx) error {
+			_, err = tx.Exec(`
+ALTER TABLE bookmarks ADD COLUMN canonical_url TEXT NOT NULL DEFAULT ''
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			// Existing URLs are canonicalized with the default rules, since the
+			// configured ones are not known here; if the server is configured
+			// differently, "geekmarks-admin recanonicalize" should be run after
+			// the migration, otherwise duplicates are not detected reliably.
+			canonicalURLs, err := getCanonicalURLs(tx)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			for id, canonicalURL := range canonicalURLs {
+				_, err = tx.Exec(
+					"UPDATE bookmarks SET canonical_url = $1 WHERE id = $2", canonicalURL, id,
+				)
+				if err != nil {
+					return errors.Trace(err)
+				}
+			}
+
+			_, err = tx.Exec(`
+CREATE INDEX ON "bookmarks" ("canonical_url")
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx dfmigrate.Tx) error {
+			_, err = tx.Exec(`
+ALTER TABLE bookmarks DROP COLUMN canonical_url
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 026: Add notes {{{
+	err = mig.AddMigration(
+		26, "Add notes",
+
+		// ---------- UP ----------
+		func(tx dfmigrate.Tx) error {
+			// A value can't be added to the enum inside a transaction block (or
+			// at least can't be used in the same transaction), so the enum is
+			// recreated instead
+			if err := setTaggableTypes(tx, "'bookmark', 'note'"); err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+				CREATE TABLE notes (
+					id INTEGER NOT NULL PRIMARY KEY,
+					title TEXT NOT NULL,
+					body TEXT NOT NULL,
+					FOREIGN KEY (id) REFERENCES taggables(id) ON DELETE CASCADE
+				)
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx dfmigrate.Tx) error {
+			_, err = tx.Exec(`
+DELETE FROM taggables WHERE "type" = 'note'
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+DROP TABLE "notes"
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			if err := setTaggableTypes(tx, "'bookmark'"); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 027: Add link_checks table {{{
+	err = mig.AddMigration(
+		27, "Add link_checks table",
+
+		// ---------- UP ----------
+		func(tx dfmigrate.Tx) error {
+			_, err = tx.Exec(`
+				CREATE TABLE link_checks (
+					bookmark_id INTEGER NOT NULL PRIMARY KEY,
+					url TEXT NOT NULL,
+					status_code INTEGER NOT NULL,
+					redirect_url TEXT NOT NULL DEFAULT '',
+					error TEXT NOT NULL DEFAULT '',
+					checked_ts TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+					FOREIGN KEY (bookmark_id) REFERENCES bookmarks(id) ON DELETE CASCADE
+				)
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			_, err = tx.Exec(`
+CREATE INDEX link_checks_checked_ts ON link_checks (checked_ts)
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx dfmigrate.Tx) error {
+			_, err = tx.Exec(`
+DROP TABLE "link_checks"
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 028: Add page_meta table {{{
+	err = mig.AddMigration(
+		28, "Add page_meta table",
+
+		// ---------- UP ----------
+		func(tx dfmigrate.Tx) error {
+			_, err = tx.Exec(`
+				CREATE TABLE page_meta (
+					bookmark_id INTEGER NOT NULL PRIMARY KEY,
+					url TEXT NOT NULL,
+					title TEXT NOT NULL DEFAULT '',
+					description TEXT NOT NULL DEFAULT '',
+					canonical_url TEXT NOT NULL DEFAULT '',
+					favicon_url TEXT NOT NULL DEFAULT '',
+					error TEXT NOT NULL DEFAULT '',
+					fetched_ts TIMESTAMPTZ,
+					FOREIGN KEY (bookmark_id) REFERENCES bookmarks(id) ON DELETE CASCADE
+				)
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx dfmigrate.Tx) error {
+			_, err = tx.Exec(`
+DROP TABLE "page_meta"
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 029: Keep explicit created_ts of taggables {{{
+	err = mig.AddMigration(
+		29, "Keep explicit created_ts of taggables",
+
+		// ---------- UP ----------
+		func(tx dfmigrate.Tx) error {
+			// Imported bookmarks keep their original creation time
+			_, err = tx.Exec(`
+    CREATE OR REPLACE FUNCTION set_created_ts () RETURNS trigger AS'
+    BEGIN
+        IF NEW.created_ts IS NULL THEN
+            NEW.created_ts = NOW();
+        END IF;
+        RETURN NEW;
+    END;
+    'LANGUAGE 'plpgsql' IMMUTABLE
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx dfmigrate.Tx) error {
+			_, err = tx.Exec(`
+    CREATE OR REPLACE FUNCTION set_created_ts () RETURNS trigger AS'
+    BEGIN
+        NEW.created_ts = NOW();
+        RETURN NEW;
+    END;
+    'LANGUAGE 'plpgsql' IMMUTABLE
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 030: Keep explicit updated_ts of new taggables {{{
+	err = mig.AddMigration(
+		30, "Keep explicit updated_ts of new taggables",
+
+		// ---------- UP ----------
+		func(tx dfmigrate.Tx) error {
+			// Restored bookmarks and notes keep their original modification time
+			_, err = tx.Exec(`
+    CREATE OR REPLACE FUNCTION set_updated_ts () RETURNS trigger AS'
+    BEGIN
+        IF TG_OP = ''UPDATE'' OR NEW.updated_ts IS NULL THEN
+            NEW.updated_ts = NOW();
+        END IF;
+        RETURN NEW;
+    END;
+    'LANGUAGE 'plpgsql' IMMUTABLE
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx dfmigrate.Tx) error {
+			_, err = tx.Exec(`
+    CREATE OR REPLACE FUNCTION set_updated_ts () RETURNS trigger AS'
+    BEGIN
+        NEW.updated_ts = NOW();
+        RETURN NEW;
+    END;
+    'LANGUAGE 'plpgsql' IMMUTABLE
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 031: Keep explicit updated_ts of updated taggables {{{
+	err = mig.AddMigration(
+		31, "Keep explicit updated_ts of updated taggables",
+
+		// ---------- UP ----------
+		func(tx dfmigrate.Tx) error {
+			// Updates of other columns still bump updated_ts, but setting it
+			// explicitly (e.g. restored bookmarks and notes get their original
+			// time back after their taggings are set) doesn't fire the trigger.
+			_, err = tx.Exec(`
+    DROP TRIGGER "trg_set_updated_ts" ON taggables;
+    CREATE TRIGGER "trg_set_updated_ts"
+    BEFORE INSERT OR UPDATE OF id, owner_id, type, created_ts
+    ON taggables FOR EACH ROW
+    EXECUTE PROCEDURE set_updated_ts();
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx dfmigrate.Tx) error {
+			_, err = tx.Exec(`
+    DROP TRIGGER "trg_set_updated_ts" ON taggables;
+    CREATE TRIGGER "trg_set_updated_ts" BEFORE INSERT OR UPDATE
+    ON taggables FOR EACH ROW
+    EXECUTE PROCEDURE set_updated_ts();
+			`)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
 
 	return mig, nil
 }
+
+// getCanonicalURLs returns canonical URLs of all bookmarks (as per the default
+// rules), keyed by bookmark id.
+func getCanonicalURLs(tx dfmigrate.Tx) (map[int]string, error) {
+	rows, err := tx.Query("SELECT id, url FROM bookmarks")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer rows.Close()
+
+	canonicalURLs := map[int]string{}
+	for rows.Next() {
+		var id int
+		var url string
+		if err := rows.Scan(&id, &url); err != nil {
+			return nil, errors.Trace(err)
+		}
+		canonicalURLs[id] = urlcanon.Canonicalize(url, urlcanon.DefaultRules())
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return canonicalURLs, nil
+}
+
+// setTaggableTypes recreates the taggable_type enum with the given values
+// (like "'bookmark', 'note'"), and converts the "type" column of taggables
+// to the new enum.
+func setTaggableTypes(tx dfmigrate.Tx, values string) error {
+	queries := []string{
+		`ALTER TYPE taggable_type RENAME TO taggable_type_old`,
+		`CREATE TYPE taggable_type AS ENUM (` + values + `)`,
+		`ALTER TABLE taggables ALTER COLUMN "type" TYPE taggable_type USING "type"::text::taggable_type`,
+		`DROP TYPE taggable_type_old`,
+	}
+
+	for _, query := range queries {
+		if _, err := tx.Exec(query); err != nil {
+			return errors.Annotatef(err, "query %q", query)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,183 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package postgres
+
+import (
+	"database/sql"
+	"fmt"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/storage/internal/tagbrief"
+	"github.com/dimonomid/interrors"
+	"github.com/juju/errors"
+)
+
+func (s *StoragePostgres) CreateNote(tx *sql.Tx, nd *storage.NoteData) (noteID int, err error) {
+	noteID, err = s.CreateTaggable(tx, &storage.TaggableData{
+		OwnerID:   nd.OwnerID,
+		Type:      storage.TaggableTypeNote,
+		CreatedAt: nd.CreatedAt,
+		UpdatedAt: nd.UpdatedAt,
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	_, err = tx.ExecContext(
+		s.ctx(tx), "INSERT INTO notes (id, title, body) VALUES ($1, $2, $3)",
+		noteID, nd.Title, nd.Body,
+	)
+	if err != nil {
+		return 0, hh.MakeInternalServerError(errors.Annotatef(
+			err, "adding note %d", noteID,
+		))
+	}
+
+	return noteID, nil
+}
+
+func (s *StoragePostgres) UpdateNote(tx *sql.Tx, nd *storage.NoteData) (err error) {
+	_, err = tx.ExecContext(
+		s.ctx(tx), "UPDATE notes SET title = $1, body = $2 WHERE id = $3",
+		nd.Title, nd.Body, nd.ID,
+	)
+	if err != nil {
+		return hh.MakeInternalServerError(errors.Annotatef(
+			err, "updating note %d", nd.ID,
+		))
+	}
+
+	if err := s.SetTaggableUpdatedAt(tx, nd.ID, 0); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+// notesQuery returns the SELECT query which fetches notes in the format
+// expected by rowsToNotes, with the given WHERE clause.
+func notesQuery(tagsFetchOpts *storage.TagsFetchOpts, where string) (string, error) {
+	tagsJsonFieldQuery, err := getTagsJsonFieldQuery(tagsFetchOpts, "t")
+	if err != nil {
+		return "", hh.MakeInternalServerError(err)
+	}
+
+	return fmt.Sprintf(`
+SELECT t.id, n.title, n.body, t.owner_id,
+       CAST(EXTRACT(EPOCH FROM t.created_ts) AS INTEGER),
+       CAST(EXTRACT(EPOCH FROM t.updated_ts) AS INTEGER),
+       %s as tagsjson
+  FROM taggables t
+  JOIN notes n ON t.id = n.id
+  WHERE %s
+	`, tagsJsonFieldQuery, where), nil
+}
+
+func (s *StoragePostgres) GetNotes(
+	tx *sql.Tx, args *storage.GetNotesArgs, tagsFetchOpts *storage.TagsFetchOpts,
+) (notes []storage.NoteDataWTags, err error) {
+	tagsFetchOpts = setDefaultTagFetchOpts(tagsFetchOpts)
+
+	qargs := []interface{}{}
+	addArg := func(v interface{}) string {
+		qargs = append(qargs, v)
+		return fmt.Sprintf("$%d", len(qargs))
+	}
+
+	where := "t.owner_id = " + addArg(args.OwnerID)
+
+	for _, tagID := range args.TagIDs {
+		where += " AND " + getTaggedCond(addArg(tagID))
+	}
+
+	if args.TagExpr != nil {
+		cond, err := getTagExprCond(args.TagExpr, addArg)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		where += " AND " + cond
+	}
+
+	query, err := notesQuery(tagsFetchOpts, where+" ORDER BY t.id")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	rows, err := tx.QueryContext(s.ctx(tx), query, qargs...)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	return rowsToNotes(rows, tagsFetchOpts)
+}
+
+func (s *StoragePostgres) GetNoteByID(
+	tx *sql.Tx, noteID int, tagsFetchOpts *storage.TagsFetchOpts,
+) (note *storage.NoteDataWTags, err error) {
+	tagsFetchOpts = setDefaultTagFetchOpts(tagsFetchOpts)
+
+	query, err := notesQuery(tagsFetchOpts, "t.id = $1")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	rows, err := tx.QueryContext(s.ctx(tx), query, noteID)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	notes, err := rowsToNotes(rows, tagsFetchOpts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if len(notes) == 0 {
+		return nil, errors.Annotatef(
+			interrors.WrapInternalError(
+				sql.ErrNoRows,
+				storage.ErrNoteDoesNotExist,
+			),
+			"id %d", noteID,
+		)
+	}
+
+	return &notes[0], nil
+}
+
+// rowsToNotes expects each row to contain the following fields, in this
+// order:
+//
+// id, title, body, owner_id, created_time, updated_time, tags_data.
+// For some details on what is tags_data, see tagbrief.Parse().
+func rowsToNotes(
+	rows *sql.Rows, tagsFetchOpts *storage.TagsFetchOpts,
+) (notes []storage.NoteDataWTags, err error) {
+	notes = []storage.NoteDataWTags{}
+	for rows.Next() {
+		note := storage.NoteDataWTags{}
+		var tagBriefData []byte
+		err := rows.Scan(
+			&note.ID, &note.Title, &note.Body, &note.OwnerID,
+			&note.CreatedAt, &note.UpdatedAt,
+			&tagBriefData,
+		)
+		if err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+
+		note.Tags, err = tagbrief.Parse(tagBriefData, tagsFetchOpts)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		notes = append(notes, note)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	return notes, nil
+}
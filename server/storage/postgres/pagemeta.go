@@ -0,0 +1,131 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package postgres
+
+import (
+	"database/sql"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+func (s *StoragePostgres) RequestPageMeta(tx *sql.Tx, bookmarkID int) error {
+	_, err := tx.ExecContext(s.ctx(tx), `
+DELETE FROM page_meta WHERE bookmark_id = $1
+	`, bookmarkID)
+	if err != nil {
+		return hh.MakeInternalServerError(
+			errors.Annotatef(err, "deleting page meta of bookmark %d", bookmarkID),
+		)
+	}
+
+	_, err = tx.ExecContext(s.ctx(tx), `
+INSERT INTO page_meta (bookmark_id, url)
+  SELECT id, url FROM bookmarks WHERE id = $1
+	`, bookmarkID)
+	if err != nil {
+		return hh.MakeInternalServerError(
+			errors.Annotatef(err, "requesting page meta of bookmark %d", bookmarkID),
+		)
+	}
+
+	return nil
+}
+
+func (s *StoragePostgres) GetPendingPageMeta(
+	tx *sql.Tx, limit int,
+) ([]storage.BookmarkData, error) {
+	rows, err := tx.QueryContext(s.ctx(tx), `
+SELECT t.id, t.owner_id, b.url
+  FROM page_meta pm
+  JOIN taggables t ON t.id = pm.bookmark_id
+  JOIN bookmarks b ON b.id = pm.bookmark_id
+  WHERE pm.fetched_ts IS NULL
+  ORDER BY t.id
+  LIMIT $1
+	`, limit)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	bkms := []storage.BookmarkData{}
+	for rows.Next() {
+		var bkm storage.BookmarkData
+		if err := rows.Scan(&bkm.ID, &bkm.OwnerID, &bkm.URL); err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+		bkms = append(bkms, bkm)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	return bkms, nil
+}
+
+func (s *StoragePostgres) SetPageMeta(tx *sql.Tx, pm *storage.PageMetaData) error {
+	_, err := tx.ExecContext(s.ctx(tx), `
+UPDATE page_meta
+  SET url = $1, title = $2, description = $3, canonical_url = $4,
+      favicon_url = $5, error = $6, fetched_ts = NOW()
+  WHERE bookmark_id = $7
+	`,
+		pm.URL, pm.Title, pm.Description, pm.CanonicalURL, pm.FaviconURL,
+		pm.Error, pm.BookmarkID,
+	)
+	if err != nil {
+		return hh.MakeInternalServerError(
+			errors.Annotatef(err, "saving page meta of bookmark %d", pm.BookmarkID),
+		)
+	}
+
+	return nil
+}
+
+func (s *StoragePostgres) GetPageMeta(
+	tx *sql.Tx, bookmarkIDs []int,
+) (map[int]storage.PageMetaData, error) {
+	pms := map[int]storage.PageMetaData{}
+	if len(bookmarkIDs) == 0 {
+		return pms, nil
+	}
+
+	args := []interface{}{}
+	for _, id := range bookmarkIDs {
+		args = append(args, id)
+	}
+
+	rows, err := tx.QueryContext(s.ctx(tx), `
+SELECT pm.bookmark_id, pm.url, pm.title, pm.description, pm.canonical_url,
+       pm.favicon_url, pm.error,
+       CAST(EXTRACT(EPOCH FROM pm.fetched_ts) AS INTEGER)
+  FROM page_meta pm
+  JOIN bookmarks b ON b.id = pm.bookmark_id AND b.url = pm.url
+  WHERE pm.fetched_ts IS NOT NULL
+    AND pm.bookmark_id IN (`+getPlaceholdersString(1, len(bookmarkIDs))+`)
+	`, args...)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var pm storage.PageMetaData
+		err := rows.Scan(
+			&pm.BookmarkID, &pm.URL, &pm.Title, &pm.Description, &pm.CanonicalURL,
+			&pm.FaviconURL, &pm.Error, &pm.FetchedAt,
+		)
+		if err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+		pms[pm.BookmarkID] = pm
+	}
+	if err := rows.Err(); err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	return pms, nil
+}
@@ -6,6 +6,9 @@ package postgres // import "dmitryfrank.com/geekmarks/server/storage/postgres"
 import (
 	"database/sql"
 
+	"dmitryfrank.com/geekmarks/server/dfmigrate"
+	"dmitryfrank.com/geekmarks/server/storage/internal/txctx"
+
 	"github.com/juju/errors"
 	_ "github.com/lib/pq"
 )
@@ -14,6 +17,9 @@ import (
 type StoragePostgres struct {
 	postgresURL string
 	db          *sql.DB
+	txCtxs      txctx.Registry
+
+	migrationDriftMode dfmigrate.DriftMode
 }
 
 func New(postgresURL string) (*StoragePostgres, error) {
@@ -33,7 +39,7 @@ func (s *StoragePostgres) Connect() error {
 }
 
 func (s *StoragePostgres) ApplyMigrations() error {
-	mig, err := initMigrations()
+	mig, err := s.getMigrations()
 	if err != nil {
 		return errors.Trace(err)
 	}
@@ -45,3 +51,74 @@ func (s *StoragePostgres) ApplyMigrations() error {
 
 	return nil
 }
+
+func (s *StoragePostgres) GetMigrationStatus() (*dfmigrate.Status, error) {
+	mig, err := s.getMigrations()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	status, err := mig.Status(s.db)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return status, nil
+}
+
+func (s *StoragePostgres) Migrate(targetMigrationID int) error {
+	mig, err := s.getMigrations()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = mig.Migrate(s.db, targetMigrationID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func (s *StoragePostgres) DryRunMigration(targetMigrationID int) ([]dfmigrate.Step, error) {
+	mig, err := s.getMigrations()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	steps, err := mig.DryRun(s.db, targetMigrationID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return steps, nil
+}
+
+func (s *StoragePostgres) SetMigrationDriftMode(mode dfmigrate.DriftMode) {
+	s.migrationDriftMode = mode
+}
+
+func (s *StoragePostgres) AcceptMigrationDrift() error {
+	mig, err := s.getMigrations()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = mig.AcceptDrift(s.db)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func (s *StoragePostgres) getMigrations() (*dfmigrate.Migrations, error) {
+	mig, err := initMigrations()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	mig.SetDriftMode(s.migrationDriftMode)
+
+	return mig, nil
+}
@@ -9,11 +9,13 @@ import (
 	"database/sql"
 	"flag"
 	"os"
+	"reflect"
 	"testing"
 
 	"dmitryfrank.com/geekmarks/server/cptr"
 	"github.com/dimonomid/interrors"
 	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/storage/storagetest"
 	"dmitryfrank.com/geekmarks/server/testutils"
 
 	"github.com/juju/errors"
@@ -25,24 +27,31 @@ var (
 			"given in an environment variable GM_POSTGRES_URL.")
 )
 
-func runWithRealDB(t *testing.T, f func(si *StoragePostgres) error) {
+func newRealDB(t *testing.T) (*StoragePostgres, error) {
 	pgURL := *postgresURL
 	if pgURL == "" {
 		pgURL = os.Getenv("GM_POSTGRES_URL")
 	}
 	si, err := New(pgURL)
 	if err != nil {
-		t.Errorf("%s", interrors.ErrorStack(err))
-		return
+		return nil, errors.Trace(err)
 	}
 
 	err = si.Connect()
 	if err != nil {
-		t.Errorf("%s", interrors.ErrorStack(err))
-		return
+		return nil, errors.Trace(err)
 	}
 
 	err = testutils.PrepareTestDB(t, si)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return si, nil
+}
+
+func runWithRealDB(t *testing.T, f func(si *StoragePostgres) error) {
+	si, err := newRealDB(t)
 	if err != nil {
 		t.Errorf("%s", interrors.ErrorStack(err))
 		return
@@ -110,3 +119,105 @@ func TestTransactionRollback(t *testing.T) {
 		return nil
 	})
 }
+
+// TestTxContextsRemoved checks that the contexts of transactions are not
+// kept after the transactions are committed or rolled back: otherwise, every
+// request context would be leaked.
+func TestTxContextsRemoved(t *testing.T) {
+	runWithRealDB(t, func(si *StoragePostgres) error {
+		errTest := errors.New("test error")
+
+		txFuncs := map[string]func() error{
+			"commit": func() error {
+				return si.Tx(func(tx *sql.Tx) error {
+					return nil
+				})
+			},
+			"rollback": func() error {
+				return si.Tx(func(tx *sql.Tx) error {
+					return errTest
+				})
+			},
+			"read-only rollback": func() error {
+				return si.TxOpt(
+					storage.TxILevelRepeatableRead, storage.TxModeReadOnly,
+					func(tx *sql.Tx) error {
+						return errTest
+					},
+				)
+			},
+		}
+
+		for name, f := range txFuncs {
+			if err := f(); err != nil && errors.Cause(err) != errTest {
+				return errors.Annotatef(err, "%s", name)
+			}
+
+			if n := si.txCtxs.Len(); n != 0 {
+				return errors.Errorf("%s: expected no registered transactions, got %d", name, n)
+			}
+		}
+
+		return nil
+	})
+}
+
+// TestOrphanedTagNames checks the report and repair of tag names which
+// belong to no tag; unlike other integrity problems, those can't be created
+// by the conformance suite in a backend-agnostic way. It also makes sure that
+// the repair works in Postgres at all, since it needs a read-write
+// transaction.
+func TestOrphanedTagNames(t *testing.T) {
+	runWithRealDB(t, func(si *StoragePostgres) error {
+		// Foreign keys prevent orphaned tag names, so the triggers checking them
+		// have to be disabled to create one.
+		err := si.Tx(func(tx *sql.Tx) error {
+			for _, q := range []string{
+				"SET LOCAL session_replication_role = replica",
+				"INSERT INTO tag_names (tag_id, name) VALUES (9999, 'ghost')",
+			} {
+				if _, err := tx.Exec(q); err != nil {
+					return errors.Annotatef(err, "query %q", q)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		report, err := si.GetIntegrityReport()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		expected := []storage.OrphanedTagName{{TagID: 9999, Name: "ghost"}}
+		if !reflect.DeepEqual(report.OrphanedTagNames, expected) {
+			return errors.Errorf(
+				"expected orphaned tag names %v, got %v", expected, report.OrphanedTagNames,
+			)
+		}
+
+		fixes, err := si.RepairIntegrity()
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(fixes) != 1 || fixes[0].Kind != storage.IntegrityFixKindOrphanedTagName {
+			return errors.Errorf("unexpected fixes: %+v", fixes)
+		}
+
+		return errors.Trace(si.CheckIntegrity())
+	})
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) (storage.Storage, func()) {
+		si, err := newRealDB(t)
+		if err != nil {
+			t.Fatalf("%s", interrors.ErrorStack(err))
+		}
+
+		return si, func() {
+			si.db.Close()
+		}
+	})
+}
@@ -0,0 +1,159 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package postgres
+
+import (
+	"database/sql"
+	"sort"
+	"strconv"
+	"strings"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/dimonomid/interrors"
+	"github.com/juju/errors"
+)
+
+func (s *StoragePostgres) SaveBookmarkRevision(
+	tx *sql.Tx, bookmarkID int,
+) (revisionID int, err error) {
+	tagIDs, err := s.GetTaggings(tx, bookmarkID, storage.TaggingModeLeafs)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	err = tx.QueryRowContext(s.ctx(tx), `
+INSERT INTO bookmark_revisions (bookmark_id, url, title, comment, tag_ids)
+  SELECT id, url, title, comment, $2 FROM bookmarks WHERE id = $1
+  RETURNING id
+	`, bookmarkID, joinIDs(tagIDs),
+	).Scan(&revisionID)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return 0, errors.Annotatef(
+				interrors.WrapInternalError(
+					err,
+					storage.ErrBookmarkDoesNotExist,
+				),
+				"id %d", bookmarkID,
+			)
+		}
+		return 0, hh.MakeInternalServerError(errors.Annotatef(
+			err, "saving revision of bookmark with id %d", bookmarkID,
+		))
+	}
+
+	return revisionID, nil
+}
+
+func (s *StoragePostgres) GetBookmarkRevisions(
+	tx *sql.Tx, bookmarkID int,
+) ([]storage.BookmarkRevisionData, error) {
+	rows, err := tx.QueryContext(s.ctx(tx), `
+SELECT `+bookmarkRevisionFields+`
+  FROM bookmark_revisions
+  WHERE bookmark_id = $1
+  ORDER BY id DESC
+	`, bookmarkID,
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	revs := []storage.BookmarkRevisionData{}
+	for rows.Next() {
+		rev, err := scanBookmarkRevision(rows)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		revs = append(revs, *rev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	return revs, nil
+}
+
+func (s *StoragePostgres) GetBookmarkRevision(
+	tx *sql.Tx, revisionID int,
+) (*storage.BookmarkRevisionData, error) {
+	rev, err := scanBookmarkRevision(tx.QueryRowContext(s.ctx(tx), `
+SELECT `+bookmarkRevisionFields+`
+  FROM bookmark_revisions
+  WHERE id = $1
+	`, revisionID,
+	))
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, errors.Annotatef(
+				interrors.WrapInternalError(
+					err,
+					storage.ErrBookmarkRevisionDoesNotExist,
+				),
+				"id %d", revisionID,
+			)
+		}
+		return nil, errors.Trace(err)
+	}
+
+	return rev, nil
+}
+
+const bookmarkRevisionFields = `id, bookmark_id, url, title, comment, tag_ids,
+       CAST(EXTRACT(EPOCH FROM created_ts) AS INTEGER)`
+
+// scanBookmarkRevision scans the row with bookmarkRevisionFields. Errors are
+// returned as is, so that the caller can check for sql.ErrNoRows.
+func scanBookmarkRevision(row scanner) (*storage.BookmarkRevisionData, error) {
+	rev := storage.BookmarkRevisionData{}
+	var tagIDs string
+	err := row.Scan(
+		&rev.ID, &rev.BookmarkID, &rev.URL, &rev.Title, &rev.Comment, &tagIDs,
+		&rev.CreatedAt,
+	)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	rev.TagIDs, err = splitIDs(tagIDs)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	return &rev, nil
+}
+
+// joinIDs and splitIDs convert ids to the comma-separated string and back.
+func joinIDs(ids []int) string {
+	ids = append([]int{}, ids...)
+	sort.Ints(ids)
+
+	strs := []string{}
+	for _, id := range ids {
+		strs = append(strs, strconv.Itoa(id))
+	}
+	return strings.Join(strs, ",")
+}
+
+func splitIDs(s string) ([]int, error) {
+	ids := []int{}
+	if s == "" {
+		return ids, nil
+	}
+
+	for _, str := range strings.Split(s, ",") {
+		id, err := strconv.Atoi(str)
+		if err != nil {
+			return nil, errors.Annotatef(err, "parsing ids %q", s)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
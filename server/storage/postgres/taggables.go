@@ -5,22 +5,31 @@ package postgres
 
 import (
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"strconv"
 
 	hh "dmitryfrank.com/geekmarks/server/httphelper"
 	"dmitryfrank.com/geekmarks/server/storage"
-	"dmitryfrank.com/geekmarks/server/storage/postgres/internal/taghier"
 	"github.com/juju/errors"
 	_ "github.com/lib/pq"
 )
 
 func (s *StoragePostgres) CreateTaggable(tx *sql.Tx, tgbd *storage.TaggableData) (tgbID int, err error) {
-	err = tx.QueryRow(
-		"INSERT INTO taggables (owner_id, type) VALUES ($1, $2) RETURNING id",
-		tgbd.OwnerID, string(tgbd.Type),
-	).Scan(&tgbID)
+	cols := "owner_id, type"
+	phs := "$1, $2"
+	args := []interface{}{tgbd.OwnerID, string(tgbd.Type)}
+	if tgbd.CreatedAt != 0 {
+		args = append(args, tgbd.CreatedAt)
+		cols += ", created_ts"
+		phs += fmt.Sprintf(", to_timestamp($%d)", len(args))
+	}
+	if tgbd.UpdatedAt != 0 {
+		args = append(args, tgbd.UpdatedAt)
+		cols += ", updated_ts"
+		phs += fmt.Sprintf(", to_timestamp($%d)", len(args))
+	}
+
+	query := "INSERT INTO taggables (" + cols + ") VALUES (" + phs + ") RETURNING id"
+	err = tx.QueryRowContext(s.ctx(tx), query, args...).Scan(&tgbID)
 	if err != nil {
 		return 0, hh.MakeInternalServerError(errors.Annotatef(
 			err, "adding new taggable (owner_id: %d, type: %s)", tgbd.OwnerID, tgbd.Type,
@@ -31,8 +40,8 @@ func (s *StoragePostgres) CreateTaggable(tx *sql.Tx, tgbd *storage.TaggableData)
 }
 
 func (s *StoragePostgres) DeleteTaggable(tx *sql.Tx, taggableID int) error {
-	_, err := tx.Exec(
-		"DELETE FROM taggables WHERE id = $1", taggableID,
+	_, err := tx.ExecContext(
+		s.ctx(tx), "DELETE FROM taggables WHERE id = $1", taggableID,
 	)
 	if err != nil {
 		return hh.MakeInternalServerError(errors.Annotatef(
@@ -43,6 +52,28 @@ func (s *StoragePostgres) DeleteTaggable(tx *sql.Tx, taggableID int) error {
 	return nil
 }
 
+func (s *StoragePostgres) SetTaggableUpdatedAt(
+	tx *sql.Tx, taggableID int, updatedAt uint64,
+) (err error) {
+	if updatedAt == 0 {
+		_, err = tx.ExecContext(
+			s.ctx(tx), "UPDATE taggables SET updated_ts = NOW() WHERE id = $1", taggableID,
+		)
+	} else {
+		_, err = tx.ExecContext(
+			s.ctx(tx), "UPDATE taggables SET updated_ts = to_timestamp($1) WHERE id = $2",
+			updatedAt, taggableID,
+		)
+	}
+	if err != nil {
+		return hh.MakeInternalServerError(errors.Annotatef(
+			err, "setting update time of taggable %d", taggableID,
+		))
+	}
+
+	return nil
+}
+
 func (s *StoragePostgres) GetTaggedTaggableIDs(
 	tx *sql.Tx, tagIDs []int, ownerID *int, ttypes []storage.TaggableType,
 ) (taggableIDs []int, err error) {
@@ -94,7 +125,7 @@ func (s *StoragePostgres) GetTaggedTaggableIDs(
 	}
 
 	// Execute it
-	rows, err := tx.Query(query, args...)
+	rows, err := tx.QueryContext(s.ctx(tx), query, args...)
 	if err != nil {
 		return nil, hh.MakeInternalServerError(err)
 	}
@@ -120,7 +151,7 @@ func (s *StoragePostgres) GetTaggedTaggableIDs(
 func (s *StoragePostgres) getTaggablesTaggedWithOnlyOneTag(
 	tx *sql.Tx, tagID int,
 ) (taggableIDs []int, err error) {
-	rows, err := tx.Query(`
+	rows, err := tx.QueryContext(s.ctx(tx), `
 SELECT id FROM taggables
 JOIN taggings t ON (t.taggable_id = taggables.id AND t.tag_id = $1)
 FULL OUTER JOIN taggings t2 ON (t2.taggable_id = taggables.id AND t2.tag_id != $1)
@@ -141,45 +172,8 @@ WHERE t2.taggable_id IS NULL
 	return taggableIDs, nil
 }
 
-type tagBrief struct {
-	ID       int    `json:"id"`
-	ParentID int    `json:"parent_id"`
-	Name     string `json:"name"`
-}
-
-type tagBriefMap map[string]tagBrief
-
-func (tm tagBriefMap) GetParent(id int) (int, error) {
-	t, ok := tm[strconv.Itoa(id)]
-	if !ok {
-		return 0, hh.MakeInternalServerError(errors.Errorf("no tag with id %d", id))
-	}
-	return t.ParentID, nil
-}
-
-func (tm tagBriefMap) GetPath(id int) ([]storage.BookmarkTagPathItem, error) {
-	t, ok := tm[strconv.Itoa(id)]
-	if !ok {
-		return nil, hh.MakeInternalServerError(errors.Errorf("no tag with id %d", id))
-	}
-
-	var ret []storage.BookmarkTagPathItem
-	if t.ParentID != 0 {
-		var err error
-		ret, err = tm.GetPath(t.ParentID)
-		if err != nil {
-			return nil, errors.Trace(err)
-		}
-	}
-
-	return append(ret, storage.BookmarkTagPathItem{
-		ID:   t.ID,
-		Name: t.Name,
-	}), nil
-}
-
 // getTagsJsonFieldQuery returns a part of SQL query which results in a "tag
-// brief data" JSON. For details on that, see parseTagBrief().
+// brief data" JSON. For details on that, see tagbrief.Parse().
 func getTagsJsonFieldQuery(opts *storage.TagsFetchOpts, taggablesAlias string) (string, error) {
 	switch opts.TagsFetchMode {
 	case storage.TagsFetchModeNone:
@@ -212,53 +206,3 @@ func getTagsJsonFieldQuery(opts *storage.TagsFetchOpts, taggablesAlias string) (
 		return "", errors.Errorf("wrong tags fetch mode %q", opts.TagsFetchMode)
 	}
 }
-
-// parseTagBrief takes "tag brief data", and converts it to an array of
-// storage.BookmarkTagPath.
-//
-// "tag brief data" is the following JSON data: a map from a tag id to JSON
-// object which represents a PostgreSQL type gm_tag_brief: (id int, parent_id
-// int, name text).
-func parseTagBrief(
-	tagBriefData []byte, tagsFetchOpts *storage.TagsFetchOpts,
-) (bmTags []storage.BookmarkTagPath, err error) {
-	if len(tagBriefData) == 0 {
-		tagBriefData = []byte("{}")
-	}
-
-	var tagBriefMap tagBriefMap
-	if err := json.Unmarshal(tagBriefData, &tagBriefMap); err != nil {
-		return nil, hh.MakeInternalServerError(err)
-	}
-
-	thier := taghier.New(tagBriefMap)
-	for _, t := range tagBriefMap {
-		thier.Add(t.ID)
-	}
-
-	var bkmTagIDs []int
-	switch tagsFetchOpts.TagsFetchMode {
-	case storage.TagsFetchModeLeafs:
-		bkmTagIDs = thier.GetLeafs()
-
-	case storage.TagsFetchModeAll:
-		bkmTagIDs = thier.GetAll()
-	}
-
-	for _, tagID := range bkmTagIDs {
-		var tagPathItems []storage.BookmarkTagPathItem
-		if tagsFetchOpts.TagNamesFetchMode == storage.TagNamesFetchModeFull {
-			var err error
-			tagPathItems, err = tagBriefMap.GetPath(tagID)
-			if err != nil {
-				return nil, errors.Trace(err)
-			}
-		}
-
-		bmTags = append(bmTags, storage.BookmarkTagPath{
-			TagItems: tagPathItems,
-		})
-	}
-
-	return bmTags, nil
-}
@@ -8,7 +8,7 @@ import (
 
 	hh "dmitryfrank.com/geekmarks/server/httphelper"
 	"dmitryfrank.com/geekmarks/server/storage"
-	"dmitryfrank.com/geekmarks/server/storage/postgres/internal/taghier"
+	"dmitryfrank.com/geekmarks/server/storage/internal/taghier"
 	"github.com/juju/errors"
 	_ "github.com/lib/pq"
 )
@@ -16,7 +16,7 @@ import (
 func (s *StoragePostgres) GetTaggings(
 	tx *sql.Tx, taggableID int, tm storage.TaggingMode,
 ) (tagIDs []int, err error) {
-	rows, err := tx.Query("SELECT tag_id FROM taggings WHERE taggable_id = $1", taggableID)
+	rows, err := tx.QueryContext(s.ctx(tx), "SELECT tag_id FROM taggings WHERE taggable_id = $1", taggableID)
 	if err != nil {
 		return nil, errors.Annotatef(
 			hh.MakeInternalServerError(err),
@@ -101,8 +101,18 @@ func (s *StoragePostgres) SetTaggings(
 	diff := taghier.GetDiff(current, desired)
 
 	// Apply the difference
-	s.addTaggings(tx, taggableID, diff.Add)
-	s.deleteTaggings(tx, taggableID, diff.Delete)
+	if err := s.addTaggings(tx, taggableID, diff.Add); err != nil {
+		return errors.Trace(err)
+	}
+	if err := s.deleteTaggings(tx, taggableID, diff.Delete); err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(diff.Add) > 0 || len(diff.Delete) > 0 {
+		if err := s.SetTaggableUpdatedAt(tx, taggableID, 0); err != nil {
+			return errors.Trace(err)
+		}
+	}
 
 	return nil
 }
@@ -111,8 +121,8 @@ func (s *StoragePostgres) addTaggings(
 	tx *sql.Tx, taggableID int, tagIDsToAdd []int,
 ) (err error) {
 	for _, tagID := range tagIDsToAdd {
-		_, err := tx.Exec(
-			"INSERT INTO taggings (taggable_id, tag_id) VALUES ($1, $2)",
+		_, err := tx.ExecContext(
+			s.ctx(tx), "INSERT INTO taggings (taggable_id, tag_id) VALUES ($1, $2)",
 			taggableID, tagID,
 		)
 		if err != nil {
@@ -126,8 +136,8 @@ func (s *StoragePostgres) deleteTaggings(
 	tx *sql.Tx, taggableID int, tagIDsToDelete []int,
 ) (err error) {
 	for _, tagID := range tagIDsToDelete {
-		_, err := tx.Exec(
-			"DELETE FROM taggings WHERE taggable_id = $1 and tag_id = $2",
+		_, err := tx.ExecContext(
+			s.ctx(tx), "DELETE FROM taggings WHERE taggable_id = $1 and tag_id = $2",
 			taggableID, tagID,
 		)
 		if err != nil {
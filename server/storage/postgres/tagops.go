@@ -0,0 +1,175 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package postgres
+
+import (
+	"database/sql"
+	"encoding/json"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+func (s *StoragePostgres) SaveTagOperation(
+	tx *sql.Tx, op *storage.TagOperationData,
+) (opID int, err error) {
+	tag, taggings, err := marshalTagOperation(op)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	err = tx.QueryRowContext(s.ctx(tx), `
+INSERT INTO tag_operations (owner_id, kind, tag_id, tag, taggings)
+  VALUES ($1, $2, $3, $4, $5)
+  RETURNING id
+	`, op.OwnerID, string(op.Kind), op.TagID, tag, taggings,
+	).Scan(&opID)
+	if err != nil {
+		return 0, hh.MakeInternalServerError(errors.Annotatef(
+			err, "saving %s operation on tag %d", op.Kind, op.TagID,
+		))
+	}
+
+	return opID, nil
+}
+
+func (s *StoragePostgres) GetTagOperations(
+	tx *sql.Tx, ownerID int, limit int,
+) ([]storage.TagOperationData, error) {
+	rows, err := tx.QueryContext(s.ctx(tx), `
+SELECT `+tagOperationFields+`
+  FROM tag_operations
+  WHERE owner_id = $1
+  ORDER BY id DESC
+  LIMIT $2
+	`, ownerID, limit,
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	ops := []storage.TagOperationData{}
+	for rows.Next() {
+		op, err := scanTagOperation(rows)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		ops = append(ops, *op)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	return ops, nil
+}
+
+func (s *StoragePostgres) DeleteTagOperation(tx *sql.Tx, opID int) error {
+	_, err := tx.ExecContext(
+		s.ctx(tx), "DELETE FROM tag_operations WHERE id = $1", opID,
+	)
+	if err != nil {
+		return hh.MakeInternalServerError(errors.Annotatef(
+			err, "deleting tag operation with id %d", opID,
+		))
+	}
+
+	return nil
+}
+
+func (s *StoragePostgres) PurgeTagOperations(
+	tx *sql.Tx, ownerID int, keepCnt int,
+) (purgedCnt int, err error) {
+	res, err := tx.ExecContext(s.ctx(tx), `
+DELETE FROM tag_operations
+  WHERE owner_id = $1 AND id NOT IN (
+    SELECT id FROM tag_operations WHERE owner_id = $1 ORDER BY id DESC LIMIT $2
+  )
+	`, ownerID, keepCnt,
+	)
+	if err != nil {
+		return 0, hh.MakeInternalServerError(errors.Annotatef(
+			err, "purging tag operations of the user %d", ownerID,
+		))
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, hh.MakeInternalServerError(err)
+	}
+
+	return int(n), nil
+}
+
+const tagOperationFields = `id, owner_id, kind, tag_id, tag, taggings,
+       CAST(EXTRACT(EPOCH FROM created_ts) AS INTEGER)`
+
+func scanTagOperation(row scanner) (*storage.TagOperationData, error) {
+	op := storage.TagOperationData{}
+	var kind, tag, taggings string
+	err := row.Scan(
+		&op.ID, &op.OwnerID, &kind, &op.TagID, &tag, &taggings, &op.CreatedAt,
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	op.Kind = storage.TagOperationKind(kind)
+
+	if err := unmarshalTagOperation(&op, tag, taggings); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &op, nil
+}
+
+// marshalTagOperation and unmarshalTagOperation convert the tag snapshot and
+// the taggings of the operation to the JSON strings and back; empty strings
+// stand for nil.
+func marshalTagOperation(
+	op *storage.TagOperationData,
+) (tag, taggings string, err error) {
+	if op.Tag != nil {
+		data, err := json.Marshal(op.Tag)
+		if err != nil {
+			return "", "", hh.MakeInternalServerError(err)
+		}
+		tag = string(data)
+	}
+
+	if op.Taggings != nil {
+		data, err := json.Marshal(op.Taggings)
+		if err != nil {
+			return "", "", hh.MakeInternalServerError(err)
+		}
+		taggings = string(data)
+	}
+
+	return tag, taggings, nil
+}
+
+func unmarshalTagOperation(
+	op *storage.TagOperationData, tag, taggings string,
+) error {
+	if tag != "" {
+		op.Tag = &storage.TagData{}
+		if err := json.Unmarshal([]byte(tag), op.Tag); err != nil {
+			return hh.MakeInternalServerError(errors.Annotatef(
+				err, "tag operation %d: parsing tag", op.ID,
+			))
+		}
+	}
+
+	if taggings != "" {
+		op.Taggings = map[int][]int{}
+		if err := json.Unmarshal([]byte(taggings), &op.Taggings); err != nil {
+			return hh.MakeInternalServerError(errors.Annotatef(
+				err, "tag operation %d: parsing taggings", op.ID,
+			))
+		}
+	}
+
+	return nil
+}
@@ -13,7 +13,7 @@ import (
 	hh "dmitryfrank.com/geekmarks/server/httphelper"
 	"github.com/dimonomid/interrors"
 	"dmitryfrank.com/geekmarks/server/storage"
-	"dmitryfrank.com/geekmarks/server/storage/postgres/internal/taghier"
+	"dmitryfrank.com/geekmarks/server/storage/internal/taghier"
 	"github.com/golang/glog"
 	"github.com/juju/errors"
 	_ "github.com/lib/pq"
@@ -21,6 +21,19 @@ import (
 
 func (s *StoragePostgres) CreateTag(
 	tx *sql.Tx, td *storage.TagData,
+) (tagID int, err error) {
+	return s.createTag(tx, td, false)
+}
+
+func (s *StoragePostgres) RestoreTag(tx *sql.Tx, td *storage.TagData) error {
+	_, err := s.createTag(tx, td, true)
+	return errors.Trace(err)
+}
+
+// createTag creates the tag with all its subtags; if keepIDs is true, the ids
+// are taken from the given tag data instead of being generated.
+func (s *StoragePostgres) createTag(
+	tx *sql.Tx, td *storage.TagData, keepIDs bool,
 ) (tagID int, err error) {
 	if len(td.Names) == 0 {
 		return 0, errors.Errorf("tag should have at least one name")
@@ -36,7 +49,7 @@ func (s *StoragePostgres) CreateTag(
 	if parentID > 0 {
 		// check if given parent tag id exists
 		var tmpTagId int
-		err := tx.QueryRow("SELECT id FROM tags WHERE id = $1", parentID).
+		err := tx.QueryRowContext(s.ctx(tx), "SELECT id FROM tags WHERE id = $1", parentID).
 			Scan(&tmpTagId)
 		if err != nil {
 			if errors.Cause(err) == sql.ErrNoRows {
@@ -48,7 +61,7 @@ func (s *StoragePostgres) CreateTag(
 		}
 
 		// increment children count of the parent
-		_, err = tx.Exec("UPDATE tags SET children_cnt = children_cnt + 1 WHERE id = $1", parentID)
+		_, err = tx.ExecContext(s.ctx(tx), "UPDATE tags SET children_cnt = children_cnt + 1 WHERE id = $1", parentID)
 		if err != nil {
 			return 0, hh.MakeInternalServerError(errors.Annotatef(
 				err, "incrementing children_cnt of the tag with id %d", parentID,
@@ -71,10 +84,17 @@ func (s *StoragePostgres) CreateTag(
 		description = *td.Description
 	}
 
-	err = tx.QueryRow(
-		"INSERT INTO tags (parent_id, owner_id, descr) VALUES ($1, $2, $3) RETURNING id",
-		iParentID, td.OwnerID, description,
-	).Scan(&tagID)
+	if keepIDs {
+		err = tx.QueryRowContext(
+			s.ctx(tx), "INSERT INTO tags (id, parent_id, owner_id, descr) VALUES ($1, $2, $3, $4) RETURNING id",
+			td.ID, iParentID, td.OwnerID, description,
+		).Scan(&tagID)
+	} else {
+		err = tx.QueryRowContext(
+			s.ctx(tx), "INSERT INTO tags (parent_id, owner_id, descr) VALUES ($1, $2, $3) RETURNING id",
+			iParentID, td.OwnerID, description,
+		).Scan(&tagID)
+	}
 	if err != nil {
 		return 0, hh.MakeInternalServerError(errors.Annotatef(
 			err, "adding new tag (parent_id: %d, owner_id: %d)", iParentID, td.OwnerID,
@@ -94,7 +114,7 @@ func (s *StoragePostgres) CreateTag(
 
 	// Create all subtags
 	for _, subTag := range td.Subtags {
-		_, err := s.CreateTag(tx, &subTag)
+		_, err := s.createTag(tx, &subTag, keepIDs)
 		if err != nil {
 			return 0, errors.Annotatef(err, "creating subtag")
 		}
@@ -188,8 +208,8 @@ func (s *StoragePostgres) UpdateTag(
 		}
 
 		// Update parent_id of the moved tag
-		_, err = tx.Exec(
-			"UPDATE tags SET parent_id = $1 WHERE id = $2", *td.ParentTagID, td.ID,
+		_, err = tx.ExecContext(
+			s.ctx(tx), "UPDATE tags SET parent_id = $1 WHERE id = $2", *td.ParentTagID, td.ID,
 		)
 		if err != nil {
 			return hh.MakeInternalServerError(errors.Annotatef(
@@ -199,8 +219,8 @@ func (s *StoragePostgres) UpdateTag(
 		}
 
 		// Update childrent_cnt of the two parents
-		_, err = tx.Exec(
-			"UPDATE tags SET children_cnt = children_cnt - 1 WHERE id = $1", oldParentID,
+		_, err = tx.ExecContext(
+			s.ctx(tx), "UPDATE tags SET children_cnt = children_cnt - 1 WHERE id = $1", oldParentID,
 		)
 		if err != nil {
 			return hh.MakeInternalServerError(errors.Annotatef(
@@ -208,8 +228,8 @@ func (s *StoragePostgres) UpdateTag(
 			))
 		}
 
-		_, err = tx.Exec(
-			"UPDATE tags SET children_cnt = children_cnt + 1 WHERE id = $1", *td.ParentTagID,
+		_, err = tx.ExecContext(
+			s.ctx(tx), "UPDATE tags SET children_cnt = children_cnt + 1 WHERE id = $1", *td.ParentTagID,
 		)
 		if err != nil {
 			return hh.MakeInternalServerError(errors.Annotatef(
@@ -221,13 +241,13 @@ func (s *StoragePostgres) UpdateTag(
 
 	// Update tag description, if needed {{{
 	if td.Description != nil {
-		_, err = tx.Exec(
-			"UPDATE tags SET descr = $1 WHERE id = $2", td.Description, td.ID,
+		_, err = tx.ExecContext(
+			s.ctx(tx), "UPDATE tags SET descr = $1 WHERE id = $2", td.Description, td.ID,
 		)
 		if err != nil {
 			return hh.MakeInternalServerError(errors.Annotatef(
 				err, "updating tag description (id: %d, description: %q)",
-				td.ID, td.Description,
+				td.ID, *td.Description,
 			))
 		}
 	}
@@ -314,14 +334,14 @@ func (s *StoragePostgres) DeleteTag(
 
 	// Here we just delete the subject tag; all the subtags and taggings
 	// will be deleted automatically thanks to ON DELETE CASCADE
-	_, err = tx.Exec("DELETE FROM tags WHERE id = $1", tagID)
+	_, err = tx.ExecContext(s.ctx(tx), "DELETE FROM tags WHERE id = $1", tagID)
 	if err != nil {
 		return hh.MakeInternalServerError(errors.Annotatef(
 			err, "deleting the tag with id %d", tagID,
 		))
 	}
 
-	_, err = tx.Exec("UPDATE tags SET children_cnt = children_cnt - 1 WHERE id = $1", td.ParentTagID)
+	_, err = tx.ExecContext(s.ctx(tx), "UPDATE tags SET children_cnt = children_cnt - 1 WHERE id = $1", td.ParentTagID)
 	if err != nil {
 		return hh.MakeInternalServerError(errors.Annotatef(
 			err, "decrementing children_cnt of the tag with id %d", td.ParentTagID,
@@ -373,7 +393,7 @@ func (s *StoragePostgres) GetTagIDByName(
 	tx *sql.Tx, parentTagID int, tagName string,
 ) (int, error) {
 	var tagID int
-	err := tx.QueryRow(`
+	err := tx.QueryRowContext(s.ctx(tx), `
 		SELECT t.id
 			FROM tag_names n
 			JOIN tags t ON n.tag_id = t.id
@@ -399,8 +419,8 @@ func (s *StoragePostgres) GetTagIDByName(
 // GetRootTagID returns the id of the root tag for the given user.
 func (s *StoragePostgres) GetRootTagID(tx *sql.Tx, ownerID int) (int, error) {
 	var rootTagID int
-	err := tx.QueryRow(
-		"SELECT id FROM tags WHERE owner_id = $1 AND parent_id IS NULL",
+	err := tx.QueryRowContext(
+		s.ctx(tx), "SELECT id FROM tags WHERE owner_id = $1 AND parent_id IS NULL",
 		ownerID,
 	).Scan(&rootTagID)
 	if err != nil {
@@ -414,7 +434,7 @@ func (s *StoragePostgres) GetRootTagID(tx *sql.Tx, ownerID int) (int, error) {
 
 func (s *StoragePostgres) GetTagNames(tx *sql.Tx, tagID int) ([]string, error) {
 	var tagNames []string
-	rows, err := tx.Query(`SELECT name FROM tag_names WHERE tag_id = $1 ORDER BY "primary" DESC`, tagID)
+	rows, err := tx.QueryContext(s.ctx(tx), `SELECT name FROM tag_names WHERE tag_id = $1 ORDER BY "primary" DESC`, tagID)
 	if err != nil {
 		return nil, errors.Annotatef(
 			hh.MakeInternalServerError(err),
@@ -439,6 +459,72 @@ func (s *StoragePostgres) GetTagNames(tx *sql.Tx, tagID int) ([]string, error) {
 	return tagNames, nil
 }
 
+func (s *StoragePostgres) GetTagBookmarkCounts(
+	tx *sql.Tx, ownerID int,
+) (counts map[int]storage.TagBookmarkCounts, err error) {
+	counts = make(map[int]storage.TagBookmarkCounts)
+
+	// Since bookmarks are tagged with all the supertags too, the total count
+	// is just the number of taggings, and the bookmark is tagged directly if
+	// it's not tagged with any of the subtags.
+	rows, err := tx.QueryContext(s.ctx(tx), `
+SELECT tg.tag_id, COUNT(*), SUM(CASE WHEN NOT EXISTS (
+    SELECT 1 FROM taggings ctg JOIN tags ct ON ct.id = ctg.tag_id
+      WHERE ctg.taggable_id = tg.taggable_id AND ct.parent_id = tg.tag_id
+  ) THEN 1 ELSE 0 END)
+  FROM taggings tg
+    JOIN bookmarks b ON b.id = tg.taggable_id
+    JOIN taggables t ON t.id = tg.taggable_id
+    JOIN tags ON tags.id = tg.tag_id
+  WHERE t.owner_id = $1 AND tags.parent_id IS NOT NULL
+  GROUP BY tg.tag_id`, ownerID,
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(errors.Annotatef(
+			err, "getting bookmark counts of tags of the user %d", ownerID,
+		))
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tagID int
+		var cnt storage.TagBookmarkCounts
+		if err := rows.Scan(&tagID, &cnt.Total, &cnt.Direct); err != nil {
+			return nil, hh.MakeInternalServerError(errors.Trace(err))
+		}
+		counts[tagID] = cnt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, hh.MakeInternalServerError(errors.Trace(err))
+	}
+
+	// The root tag: bookmarks tagged with the root tag only (which shouldn't
+	// happen normally) are considered untagged, like GetBookmarks does.
+	var rootCnt storage.TagBookmarkCounts
+	err = tx.QueryRowContext(s.ctx(tx), `
+SELECT COUNT(*), COALESCE(SUM(CASE WHEN NOT EXISTS (
+    SELECT 1 FROM taggings tg JOIN tags ON tags.id = tg.tag_id
+      WHERE tg.taggable_id = t.id AND tags.parent_id IS NOT NULL
+  ) THEN 1 ELSE 0 END), 0)
+  FROM taggables t JOIN bookmarks b ON b.id = t.id
+  WHERE t.owner_id = $1`, ownerID,
+	).Scan(&rootCnt.Total, &rootCnt.Direct)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(errors.Annotatef(
+			err, "getting bookmark counts of the user %d", ownerID,
+		))
+	}
+
+	if rootCnt.Total > 0 {
+		rootTagID, err := s.GetRootTagID(tx, ownerID)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		counts[rootTagID] = rootCnt
+	}
+
+	return counts, nil
+}
+
 func (s *StoragePostgres) GetTag(
 	tx *sql.Tx, tagID int, opts *storage.GetTagOpts,
 ) (*storage.TagData, error) {
@@ -519,7 +605,7 @@ func (s *StoragePostgres) getTagsInternal(
 		)
 	}
 
-	rows, err := tx.Query(query, tagID)
+	rows, err := tx.QueryContext(s.ctx(tx), query, tagID)
 	if err != nil {
 		if errors.Cause(err) != sql.ErrNoRows {
 			return nil, errors.Annotatef(
@@ -585,7 +671,7 @@ func (s *StoragePostgres) getTagsInternal(
 // the given parent tag.
 func (s *StoragePostgres) tagExists(tx *sql.Tx, parentTagID int, name string) (ok bool, err error) {
 	var cnt int
-	err = tx.QueryRow(`
+	err = tx.QueryRowContext(s.ctx(tx), `
 		SELECT COUNT(t.id)
 			FROM tag_names n
 			JOIN tags t ON n.tag_id = t.id
@@ -656,7 +742,7 @@ func (s *StoragePostgres) addTagName(
 	tx *sql.Tx, tagID, parentTagID int, name string, primary, allowEmpty bool,
 ) error {
 	glog.V(3).Infof(
-		"Adding tag name %q for tag %d, primary: %q", name, tagID, primary,
+		"Adding tag name %q for tag %d, primary: %v", name, tagID, primary,
 	)
 
 	err := storage.ValidateTagName(name, allowEmpty)
@@ -673,8 +759,8 @@ func (s *StoragePostgres) addTagName(
 		return errors.Errorf("Tag with the name %q already exists", name)
 	}
 
-	_, err = tx.Exec(
-		`INSERT INTO tag_names (tag_id, name, "primary") VALUES ($1, $2, $3)`,
+	_, err = tx.ExecContext(
+		s.ctx(tx), `INSERT INTO tag_names (tag_id, name, "primary") VALUES ($1, $2, $3)`,
 		tagID, name, primary,
 	)
 	if err != nil {
@@ -691,8 +777,8 @@ func (s *StoragePostgres) deleteTagName(
 ) error {
 	glog.V(3).Infof("Deleting tag name %q from tag %d", name, tagID)
 
-	_, err := tx.Exec(
-		`DELETE FROM tag_names WHERE tag_id = $1 and name = $2`,
+	_, err := tx.ExecContext(
+		s.ctx(tx), `DELETE FROM tag_names WHERE tag_id = $1 and name = $2`,
 		tagID, name,
 	)
 	if err != nil {
@@ -708,17 +794,17 @@ func (s *StoragePostgres) setTagNamePrimary(
 	tx *sql.Tx, tagID int, name string, primary bool,
 ) error {
 	glog.V(3).Infof(
-		"Setting primariness of tag name %q from tag %d, primary: %q",
+		"Setting primariness of tag name %q from tag %d, primary: %v",
 		name, tagID, primary,
 	)
 
-	_, err := tx.Exec(
-		`UPDATE tag_names SET "primary" = $1 WHERE tag_id = $2 and name = $3`,
+	_, err := tx.ExecContext(
+		s.ctx(tx), `UPDATE tag_names SET "primary" = $1 WHERE tag_id = $2 and name = $3`,
 		primary, tagID, name,
 	)
 	if err != nil {
 		return hh.MakeInternalServerError(errors.Annotatef(
-			err, "updating tag name primariness: %q for tag with id %d, primary: %q",
+			err, "updating tag name primariness: %q for tag with id %d, primary: %v",
 			name, tagID, primary,
 		))
 	}
@@ -4,6 +4,7 @@
 package postgres
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"net"
@@ -17,11 +18,27 @@ import (
 )
 
 func (s *StoragePostgres) Tx(fn func(*sql.Tx) error) error {
-	return s.TxOpt(storage.TxILevelReadCommitted, storage.TxModeReadWrite, fn)
+	return s.TxOptCtx(
+		context.Background(),
+		storage.TxILevelReadCommitted, storage.TxModeReadWrite, fn,
+	)
 }
 
 func (s *StoragePostgres) TxOpt(
 	ilevel storage.TxILevel, mode storage.TxMode, fn func(*sql.Tx) error,
+) error {
+	return s.TxOptCtx(context.Background(), ilevel, mode, fn)
+}
+
+func (s *StoragePostgres) TxCtx(ctx context.Context, fn func(*sql.Tx) error) error {
+	return s.TxOptCtx(
+		ctx, storage.TxILevelReadCommitted, storage.TxModeReadWrite, fn,
+	)
+}
+
+func (s *StoragePostgres) TxOptCtx(
+	ctx context.Context,
+	ilevel storage.TxILevel, mode storage.TxMode, fn func(*sql.Tx) error,
 ) error {
 	if ilevel != storage.TxILevelReadCommitted && mode == storage.TxModeReadWrite {
 		// TODO: implement retrying of read-write transactions in case of
@@ -39,7 +56,7 @@ func (s *StoragePostgres) TxOpt(
 	// hack: we keep retrying to connect for 10 seconds.
 	timeoutChan := time.After(10 * time.Second)
 	for {
-		tx, err = s.db.Begin()
+		tx, err = s.db.BeginTx(ctx, nil)
 		if err != nil {
 			err2 := errors.Annotate(err, "begin transaction")
 			pqerr, ok := err.(*net.OpError)
@@ -60,17 +77,22 @@ func (s *StoragePostgres) TxOpt(
 		break
 	}
 
+	defer s.txCtxs.Add(tx, ctx)()
+
 	// Adjust transaction params (isolation level and access mode), if needed {{{
 	if ilevel != storage.TxILevelReadCommitted {
-		if _, err := tx.Exec(
+		if _, err := tx.ExecContext(
+			ctx,
 			fmt.Sprintf("SET TRANSACTION ISOLATION LEVEL %s", ilevelToString(ilevel)),
 		); err != nil {
+			tx.Rollback()
 			return errors.Annotate(err, "set isolation level")
 		}
 	}
 
 	if mode == storage.TxModeReadOnly {
-		if _, err := tx.Exec("SET TRANSACTION READ ONLY"); err != nil {
+		if _, err := tx.ExecContext(ctx, "SET TRANSACTION READ ONLY"); err != nil {
+			tx.Rollback()
 			return errors.Annotate(err, "set isolation level")
 		}
 	}
@@ -78,7 +100,9 @@ func (s *StoragePostgres) TxOpt(
 
 	err = fn(tx)
 	if err != nil {
-		if err2 := tx.Rollback(); err2 != nil {
+		// If the context is done, the transaction is already rolled back by
+		// database/sql, so ErrTxDone is expected
+		if err2 := tx.Rollback(); err2 != nil && err2 != sql.ErrTxDone {
 			glog.Errorf("Transaction rollback failed: %+v", err2)
 		}
 		return errors.Trace(err)
@@ -102,3 +126,10 @@ func ilevelToString(ilevel storage.TxILevel) string {
 	}
 	panic(fmt.Sprintf("unknown isolation level: %d", ilevel))
 }
+
+// ctx returns the context which the given transaction was started with; all
+// queries should be made with it, so that they are cancelled together with
+// the transaction.
+func (s *StoragePostgres) ctx(tx *sql.Tx) context.Context {
+	return s.txCtxs.Get(tx)
+}
@@ -38,8 +38,8 @@ func (s *StoragePostgres) GetUser(
 		))
 	}
 
-	err := tx.QueryRow(
-		"SELECT id, username, password, email FROM users WHERE "+where,
+	err := tx.QueryRowContext(
+		s.ctx(tx), "SELECT id, username, password, email FROM users WHERE "+where,
 		queryArgs...,
 	).Scan(&ud.ID, &ud.Username, &ud.Password, &ud.Email)
 	if err != nil {
@@ -57,8 +57,8 @@ func (s *StoragePostgres) GetUser(
 func (s *StoragePostgres) CreateUser(
 	tx *sql.Tx, ud *storage.UserData,
 ) (userID int, err error) {
-	err = tx.QueryRow(
-		"INSERT INTO users (username, password, email) VALUES ($1, $2, $3) RETURNING id",
+	err = tx.QueryRowContext(
+		s.ctx(tx), "INSERT INTO users (username, password, email) VALUES ($1, $2, $3) RETURNING id",
 		ud.Username, ud.Password, ud.Email,
 	).Scan(&userID)
 	if err != nil {
@@ -80,8 +80,8 @@ func (s *StoragePostgres) CreateUser(
 }
 
 func (s *StoragePostgres) DeleteUser(tx *sql.Tx, userID int) error {
-	_, err := tx.Exec(
-		"DELETE FROM users WHERE id = $1", userID,
+	_, err := tx.ExecContext(
+		s.ctx(tx), "DELETE FROM users WHERE id = $1", userID,
 	)
 	if err != nil {
 		return hh.MakeInternalServerError(err)
@@ -92,8 +92,8 @@ func (s *StoragePostgres) DeleteUser(tx *sql.Tx, userID int) error {
 func (s *StoragePostgres) GetUsers(tx *sql.Tx) ([]storage.UserData, error) {
 	var ret []storage.UserData
 
-	rows, err := tx.Query(
-		"SELECT id, username, password, email FROM users",
+	rows, err := tx.QueryContext(
+		s.ctx(tx), "SELECT id, username, password, email FROM users",
 	)
 	if err != nil {
 		return nil, hh.MakeInternalServerError(err)
@@ -116,8 +116,8 @@ func (s *StoragePostgres) GetAccessToken(
 	tx *sql.Tx, userID int, descr string, createIfNotExist bool,
 ) (token string, err error) {
 
-	err = tx.QueryRow(
-		"SELECT token FROM access_tokens WHERE user_id = $1 and descr = $2",
+	err = tx.QueryRowContext(
+		s.ctx(tx), "SELECT token FROM access_tokens WHERE user_id = $1 and descr = $2",
 		userID, descr,
 	).Scan(&token)
 	if err != nil && errors.Cause(err) != sql.ErrNoRows {
@@ -130,8 +130,8 @@ func (s *StoragePostgres) GetAccessToken(
 		if createIfNotExist {
 			// Let's create one
 			token = uniuri.NewLen(accessTokenLen)
-			_, err := tx.Exec(
-				"INSERT INTO access_tokens (user_id, token, descr) VALUES ($1, $2, $3)",
+			_, err := tx.ExecContext(
+				s.ctx(tx), "INSERT INTO access_tokens (user_id, token, descr) VALUES ($1, $2, $3)",
 				userID, token, descr,
 			)
 			if err != nil {
@@ -153,7 +153,7 @@ func (s *StoragePostgres) GetUserByAccessToken(
 ) (*storage.UserData, error) {
 	var ud storage.UserData
 
-	err := tx.QueryRow(`
+	err := tx.QueryRowContext(s.ctx(tx), `
 SELECT u.id, u.username, u.password, u.email FROM users u
 JOIN access_tokens tok ON tok.user_id = u.id
 WHERE tok.token = $1`, token,
@@ -175,7 +175,7 @@ func (s *StoragePostgres) GetUserByGoogleUserID(
 ) (*storage.UserData, error) {
 	var ud storage.UserData
 
-	err := tx.QueryRow(`
+	err := tx.QueryRowContext(s.ctx(tx), `
 SELECT u.id, u.username, u.password, u.email FROM users u
 JOIN google_auth google ON google.user_id = u.id
 WHERE google.google_user_id = $1`, googleUserID,
@@ -195,7 +195,7 @@ WHERE google.google_user_id = $1`, googleUserID,
 func (s *StoragePostgres) CreateGoogleUser(
 	tx *sql.Tx, userID int, googleUserID, email string,
 ) error {
-	_, err := tx.Exec(`
+	_, err := tx.ExecContext(s.ctx(tx), `
   INSERT INTO google_auth (google_user_id, user_id, email) VALUES ($1, $2, $3)
 `, googleUserID, userID, email)
 	if err != nil {
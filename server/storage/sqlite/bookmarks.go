@@ -0,0 +1,542 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/storage/internal/tagbrief"
+	"github.com/dimonomid/interrors"
+	"github.com/juju/errors"
+)
+
+func (s *StorageSQLite) CreateBookmark(tx *sql.Tx, bd *storage.BookmarkData) (bkmID int, err error) {
+	bkmID, err = s.CreateTaggable(tx, &storage.TaggableData{
+		OwnerID:   bd.OwnerID,
+		Type:      storage.TaggableTypeBookmark,
+		CreatedAt: bd.CreatedAt,
+		UpdatedAt: bd.UpdatedAt,
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	_, err = tx.ExecContext(
+		s.ctx(tx), `
+INSERT INTO bookmarks (id, url, title, comment, canonical_url) VALUES (?, ?, ?, ?, ?)
+		`,
+		bkmID, bd.URL, bd.Title, bd.Comment, bd.GetCanonicalURL(),
+	)
+	if err != nil {
+		return 0, hh.MakeInternalServerError(errors.Annotatef(
+			err, "adding bookmark %d", bkmID,
+		))
+	}
+
+	_, err = tx.ExecContext(
+		s.ctx(tx), "INSERT INTO bookmarks_fts (docid, title, comment, url) VALUES (?, ?, ?, ?)",
+		bkmID, bd.Title, bd.Comment, bd.URL,
+	)
+	if err != nil {
+		return 0, hh.MakeInternalServerError(errors.Annotatef(
+			err, "adding bookmark %d to the search index", bkmID,
+		))
+	}
+
+	return bkmID, nil
+}
+
+func (s *StorageSQLite) UpdateBookmark(tx *sql.Tx, bd *storage.BookmarkData) (err error) {
+	_, err = tx.ExecContext(
+		s.ctx(tx), `
+UPDATE bookmarks SET url = ?, title = ?, comment = ?, canonical_url = ? WHERE id = ?
+		`,
+		bd.URL, bd.Title, bd.Comment, bd.GetCanonicalURL(), bd.ID,
+	)
+	if err != nil {
+		return hh.MakeInternalServerError(errors.Annotatef(
+			err, "updating bookmark %d", bd.ID,
+		))
+	}
+
+	_, err = tx.ExecContext(
+		s.ctx(tx), "UPDATE bookmarks_fts SET title = ?, comment = ?, url = ? WHERE docid = ?",
+		bd.Title, bd.Comment, bd.URL, bd.ID,
+	)
+	if err != nil {
+		return hh.MakeInternalServerError(errors.Annotatef(
+			err, "updating bookmark %d in the search index", bd.ID,
+		))
+	}
+
+	if err := s.SetTaggableUpdatedAt(tx, bd.ID, 0); err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func setDefaultTagFetchOpts(tagsFetchOpts *storage.TagsFetchOpts) *storage.TagsFetchOpts {
+	if tagsFetchOpts == nil {
+		tagsFetchOpts = &storage.TagsFetchOpts{}
+	}
+
+	if tagsFetchOpts.TagsFetchMode == "" {
+		tagsFetchOpts.TagsFetchMode = storage.TagsFetchModeDefault
+	}
+
+	if tagsFetchOpts.TagNamesFetchMode == "" {
+		tagsFetchOpts.TagNamesFetchMode = storage.TagNamesFetchModeDefault
+	}
+
+	return tagsFetchOpts
+}
+
+// bookmarksQuery returns the SELECT query which fetches bookmarks in the
+// format expected by rowsToBookmarks, with the given WHERE clause.
+func bookmarksQuery(tagsFetchOpts *storage.TagsFetchOpts, where string) (string, error) {
+	tagsJSONFieldQuery, err := getTagsJSONFieldQuery(tagsFetchOpts, "t")
+	if err != nil {
+		return "", hh.MakeInternalServerError(err)
+	}
+
+	return fmt.Sprintf(`
+SELECT t.id, b.url, b.title, b.comment, t.owner_id,
+       t.created_ts, t.updated_ts,
+       %s as tagsjson
+  FROM taggables t
+  JOIN bookmarks b ON t.id = b.id
+  WHERE %s
+	`, tagsJSONFieldQuery, where), nil
+}
+
+func (s *StorageSQLite) GetTaggedBookmarks(
+	tx *sql.Tx, tagIDs []int, ownerID *int, tagsFetchOpts *storage.TagsFetchOpts,
+) (bookmarks []storage.BookmarkDataWTags, err error) {
+	bookmarks = []storage.BookmarkDataWTags{}
+
+	tagsFetchOpts = setDefaultTagFetchOpts(tagsFetchOpts)
+
+	taggableIDs, err := s.GetTaggedTaggableIDs(
+		tx, tagIDs, ownerID, []storage.TaggableType{storage.TaggableTypeBookmark},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if len(taggableIDs) > 0 {
+		args := []interface{}{}
+		for _, id := range taggableIDs {
+			args = append(args, id)
+		}
+
+		query, err := bookmarksQuery(
+			tagsFetchOpts, "t.id IN ("+getPlaceholdersString(len(taggableIDs))+")",
+		)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		rows, err := tx.QueryContext(s.ctx(tx), query, args...)
+		if err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+		defer rows.Close()
+		return rowsToBookmarks(rows, tagsFetchOpts)
+	}
+
+	return bookmarks, nil
+}
+
+func (s *StorageSQLite) GetBookmarksByURL(
+	tx *sql.Tx, url string, ownerID int, tagsFetchOpts *storage.TagsFetchOpts,
+) (bookmarks []storage.BookmarkDataWTags, err error) {
+	tagsFetchOpts = setDefaultTagFetchOpts(tagsFetchOpts)
+
+	query, err := bookmarksQuery(tagsFetchOpts, "t.owner_id = ? AND b.url = ?")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	rows, err := tx.QueryContext(s.ctx(tx), query, ownerID, url)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+	return rowsToBookmarks(rows, tagsFetchOpts)
+}
+
+func (s *StorageSQLite) GetBookmarks(
+	tx *sql.Tx, args *storage.GetBookmarksArgs, tagsFetchOpts *storage.TagsFetchOpts,
+) (bookmarks []storage.BookmarkDataWTags, next *storage.BookmarksCursor, err error) {
+	tagsFetchOpts = setDefaultTagFetchOpts(tagsFetchOpts)
+
+	bkmsSort, err := args.GetSort()
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	qargs := []interface{}{}
+	addArg := func(v interface{}) string {
+		qargs = append(qargs, v)
+		return "?"
+	}
+
+	where := "t.owner_id = " + addArg(args.OwnerID)
+
+	for _, tagID := range args.TagIDs {
+		where += " AND " + getTaggedCond(addArg(tagID))
+		if args.DirectlyTagged {
+			where += ` AND t.id NOT IN (
+  SELECT tg.taggable_id FROM taggings tg JOIN tags ON tags.id = tg.tag_id
+    WHERE tags.parent_id = ` + addArg(tagID) + `
+)`
+		}
+	}
+
+	if args.TagExpr != nil {
+		cond, err := getTagExprCond(args.TagExpr, addArg)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		where += " AND " + cond
+	}
+
+	if args.CanonicalURL != "" {
+		where += " AND b.canonical_url = " + addArg(args.CanonicalURL)
+	}
+
+	if args.LinkStatus != storage.LinkStatusAny {
+		cond, err := getLinkStatusCond(args.LinkStatus)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+		where += " AND " + cond
+	}
+
+	if args.Untagged {
+		where += ` AND t.id NOT IN (
+  SELECT tg.taggable_id FROM taggings tg JOIN tags ON tags.id = tg.tag_id
+    WHERE tags.parent_id IS NOT NULL
+)`
+	}
+
+	var scores map[int]float64
+	if args.Query != "" {
+		match := getFTSMatchExpr(args.Query)
+		if match == "" {
+			// No words to look for
+			return []storage.BookmarkDataWTags{}, nil, nil
+		}
+
+		scores, err = s.getFTSScores(tx, args.OwnerID, match)
+		if err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+
+		where += " AND t.id IN (SELECT docid FROM bookmarks_fts WHERE bookmarks_fts MATCH " + addArg(match) + ")"
+	}
+
+	orderBy := "t.id"
+	limit := ""
+	if bkmsSort != storage.BookmarksSortRelevance {
+		var afterCond string
+		orderBy, afterCond = getBookmarksOrder(bkmsSort, args.After, addArg)
+		if afterCond != "" {
+			where += " AND " + afterCond
+		}
+
+		if args.Limit > 0 {
+			// Fetch one more bookmark to find out whether there are more pages
+			limit = " LIMIT " + addArg(args.Limit+1)
+		}
+	}
+
+	query, err := bookmarksQuery(tagsFetchOpts, where+" ORDER BY "+orderBy+limit)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	rows, err := tx.QueryContext(s.ctx(tx), query, qargs...)
+	if err != nil {
+		return nil, nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	bookmarks, err = rowsToBookmarks(rows, tagsFetchOpts)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+
+	if bkmsSort == storage.BookmarksSortRelevance {
+		// SQLite doesn't rank the matches, so we sort them here; the order by
+		// id is kept for equal scores. Since the whole result is sorted here
+		// anyway, the page is also cut here.
+		sort.SliceStable(bookmarks, func(i, j int) bool {
+			return scores[bookmarks[i].ID] > scores[bookmarks[j].ID]
+		})
+
+		if args.After != nil {
+			if args.After.Offset < len(bookmarks) {
+				bookmarks = bookmarks[args.After.Offset:]
+			} else {
+				bookmarks = []storage.BookmarkDataWTags{}
+			}
+		}
+	}
+
+	if args.Limit > 0 && len(bookmarks) > args.Limit {
+		bookmarks = bookmarks[:args.Limit]
+		next = storage.GetNextBookmarksCursor(args, bkmsSort, bookmarks)
+	}
+
+	return bookmarks, next, nil
+}
+
+// getTaggedCond returns the condition which is true if the taggable t is
+// tagged with the tag given by the placeholder.
+func getTaggedCond(tagIDPlaceholder string) string {
+	return "t.id IN (SELECT taggable_id FROM taggings WHERE tag_id = " + tagIDPlaceholder + ")"
+}
+
+// getTagExprCond returns the condition which is true if the taggable t
+// matches the tag expression.
+func getTagExprCond(
+	e *storage.TagExpr, addArg func(v interface{}) string,
+) (string, error) {
+	switch e.Op {
+	case storage.TagExprOpTag:
+		return getTaggedCond(addArg(e.TagID)), nil
+
+	case storage.TagExprOpNot:
+		if len(e.Args) != 1 {
+			return "", errors.Errorf("%q should have 1 operand, got %d", e.Op, len(e.Args))
+		}
+		cond, err := getTagExprCond(&e.Args[0], addArg)
+		if err != nil {
+			return "", errors.Trace(err)
+		}
+		return "(NOT " + cond + ")", nil
+
+	case storage.TagExprOpAnd, storage.TagExprOpOr:
+		if len(e.Args) == 0 {
+			return "", errors.Errorf("%q should have operands", e.Op)
+		}
+		conds := []string{}
+		for i := range e.Args {
+			cond, err := getTagExprCond(&e.Args[i], addArg)
+			if err != nil {
+				return "", errors.Trace(err)
+			}
+			conds = append(conds, cond)
+		}
+		return "(" + strings.Join(conds, " "+strings.ToUpper(string(e.Op))+" ") + ")", nil
+	}
+
+	return "", errors.Errorf("invalid tag expression operation %q", e.Op)
+}
+
+// getBookmarksOrder returns the ORDER BY clause for the given sort order
+// (other than relevance), and the condition which selects the bookmarks after
+// the cursor (empty if the cursor is nil). addArg should add the query
+// argument and return its placeholder.
+func getBookmarksOrder(
+	bkmsSort storage.BookmarksSort, after *storage.BookmarksCursor,
+	addArg func(v interface{}) string,
+) (orderBy, afterCond string) {
+	var key string
+	var keyArg interface{}
+	desc := false
+
+	switch bkmsSort {
+	case storage.BookmarksSortUpdated:
+		key, desc = "t.updated_ts", true
+	case storage.BookmarksSortCreated:
+		key, desc = "t.created_ts", true
+	case storage.BookmarksSortTitle:
+		key = "b.title"
+	case storage.BookmarksSortURL:
+		key = "b.url"
+	}
+
+	if after != nil {
+		keyArg = after.Str
+		if desc {
+			keyArg = after.Time
+		}
+	}
+
+	op, dir := ">", ""
+	if desc {
+		op, dir = "<", " DESC"
+	}
+
+	if key == "" {
+		orderBy = "t.id" + dir
+		if after != nil {
+			afterCond = "t.id " + op + " " + addArg(after.ID)
+		}
+		return orderBy, afterCond
+	}
+
+	orderBy = key + dir + ", t.id" + dir
+	if after != nil {
+		afterCond = fmt.Sprintf(
+			"(%s %s %s OR (%s = %s AND t.id %s %s))",
+			key, op, addArg(keyArg), key, addArg(keyArg), op, addArg(after.ID),
+		)
+	}
+
+	return orderBy, afterCond
+}
+
+// Weights of matches in the bookmarks_fts columns: title, comment, url
+var ftsColumnWeights = []float64{1.0, 0.4, 0.2}
+
+// getFTSScores returns relevance scores of the user's bookmarks matching the
+// given FTS expression, keyed by bookmark id. The score is a sum of weights
+// of all the matches, see ftsColumnWeights.
+func (s *StorageSQLite) getFTSScores(
+	tx *sql.Tx, ownerID int, match string,
+) (map[int]float64, error) {
+	rows, err := tx.QueryContext(s.ctx(tx), `
+SELECT bookmarks_fts.docid, offsets(bookmarks_fts)
+  FROM bookmarks_fts
+  JOIN taggables t ON t.id = bookmarks_fts.docid
+  WHERE bookmarks_fts MATCH ? AND t.owner_id = ?
+	`, match, ownerID,
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	scores := map[int]float64{}
+	for rows.Next() {
+		var id int
+		var offsets string
+		if err := rows.Scan(&id, &offsets); err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+
+		// Offsets consist of 4 integers per match, the first one being the
+		// column number
+		fields := strings.Fields(offsets)
+		for i := 0; i+3 < len(fields); i += 4 {
+			col, err := strconv.Atoi(fields[i])
+			if err != nil || col < 0 || col >= len(ftsColumnWeights) {
+				return nil, hh.MakeInternalServerError(
+					errors.Errorf("invalid offsets %q", offsets),
+				)
+			}
+			scores[id] += ftsColumnWeights[col]
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	return scores, nil
+}
+
+// getFTSMatchExpr returns the FTS expression matching all the words of the
+// given query, or an empty string if there are no words. Every word is
+// quoted, so that the FTS query syntax is not exposed to the user.
+func getFTSMatchExpr(query string) string {
+	words := strings.FieldsFunc(query, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	quoted := []string{}
+	for _, word := range words {
+		quoted = append(quoted, `"`+word+`"`)
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+func (s *StorageSQLite) GetBookmarkByID(
+	tx *sql.Tx, bookmarkID int, tagsFetchOpts *storage.TagsFetchOpts,
+) (bookmark *storage.BookmarkDataWTags, err error) {
+	tagsFetchOpts = setDefaultTagFetchOpts(tagsFetchOpts)
+
+	query, err := bookmarksQuery(tagsFetchOpts, "t.id = ?")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	bkm := storage.BookmarkDataWTags{}
+	var tagBriefData []byte
+
+	err = tx.QueryRowContext(s.ctx(tx), query, bookmarkID).Scan(
+		&bkm.ID, &bkm.URL, &bkm.Title, &bkm.Comment, &bkm.OwnerID,
+		&bkm.CreatedAt, &bkm.UpdatedAt,
+		&tagBriefData,
+	)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, errors.Annotatef(
+				interrors.WrapInternalError(
+					err,
+					storage.ErrBookmarkDoesNotExist,
+				),
+				"id %d", bookmarkID,
+			)
+		}
+		// Some unexpected error
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	bkm.Tags, err = tagbrief.Parse(tagBriefData, tagsFetchOpts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return &bkm, nil
+}
+
+func getPlaceholdersString(cnt int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", cnt), ",")
+}
+
+// rowsToBookmarks expects each row to contain the following fields, in this
+// order:
+//
+// id, url, title, comment, owner_id, created_time, updated_time, tags_data.
+// For some details on what is tags_data, see tagbrief.Parse().
+func rowsToBookmarks(
+	rows *sql.Rows, tagsFetchOpts *storage.TagsFetchOpts,
+) (bookmarks []storage.BookmarkDataWTags, err error) {
+	bookmarks = []storage.BookmarkDataWTags{}
+	for rows.Next() {
+		bkm := storage.BookmarkDataWTags{}
+		var tagBriefData []byte
+		err := rows.Scan(
+			&bkm.ID, &bkm.URL, &bkm.Title, &bkm.Comment, &bkm.OwnerID,
+			&bkm.CreatedAt, &bkm.UpdatedAt,
+			&tagBriefData,
+		)
+		if err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+
+		bkm.Tags, err = tagbrief.Parse(tagBriefData, tagsFetchOpts)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		bookmarks = append(bookmarks, bkm)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	return bookmarks, nil
+}
@@ -0,0 +1,419 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/storage/internal/taghier"
+
+	"github.com/juju/errors"
+)
+
+func (s *StorageSQLite) CheckIntegrity() error {
+	report, err := s.GetIntegrityReport()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if !report.OK() {
+		return errors.Errorf("integrity is broken:\n%s", report)
+	}
+
+	return nil
+}
+
+func (s *StorageSQLite) GetIntegrityReport() (report *storage.IntegrityReport, err error) {
+	err = s.TxOpt(
+		storage.TxILevelRepeatableRead, storage.TxModeReadOnly,
+		func(tx *sql.Tx) error {
+			var err error
+			report, err = s.getIntegrityReport(tx)
+			return errors.Trace(err)
+		})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return report, nil
+}
+
+func (s *StorageSQLite) getIntegrityReport(tx *sql.Tx) (*storage.IntegrityReport, error) {
+	report := &storage.IntegrityReport{}
+
+	badChildrenCnts, err := s.getBadChildrenCnts(tx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	users, err := s.GetUsers(tx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	for _, user := range users {
+		ur := &storage.UserIntegrityReport{
+			UserID:          user.ID,
+			BadChildrenCnts: badChildrenCnts[user.ID],
+		}
+
+		if err := s.checkUserTaggings(tx, ur); err != nil {
+			return nil, errors.Annotatef(err, "user %d", user.ID)
+		}
+
+		report.AddUser(ur)
+	}
+
+	report.OrphanedTagNames, err = s.getOrphanedTagNames(tx)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return report, nil
+}
+
+// checkUserTaggings feeds all user's tags to taghier, makes sure that there
+// is just a single root, and that each taggable is tagged with full paths to
+// all its tags, but not with the root tag only. Tags which don't belong to
+// the user are reported separately and ignored by the other checks.
+func (s *StorageSQLite) checkUserTaggings(
+	tx *sql.Tx, ur *storage.UserIntegrityReport,
+) error {
+	reg, rootTagIDs, err := s.getTagsRegistry(tx, ur.UserID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(rootTagIDs) != 1 {
+		ur.BadRootTagIDs = rootTagIDs
+	}
+
+	taggings, taggableIDs, err := s.getUserTaggings(tx, ur.UserID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, taggableID := range taggableIDs {
+		tagIDs := []int{}
+		unknownTagIDs := []int{}
+		for _, tagID := range taggings[taggableID] {
+			if _, ok := reg[tagID]; ok {
+				tagIDs = append(tagIDs, tagID)
+			} else {
+				unknownTagIDs = append(unknownTagIDs, tagID)
+			}
+		}
+
+		if len(unknownTagIDs) > 0 {
+			ur.UnknownTaggings = append(ur.UnknownTaggings, storage.UnknownTagging{
+				TaggableID: taggableID,
+				TagIDs:     unknownTagIDs,
+			})
+		}
+
+		if len(tagIDs) == 1 && reg[tagIDs[0]] == 0 {
+			ur.RootOnlyTaggableIDs = append(ur.RootOnlyTaggableIDs, taggableID)
+			continue
+		}
+
+		th := taghier.New(reg)
+		for _, tagID := range tagIDs {
+			if err := th.Add(tagID); err != nil {
+				return errors.Annotatef(err, "taggable %d", taggableID)
+			}
+		}
+
+		diff := taghier.GetDiff(tagIDs, th.GetAll())
+		if len(diff.Add) > 0 {
+			ur.IncompleteTagPaths = append(ur.IncompleteTagPaths, storage.IncompleteTagPath{
+				TaggableID:    taggableID,
+				MissingTagIDs: diff.Add,
+			})
+		}
+	}
+
+	return nil
+}
+
+// getBadChildrenCnts returns tags whose children_cnt doesn't match the
+// actual number of children, grouped by the owner.
+func (s *StorageSQLite) getBadChildrenCnts(
+	tx *sql.Tx,
+) (map[int][]storage.BadChildrenCnt, error) {
+	rows, err := tx.QueryContext(s.ctx(tx), `
+SELECT id, owner_id, children_cnt, children_cnt_actual
+  FROM
+    (SELECT id, owner_id, children_cnt,
+            (SELECT COUNT(id) FROM tags WHERE parent_id = t.id) AS children_cnt_actual
+          FROM tags t) T
+  WHERE children_cnt != children_cnt_actual
+  ORDER BY id
+`,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	ret := map[int][]storage.BadChildrenCnt{}
+
+	defer rows.Close()
+	for rows.Next() {
+		var cur storage.BadChildrenCnt
+		var ownerID int
+		err := rows.Scan(&cur.TagID, &ownerID, &cur.ChildrenCnt, &cur.ActualChildrenCnt)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		ret[ownerID] = append(ret[ownerID], cur)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, errors.Annotatef(err, "closing rows")
+	}
+
+	return ret, nil
+}
+
+func (s *StorageSQLite) getOrphanedTagNames(
+	tx *sql.Tx,
+) ([]storage.OrphanedTagName, error) {
+	rows, err := tx.QueryContext(s.ctx(tx), `
+SELECT tn.tag_id, tn.name FROM tag_names tn
+  LEFT JOIN tags t ON t.id = tn.tag_id
+  WHERE t.id IS NULL
+  ORDER BY tn.tag_id, tn.name
+`,
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var ret []storage.OrphanedTagName
+
+	defer rows.Close()
+	for rows.Next() {
+		var cur storage.OrphanedTagName
+		if err := rows.Scan(&cur.TagID, &cur.Name); err != nil {
+			return nil, errors.Trace(err)
+		}
+		ret = append(ret, cur)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, errors.Annotatef(err, "closing rows")
+	}
+
+	return ret, nil
+}
+
+// RepairIntegrity fixes everything reported by GetIntegrityReport, except
+// for the wrong number of root tags, which results in an error.
+func (s *StorageSQLite) RepairIntegrity() (fixes []storage.IntegrityFix, err error) {
+	err = s.TxOpt(
+		storage.TxILevelSerializable, storage.TxModeReadWrite,
+		func(tx *sql.Tx) error {
+			report, err := s.getIntegrityReport(tx)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			fixes = []storage.IntegrityFix{}
+
+			for _, ur := range report.Users {
+				if len(ur.BadRootTagIDs) > 0 {
+					return errors.Errorf(
+						"user %d: tag roots count is %d (should be 1), can't repair",
+						ur.UserID, len(ur.BadRootTagIDs),
+					)
+				}
+
+				curFixes, err := s.repairUser(tx, &ur)
+				if err != nil {
+					return errors.Annotatef(err, "user %d", ur.UserID)
+				}
+				fixes = append(fixes, curFixes...)
+			}
+
+			for _, otn := range report.OrphanedTagNames {
+				_, err := tx.ExecContext(
+					s.ctx(tx), "DELETE FROM tag_names WHERE tag_id = ? AND name = ?",
+					otn.TagID, otn.Name,
+				)
+				if err != nil {
+					return errors.Trace(err)
+				}
+
+				fixes = append(fixes, storage.IntegrityFix{
+					Kind:  storage.IntegrityFixKindOrphanedTagName,
+					TagID: otn.TagID,
+					Descr: fmt.Sprintf(
+						"deleted name %q of non-existing tag %d", otn.Name, otn.TagID,
+					),
+				})
+			}
+
+			return nil
+		})
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return fixes, nil
+}
+
+func (s *StorageSQLite) repairUser(
+	tx *sql.Tx, ur *storage.UserIntegrityReport,
+) ([]storage.IntegrityFix, error) {
+	fixes := []storage.IntegrityFix{}
+
+	// Unknown taggings go first, so that only the root tagging is left on the
+	// root-only taggables
+	for _, ut := range ur.UnknownTaggings {
+		if err := s.deleteTaggings(tx, ut.TaggableID, ut.TagIDs); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		for _, tagID := range ut.TagIDs {
+			fixes = append(fixes, storage.IntegrityFix{
+				Kind:       storage.IntegrityFixKindUnknownTagging,
+				TagID:      tagID,
+				TaggableID: ut.TaggableID,
+				Descr: fmt.Sprintf(
+					"user %d, taggable %d: removed tagging with unknown tag %d",
+					ur.UserID, ut.TaggableID, tagID,
+				),
+			})
+		}
+	}
+
+	for _, bc := range ur.BadChildrenCnts {
+		_, err := tx.ExecContext(
+			s.ctx(tx), "UPDATE tags SET children_cnt = ? WHERE id = ?",
+			bc.ActualChildrenCnt, bc.TagID,
+		)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		fixes = append(fixes, storage.IntegrityFix{
+			Kind:  storage.IntegrityFixKindChildrenCnt,
+			TagID: bc.TagID,
+			Descr: fmt.Sprintf(
+				"tag %d: children count changed from %d to %d",
+				bc.TagID, bc.ChildrenCnt, bc.ActualChildrenCnt,
+			),
+		})
+	}
+
+	for _, itp := range ur.IncompleteTagPaths {
+		if err := s.addTaggings(tx, itp.TaggableID, itp.MissingTagIDs); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		fixes = append(fixes, storage.IntegrityFix{
+			Kind:       storage.IntegrityFixKindMissingTaggings,
+			TaggableID: itp.TaggableID,
+			TagIDs:     itp.MissingTagIDs,
+			Descr: fmt.Sprintf(
+				"user %d, taggable %d: added missing taggings with tags %v",
+				ur.UserID, itp.TaggableID, itp.MissingTagIDs,
+			),
+		})
+	}
+
+	for _, taggableID := range ur.RootOnlyTaggableIDs {
+		rootTagIDs, err := s.GetTaggings(tx, taggableID, storage.TaggingModeAll)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		if err := s.deleteTaggings(tx, taggableID, rootTagIDs); err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		for _, rootTagID := range rootTagIDs {
+			fixes = append(fixes, storage.IntegrityFix{
+				Kind:       storage.IntegrityFixKindRootOnlyTagging,
+				TagID:      rootTagID,
+				TaggableID: taggableID,
+				Descr: fmt.Sprintf(
+					"taggable %d: removed the only tagging with the root tag %d",
+					taggableID, rootTagID,
+				),
+			})
+		}
+	}
+
+	return fixes, nil
+}
+
+// getTagsRegistry returns a taghier registry with all the tags of the given
+// user, and the ids of the root tags (there should be exactly one).
+func (s *StorageSQLite) getTagsRegistry(
+	tx *sql.Tx, userID int,
+) (reg taghier.MapRegistry, rootTagIDs []int, err error) {
+	rows, err := tx.QueryContext(
+		s.ctx(tx), "SELECT id, parent_id FROM tags WHERE owner_id = ? ORDER BY id", userID,
+	)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	defer rows.Close()
+
+	reg = taghier.MapRegistry{}
+	for rows.Next() {
+		var id int
+		var parentID sql.NullInt64
+		if err := rows.Scan(&id, &parentID); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+
+		reg[id] = int(parentID.Int64)
+		if !parentID.Valid {
+			rootTagIDs = append(rootTagIDs, id)
+		}
+	}
+	if err := rows.Close(); err != nil {
+		return nil, nil, errors.Annotatef(err, "closing rows")
+	}
+
+	return reg, rootTagIDs, nil
+}
+
+// getUserTaggings returns all taggings of the user's taggables, as well as
+// sorted ids of the taggables which have any taggings.
+func (s *StorageSQLite) getUserTaggings(
+	tx *sql.Tx, userID int,
+) (taggings map[int][]int, taggableIDs []int, err error) {
+	rows, err := tx.QueryContext(s.ctx(tx), `
+SELECT tg.taggable_id, tg.tag_id FROM taggings tg
+  JOIN taggables t ON t.id = tg.taggable_id
+  WHERE t.owner_id = ?
+  ORDER BY tg.taggable_id, tg.tag_id
+`, userID,
+	)
+	if err != nil {
+		return nil, nil, errors.Trace(err)
+	}
+	defer rows.Close()
+
+	taggings = map[int][]int{}
+	for rows.Next() {
+		var taggableID, tagID int
+		if err := rows.Scan(&taggableID, &tagID); err != nil {
+			return nil, nil, errors.Trace(err)
+		}
+
+		if _, ok := taggings[taggableID]; !ok {
+			taggableIDs = append(taggableIDs, taggableID)
+		}
+		taggings[taggableID] = append(taggings[taggableID], tagID)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, nil, errors.Annotatef(err, "closing rows")
+	}
+
+	return taggings, taggableIDs, nil
+}
@@ -0,0 +1,620 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package sqlite
+
+import (
+	"github.com/juju/errors"
+
+	"dmitryfrank.com/geekmarks/server/dfmigrate"
+	"dmitryfrank.com/geekmarks/server/urlcanon"
+)
+
+// NOTE: SQLite schema doesn't have the history of the Postgres one, so the
+// very first migration creates the structure equivalent to the latest Postgres
+// migration. Timestamps are stored as unix time in seconds.
+
+func initMigrations() (*dfmigrate.Migrations, error) {
+	mig := &dfmigrate.Migrations{}
+	var err error
+
+	// 001: Initial structure {{{
+	err = mig.AddMigration(
+		1, "Initial structure",
+
+		// ---------- UP ----------
+		func(tx dfmigrate.Tx) error {
+			if _, err := tx.Exec(`
+				CREATE TABLE users (
+					id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+					username VARCHAR(50) UNIQUE,
+					password VARCHAR(100),
+					email VARCHAR(50) UNIQUE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				CREATE TABLE tags (
+					id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+					parent_id INTEGER,
+					owner_id INTEGER NOT NULL,
+					descr TEXT NOT NULL DEFAULT '',
+					children_cnt INTEGER NOT NULL DEFAULT 0,
+					FOREIGN KEY (parent_id) REFERENCES tags(id) ON DELETE CASCADE,
+					FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			// Allow only one tag with NULL parent (the root tag) per owner
+			if _, err := tx.Exec(`
+				CREATE UNIQUE INDEX tags_root_uniq ON tags (owner_id) WHERE parent_id IS NULL
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				CREATE TABLE tag_names (
+					tag_id INTEGER NOT NULL,
+					name VARCHAR(30) NOT NULL,
+					"primary" BOOLEAN NOT NULL DEFAULT 0,
+					PRIMARY KEY (tag_id, name),
+					FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				CREATE TABLE taggables (
+					id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+					owner_id INTEGER NOT NULL,
+					"type" TEXT NOT NULL,
+					created_ts INTEGER NOT NULL DEFAULT (CAST(strftime('%s', 'now') AS INTEGER)),
+					updated_ts INTEGER NOT NULL DEFAULT (CAST(strftime('%s', 'now') AS INTEGER)),
+					FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				CREATE TRIGGER trg_set_updated_ts AFTER UPDATE ON taggables
+				FOR EACH ROW BEGIN
+					UPDATE taggables SET updated_ts = CAST(strftime('%s', 'now') AS INTEGER)
+						WHERE id = NEW.id;
+				END
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				CREATE TABLE bookmarks (
+					id INTEGER NOT NULL PRIMARY KEY,
+					url TEXT NOT NULL,
+					title TEXT NOT NULL,
+					comment TEXT NOT NULL,
+					FOREIGN KEY (id) REFERENCES taggables(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				CREATE TABLE taggings (
+					taggable_id INTEGER NOT NULL,
+					tag_id INTEGER NOT NULL,
+					PRIMARY KEY (taggable_id, tag_id),
+					FOREIGN KEY (taggable_id) REFERENCES taggables(id) ON DELETE CASCADE,
+					FOREIGN KEY (tag_id) REFERENCES tags(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				CREATE TABLE access_tokens (
+					token VARCHAR(32) NOT NULL PRIMARY KEY,
+					user_id INTEGER NOT NULL,
+					descr TEXT NOT NULL DEFAULT '',
+					created_ts INTEGER NOT NULL DEFAULT (CAST(strftime('%s', 'now') AS INTEGER)),
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				CREATE TABLE google_auth (
+					google_user_id TEXT NOT NULL PRIMARY KEY,
+					user_id INTEGER NOT NULL,
+					email TEXT NOT NULL,
+					created_ts INTEGER NOT NULL DEFAULT (CAST(strftime('%s', 'now') AS INTEGER)),
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			for _, q := range []string{
+				`CREATE INDEX taggings_tag_id ON taggings (tag_id)`,
+				`CREATE INDEX taggables_owner_id ON taggables (owner_id)`,
+				`CREATE INDEX taggables_type ON taggables ("type")`,
+				`CREATE INDEX tags_parent_id ON tags (parent_id)`,
+				`CREATE INDEX tags_owner_id ON tags (owner_id)`,
+				`CREATE INDEX bookmarks_url ON bookmarks (url)`,
+			} {
+				if _, err := tx.Exec(q); err != nil {
+					return errors.Trace(err)
+				}
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx dfmigrate.Tx) error {
+			for _, table := range []string{
+				"google_auth", "access_tokens", "taggings", "bookmarks",
+				"taggables", "tag_names", "tags", "users",
+			} {
+				if _, err := tx.Exec(`DROP TABLE ` + table); err != nil {
+					return errors.Trace(err)
+				}
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+	// 002: Add trashed_bookmarks table {{{
+	err = mig.AddMigration(
+		2, "Add trashed_bookmarks table",
+
+		// ---------- UP ----------
+		func(tx dfmigrate.Tx) error {
+			if _, err := tx.Exec(`
+				CREATE TABLE trashed_bookmarks (
+					id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+					owner_id INTEGER NOT NULL,
+					bookmark_id INTEGER NOT NULL,
+					url TEXT NOT NULL,
+					title TEXT NOT NULL,
+					comment TEXT NOT NULL,
+					tag_paths TEXT NOT NULL DEFAULT '',
+					created_ts INTEGER NOT NULL,
+					updated_ts INTEGER NOT NULL,
+					deleted_ts INTEGER NOT NULL DEFAULT (CAST(strftime('%s', 'now') AS INTEGER)),
+					FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			for _, q := range []string{
+				`CREATE INDEX trashed_bookmarks_owner_id ON trashed_bookmarks (owner_id)`,
+				`CREATE INDEX trashed_bookmarks_deleted_ts ON trashed_bookmarks (deleted_ts)`,
+			} {
+				if _, err := tx.Exec(q); err != nil {
+					return errors.Trace(err)
+				}
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx dfmigrate.Tx) error {
+			if _, err := tx.Exec(`DROP TABLE trashed_bookmarks`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+	// 003: Add bookmark_revisions table {{{
+	err = mig.AddMigration(
+		3, "Add bookmark_revisions table",
+
+		// ---------- UP ----------
+		func(tx dfmigrate.Tx) error {
+			if _, err := tx.Exec(`
+				CREATE TABLE bookmark_revisions (
+					id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+					bookmark_id INTEGER NOT NULL,
+					url TEXT NOT NULL,
+					title TEXT NOT NULL,
+					comment TEXT NOT NULL,
+					tag_ids TEXT NOT NULL DEFAULT '',
+					created_ts INTEGER NOT NULL DEFAULT (CAST(strftime('%s', 'now') AS INTEGER)),
+					FOREIGN KEY (bookmark_id) REFERENCES taggables(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(
+				`CREATE INDEX bookmark_revisions_bookmark_id ON bookmark_revisions (bookmark_id)`,
+			); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx dfmigrate.Tx) error {
+			if _, err := tx.Exec(`DROP TABLE bookmark_revisions`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 004: Add tag_operations table {{{
+	err = mig.AddMigration(
+		4, "Add tag_operations table",
+
+		// ---------- UP ----------
+		func(tx dfmigrate.Tx) error {
+			if _, err := tx.Exec(`
+				CREATE TABLE tag_operations (
+					id INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+					owner_id INTEGER NOT NULL,
+					kind TEXT NOT NULL,
+					tag_id INTEGER NOT NULL,
+					tag TEXT NOT NULL DEFAULT '',
+					taggings TEXT NOT NULL DEFAULT '',
+					created_ts INTEGER NOT NULL DEFAULT (CAST(strftime('%s', 'now') AS INTEGER)),
+					FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(
+				`CREATE INDEX tag_operations_owner_id ON tag_operations (owner_id)`,
+			); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx dfmigrate.Tx) error {
+			if _, err := tx.Exec(`DROP TABLE tag_operations`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 005: Add full-text search index of bookmarks {{{
+	err = mig.AddMigration(
+		5, "Add full-text search index of bookmarks",
+
+		// ---------- UP ----------
+		func(tx dfmigrate.Tx) error {
+			// docid of the index row is the id of the bookmark
+			if _, err := tx.Exec(`
+				CREATE VIRTUAL TABLE bookmarks_fts USING fts4(
+					title, comment, url, tokenize=porter
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				INSERT INTO bookmarks_fts (docid, title, comment, url)
+					SELECT id, title, comment, url FROM bookmarks
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			// Bookmarks are usually deleted by cascade from taggables, so the index
+			// is cleaned up by the trigger
+			if _, err := tx.Exec(`
+				CREATE TRIGGER bookmarks_fts_delete AFTER DELETE ON bookmarks
+				BEGIN
+					DELETE FROM bookmarks_fts WHERE docid = old.id;
+				END
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx dfmigrate.Tx) error {
+			if _, err := tx.Exec(`DROP TRIGGER bookmarks_fts_delete`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`DROP TABLE bookmarks_fts`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 006: Add canonical URLs of bookmarks {{{
+	err = mig.AddMigration(
+		6, "Add canonical URLs of bookmarks",
+
+		// ---------- UP ----------
+		func(tx dfmigrate.Tx) error {
+			if _, err := tx.Exec(`
+				ALTER TABLE bookmarks ADD COLUMN canonical_url TEXT NOT NULL DEFAULT ''
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			// Existing URLs are canonicalized with the default rules, since the
+			// configured ones are not known here; if the server is configured
+			// differently, "geekmarks-admin recanonicalize" should be run after
+			// the migration, otherwise duplicates are not detected reliably.
+			canonicalURLs, err := getCanonicalURLs(tx)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			for id, canonicalURL := range canonicalURLs {
+				if _, err := tx.Exec(
+					"UPDATE bookmarks SET canonical_url = ? WHERE id = ?", canonicalURL, id,
+				); err != nil {
+					return errors.Trace(err)
+				}
+			}
+
+			if _, err := tx.Exec(`
+				CREATE INDEX bookmarks_canonical_url ON bookmarks (canonical_url)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx dfmigrate.Tx) error {
+			if _, err := tx.Exec(`DROP INDEX bookmarks_canonical_url`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`ALTER TABLE bookmarks DROP COLUMN canonical_url`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 007: Add notes {{{
+	err = mig.AddMigration(
+		7, "Add notes",
+
+		// ---------- UP ----------
+		func(tx dfmigrate.Tx) error {
+			if _, err := tx.Exec(`
+				CREATE TABLE notes (
+					id INTEGER NOT NULL PRIMARY KEY,
+					title TEXT NOT NULL,
+					body TEXT NOT NULL,
+					FOREIGN KEY (id) REFERENCES taggables(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx dfmigrate.Tx) error {
+			if _, err := tx.Exec(`DELETE FROM taggables WHERE "type" = 'note'`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`DROP TABLE notes`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 008: Add link_checks table {{{
+	err = mig.AddMigration(
+		8, "Add link_checks table",
+
+		// ---------- UP ----------
+		func(tx dfmigrate.Tx) error {
+			if _, err := tx.Exec(`
+				CREATE TABLE link_checks (
+					bookmark_id INTEGER NOT NULL PRIMARY KEY,
+					url TEXT NOT NULL,
+					status_code INTEGER NOT NULL,
+					redirect_url TEXT NOT NULL DEFAULT '',
+					error TEXT NOT NULL DEFAULT '',
+					checked_ts INTEGER NOT NULL DEFAULT (CAST(strftime('%s', 'now') AS INTEGER)),
+					FOREIGN KEY (bookmark_id) REFERENCES bookmarks(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(
+				`CREATE INDEX link_checks_checked_ts ON link_checks (checked_ts)`,
+			); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx dfmigrate.Tx) error {
+			if _, err := tx.Exec(`DROP TABLE link_checks`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 009: Add page_meta table {{{
+	err = mig.AddMigration(
+		9, "Add page_meta table",
+
+		// ---------- UP ----------
+		func(tx dfmigrate.Tx) error {
+			if _, err := tx.Exec(`
+				CREATE TABLE page_meta (
+					bookmark_id INTEGER NOT NULL PRIMARY KEY,
+					url TEXT NOT NULL,
+					title TEXT NOT NULL DEFAULT '',
+					description TEXT NOT NULL DEFAULT '',
+					canonical_url TEXT NOT NULL DEFAULT '',
+					favicon_url TEXT NOT NULL DEFAULT '',
+					error TEXT NOT NULL DEFAULT '',
+					fetched_ts INTEGER,
+					FOREIGN KEY (bookmark_id) REFERENCES bookmarks(id) ON DELETE CASCADE
+				)
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx dfmigrate.Tx) error {
+			if _, err := tx.Exec(`DROP TABLE page_meta`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	// 010: Keep explicit updated_ts of updated taggables {{{
+	err = mig.AddMigration(
+		10, "Keep explicit updated_ts of updated taggables",
+
+		// ---------- UP ----------
+		func(tx dfmigrate.Tx) error {
+			// Updates of other columns still bump updated_ts, but setting it
+			// explicitly (e.g. restored bookmarks and notes get their original
+			// time back after their taggings are set) doesn't fire the trigger.
+			if _, err := tx.Exec(`DROP TRIGGER trg_set_updated_ts`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				CREATE TRIGGER trg_set_updated_ts
+				AFTER UPDATE OF id, owner_id, "type", created_ts ON taggables
+				FOR EACH ROW BEGIN
+					UPDATE taggables SET updated_ts = CAST(strftime('%s', 'now') AS INTEGER)
+						WHERE id = NEW.id;
+				END
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+
+		// ---------- DOWN ----------
+		func(tx dfmigrate.Tx) error {
+			if _, err := tx.Exec(`DROP TRIGGER trg_set_updated_ts`); err != nil {
+				return errors.Trace(err)
+			}
+
+			if _, err := tx.Exec(`
+				CREATE TRIGGER trg_set_updated_ts AFTER UPDATE ON taggables
+				FOR EACH ROW BEGIN
+					UPDATE taggables SET updated_ts = CAST(strftime('%s', 'now') AS INTEGER)
+						WHERE id = NEW.id;
+				END
+				`); err != nil {
+				return errors.Trace(err)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	// }}}
+
+	return mig, nil
+}
+
+// getCanonicalURLs returns canonical URLs of all bookmarks (as per the default
+// rules), keyed by bookmark id.
+func getCanonicalURLs(tx dfmigrate.Tx) (map[int]string, error) {
+	rows, err := tx.Query("SELECT id, url FROM bookmarks")
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	defer rows.Close()
+
+	canonicalURLs := map[int]string{}
+	for rows.Next() {
+		var id int
+		var url string
+		if err := rows.Scan(&id, &url); err != nil {
+			return nil, errors.Trace(err)
+		}
+		canonicalURLs[id] = urlcanon.Canonicalize(url, urlcanon.DefaultRules())
+	}
+	if err := rows.Err(); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return canonicalURLs, nil
+}
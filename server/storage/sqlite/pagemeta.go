@@ -0,0 +1,121 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package sqlite
+
+import (
+	"database/sql"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+func (s *StorageSQLite) RequestPageMeta(tx *sql.Tx, bookmarkID int) error {
+	_, err := tx.ExecContext(s.ctx(tx), `
+INSERT OR REPLACE INTO page_meta (bookmark_id, url)
+  SELECT id, url FROM bookmarks WHERE id = ?
+	`, bookmarkID)
+	if err != nil {
+		return hh.MakeInternalServerError(
+			errors.Annotatef(err, "requesting page meta of bookmark %d", bookmarkID),
+		)
+	}
+
+	return nil
+}
+
+func (s *StorageSQLite) GetPendingPageMeta(
+	tx *sql.Tx, limit int,
+) ([]storage.BookmarkData, error) {
+	rows, err := tx.QueryContext(s.ctx(tx), `
+SELECT t.id, t.owner_id, b.url
+  FROM page_meta pm
+  JOIN taggables t ON t.id = pm.bookmark_id
+  JOIN bookmarks b ON b.id = pm.bookmark_id
+  WHERE pm.fetched_ts IS NULL
+  ORDER BY t.id
+  LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	bkms := []storage.BookmarkData{}
+	for rows.Next() {
+		var bkm storage.BookmarkData
+		if err := rows.Scan(&bkm.ID, &bkm.OwnerID, &bkm.URL); err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+		bkms = append(bkms, bkm)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	return bkms, nil
+}
+
+func (s *StorageSQLite) SetPageMeta(tx *sql.Tx, pm *storage.PageMetaData) error {
+	_, err := tx.ExecContext(s.ctx(tx), `
+UPDATE page_meta
+  SET url = ?, title = ?, description = ?, canonical_url = ?, favicon_url = ?,
+      error = ?, fetched_ts = CAST(strftime('%s', 'now') AS INTEGER)
+  WHERE bookmark_id = ?
+	`,
+		pm.URL, pm.Title, pm.Description, pm.CanonicalURL, pm.FaviconURL,
+		pm.Error, pm.BookmarkID,
+	)
+	if err != nil {
+		return hh.MakeInternalServerError(
+			errors.Annotatef(err, "saving page meta of bookmark %d", pm.BookmarkID),
+		)
+	}
+
+	return nil
+}
+
+func (s *StorageSQLite) GetPageMeta(
+	tx *sql.Tx, bookmarkIDs []int,
+) (map[int]storage.PageMetaData, error) {
+	pms := map[int]storage.PageMetaData{}
+	if len(bookmarkIDs) == 0 {
+		return pms, nil
+	}
+
+	args := []interface{}{}
+	for _, id := range bookmarkIDs {
+		args = append(args, id)
+	}
+
+	rows, err := tx.QueryContext(s.ctx(tx), `
+SELECT pm.bookmark_id, pm.url, pm.title, pm.description, pm.canonical_url,
+       pm.favicon_url, pm.error, pm.fetched_ts
+  FROM page_meta pm
+  JOIN bookmarks b ON b.id = pm.bookmark_id AND b.url = pm.url
+  WHERE pm.fetched_ts IS NOT NULL
+    AND pm.bookmark_id IN (`+getPlaceholdersString(len(bookmarkIDs))+`)
+	`, args...)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var pm storage.PageMetaData
+		err := rows.Scan(
+			&pm.BookmarkID, &pm.URL, &pm.Title, &pm.Description, &pm.CanonicalURL,
+			&pm.FaviconURL, &pm.Error, &pm.FetchedAt,
+		)
+		if err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+		pms[pm.BookmarkID] = pm
+	}
+	if err := rows.Err(); err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	return pms, nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package sqlite
+
+import (
+	"database/sql"
+	"sort"
+	"strconv"
+	"strings"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/dimonomid/interrors"
+	"github.com/juju/errors"
+)
+
+func (s *StorageSQLite) SaveBookmarkRevision(
+	tx *sql.Tx, bookmarkID int,
+) (revisionID int, err error) {
+	tagIDs, err := s.GetTaggings(tx, bookmarkID, storage.TaggingModeLeafs)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	res, err := tx.ExecContext(s.ctx(tx), `
+INSERT INTO bookmark_revisions (bookmark_id, url, title, comment, tag_ids)
+  SELECT id, url, title, comment, ? FROM bookmarks WHERE id = ?
+	`, joinIDs(tagIDs), bookmarkID,
+	)
+	if err != nil {
+		return 0, hh.MakeInternalServerError(errors.Annotatef(
+			err, "saving revision of bookmark with id %d", bookmarkID,
+		))
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, hh.MakeInternalServerError(err)
+	}
+	if n == 0 {
+		return 0, errors.Annotatef(storage.ErrBookmarkDoesNotExist, "id %d", bookmarkID)
+	}
+
+	revisionID, err = lastInsertID(res)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return revisionID, nil
+}
+
+func (s *StorageSQLite) GetBookmarkRevisions(
+	tx *sql.Tx, bookmarkID int,
+) ([]storage.BookmarkRevisionData, error) {
+	rows, err := tx.QueryContext(s.ctx(tx), `
+SELECT `+bookmarkRevisionFields+`
+  FROM bookmark_revisions
+  WHERE bookmark_id = ?
+  ORDER BY id DESC
+	`, bookmarkID,
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	revs := []storage.BookmarkRevisionData{}
+	for rows.Next() {
+		rev, err := scanBookmarkRevision(rows)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		revs = append(revs, *rev)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	return revs, nil
+}
+
+func (s *StorageSQLite) GetBookmarkRevision(
+	tx *sql.Tx, revisionID int,
+) (*storage.BookmarkRevisionData, error) {
+	rev, err := scanBookmarkRevision(tx.QueryRowContext(s.ctx(tx), `
+SELECT `+bookmarkRevisionFields+`
+  FROM bookmark_revisions
+  WHERE id = ?
+	`, revisionID,
+	))
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, errors.Annotatef(
+				interrors.WrapInternalError(
+					err,
+					storage.ErrBookmarkRevisionDoesNotExist,
+				),
+				"id %d", revisionID,
+			)
+		}
+		return nil, errors.Trace(err)
+	}
+
+	return rev, nil
+}
+
+const bookmarkRevisionFields = `id, bookmark_id, url, title, comment, tag_ids,
+       created_ts`
+
+// scanBookmarkRevision scans the row with bookmarkRevisionFields. Errors are
+// returned as is, so that the caller can check for sql.ErrNoRows.
+func scanBookmarkRevision(row scanner) (*storage.BookmarkRevisionData, error) {
+	rev := storage.BookmarkRevisionData{}
+	var tagIDs string
+	err := row.Scan(
+		&rev.ID, &rev.BookmarkID, &rev.URL, &rev.Title, &rev.Comment, &tagIDs,
+		&rev.CreatedAt,
+	)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	rev.TagIDs, err = splitIDs(tagIDs)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	return &rev, nil
+}
+
+// joinIDs and splitIDs convert ids to the comma-separated string and back.
+func joinIDs(ids []int) string {
+	ids = append([]int{}, ids...)
+	sort.Ints(ids)
+
+	strs := []string{}
+	for _, id := range ids {
+		strs = append(strs, strconv.Itoa(id))
+	}
+	return strings.Join(strs, ",")
+}
+
+func splitIDs(s string) ([]int, error) {
+	ids := []int{}
+	if s == "" {
+		return ids, nil
+	}
+
+	for _, str := range strings.Split(s, ",") {
+		id, err := strconv.Atoi(str)
+		if err != nil {
+			return nil, errors.Annotatef(err, "parsing ids %q", s)
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// Package sqlite implements storage.Storage on top of SQLite, so that
+// geekmarks can run without a separate database server: e.g. for small
+// self-hosted installations, or on a laptop.
+package sqlite // import "dmitryfrank.com/geekmarks/server/storage/sqlite"
+
+import (
+	"database/sql"
+	"strings"
+
+	"dmitryfrank.com/geekmarks/server/dfmigrate"
+	"dmitryfrank.com/geekmarks/server/storage/internal/txctx"
+
+	"github.com/juju/errors"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Implements storage.Storage
+type StorageSQLite struct {
+	dsn    string
+	db     *sql.DB
+	txCtxs txctx.Registry
+
+	migrationDriftMode dfmigrate.DriftMode
+}
+
+// New creates a new SQLite storage. path is a path to the database file;
+// it can also be any data source name supported by the go-sqlite3 driver,
+// e.g. "file:foo.db?cache=shared".
+func New(path string) (*StorageSQLite, error) {
+	if path == "" {
+		return nil, errors.Errorf("SQLite database path is empty")
+	}
+
+	// Foreign keys are disabled in SQLite by default, but we rely on
+	// ON DELETE CASCADE heavily, so enable them for every connection.
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	dsn := path + sep + "_foreign_keys=1&_busy_timeout=10000"
+
+	return &StorageSQLite{
+		dsn: dsn,
+	}, nil
+}
+
+func (s *StorageSQLite) Connect() error {
+	var err error
+	s.db, err = sql.Open("sqlite3", s.dsn)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// SQLite allows only one writer at a time anyway, and having a single
+	// connection saves us from "database is locked" errors when concurrent
+	// transactions try to upgrade their locks.
+	s.db.SetMaxOpenConns(1)
+
+	return nil
+}
+
+// Close closes the database; Connect can be called again afterwards.
+func (s *StorageSQLite) Close() error {
+	if s.db == nil {
+		return nil
+	}
+
+	err := s.db.Close()
+	s.db = nil
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func (s *StorageSQLite) ApplyMigrations() error {
+	mig, err := s.getMigrations()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = mig.MigrateToLatest(s.db)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func (s *StorageSQLite) GetMigrationStatus() (*dfmigrate.Status, error) {
+	mig, err := s.getMigrations()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	status, err := mig.Status(s.db)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return status, nil
+}
+
+func (s *StorageSQLite) Migrate(targetMigrationID int) error {
+	mig, err := s.getMigrations()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = mig.Migrate(s.db, targetMigrationID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func (s *StorageSQLite) DryRunMigration(targetMigrationID int) ([]dfmigrate.Step, error) {
+	mig, err := s.getMigrations()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	steps, err := mig.DryRun(s.db, targetMigrationID)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return steps, nil
+}
+
+func (s *StorageSQLite) SetMigrationDriftMode(mode dfmigrate.DriftMode) {
+	s.migrationDriftMode = mode
+}
+
+func (s *StorageSQLite) AcceptMigrationDrift() error {
+	mig, err := s.getMigrations()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	err = mig.AcceptDrift(s.db)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
+
+func (s *StorageSQLite) getMigrations() (*dfmigrate.Migrations, error) {
+	mig, err := initMigrations()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	mig.SetDriftMode(s.migrationDriftMode)
+
+	return mig, nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests
+
+package sqlite
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/storage/storagetest"
+	"dmitryfrank.com/geekmarks/server/testutils"
+	"github.com/dimonomid/interrors"
+
+	"github.com/juju/errors"
+)
+
+// newTestDB creates a fresh SQLite database in a temporary directory and
+// applies all migrations; the returned function removes the database.
+func newTestDB(t *testing.T) (*StorageSQLite, func()) {
+	dir, err := ioutil.TempDir("", "geekmarks_sqlite_test")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+
+	si, err := New(filepath.Join(dir, "geekmarks.db"))
+	if err == nil {
+		err = si.Connect()
+	}
+	if err == nil {
+		err = si.ApplyMigrations()
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("%s", interrors.ErrorStack(err))
+	}
+
+	return si, func() {
+		si.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) (storage.Storage, func()) {
+		return newTestDB(t)
+	})
+}
+
+func TestReadOnlyTx(t *testing.T) {
+	si, cleanup := newTestDB(t)
+	defer cleanup()
+
+	err := si.TxOpt(
+		storage.TxILevelRepeatableRead, storage.TxModeReadOnly,
+		func(tx *sql.Tx) error {
+			_, err := si.CreateUser(tx, &storage.UserData{Username: "test1"})
+			return errors.Trace(err)
+		},
+	)
+	if err == nil {
+		t.Errorf("should not be able to write in a read-only transaction")
+	}
+
+	// The connection should be writable again after the read-only
+	// transaction
+	if _, _, err := testutils.CreateTestUser(si, "test1", "1@1.1"); err != nil {
+		t.Errorf("%s", interrors.ErrorStack(err))
+	}
+}
+
+func TestMigrateDownAndUp(t *testing.T) {
+	si, cleanup := newTestDB(t)
+	defer cleanup()
+
+	mig, err := initMigrations()
+	if err != nil {
+		t.Fatalf("%s", interrors.ErrorStack(err))
+	}
+
+	// Revert everything and then apply again: the schema should be usable
+	if err := mig.Migrate(si.db, 0); err != nil {
+		t.Fatalf("%s", interrors.ErrorStack(err))
+	}
+	if err := si.ApplyMigrations(); err != nil {
+		t.Fatalf("%s", interrors.ErrorStack(err))
+	}
+
+	if _, _, err := testutils.CreateTestUser(si, "test1", "1@1.1"); err != nil {
+		t.Errorf("%s", interrors.ErrorStack(err))
+	}
+}
+
+func TestOrphanedTagNames(t *testing.T) {
+	si, cleanup := newTestDB(t)
+	defer cleanup()
+
+	// Foreign keys prevent orphaned tag names, so they have to be disabled
+	// to create one. There's just one connection, so the pragma sticks.
+	for _, q := range []string{
+		"PRAGMA foreign_keys = OFF",
+		"INSERT INTO tag_names (tag_id, name) VALUES (9999, 'ghost')",
+		"PRAGMA foreign_keys = ON",
+	} {
+		if _, err := si.db.Exec(q); err != nil {
+			t.Fatalf("%s: %s", q, err)
+		}
+	}
+
+	report, err := si.GetIntegrityReport()
+	if err != nil {
+		t.Fatalf("%s", interrors.ErrorStack(err))
+	}
+	expected := []storage.OrphanedTagName{{TagID: 9999, Name: "ghost"}}
+	if !reflect.DeepEqual(report.OrphanedTagNames, expected) {
+		t.Errorf("expected orphaned tag names %v, got %v", expected, report.OrphanedTagNames)
+	}
+
+	fixes, err := si.RepairIntegrity()
+	if err != nil {
+		t.Fatalf("%s", interrors.ErrorStack(err))
+	}
+	if len(fixes) != 1 || fixes[0].Kind != storage.IntegrityFixKindOrphanedTagName {
+		t.Errorf("unexpected fixes: %+v", fixes)
+	}
+
+	if err := si.CheckIntegrity(); err != nil {
+		t.Errorf("%s", interrors.ErrorStack(err))
+	}
+}
+
+// TestTxContextsRemoved checks that the contexts of transactions are not
+// kept after the transactions are committed or rolled back: otherwise, every
+// request context would be leaked.
+func TestTxContextsRemoved(t *testing.T) {
+	si, cleanup := newTestDB(t)
+	defer cleanup()
+
+	errTest := errors.New("test error")
+
+	txFuncs := map[string]func() error{
+		"commit": func() error {
+			return si.Tx(func(tx *sql.Tx) error {
+				return nil
+			})
+		},
+		"rollback": func() error {
+			return si.Tx(func(tx *sql.Tx) error {
+				return errTest
+			})
+		},
+		"read-only rollback": func() error {
+			return si.TxOpt(
+				storage.TxILevelRepeatableRead, storage.TxModeReadOnly,
+				func(tx *sql.Tx) error {
+					return errTest
+				},
+			)
+		},
+	}
+
+	for name, f := range txFuncs {
+		if err := f(); err != nil && errors.Cause(err) != errTest {
+			t.Errorf("%s: %s", name, interrors.ErrorStack(err))
+		}
+
+		if n := si.txCtxs.Len(); n != 0 {
+			t.Errorf("%s: expected no registered transactions, got %d", name, n)
+		}
+	}
+}
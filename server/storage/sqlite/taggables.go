@@ -0,0 +1,207 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package sqlite
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/juju/errors"
+)
+
+func (s *StorageSQLite) CreateTaggable(tx *sql.Tx, tgbd *storage.TaggableData) (tgbID int, err error) {
+	cols := `owner_id, "type"`
+	phs := "?, ?"
+	args := []interface{}{tgbd.OwnerID, string(tgbd.Type)}
+	if tgbd.CreatedAt != 0 {
+		cols += ", created_ts"
+		phs += ", ?"
+		args = append(args, tgbd.CreatedAt)
+	}
+	if tgbd.UpdatedAt != 0 {
+		cols += ", updated_ts"
+		phs += ", ?"
+		args = append(args, tgbd.UpdatedAt)
+	}
+
+	query := "INSERT INTO taggables (" + cols + ") VALUES (" + phs + ")"
+	res, err := tx.ExecContext(s.ctx(tx), query, args...)
+	if err != nil {
+		return 0, hh.MakeInternalServerError(errors.Annotatef(
+			err, "adding new taggable (owner_id: %d, type: %s)", tgbd.OwnerID, tgbd.Type,
+		))
+	}
+
+	tgbID, err = lastInsertID(res)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return tgbID, nil
+}
+
+func (s *StorageSQLite) DeleteTaggable(tx *sql.Tx, taggableID int) error {
+	_, err := tx.ExecContext(
+		s.ctx(tx), "DELETE FROM taggables WHERE id = ?", taggableID,
+	)
+	if err != nil {
+		return hh.MakeInternalServerError(errors.Annotatef(
+			err, "deleting taggable with id %d", taggableID,
+		))
+	}
+
+	return nil
+}
+
+func (s *StorageSQLite) SetTaggableUpdatedAt(
+	tx *sql.Tx, taggableID int, updatedAt uint64,
+) (err error) {
+	if updatedAt == 0 {
+		_, err = tx.ExecContext(
+			s.ctx(tx), `
+UPDATE taggables SET updated_ts = CAST(strftime('%s', 'now') AS INTEGER) WHERE id = ?
+			`, taggableID,
+		)
+	} else {
+		_, err = tx.ExecContext(
+			s.ctx(tx), "UPDATE taggables SET updated_ts = ? WHERE id = ?",
+			updatedAt, taggableID,
+		)
+	}
+	if err != nil {
+		return hh.MakeInternalServerError(errors.Annotatef(
+			err, "setting update time of taggable %d", taggableID,
+		))
+	}
+
+	return nil
+}
+
+func (s *StorageSQLite) GetTaggedTaggableIDs(
+	tx *sql.Tx, tagIDs []int, ownerID *int, ttypes []storage.TaggableType,
+) (taggableIDs []int, err error) {
+	args := []interface{}{}
+
+	// Build query
+	query := "SELECT taggables.id FROM taggables "
+
+	// There is a different logic for two cases:
+	// - There is at least one tag given: we'll fetch taggables which are tagged
+	//   with all of the given tags (and possibly with any other tags)
+	// - There are no tags given: we'll fetch taggables which are untagged at all
+	if len(tagIDs) > 0 {
+		for k, tagID := range tagIDs {
+			query += fmt.Sprintf(
+				"JOIN taggings t%d ON (t%d.taggable_id = taggables.id AND t%d.tag_id = ?) ",
+				k, k, k,
+			)
+			args = append(args, tagID)
+		}
+
+		query += "WHERE 1=1 "
+	} else {
+		// Get untagged
+		query += "LEFT JOIN taggings t ON (t.taggable_id = taggables.id) "
+		query += "WHERE t.taggable_id IS NULL "
+	}
+
+	if ownerID != nil {
+		query += "AND owner_id = ? "
+		args = append(args, *ownerID)
+	}
+
+	if len(ttypes) > 0 {
+		conds := []string{}
+		for _, ttype := range ttypes {
+			conds = append(conds, `"type" = ?`)
+			args = append(args, string(ttype))
+		}
+		query += "AND ( " + strings.Join(conds, " OR ") + " ) "
+	}
+
+	// Execute it
+	rows, err := tx.QueryContext(s.ctx(tx), query, args...)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var taggableID int
+		err := rows.Scan(&taggableID)
+		if err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+		taggableIDs = append(taggableIDs, taggableID)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, errors.Annotatef(err, "closing rows")
+	}
+
+	return taggableIDs, nil
+}
+
+// getTaggablesTaggedWithOnlyOneTag returns a slice of taggable ids tagged
+// with just one tag with given tagID. It is used to get taggables which are
+// tagged with root tag only.
+func (s *StorageSQLite) getTaggablesTaggedWithOnlyOneTag(
+	tx *sql.Tx, tagID int,
+) (taggableIDs []int, err error) {
+	rows, err := tx.QueryContext(s.ctx(tx), `
+SELECT t.taggable_id FROM taggings t
+WHERE t.tag_id = ? AND NOT EXISTS (
+  SELECT 1 FROM taggings t2 WHERE t2.taggable_id = t.taggable_id AND t2.tag_id != t.tag_id
+)
+	`, tagID)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cur int
+		err := rows.Scan(&cur)
+		if err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+		taggableIDs = append(taggableIDs, cur)
+	}
+	return taggableIDs, nil
+}
+
+// getTagsJSONFieldQuery returns a part of SQL query which results in a "tag
+// brief data" JSON. For details on that, see tagbrief.Parse().
+func getTagsJSONFieldQuery(opts *storage.TagsFetchOpts, taggablesAlias string) (string, error) {
+	switch opts.TagsFetchMode {
+	case storage.TagsFetchModeNone:
+		return "'{}'", nil
+	case storage.TagsFetchModeLeafs, storage.TagsFetchModeAll:
+		var nameArg, namesJoin string
+		switch opts.TagNamesFetchMode {
+		case storage.TagNamesFetchModeNone:
+			nameArg = "''"
+			namesJoin = ""
+		case storage.TagNamesFetchModeFull:
+			nameArg = "tn.name"
+			namesJoin = `JOIN tag_names tn ON tags.id = tn.tag_id AND tn."primary" = 1`
+		default:
+			return "", errors.Errorf("wrong tag names fetch mode %q", opts.TagNamesFetchMode)
+		}
+		return fmt.Sprintf(`
+       (
+         SELECT json_group_object(
+           tags.id,
+           json_object('id', tags.id, 'parent_id', tags.parent_id, 'name', %s)
+         )
+         FROM taggings
+         JOIN tags ON tags.id = taggings.tag_id
+         %s
+         WHERE taggings.taggable_id=%s.id
+       )
+		`, nameArg, namesJoin, taggablesAlias), nil
+	default:
+		return "", errors.Errorf("wrong tags fetch mode %q", opts.TagsFetchMode)
+	}
+}
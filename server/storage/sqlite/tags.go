@@ -0,0 +1,827 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package sqlite
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"dmitryfrank.com/geekmarks/server/storage/internal/taghier"
+	"github.com/dimonomid/interrors"
+	"github.com/golang/glog"
+	"github.com/juju/errors"
+)
+
+func (s *StorageSQLite) CreateTag(
+	tx *sql.Tx, td *storage.TagData,
+) (tagID int, err error) {
+	return s.createTag(tx, td, false)
+}
+
+func (s *StorageSQLite) RestoreTag(tx *sql.Tx, td *storage.TagData) error {
+	_, err := s.createTag(tx, td, true)
+	return errors.Trace(err)
+}
+
+// createTag creates the tag with all its subtags; if keepIDs is true, the ids
+// are taken from the given tag data instead of being generated.
+func (s *StorageSQLite) createTag(
+	tx *sql.Tx, td *storage.TagData, keepIDs bool,
+) (tagID int, err error) {
+	if len(td.Names) == 0 {
+		return 0, errors.Errorf("tag should have at least one name")
+	}
+
+	var iParentID interface{}
+	var parentID int
+
+	if td.ParentTagID != nil {
+		parentID = *td.ParentTagID
+	}
+
+	if parentID > 0 {
+		// check if given parent tag id exists
+		var tmpTagId int
+		err := tx.QueryRowContext(s.ctx(tx), "SELECT id FROM tags WHERE id = ?", parentID).
+			Scan(&tmpTagId)
+		if err != nil {
+			if errors.Cause(err) == sql.ErrNoRows {
+				return 0, errors.Errorf("Given parent tag id %d does not exist", parentID)
+			}
+			return 0, hh.MakeInternalServerError(errors.Annotatef(
+				err, "checking if parent tag id %d exists", parentID,
+			))
+		}
+
+		// increment children count of the parent
+		_, err = tx.ExecContext(s.ctx(tx), "UPDATE tags SET children_cnt = children_cnt + 1 WHERE id = ?", parentID)
+		if err != nil {
+			return 0, hh.MakeInternalServerError(errors.Annotatef(
+				err, "incrementing children_cnt of the tag with id %d", parentID,
+			))
+		}
+
+		iParentID = parentID
+	}
+
+	// check if given owner exists
+	{
+		_, err := s.GetUser(tx, &storage.GetUserArgs{ID: cptr.Int(td.OwnerID)})
+		if err != nil {
+			return 0, errors.Annotatef(err, "owner id %d", td.OwnerID)
+		}
+	}
+
+	description := ""
+	if td.Description != nil {
+		description = *td.Description
+	}
+
+	var res sql.Result
+	if keepIDs {
+		res, err = tx.ExecContext(
+			s.ctx(tx), "INSERT INTO tags (id, parent_id, owner_id, descr) VALUES (?, ?, ?, ?)",
+			td.ID, iParentID, td.OwnerID, description,
+		)
+	} else {
+		res, err = tx.ExecContext(
+			s.ctx(tx), "INSERT INTO tags (parent_id, owner_id, descr) VALUES (?, ?, ?)",
+			iParentID, td.OwnerID, description,
+		)
+	}
+	if err != nil {
+		return 0, hh.MakeInternalServerError(errors.Annotatef(
+			err, "adding new tag (parent_id: %v, owner_id: %d)", iParentID, td.OwnerID,
+		))
+	}
+
+	tagID, err = lastInsertID(res)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	// Add all names
+	for i, name := range td.Names {
+		if err := s.addTagName(
+			tx, tagID, parentID, name,
+			(i == 0),           // primary
+			(iParentID == nil), // allowEmpty
+		); err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+
+	// Create all subtags
+	for _, subTag := range td.Subtags {
+		_, err := s.createTag(tx, &subTag, keepIDs)
+		if err != nil {
+			return 0, errors.Annotatef(err, "creating subtag")
+		}
+	}
+
+	return tagID, nil
+}
+
+func (s *StorageSQLite) UpdateTag(
+	tx *sql.Tx, td *storage.TagData, leafPolicy storage.TaggableLeafPolicy,
+) (err error) {
+	// Move tag, if needed {{{
+	if td.ParentTagID != nil {
+		// We need to move the tag under another tag
+
+		reg := thReg{
+			s:  s,
+			tx: tx,
+		}
+		hierProto := taghier.New(&reg)
+
+		if err := hierProto.Add(td.ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := hierProto.Add(*td.ParentTagID); err != nil {
+			return errors.Trace(err)
+		}
+
+		// Make sure that the new parent is not the current tag or one of its
+		// descendants
+		isSubnode, err := hierProto.IsSubnode(*td.ParentTagID, td.ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if *td.ParentTagID == td.ID || isSubnode {
+			return errors.Errorf("tag cannot be moved under itself or one of its descendants")
+		}
+
+		oldParentID := hierProto.GetParent(td.ID)
+
+		// Get affected bookmarks (those tagged with the original tag id and its
+		// descendants)
+		taggableIDs, err := s.GetTaggedTaggableIDs(tx, []int{td.ID}, nil, nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		var removeNewLeafs bool
+		switch leafPolicy {
+		case storage.TaggableLeafPolicyKeep:
+			removeNewLeafs = false
+		case storage.TaggableLeafPolicyDel:
+			removeNewLeafs = true
+		default:
+			return errors.Errorf("invalid leafPolicy: %q", leafPolicy)
+		}
+
+		// For all the affected bookmarks, calculate the difference and apply
+		for _, taggableID := range taggableIDs {
+			// Get all taggings for the current bookmark
+			tagIDs, err := s.GetTaggings(tx, taggableID, storage.TaggingModeAll)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			// Create a warmed-up copy of taghier instance, and feed all current tag
+			// IDs to it
+			hierCur := hierProto.MakeCopy()
+			for _, id := range tagIDs {
+				if err := hierCur.Add(id); err != nil {
+					return errors.Trace(err)
+				}
+			}
+
+			// Perform the in-memory move, and delete all new leafs
+			if err := hierCur.Move(td.ID, *td.ParentTagID, removeNewLeafs); err != nil {
+				return errors.Trace(err)
+			}
+
+			// Apply the taggings change
+			err = s.SetTaggings(tx, taggableID, hierCur.GetAll(), storage.TaggingModeAll)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		// Update parent_id of the moved tag
+		_, err = tx.ExecContext(
+			s.ctx(tx), "UPDATE tags SET parent_id = ? WHERE id = ?", *td.ParentTagID, td.ID,
+		)
+		if err != nil {
+			return hh.MakeInternalServerError(errors.Annotatef(
+				err, "updating tag parent_id (id: %d, parent_id: %d)",
+				td.ID, *td.ParentTagID,
+			))
+		}
+
+		// Update children_cnt of the two parents
+		_, err = tx.ExecContext(
+			s.ctx(tx), "UPDATE tags SET children_cnt = children_cnt - 1 WHERE id = ?", oldParentID,
+		)
+		if err != nil {
+			return hh.MakeInternalServerError(errors.Annotatef(
+				err, "decrementing children_cnt of the tag %d", oldParentID,
+			))
+		}
+
+		_, err = tx.ExecContext(
+			s.ctx(tx), "UPDATE tags SET children_cnt = children_cnt + 1 WHERE id = ?", *td.ParentTagID,
+		)
+		if err != nil {
+			return hh.MakeInternalServerError(errors.Annotatef(
+				err, "incrementing children_cnt of the tag %d", *td.ParentTagID,
+			))
+		}
+	}
+	// }}}
+
+	// Update tag description, if needed {{{
+	if td.Description != nil {
+		_, err = tx.ExecContext(
+			s.ctx(tx), "UPDATE tags SET descr = ? WHERE id = ?", *td.Description, td.ID,
+		)
+		if err != nil {
+			return hh.MakeInternalServerError(errors.Annotatef(
+				err, "updating tag description (id: %d, description: %q)",
+				td.ID, *td.Description,
+			))
+		}
+	}
+	// }}}
+
+	// Update tag names, if needed {{{
+	if td.Names != nil {
+		if len(td.Names) == 0 {
+			return errors.Errorf("tag should have at least one name")
+		}
+
+		curNames, err := s.GetTagNames(tx, td.ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		namesDiff := getNamesDiff(curNames, td.Names)
+
+		// Apply the names difference
+		if len(namesDiff.add) > 0 {
+			// To add a name, we need to know a tag parent's ID (it's used for the
+			// check whether a tag with the given name already exists under the parent)
+			existingTD, err := s.GetTag(tx, td.ID, &storage.GetTagOpts{})
+			if err != nil {
+				return errors.Trace(err)
+			}
+			tagParentID := *existingTD.ParentTagID
+
+			for _, name := range namesDiff.add {
+				if err := s.addTagName(
+					tx, td.ID, tagParentID, name,
+					false, // not primary (primary name will be adjusted later, if needed)
+					false, // do not allow empty
+				); err != nil {
+					return errors.Trace(err)
+				}
+			}
+		}
+
+		for _, name := range namesDiff.delete {
+			if err := s.deleteTagName(tx, td.ID, name); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		// If needed, adjust primary name
+		if namesDiff.clearPrimary != nil {
+			if err := s.setTagNamePrimary(tx, td.ID, *namesDiff.clearPrimary, false); err != nil {
+				return errors.Trace(err)
+			}
+		}
+		if namesDiff.setPrimary != nil {
+			if err := s.setTagNamePrimary(tx, td.ID, *namesDiff.setPrimary, true); err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+	// }}}
+
+	return nil
+}
+
+func (s *StorageSQLite) DeleteTag(
+	tx *sql.Tx, tagID int, leafPolicy storage.TaggableLeafPolicy,
+) (err error) {
+	// TODO: so far only "keep new leaf" policy is implemented for tag deletion
+	if leafPolicy != storage.TaggableLeafPolicyKeep {
+		return errors.Annotatef(
+			storage.ErrNotImplemented,
+			"so far, only \"keep new leaf\" policy is implemented",
+		)
+	}
+
+	td, err := s.GetTag(tx, tagID, &storage.GetTagOpts{})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Make sure the tag to be deleted is not the user's root tag
+	rootTagID, err := s.GetRootTagID(tx, td.OwnerID)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if tagID == rootTagID {
+		glog.V(2).Infof("tried to delete the root tag")
+		return errors.Errorf("cowardly refused to delete the root tag")
+	}
+
+	// Here we just delete the subject tag; all the subtags and taggings
+	// will be deleted automatically thanks to ON DELETE CASCADE
+	_, err = tx.ExecContext(s.ctx(tx), "DELETE FROM tags WHERE id = ?", tagID)
+	if err != nil {
+		return hh.MakeInternalServerError(errors.Annotatef(
+			err, "deleting the tag with id %d", tagID,
+		))
+	}
+
+	_, err = tx.ExecContext(s.ctx(tx), "UPDATE tags SET children_cnt = children_cnt - 1 WHERE id = ?", *td.ParentTagID)
+	if err != nil {
+		return hh.MakeInternalServerError(errors.Annotatef(
+			err, "decrementing children_cnt of the tag with id %d", *td.ParentTagID,
+		))
+	}
+
+	// if ParentTagID is a root tag for the user, then we should find
+	// bookmarks tagged with only this flag, and make them untagged
+	// (remove tagging by the root tag)
+	if *td.ParentTagID == rootTagID {
+		tgbIDs, err := s.getTaggablesTaggedWithOnlyOneTag(tx, rootTagID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for _, curTgbID := range tgbIDs {
+			err := s.SetTaggings(tx, curTgbID, []int{}, storage.TaggingModeAll)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *StorageSQLite) GetTagIDByPath(tx *sql.Tx, ownerID int, tagPath string) (int, error) {
+	names := strings.Split(tagPath, "/")
+	curTagID, err := s.GetRootTagID(tx, ownerID)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	for _, tagName := range names {
+		if tagName == "" {
+			// skip empty names
+			continue
+		}
+		var err error
+		curTagID, err = s.GetTagIDByName(tx, curTagID, tagName)
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+	}
+
+	return curTagID, nil
+}
+
+func (s *StorageSQLite) GetTagIDByName(
+	tx *sql.Tx, parentTagID int, tagName string,
+) (int, error) {
+	var tagID int
+	err := tx.QueryRowContext(s.ctx(tx), `
+		SELECT t.id
+			FROM tag_names n
+			JOIN tags t ON n.tag_id = t.id
+			WHERE t.parent_id = ? and n.name = ?
+	`, parentTagID, tagName,
+	).Scan(&tagID)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return 0, errors.Annotatef(
+				interrors.WrapInternalError(
+					err,
+					storage.ErrTagDoesNotExist,
+				),
+				"%q", tagName,
+			)
+		}
+		// Some unexpected error
+		return 0, hh.MakeInternalServerError(err)
+	}
+	return tagID, nil
+}
+
+// GetRootTagID returns the id of the root tag for the given user.
+func (s *StorageSQLite) GetRootTagID(tx *sql.Tx, ownerID int) (int, error) {
+	var rootTagID int
+	err := tx.QueryRowContext(
+		s.ctx(tx), "SELECT id FROM tags WHERE owner_id = ? AND parent_id IS NULL",
+		ownerID,
+	).Scan(&rootTagID)
+	if err != nil {
+		return 0, hh.MakeInternalServerError(
+			errors.Annotatef(err, "getting root tag id for the user id %d", ownerID),
+		)
+	}
+
+	return rootTagID, nil
+}
+
+func (s *StorageSQLite) GetTagNames(tx *sql.Tx, tagID int) ([]string, error) {
+	var tagNames []string
+	rows, err := tx.QueryContext(
+		s.ctx(tx), `SELECT name FROM tag_names WHERE tag_id = ? ORDER BY "primary" DESC, rowid`, tagID,
+	)
+	if err != nil {
+		return nil, errors.Annotatef(
+			hh.MakeInternalServerError(err),
+			"getting tag names for tag %d", tagID,
+		)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tagName string
+		err := rows.Scan(&tagName)
+		if err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+
+		tagNames = append(tagNames, tagName)
+	}
+
+	if err := rows.Close(); err != nil {
+		return nil, errors.Annotatef(err, "closing rows")
+	}
+
+	return tagNames, nil
+}
+
+func (s *StorageSQLite) GetTagBookmarkCounts(
+	tx *sql.Tx, ownerID int,
+) (counts map[int]storage.TagBookmarkCounts, err error) {
+	counts = make(map[int]storage.TagBookmarkCounts)
+
+	// Since bookmarks are tagged with all the supertags too, the total count
+	// is just the number of taggings, and the bookmark is tagged directly if
+	// it's not tagged with any of the subtags.
+	rows, err := tx.QueryContext(s.ctx(tx), `
+SELECT tg.tag_id, COUNT(*), SUM(CASE WHEN NOT EXISTS (
+    SELECT 1 FROM taggings ctg JOIN tags ct ON ct.id = ctg.tag_id
+      WHERE ctg.taggable_id = tg.taggable_id AND ct.parent_id = tg.tag_id
+  ) THEN 1 ELSE 0 END)
+  FROM taggings tg
+    JOIN bookmarks b ON b.id = tg.taggable_id
+    JOIN taggables t ON t.id = tg.taggable_id
+    JOIN tags ON tags.id = tg.tag_id
+  WHERE t.owner_id = ? AND tags.parent_id IS NOT NULL
+  GROUP BY tg.tag_id`, ownerID,
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(errors.Annotatef(
+			err, "getting bookmark counts of tags of the user %d", ownerID,
+		))
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tagID int
+		var cnt storage.TagBookmarkCounts
+		if err := rows.Scan(&tagID, &cnt.Total, &cnt.Direct); err != nil {
+			return nil, hh.MakeInternalServerError(errors.Trace(err))
+		}
+		counts[tagID] = cnt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, hh.MakeInternalServerError(errors.Trace(err))
+	}
+
+	// The root tag: bookmarks tagged with the root tag only (which shouldn't
+	// happen normally) are considered untagged, like GetBookmarks does.
+	var rootCnt storage.TagBookmarkCounts
+	err = tx.QueryRowContext(s.ctx(tx), `
+SELECT COUNT(*), COALESCE(SUM(CASE WHEN NOT EXISTS (
+    SELECT 1 FROM taggings tg JOIN tags ON tags.id = tg.tag_id
+      WHERE tg.taggable_id = t.id AND tags.parent_id IS NOT NULL
+  ) THEN 1 ELSE 0 END), 0)
+  FROM taggables t JOIN bookmarks b ON b.id = t.id
+  WHERE t.owner_id = ?`, ownerID,
+	).Scan(&rootCnt.Total, &rootCnt.Direct)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(errors.Annotatef(
+			err, "getting bookmark counts of the user %d", ownerID,
+		))
+	}
+
+	if rootCnt.Total > 0 {
+		rootTagID, err := s.GetRootTagID(tx, ownerID)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		counts[rootTagID] = rootCnt
+	}
+
+	return counts, nil
+}
+
+func (s *StorageSQLite) GetTag(
+	tx *sql.Tx, tagID int, opts *storage.GetTagOpts,
+) (*storage.TagData, error) {
+	tagsData, err := s.getTagsInternal(tx, "id", tagID, opts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	if len(tagsData) == 0 {
+		return nil, storage.ErrTagDoesNotExist
+	}
+
+	if len(tagsData) > 1 {
+		return nil, hh.MakeInternalServerError(
+			errors.Errorf("getTagsInternal() should have returned just 1 row, but it returned %d", len(tagsData)),
+		)
+	}
+
+	return &tagsData[0], nil
+}
+
+func (s *StorageSQLite) GetTags(
+	tx *sql.Tx, parentTagID int, opts *storage.GetTagOpts,
+) ([]storage.TagData, error) {
+	tagsData, err := s.getTagsInternal(tx, "parent_id", parentTagID, opts)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return tagsData, nil
+}
+
+func (s *StorageSQLite) getTagsInternal(
+	tx *sql.Tx, fieldName string, tagID int, opts *storage.GetTagOpts,
+) ([]storage.TagData, error) {
+	var tagsData []storage.TagData
+	var childrenCntArr []int
+	if fieldName != "id" && fieldName != "parent_id" {
+		return nil, errors.Trace(hh.MakeInternalServerError(
+			errors.Errorf("invalid fieldName: %q", fieldName),
+		))
+	}
+
+	tagFields := "tags.id, tags.owner_id, tags.parent_id, tags.descr, tags.children_cnt"
+	var query string
+	if !opts.GetNames {
+		// No need to get tag names, so, just a simple query to the tags table
+		query = fmt.Sprintf("SELECT %s FROM tags WHERE %s = ?", tagFields, fieldName)
+	} else {
+		// We need to get tag names, so here we add JSON array column with all
+		// names (the first one is the primary one); SQLite aggregates rows in
+		// the order they come from the subquery. For ordering the tags
+		// themselves, we join the primary name separately.
+		tagFields += `, (
+					SELECT json_group_array(name) FROM (
+						SELECT name FROM tag_names
+							WHERE tag_id = tags.id
+							ORDER BY "primary" DESC, rowid
+					)
+				) AS names`
+		query = fmt.Sprintf(`
+				SELECT %s FROM tags
+				JOIN tag_names pn ON pn.tag_id = tags.id AND pn."primary" = 1
+				WHERE tags.%s = ?
+				ORDER BY pn.name`,
+			tagFields, fieldName,
+		)
+	}
+
+	rows, err := tx.QueryContext(s.ctx(tx), query, tagID)
+	if err != nil {
+		return nil, errors.Annotatef(
+			hh.MakeInternalServerError(err),
+			"getting tags with %s %d", fieldName, tagID,
+		)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var td storage.TagData
+		var childrenCnt int
+		var pparentTagID *int
+		var namesJSON []byte
+		scan := []interface{}{
+			&td.ID, &td.OwnerID, &pparentTagID, &td.Description, &childrenCnt,
+		}
+		if opts.GetNames {
+			scan = append(scan, &namesJSON)
+		}
+		err := rows.Scan(scan...)
+		if err != nil {
+			return nil, errors.Trace(hh.MakeInternalServerError(err))
+		}
+
+		if opts.GetNames {
+			if err := json.Unmarshal(namesJSON, &td.Names); err != nil {
+				return nil, errors.Trace(hh.MakeInternalServerError(err))
+			}
+		}
+
+		if pparentTagID != nil {
+			// There is a parent tag ID
+			td.ParentTagID = pparentTagID
+		} else {
+			// There is no parent tag ID: use 0
+			td.ParentTagID = cptr.Int(0)
+		}
+
+		tagsData = append(tagsData, td)
+		childrenCntArr = append(childrenCntArr, childrenCnt)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, errors.Annotatef(err, "closing rows")
+	}
+
+	if opts.GetSubtags {
+		for i := range tagsData {
+			if childrenCntArr[i] > 0 {
+				td := &tagsData[i]
+				td.Subtags, err = s.getTagsInternal(tx, "parent_id", td.ID, opts)
+				if err != nil {
+					return nil, errors.Trace(err)
+				}
+			}
+		}
+	}
+
+	return tagsData, nil
+}
+
+// tagExists returns whether the tag with the given name already exists under
+// the given parent tag.
+func (s *StorageSQLite) tagExists(tx *sql.Tx, parentTagID int, name string) (ok bool, err error) {
+	var cnt int
+	err = tx.QueryRowContext(s.ctx(tx), `
+		SELECT COUNT(t.id)
+			FROM tag_names n
+			JOIN tags t ON n.tag_id = t.id
+			WHERE t.parent_id = ? and n.name = ?
+	`, parentTagID, name,
+	).Scan(&cnt)
+	if err != nil {
+		return false, hh.MakeInternalServerError(
+			errors.Annotatef(
+				err,
+				"checking whether tag %q already exists under the parent %d",
+				name, parentTagID,
+			),
+		)
+	}
+
+	return cnt > 0, nil
+}
+
+type namesDiff struct {
+	add          []string
+	delete       []string
+	setPrimary   *string
+	clearPrimary *string
+}
+
+func getNamesDiff(current, desired []string) *namesDiff {
+	diff := namesDiff{}
+
+	cm := make(map[string]struct{})
+	dm := make(map[string]struct{})
+
+	for _, k := range current {
+		cm[k] = struct{}{}
+	}
+
+	for _, k := range desired {
+		dm[k] = struct{}{}
+	}
+
+	for _, k := range desired {
+		if _, ok := cm[k]; !ok {
+			diff.add = append(diff.add, k)
+		}
+	}
+
+	for _, k := range current {
+		if _, ok := dm[k]; !ok {
+			diff.delete = append(diff.delete, k)
+		}
+	}
+
+	if current[0] != desired[0] {
+		// We'll need to set a new primary name
+		diff.setPrimary = &desired[0]
+
+		// We'll also need to clear a primary flag for the old primary name,
+		// but if only this name is not going to be deleted at all
+		if _, ok := dm[current[0]]; ok {
+			diff.clearPrimary = &current[0]
+		}
+	}
+
+	return &diff
+}
+
+func (s *StorageSQLite) addTagName(
+	tx *sql.Tx, tagID, parentTagID int, name string, primary, allowEmpty bool,
+) error {
+	glog.V(3).Infof(
+		"Adding tag name %q for tag %d, primary: %v", name, tagID, primary,
+	)
+
+	err := storage.ValidateTagName(name, allowEmpty)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Check if tag with the given name already exists under the parent tag
+	exists, err := s.tagExists(tx, parentTagID, name)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if exists {
+		return errors.Errorf("Tag with the name %q already exists", name)
+	}
+
+	_, err = tx.ExecContext(
+		s.ctx(tx), `INSERT INTO tag_names (tag_id, name, "primary") VALUES (?, ?, ?)`,
+		tagID, name, primary,
+	)
+	if err != nil {
+		return hh.MakeInternalServerError(errors.Annotatef(
+			err, "adding tag name: %q for tag with id %d", name, tagID,
+		))
+	}
+
+	return nil
+}
+
+func (s *StorageSQLite) deleteTagName(
+	tx *sql.Tx, tagID int, name string,
+) error {
+	glog.V(3).Infof("Deleting tag name %q from tag %d", name, tagID)
+
+	_, err := tx.ExecContext(
+		s.ctx(tx), `DELETE FROM tag_names WHERE tag_id = ? and name = ?`,
+		tagID, name,
+	)
+	if err != nil {
+		return hh.MakeInternalServerError(errors.Annotatef(
+			err, "deleting tag name: %q for tag with id %d", name, tagID,
+		))
+	}
+
+	return nil
+}
+
+func (s *StorageSQLite) setTagNamePrimary(
+	tx *sql.Tx, tagID int, name string, primary bool,
+) error {
+	glog.V(3).Infof(
+		"Setting primariness of tag name %q from tag %d, primary: %v",
+		name, tagID, primary,
+	)
+
+	_, err := tx.ExecContext(
+		s.ctx(tx), `UPDATE tag_names SET "primary" = ? WHERE tag_id = ? and name = ?`,
+		primary, tagID, name,
+	)
+	if err != nil {
+		return hh.MakeInternalServerError(errors.Annotatef(
+			err, "updating tag name primariness: %q for tag with id %d, primary: %v",
+			name, tagID, primary,
+		))
+	}
+
+	return nil
+}
+
+// taghier's registry implementation which hits the database {{{
+type thReg struct {
+	s  *StorageSQLite
+	tx *sql.Tx
+}
+
+func (r *thReg) GetParent(id int) (int, error) {
+	td, err := r.s.GetTag(r.tx, id, &storage.GetTagOpts{
+		GetNames:   false,
+		GetSubtags: false,
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return *td.ParentTagID, nil
+}
+
+// }}}
@@ -0,0 +1,102 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/golang/glog"
+	"github.com/juju/errors"
+)
+
+func (s *StorageSQLite) Tx(fn func(*sql.Tx) error) error {
+	return s.TxOptCtx(
+		context.Background(),
+		storage.TxILevelReadCommitted, storage.TxModeReadWrite, fn,
+	)
+}
+
+func (s *StorageSQLite) TxOpt(
+	ilevel storage.TxILevel, mode storage.TxMode, fn func(*sql.Tx) error,
+) error {
+	return s.TxOptCtx(context.Background(), ilevel, mode, fn)
+}
+
+func (s *StorageSQLite) TxCtx(ctx context.Context, fn func(*sql.Tx) error) error {
+	return s.TxOptCtx(
+		ctx, storage.TxILevelReadCommitted, storage.TxModeReadWrite, fn,
+	)
+}
+
+// TxOptCtx runs fn in a transaction. SQLite transactions are always
+// serializable, so any requested isolation level is satisfied; read-only
+// mode is enforced with the query_only pragma.
+func (s *StorageSQLite) TxOptCtx(
+	ctx context.Context,
+	ilevel storage.TxILevel, mode storage.TxMode, fn func(*sql.Tx) error,
+) error {
+	if err := ctx.Err(); err != nil {
+		return errors.Annotate(err, "begin transaction")
+	}
+
+	// NOTE: the context is not given to the transaction itself, but only to
+	// the queries: when the context of a transaction is done, database/sql
+	// rolls it back and closes the connection, since go-sqlite3 connections
+	// can't reset their session. For the in-memory database, losing the
+	// connection means losing all the data. A cancelled query, on the other
+	// hand, is just interrupted, and we then roll back as usual.
+	tx, err := s.db.Begin()
+	if err != nil {
+		return errors.Annotate(err, "begin transaction")
+	}
+
+	defer s.txCtxs.Add(tx, ctx)()
+
+	if mode == storage.TxModeReadOnly {
+		if _, err := tx.ExecContext(ctx, "PRAGMA query_only = 1"); err != nil {
+			tx.Rollback()
+			return errors.Annotate(err, "set read-only mode")
+		}
+
+		// The pragma is per-connection, so we have to clear it before the
+		// connection is returned to the pool (which happens as soon as the
+		// transaction is finished) and reused by another transaction.
+		origFn := fn
+		fn = func(tx *sql.Tx) error {
+			fnErr := origFn(tx)
+			if _, err := tx.Exec("PRAGMA query_only = 0"); err != nil {
+				if fnErr != nil {
+					glog.Errorf("Failed to clear read-only mode: %+v", err)
+					return errors.Trace(fnErr)
+				}
+				return errors.Annotate(err, "clear read-only mode")
+			}
+			return errors.Trace(fnErr)
+		}
+	}
+
+	err = fn(tx)
+	if err != nil {
+		if err2 := tx.Rollback(); err2 != nil {
+			glog.Errorf("Transaction rollback failed: %+v", err2)
+		}
+		return errors.Trace(err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return errors.Annotate(err, "commit transaction")
+	}
+	return nil
+}
+
+// ctx returns the context which the given transaction was started with; all
+// queries should be made with it, so that they are cancelled together with
+// the transaction.
+func (s *StorageSQLite) ctx(tx *sql.Tx) context.Context {
+	return s.txCtxs.Get(tx)
+}
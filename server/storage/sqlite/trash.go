@@ -0,0 +1,194 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package sqlite
+
+import (
+	"database/sql"
+	"sort"
+	"strings"
+	"time"
+
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/dimonomid/interrors"
+	"github.com/juju/errors"
+)
+
+func (s *StorageSQLite) TrashBookmark(
+	tx *sql.Tx, bookmarkID int,
+) (trashedBkmID int, err error) {
+	bkm, err := s.GetBookmarkByID(tx, bookmarkID, &storage.TagsFetchOpts{
+		TagsFetchMode:     storage.TagsFetchModeLeafs,
+		TagNamesFetchMode: storage.TagNamesFetchModeFull,
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	tagPaths := []string{}
+	for _, tp := range bkm.Tags {
+		tagPaths = append(tagPaths, storage.GetTagPathString(&tp))
+	}
+
+	res, err := tx.ExecContext(s.ctx(tx), `
+INSERT INTO trashed_bookmarks
+  (owner_id, bookmark_id, url, title, comment, tag_paths, created_ts, updated_ts)
+  VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`,
+		bkm.OwnerID, bkm.ID, bkm.URL, bkm.Title, bkm.Comment,
+		joinTagPaths(tagPaths), bkm.CreatedAt, bkm.UpdatedAt,
+	)
+	if err != nil {
+		return 0, hh.MakeInternalServerError(errors.Annotatef(
+			err, "trashing bookmark with id %d", bookmarkID,
+		))
+	}
+
+	trashedBkmID, err = lastInsertID(res)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	if err := s.DeleteTaggable(tx, bookmarkID); err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return trashedBkmID, nil
+}
+
+func (s *StorageSQLite) GetTrashedBookmarks(
+	tx *sql.Tx, ownerID int,
+) ([]storage.TrashedBookmarkData, error) {
+	rows, err := tx.QueryContext(s.ctx(tx), `
+SELECT `+trashedBookmarkFields+`
+  FROM trashed_bookmarks
+  WHERE owner_id = ?
+  ORDER BY deleted_ts DESC, id DESC
+	`, ownerID,
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+	defer rows.Close()
+
+	tbkms := []storage.TrashedBookmarkData{}
+	for rows.Next() {
+		tbkm, err := scanTrashedBookmark(rows)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		tbkms = append(tbkms, *tbkm)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	return tbkms, nil
+}
+
+func (s *StorageSQLite) GetTrashedBookmark(
+	tx *sql.Tx, trashedBkmID int,
+) (*storage.TrashedBookmarkData, error) {
+	tbkm, err := scanTrashedBookmark(tx.QueryRowContext(s.ctx(tx), `
+SELECT `+trashedBookmarkFields+`
+  FROM trashed_bookmarks
+  WHERE id = ?
+	`, trashedBkmID,
+	))
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, errors.Annotatef(
+				interrors.WrapInternalError(
+					err,
+					storage.ErrTrashedBookmarkDoesNotExist,
+				),
+				"id %d", trashedBkmID,
+			)
+		}
+		return nil, errors.Trace(err)
+	}
+
+	return tbkm, nil
+}
+
+func (s *StorageSQLite) DeleteTrashedBookmark(tx *sql.Tx, trashedBkmID int) error {
+	_, err := tx.ExecContext(
+		s.ctx(tx), "DELETE FROM trashed_bookmarks WHERE id = ?", trashedBkmID,
+	)
+	if err != nil {
+		return hh.MakeInternalServerError(errors.Annotatef(
+			err, "deleting trashed bookmark with id %d", trashedBkmID,
+		))
+	}
+
+	return nil
+}
+
+func (s *StorageSQLite) PurgeTrash(
+	tx *sql.Tx, ownerID *int, deletedBefore time.Time,
+) (purgedCnt int, err error) {
+	query := "DELETE FROM trashed_bookmarks WHERE deleted_ts < ?"
+	args := []interface{}{deletedBefore.Unix()}
+	if ownerID != nil {
+		query += " AND owner_id = ?"
+		args = append(args, *ownerID)
+	}
+
+	res, err := tx.ExecContext(s.ctx(tx), query, args...)
+	if err != nil {
+		return 0, hh.MakeInternalServerError(errors.Annotatef(err, "purging trash"))
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, hh.MakeInternalServerError(err)
+	}
+
+	return int(n), nil
+}
+
+const trashedBookmarkFields = `id, owner_id, bookmark_id, url, title, comment, tag_paths,
+       created_ts, updated_ts, deleted_ts`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanTrashedBookmark scans the row with trashedBookmarkFields. Errors are
+// returned as is, so that the caller can check for sql.ErrNoRows.
+func scanTrashedBookmark(row scanner) (*storage.TrashedBookmarkData, error) {
+	tbkm := storage.TrashedBookmarkData{}
+	var tagPaths string
+	err := row.Scan(
+		&tbkm.ID, &tbkm.OwnerID, &tbkm.BookmarkID,
+		&tbkm.URL, &tbkm.Title, &tbkm.Comment, &tagPaths,
+		&tbkm.CreatedAt, &tbkm.UpdatedAt, &tbkm.DeletedAt,
+	)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, err
+		}
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	tbkm.TagPaths = splitTagPaths(tagPaths)
+
+	return &tbkm, nil
+}
+
+// joinTagPaths and splitTagPaths convert tag paths to the value of the
+// tag_paths column and back. Tag names can't contain newlines, so the paths
+// are just separated by them.
+func joinTagPaths(tagPaths []string) string {
+	tagPaths = append([]string{}, tagPaths...)
+	sort.Strings(tagPaths)
+	return strings.Join(tagPaths, "\n")
+}
+
+func splitTagPaths(s string) []string {
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, "\n")
+}
@@ -0,0 +1,217 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package sqlite
+
+import (
+	"database/sql"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	hh "dmitryfrank.com/geekmarks/server/httphelper"
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/dimonomid/interrors"
+
+	"github.com/dchest/uniuri"
+	"github.com/juju/errors"
+)
+
+const (
+	accessTokenLen = 32
+)
+
+func (s *StorageSQLite) GetUser(
+	tx *sql.Tx, args *storage.GetUserArgs,
+) (*storage.UserData, error) {
+	var ud storage.UserData
+	queryArgs := []interface{}{}
+	where := ""
+	if args.ID != nil {
+		where = "id = ?"
+		queryArgs = append(queryArgs, *args.ID)
+	} else if args.Username != nil {
+		where = "username = ?"
+		queryArgs = append(queryArgs, *args.Username)
+	} else {
+		return nil, hh.MakeInternalServerError(errors.Errorf(
+			"neither id nor username is given to storage.GetUser()",
+		))
+	}
+
+	err := tx.QueryRowContext(
+		s.ctx(tx), "SELECT id, username, password, email FROM users WHERE "+where,
+		queryArgs...,
+	).Scan(&ud.ID, &ud.Username, &ud.Password, &ud.Email)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, interrors.WrapInternalError(err, storage.ErrUserDoesNotExist)
+		}
+		// Some unexpected error
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	return &ud, nil
+}
+
+func (s *StorageSQLite) CreateUser(
+	tx *sql.Tx, ud *storage.UserData,
+) (userID int, err error) {
+	res, err := tx.ExecContext(
+		s.ctx(tx), "INSERT INTO users (username, password, email) VALUES (?, ?, ?)",
+		ud.Username, ud.Password, ud.Email,
+	)
+	if err != nil {
+		return 0, hh.MakeInternalServerError(err)
+	}
+
+	userID, err = lastInsertID(res)
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	// Also, create a root tag for the newly added user: NULL parent_id and an
+	// empty string name
+	_, err = s.CreateTag(tx, &storage.TagData{
+		OwnerID:     userID,
+		Description: cptr.String("Root pseudo-tag"),
+		Names:       []string{""},
+	})
+	if err != nil {
+		return 0, errors.Trace(err)
+	}
+
+	return userID, nil
+}
+
+func (s *StorageSQLite) DeleteUser(tx *sql.Tx, userID int) error {
+	_, err := tx.ExecContext(
+		s.ctx(tx), "DELETE FROM users WHERE id = ?", userID,
+	)
+	if err != nil {
+		return hh.MakeInternalServerError(err)
+	}
+	return nil
+}
+
+func (s *StorageSQLite) GetUsers(tx *sql.Tx) ([]storage.UserData, error) {
+	var ret []storage.UserData
+
+	rows, err := tx.QueryContext(
+		s.ctx(tx), "SELECT id, username, password, email FROM users",
+	)
+	if err != nil {
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	defer rows.Close()
+	for rows.Next() {
+		var cur storage.UserData
+		err := rows.Scan(&cur.ID, &cur.Username, &cur.Password, &cur.Email)
+		if err != nil {
+			return nil, hh.MakeInternalServerError(err)
+		}
+		ret = append(ret, cur)
+	}
+
+	return ret, nil
+}
+
+func (s *StorageSQLite) GetAccessToken(
+	tx *sql.Tx, userID int, descr string, createIfNotExist bool,
+) (token string, err error) {
+
+	err = tx.QueryRowContext(
+		s.ctx(tx), "SELECT token FROM access_tokens WHERE user_id = ? and descr = ?",
+		userID, descr,
+	).Scan(&token)
+	if err != nil && errors.Cause(err) != sql.ErrNoRows {
+		// Some unexpected error
+		return "", hh.MakeInternalServerError(err)
+	}
+
+	if token == "" {
+		// Token does not exist
+		if createIfNotExist {
+			// Let's create one
+			token = uniuri.NewLen(accessTokenLen)
+			_, err := tx.ExecContext(
+				s.ctx(tx), "INSERT INTO access_tokens (user_id, token, descr) VALUES (?, ?, ?)",
+				userID, token, descr,
+			)
+			if err != nil {
+				return "", interrors.WrapInternalErrorf(
+					err, "failed to create access token %q (%q, user_id: %d)",
+					token, descr, userID,
+				)
+			}
+		} else {
+			return "", errors.Errorf("token with the descr %q does not exist", descr)
+		}
+	}
+
+	return token, nil
+}
+
+func (s *StorageSQLite) GetUserByAccessToken(
+	tx *sql.Tx, token string,
+) (*storage.UserData, error) {
+	var ud storage.UserData
+
+	err := tx.QueryRowContext(s.ctx(tx), `
+SELECT u.id, u.username, u.password, u.email FROM users u
+JOIN access_tokens tok ON tok.user_id = u.id
+WHERE tok.token = ?`, token,
+	).Scan(&ud.ID, &ud.Username, &ud.Password, &ud.Email)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, hh.MakeUnauthorizedError()
+		}
+		// Some unexpected error
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	return &ud, nil
+}
+
+func (s *StorageSQLite) GetUserByGoogleUserID(
+	tx *sql.Tx, googleUserID string,
+) (*storage.UserData, error) {
+	var ud storage.UserData
+
+	err := tx.QueryRowContext(s.ctx(tx), `
+SELECT u.id, u.username, u.password, u.email FROM users u
+JOIN google_auth google ON google.user_id = u.id
+WHERE google.google_user_id = ?`, googleUserID,
+	).Scan(&ud.ID, &ud.Username, &ud.Password, &ud.Email)
+	if err != nil {
+		if errors.Cause(err) == sql.ErrNoRows {
+			return nil, interrors.WrapInternalError(err, storage.ErrUserDoesNotExist)
+		}
+		// Some unexpected error
+		return nil, hh.MakeInternalServerError(err)
+	}
+
+	return &ud, nil
+}
+
+func (s *StorageSQLite) CreateGoogleUser(
+	tx *sql.Tx, userID int, googleUserID, email string,
+) error {
+	_, err := tx.ExecContext(s.ctx(tx), `
+  INSERT INTO google_auth (google_user_id, user_id, email) VALUES (?, ?, ?)
+`, googleUserID, userID, email)
+	if err != nil {
+		return hh.MakeInternalServerError(err)
+	}
+
+	return nil
+}
+
+// lastInsertID returns the id of the row inserted by the statement which
+// produced res.
+func lastInsertID(res sql.Result) (int, error) {
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, hh.MakeInternalServerError(errors.Annotatef(err, "getting last insert id"))
+	}
+	return int(id), nil
+}
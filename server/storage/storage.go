@@ -1,11 +1,15 @@
 package storage // import "dmitryfrank.com/geekmarks/server/storage"
 
 import (
+	"context"
 	"database/sql"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 
+	"dmitryfrank.com/geekmarks/server/dfmigrate"
+
 	"github.com/juju/errors"
 )
 
@@ -14,7 +18,11 @@ var (
 	ErrTagDoesNotExist      = errors.New("tag does not exist")
 	ErrTagNameInvalid       = errors.New("")
 	ErrBookmarkDoesNotExist = errors.New("bookmark does not exist")
+	ErrNoteDoesNotExist     = errors.New("note does not exist")
 	ErrNotImplemented       = errors.New("not implemented")
+
+	ErrTrashedBookmarkDoesNotExist  = errors.New("trashed bookmark does not exist")
+	ErrBookmarkRevisionDoesNotExist = errors.New("bookmark revision does not exist")
 )
 
 type TaggableType string
@@ -28,6 +36,7 @@ type TaggableLeafPolicy string
 
 const (
 	TaggableTypeBookmark TaggableType = "bookmark"
+	TaggableTypeNote     TaggableType = "note"
 
 	TagsFetchModeNone    TagsFetchMode = "none"
 	TagsFetchModeLeafs   TagsFetchMode = "leafs"
@@ -79,23 +88,39 @@ type GetTagOpts struct {
 	GetSubtags bool
 }
 
+// TagBookmarkCounts are numbers of bookmarks of a tag: Total includes
+// bookmarks tagged with any subtags, Direct only includes bookmarks tagged
+// with the tag itself and not with any of its subtags.
+type TagBookmarkCounts struct {
+	Direct int
+	Total  int
+}
+
 type TaggableData struct {
-	ID        int
-	OwnerID   int
-	Type      TaggableType
+	ID      int
+	OwnerID int
+	Type    TaggableType
+	// CreatedAt and UpdatedAt are the current time by default, but if they're
+	// not zero on create, they're used instead (e.g. for imported or restored
+	// bookmarks).
 	CreatedAt uint64
 	UpdatedAt uint64
 }
 
 type BookmarkData struct {
-	// We don't embed TaggableData here since we don't want Type to be here
+	// We don't embed TaggableData here since we don't want Type to be here;
+	// CreatedAt and UpdatedAt work as there.
 	ID        int
 	OwnerID   int
 	CreatedAt uint64
 	UpdatedAt uint64
 	URL       string
-	Title     string
-	Comment   string
+	// CanonicalURL is the canonical form of URL (see urlcanon package), which
+	// is used to find duplicates. It's only written: if it's empty on create
+	// or update, URL is used as the canonical URL.
+	CanonicalURL string
+	Title        string
+	Comment      string
 }
 
 type BookmarkDataWTags struct {
@@ -103,6 +128,166 @@ type BookmarkDataWTags struct {
 	Tags []BookmarkTagPath
 }
 
+// GetBookmarksArgs specifies which bookmarks of the owner GetBookmarks
+// should return.
+type GetBookmarksArgs struct {
+	OwnerID int
+	// If TagIDs is not empty, only bookmarks tagged with all of the given tags
+	// are returned.
+	TagIDs []int
+	// If CanonicalURL is not empty, only bookmarks with the given canonical URL
+	// are returned.
+	CanonicalURL string
+	// If DirectlyTagged is true, bookmarks tagged with subtags of TagIDs are
+	// not returned, only the ones for which all TagIDs are leaf tags.
+	DirectlyTagged bool
+	// If Query is not empty, only bookmarks matching the full-text query are
+	// returned, the most relevant first. All the words of the query (stemmed)
+	// should be found in the title, comment or URL of the bookmark; matches in
+	// the title weigh the most, and matches in the URL weigh the least.
+	Query string
+	// If Untagged is true, only bookmarks without any tags (except the root
+	// one) are returned; TagIDs should be empty then.
+	Untagged bool
+	// If TagExpr is not nil, only bookmarks matching the expression are
+	// returned (it's combined with TagIDs by AND).
+	TagExpr *TagExpr
+	// If LinkStatus is not empty, only bookmarks whose URL had the given
+	// status as of the last check are returned; see LinkCheckData.
+	LinkStatus LinkStatus
+
+	// Sort is the order of the returned bookmarks; by default, bookmarks are
+	// sorted by relevance if Query is given, or by id otherwise.
+	Sort BookmarksSort
+	// If Limit is positive, at most that many bookmarks are returned, and if
+	// there are more, GetBookmarks returns the cursor to get the next page.
+	Limit int
+	// After is the cursor returned by the previous call to GetBookmarks with
+	// the same arguments: if it's not nil, the bookmarks after it are returned.
+	After *BookmarksCursor
+}
+
+// LinkStatus is the state of the bookmark URL as per the last link check.
+type LinkStatus string
+
+const (
+	LinkStatusAny LinkStatus = ""
+	// LinkStatusBroken means that the URL couldn't be fetched at all, or the
+	// response status was 4xx or 5xx.
+	LinkStatusBroken LinkStatus = "broken"
+	// LinkStatusRedirected means that the URL redirects to another one.
+	LinkStatusRedirected LinkStatus = "redirected"
+)
+
+// LinkCheckData is the result of fetching the bookmark URL by the link
+// checker.
+type LinkCheckData struct {
+	BookmarkID int
+	// URL is the URL which was checked; if the URL of the bookmark has changed
+	// since then, the check is outdated.
+	URL string
+	// StatusCode is the HTTP status of the final response, or 0 if the URL
+	// couldn't be fetched (see Error then).
+	StatusCode int
+	// RedirectURL is the final URL if the request was redirected.
+	RedirectURL string
+	Error       string
+	// CheckedAt is only read: it's always set to the current time on save.
+	CheckedAt uint64
+}
+
+// PageMetaData is the metadata of the bookmarked page, extracted from its
+// HTML (see pagemeta package).
+type PageMetaData struct {
+	BookmarkID int
+	// URL is the URL the metadata was fetched from; if the URL of the
+	// bookmark has changed since then, the metadata is outdated.
+	URL          string
+	Title        string
+	Description  string
+	CanonicalURL string
+	FaviconURL   string
+	// Error is not empty if the page couldn't be fetched or parsed.
+	Error string
+	// FetchedAt is only read: it's always set to the current time on save.
+	FetchedAt uint64
+}
+
+type NoteData struct {
+	ID        int
+	OwnerID   int
+	CreatedAt uint64
+	UpdatedAt uint64
+	Title     string
+	// Body is in markdown
+	Body string
+}
+
+type NoteDataWTags struct {
+	NoteData
+	Tags []BookmarkTagPath
+}
+
+// GetNotesArgs specifies which notes of the owner GetNotes should return.
+type GetNotesArgs struct {
+	OwnerID int
+	// If TagIDs is not empty, only notes tagged with all of the given tags are
+	// returned.
+	TagIDs []int
+	// If TagExpr is not nil, only notes matching the expression are returned
+	// (it's combined with TagIDs by AND).
+	TagExpr *TagExpr
+}
+
+type TagExprOp string
+
+const (
+	TagExprOpTag TagExprOp = "tag"
+	TagExprOpAnd TagExprOp = "and"
+	TagExprOpOr  TagExprOp = "or"
+	TagExprOpNot TagExprOp = "not"
+)
+
+// TagExpr is a boolean expression over the taggings of a bookmark.
+type TagExpr struct {
+	Op TagExprOp
+	// For TagExprOpTag: the bookmark matches if it's tagged with the tag
+	// (since taggings include all supertags, a bookmark tagged with any of
+	// the subtags matches too).
+	TagID int
+	// Operands: one for TagExprOpNot, one or more for TagExprOpAnd and
+	// TagExprOpOr.
+	Args []TagExpr
+}
+
+// BookmarksSort is the order of bookmarks returned by GetBookmarks. Ties are
+// broken by the bookmark id, so the order is always deterministic.
+type BookmarksSort string
+
+const (
+	BookmarksSortDefault   BookmarksSort = ""
+	BookmarksSortID        BookmarksSort = "id"
+	BookmarksSortRelevance BookmarksSort = "relevance"
+	// Most recently updated first
+	BookmarksSortUpdated BookmarksSort = "updated"
+	// Most recently created first
+	BookmarksSortCreated BookmarksSort = "created"
+	BookmarksSortTitle   BookmarksSort = "title"
+	BookmarksSortURL     BookmarksSort = "url"
+)
+
+// BookmarksCursor points to the last bookmark of the page returned by
+// GetBookmarks. Which fields are used depends on Sort: pages sorted by
+// relevance are fetched by Offset, and for the other orders the next page
+// starts right after the sort key of the last bookmark and its ID.
+type BookmarksCursor struct {
+	Sort   BookmarksSort `json:"sort"`
+	ID     int           `json:"id,omitempty"`
+	Time   uint64        `json:"time,omitempty"`
+	Str    string        `json:"str,omitempty"`
+	Offset int           `json:"offset,omitempty"`
+}
+
 type BookmarkTagPath struct {
 	TagItems []BookmarkTagPathItem
 }
@@ -112,6 +297,62 @@ type BookmarkTagPathItem struct {
 	Name string
 }
 
+// BookmarkRevisionData is a snapshot of the bookmark made after it was
+// changed. TagIDs are leaf tags, like the ones given to SetTaggings with
+// TaggingModeLeafs; some of them might not exist anymore.
+type BookmarkRevisionData struct {
+	ID         int
+	BookmarkID int
+	// CreatedAt is the time of the change, i.e. when the bookmark was updated
+	CreatedAt uint64
+	URL       string
+	Title     string
+	Comment   string
+	TagIDs    []int
+}
+
+type TagOperationKind string
+
+const (
+	TagOperationCreate TagOperationKind = "create"
+	TagOperationUpdate TagOperationKind = "update"
+	TagOperationDelete TagOperationKind = "delete"
+)
+
+// TagOperationData is a record of a tag mutation, which holds everything
+// needed to undo it.
+type TagOperationData struct {
+	ID        int
+	OwnerID   int
+	Kind      TagOperationKind
+	CreatedAt uint64
+	// TagID is the id of the created, updated or deleted tag
+	TagID int
+	// Tag is the state of the tag before the operation (for
+	// TagOperationDelete, with all the subtags); nil for TagOperationCreate.
+	Tag *TagData
+	// Taggings maps ids of the taggables affected by the operation to all
+	// their tag ids (as in TaggingModeAll) before the operation.
+	Taggings map[int][]int
+}
+
+// TrashedBookmarkData is a deleted bookmark kept in the trash. Since the
+// taggable is gone, tags are kept as paths like "/foo/bar", so that they can
+// be looked up again on restore.
+type TrashedBookmarkData struct {
+	ID      int
+	OwnerID int
+	// BookmarkID is the id the bookmark had before it was deleted
+	BookmarkID int
+	CreatedAt  uint64
+	UpdatedAt  uint64
+	DeletedAt  uint64
+	URL        string
+	Title      string
+	Comment    string
+	TagPaths   []string
+}
+
 type TagsFetchOpts struct {
 	TagsFetchMode     TagsFetchMode
 	TagNamesFetchMode TagNamesFetchMode
@@ -136,8 +377,27 @@ type Storage interface {
 	//-- Common
 	Connect() error
 	ApplyMigrations() error
+	// GetMigrationStatus, Migrate and DryRunMigration give control over
+	// database migrations beyond ApplyMigrations; see dfmigrate.Migrations
+	// for details.
+	GetMigrationStatus() (*dfmigrate.Status, error)
+	Migrate(targetMigrationID int) error
+	DryRunMigration(targetMigrationID int) ([]dfmigrate.Step, error)
+	// SetMigrationDriftMode sets what ApplyMigrations and Migrate do if
+	// applied migrations don't match the registered ones, and
+	// AcceptMigrationDrift makes the registered migrations the reference.
+	SetMigrationDriftMode(mode dfmigrate.DriftMode)
+	AcceptMigrationDrift() error
 	Tx(fn func(*sql.Tx) error) error
 	TxOpt(ilevel TxILevel, mode TxMode, fn func(*sql.Tx) error) error
+	// TxCtx and TxOptCtx are like Tx and TxOpt, but the given context is used
+	// for the transaction and all the queries made within it by other methods
+	// of the storage: once the context is done, the query in progress is
+	// cancelled and the transaction is rolled back.
+	TxCtx(ctx context.Context, fn func(*sql.Tx) error) error
+	TxOptCtx(
+		ctx context.Context, ilevel TxILevel, mode TxMode, fn func(*sql.Tx) error,
+	) error
 
 	//-- Users
 	GetUser(tx *sql.Tx, args *GetUserArgs) (*UserData, error)
@@ -166,6 +426,29 @@ type Storage interface {
 		tx *sql.Tx, parentTagID int, opts *GetTagOpts,
 	) ([]TagData, error)
 	GetTagNames(tx *sql.Tx, tagID int) ([]string, error)
+	// GetTagBookmarkCounts returns bookmark counts of all the tags of the user
+	// which have any bookmarks. The root tag counts all the bookmarks of the
+	// user, and untagged bookmarks as the direct ones.
+	GetTagBookmarkCounts(
+		tx *sql.Tx, ownerID int,
+	) (counts map[int]TagBookmarkCounts, err error)
+	// RestoreTag creates the tag with all its subtags like CreateTag does, but
+	// keeps the ids from the given data; it's used to undo tag deletion.
+	RestoreTag(tx *sql.Tx, td *TagData) error
+
+	//-- Tag operations (undo log)
+	SaveTagOperation(tx *sql.Tx, op *TagOperationData) (opID int, err error)
+	// GetTagOperations returns at most limit latest tag operations of the
+	// user, the most recent first.
+	GetTagOperations(
+		tx *sql.Tx, ownerID int, limit int,
+	) ([]TagOperationData, error)
+	DeleteTagOperation(tx *sql.Tx, opID int) error
+	// PurgeTagOperations deletes all but keepCnt latest tag operations of the
+	// user.
+	PurgeTagOperations(
+		tx *sql.Tx, ownerID int, keepCnt int,
+	) (purgedCnt int, err error)
 
 	//-- Taggables (bookmarks)
 	CreateTaggable(tx *sql.Tx, tgbd *TaggableData) (tgbID int, err error)
@@ -184,10 +467,44 @@ type Storage interface {
 	GetBookmarksByURL(
 		tx *sql.Tx, url string, ownerID int, tagsFetchOpts *TagsFetchOpts,
 	) (bookmarks []BookmarkDataWTags, err error)
+	// GetBookmarks returns bookmarks as specified by args. If args.Limit is
+	// positive and there are more bookmarks than that, next is the cursor to
+	// be given as args.After to get the next page; otherwise it's nil.
+	GetBookmarks(
+		tx *sql.Tx, args *GetBookmarksArgs, tagsFetchOpts *TagsFetchOpts,
+	) (bookmarks []BookmarkDataWTags, next *BookmarksCursor, err error)
 	GetBookmarkByID(
 		tx *sql.Tx, bookmarkID int, tagsFetchOpts *TagsFetchOpts,
 	) (bookmark *BookmarkDataWTags, err error)
 	DeleteTaggable(tx *sql.Tx, taggableID int) error
+	// SetTaggableUpdatedAt sets the update time of the taggable, or bumps it
+	// to the current time if updatedAt is zero. UpdateBookmark, UpdateNote and
+	// SetTaggings (if taggings change) bump it on their own, so it's only
+	// needed to keep the original time of restored taggables.
+	SetTaggableUpdatedAt(tx *sql.Tx, taggableID int, updatedAt uint64) error
+
+	//-- Notes
+	CreateNote(tx *sql.Tx, nd *NoteData) (noteID int, err error)
+	UpdateNote(tx *sql.Tx, nd *NoteData) (err error)
+	// GetNotes returns notes as specified by args, sorted by id. tagsFetchOpts
+	// is treated like for GetTaggedBookmarks.
+	GetNotes(
+		tx *sql.Tx, args *GetNotesArgs, tagsFetchOpts *TagsFetchOpts,
+	) (notes []NoteDataWTags, err error)
+	GetNoteByID(
+		tx *sql.Tx, noteID int, tagsFetchOpts *TagsFetchOpts,
+	) (note *NoteDataWTags, err error)
+
+	//-- Bookmark revisions
+	// SaveBookmarkRevision saves the current state of the bookmark, together
+	// with its leaf taggings, as a new revision.
+	SaveBookmarkRevision(tx *sql.Tx, bookmarkID int) (revisionID int, err error)
+	// GetBookmarkRevisions returns all revisions of the bookmark, the most
+	// recent first.
+	GetBookmarkRevisions(
+		tx *sql.Tx, bookmarkID int,
+	) ([]BookmarkRevisionData, error)
+	GetBookmarkRevision(tx *sql.Tx, revisionID int) (*BookmarkRevisionData, error)
 
 	//-- Taggings
 	GetTaggings(
@@ -197,8 +514,151 @@ type Storage interface {
 		tx *sql.Tx, taggableID int, tagIDs []int, tm TaggingMode,
 	) error
 
+	//-- Trash
+	// TrashBookmark moves the bookmark to the trash of its owner, and deletes
+	// the bookmark.
+	TrashBookmark(tx *sql.Tx, bookmarkID int) (trashedBkmID int, err error)
+	// GetTrashedBookmarks returns the trash of the user, most recently deleted
+	// bookmarks first.
+	GetTrashedBookmarks(tx *sql.Tx, ownerID int) ([]TrashedBookmarkData, error)
+	GetTrashedBookmark(tx *sql.Tx, trashedBkmID int) (*TrashedBookmarkData, error)
+	DeleteTrashedBookmark(tx *sql.Tx, trashedBkmID int) error
+	// PurgeTrash deletes bookmarks which were trashed before the given time;
+	// if ownerID is nil, trashes of all users are purged.
+	PurgeTrash(
+		tx *sql.Tx, ownerID *int, deletedBefore time.Time,
+	) (purgedCnt int, err error)
+
+	//-- Link checks
+	// GetBookmarksToCheck returns up to limit bookmarks of all users with
+	// http(s) URLs which were never checked (or changed after the check), or
+	// were last checked before the given time; the ones never checked come
+	// first, then the least recently checked ones. Only ID, OwnerID and URL
+	// are set.
+	GetBookmarksToCheck(
+		tx *sql.Tx, checkedBefore time.Time, limit int,
+	) ([]BookmarkData, error)
+	// SetLinkCheck saves the result of the link check, replacing the previous
+	// one of the same bookmark. If the bookmark doesn't exist anymore, it's a
+	// no-op.
+	SetLinkCheck(tx *sql.Tx, lc *LinkCheckData) error
+	// GetLinkChecks returns the last link checks of the given bookmarks,
+	// keyed by bookmark id; outdated checks are omitted.
+	GetLinkChecks(tx *sql.Tx, bookmarkIDs []int) (map[int]LinkCheckData, error)
+
+	//-- Page metadata
+	// RequestPageMeta schedules fetching of the page metadata of the bookmark,
+	// replacing the previously fetched metadata if any.
+	RequestPageMeta(tx *sql.Tx, bookmarkID int) error
+	// GetPendingPageMeta returns up to limit bookmarks of all users whose page
+	// metadata was requested but not fetched yet, in the order of creation.
+	// Only ID, OwnerID and URL are set.
+	GetPendingPageMeta(tx *sql.Tx, limit int) ([]BookmarkData, error)
+	// SetPageMeta saves the page metadata requested by RequestPageMeta; if
+	// the request was removed (e.g. the bookmark was deleted), it's a no-op.
+	SetPageMeta(tx *sql.Tx, pm *PageMetaData) error
+	// GetPageMeta returns the fetched page metadata of the given bookmarks,
+	// keyed by bookmark id; pending requests and outdated metadata are
+	// omitted.
+	GetPageMeta(tx *sql.Tx, bookmarkIDs []int) (map[int]PageMetaData, error)
+
 	//-- Maintenance
+	// GetIntegrityReport checks the integrity of all the data, and returns
+	// all the problems found; see IntegrityReport. CheckIntegrity does the
+	// same, but returns an error if there are any problems.
+	GetIntegrityReport() (*IntegrityReport, error)
 	CheckIntegrity() error
+	// RepairIntegrity fixes the problems detected by CheckIntegrity where
+	// possible, and returns the list of fixes made. Problems which can't be
+	// fixed automatically result in an error, and nothing is changed then.
+	RepairIntegrity() ([]IntegrityFix, error)
+}
+
+// GetCanonicalURL returns the canonical URL to be stored for the bookmark:
+// either CanonicalURL, or URL if the former is empty.
+func (bd *BookmarkData) GetCanonicalURL() string {
+	if bd.CanonicalURL != "" {
+		return bd.CanonicalURL
+	}
+	return bd.URL
+}
+
+// GetSort returns the effective sort order of the bookmarks, or an error if
+// the order is invalid or doesn't match the cursor.
+func (args *GetBookmarksArgs) GetSort() (BookmarksSort, error) {
+	sort := args.Sort
+	if sort == BookmarksSortDefault {
+		sort = BookmarksSortID
+		if args.Query != "" {
+			sort = BookmarksSortRelevance
+		}
+	}
+
+	switch sort {
+	case BookmarksSortID, BookmarksSortUpdated, BookmarksSortCreated,
+		BookmarksSortTitle, BookmarksSortURL:
+		// ok
+	case BookmarksSortRelevance:
+		if args.Query == "" {
+			return "", errors.Errorf("sorting by relevance requires a query")
+		}
+	default:
+		return "", errors.Errorf("invalid sort order %q", sort)
+	}
+
+	if args.After != nil && args.After.Sort != sort {
+		return "", errors.Errorf(
+			"cursor is for the sort order %q, not %q", args.After.Sort, sort,
+		)
+	}
+
+	return sort, nil
+}
+
+// GetNextBookmarksCursor returns the cursor pointing right after the last one
+// of the given bookmarks, which were fetched with the given args and sort
+// order.
+func GetNextBookmarksCursor(
+	args *GetBookmarksArgs, sort BookmarksSort, bookmarks []BookmarkDataWTags,
+) *BookmarksCursor {
+	last := &bookmarks[len(bookmarks)-1]
+
+	cursor := &BookmarksCursor{
+		Sort: sort,
+		ID:   last.ID,
+	}
+
+	switch sort {
+	case BookmarksSortRelevance:
+		cursor.ID = 0
+		cursor.Offset = len(bookmarks)
+		if args.After != nil {
+			cursor.Offset += args.After.Offset
+		}
+	case BookmarksSortUpdated:
+		cursor.Time = last.UpdatedAt
+	case BookmarksSortCreated:
+		cursor.Time = last.CreatedAt
+	case BookmarksSortTitle:
+		cursor.Str = last.Title
+	case BookmarksSortURL:
+		cursor.Str = last.URL
+	}
+
+	return cursor
+}
+
+// GetTagPathString returns the path like "/foo/bar" of the given tag path;
+// the first item is expected to be the root tag, which is not included.
+func GetTagPathString(tp *BookmarkTagPath) string {
+	path := ""
+	for _, item := range tp.TagItems[ /*skip root tag*/ 1:] {
+		path += "/" + item.Name
+	}
+	if path == "" {
+		path = "/"
+	}
+	return path
 }
 
 func ValidateTagName(name string, allowEmpty bool) error {
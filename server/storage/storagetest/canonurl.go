@@ -0,0 +1,93 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package storagetest
+
+import (
+	"database/sql"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/juju/errors"
+)
+
+func testCanonicalURLs(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	u2ID, err := createUser(si, "test2", "2@2.2")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return si.Tx(func(tx *sql.Tx) error {
+		bkms := []storage.BookmarkData{
+			{OwnerID: u1ID, URL: "https://x.com/a/", CanonicalURL: "http://x.com/a"},
+			// Duplicates are checked by the server, so storage should allow them
+			{OwnerID: u1ID, URL: "http://x.com/a", CanonicalURL: "http://x.com/a"},
+			// Without the canonical URL, the URL is used as it is
+			{OwnerID: u1ID, URL: "http://x.com/b"},
+			{OwnerID: u2ID, URL: "http://x.com/a", CanonicalURL: "http://x.com/a"},
+		}
+
+		bkmIDs := []int{}
+		for _, bkm := range bkms {
+			bkmID, err := si.CreateBookmark(tx, &bkm)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			bkmIDs = append(bkmIDs, bkmID)
+		}
+
+		checkCanonicalURL := func(canonicalURL string, expected []int) error {
+			got, _, err := si.GetBookmarks(tx, &storage.GetBookmarksArgs{
+				OwnerID:      u1ID,
+				CanonicalURL: canonicalURL,
+			}, nil)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			gotIDs := []int{}
+			for _, bkm := range got {
+				gotIDs = append(gotIDs, bkm.ID)
+			}
+
+			return errors.Annotatef(
+				checkIDs(gotIDs, expected), "canonical URL %q", canonicalURL,
+			)
+		}
+
+		if err := checkCanonicalURL("http://x.com/a", bkmIDs[:2]); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := checkCanonicalURL("http://x.com/b", bkmIDs[2:3]); err != nil {
+			return errors.Trace(err)
+		}
+
+		// Update the canonical URL
+		err := si.UpdateBookmark(tx, &storage.BookmarkData{
+			ID:           bkmIDs[1],
+			OwnerID:      u1ID,
+			URL:          "http://x.com/b?utm_source=foo",
+			CanonicalURL: "http://x.com/b",
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := checkCanonicalURL("http://x.com/a", bkmIDs[:1]); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := checkCanonicalURL("http://x.com/b", bkmIDs[1:3]); err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
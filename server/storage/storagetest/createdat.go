@@ -0,0 +1,95 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package storagetest
+
+import (
+	"database/sql"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/juju/errors"
+)
+
+func testBookmarkCreatedAt(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return si.Tx(func(tx *sql.Tx) error {
+		// Explicit creation and modification times are kept, like for imported
+		// or restored bookmarks
+		const createdAt = 1262304000
+		const updatedAt = 1262390400
+
+		bkmID, err := si.CreateBookmark(tx, &storage.BookmarkData{
+			OwnerID:   u1ID,
+			URL:       "http://x.com/a",
+			CreatedAt: createdAt,
+			UpdatedAt: updatedAt,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkm, err := si.GetBookmarkByID(tx, bkmID, nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if bkm.CreatedAt != createdAt || bkm.UpdatedAt != updatedAt {
+			return errors.Errorf(
+				"expected CreatedAt %d and UpdatedAt %d, got %d and %d",
+				createdAt, updatedAt, bkm.CreatedAt, bkm.UpdatedAt,
+			)
+		}
+
+		// The same goes for notes
+		noteID, err := si.CreateNote(tx, &storage.NoteData{
+			OwnerID:   u1ID,
+			Title:     "note",
+			CreatedAt: createdAt,
+			UpdatedAt: updatedAt,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		note, err := si.GetNoteByID(tx, noteID, nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if note.CreatedAt != createdAt || note.UpdatedAt != updatedAt {
+			return errors.Errorf(
+				"note: expected CreatedAt %d and UpdatedAt %d, got %d and %d",
+				createdAt, updatedAt, note.CreatedAt, note.UpdatedAt,
+			)
+		}
+
+		// Without it, the current time is used
+		bkmID, err = si.CreateBookmark(tx, &storage.BookmarkData{
+			OwnerID: u1ID,
+			URL:     "http://x.com/b",
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkm, err = si.GetBookmarkByID(tx, bkmID, nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if bkm.CreatedAt <= createdAt || bkm.UpdatedAt <= updatedAt {
+			return errors.Errorf(
+				"expected the current time, got CreatedAt %d and UpdatedAt %d",
+				bkm.CreatedAt, bkm.UpdatedAt,
+			)
+		}
+
+		return nil
+	})
+}
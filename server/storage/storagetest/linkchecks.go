@@ -0,0 +1,212 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package storagetest
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/juju/errors"
+)
+
+func testLinkChecks(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	u2ID, err := createUser(si, "test2", "2@2.2")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return si.Tx(func(tx *sql.Tx) error {
+		bkms := []storage.BookmarkData{
+			{OwnerID: u1ID, URL: "http://x.com/ok"},
+			{OwnerID: u1ID, URL: "https://x.com/gone"},
+			{OwnerID: u1ID, URL: "http://x.com/moved"},
+			// Non-http URLs are never checked
+			{OwnerID: u1ID, URL: "mailto:foo@x.com"},
+			{OwnerID: u2ID, URL: "HTTP://y.com"},
+		}
+
+		b := []int{}
+		for _, bkm := range bkms {
+			bkmID, err := si.CreateBookmark(tx, &bkm)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			b = append(b, bkmID)
+		}
+
+		checkToCheck := func(checkedBefore time.Time, limit int, expected []int) error {
+			got, err := si.GetBookmarksToCheck(tx, checkedBefore, limit)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			gotIDs := []int{}
+			for _, bkm := range got {
+				gotIDs = append(gotIDs, bkm.ID)
+			}
+
+			if !reflect.DeepEqual(gotIDs, expected) {
+				return errors.Errorf(
+					"bookmarks to check: expected %v, got %v", expected, gotIDs,
+				)
+			}
+			return nil
+		}
+
+		checkLinkStatus := func(ls storage.LinkStatus, expected []int) error {
+			got, _, err := si.GetBookmarks(tx, &storage.GetBookmarksArgs{
+				OwnerID:    u1ID,
+				LinkStatus: ls,
+			}, nil)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			gotIDs := []int{}
+			for _, bkm := range got {
+				gotIDs = append(gotIDs, bkm.ID)
+			}
+
+			return errors.Annotatef(checkIDs(gotIDs, expected), "link status %q", ls)
+		}
+
+		now := time.Now()
+
+		if err := checkToCheck(now, 100, []int{b[0], b[1], b[2], b[4]}); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := checkToCheck(now, 2, []int{b[0], b[1]}); err != nil {
+			return errors.Trace(err)
+		}
+
+		lcs := []storage.LinkCheckData{
+			{BookmarkID: b[0], URL: bkms[0].URL, StatusCode: 200},
+			{BookmarkID: b[1], URL: bkms[1].URL, StatusCode: 404},
+			{
+				BookmarkID: b[2], URL: bkms[2].URL, StatusCode: 200,
+				RedirectURL: "http://x.com/new",
+			},
+		}
+		for _, lc := range lcs {
+			if err := si.SetLinkCheck(tx, &lc); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		// Checked bookmarks are only returned again once the check is old enough
+		if err := checkToCheck(now.Add(-time.Hour), 100, []int{b[4]}); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := checkToCheck(now.Add(time.Hour), 100, []int{b[4], b[0], b[1], b[2]}); err != nil {
+			return errors.Trace(err)
+		}
+
+		got, err := si.GetLinkChecks(tx, []int{b[0], b[1], b[2], b[3]})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if len(got) != len(lcs) {
+			return errors.Errorf("expected %d link checks, got %+v", len(lcs), got)
+		}
+
+		for _, lc := range lcs {
+			gotLC := got[lc.BookmarkID]
+			if gotLC.CheckedAt == 0 {
+				return errors.Errorf("link check %+v: CheckedAt is not set", gotLC)
+			}
+
+			gotLC.CheckedAt = 0
+			if !reflect.DeepEqual(gotLC, lc) {
+				return errors.Errorf("link check: expected %+v, got %+v", lc, gotLC)
+			}
+		}
+
+		if err := checkLinkStatus(storage.LinkStatusBroken, []int{b[1]}); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := checkLinkStatus(storage.LinkStatusRedirected, []int{b[2]}); err != nil {
+			return errors.Trace(err)
+		}
+
+		// The check replaces the previous one; URLs which couldn't be fetched
+		// at all are broken
+		err = si.SetLinkCheck(tx, &storage.LinkCheckData{
+			BookmarkID: b[2], URL: bkms[2].URL, Error: "timeout",
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := checkLinkStatus(storage.LinkStatusBroken, []int{b[1], b[2]}); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := checkLinkStatus(storage.LinkStatusRedirected, []int{}); err != nil {
+			return errors.Trace(err)
+		}
+
+		// Once the URL is changed, the check is outdated
+		err = si.UpdateBookmark(tx, &storage.BookmarkData{
+			ID:      b[1],
+			OwnerID: u1ID,
+			URL:     "https://x.com/new",
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := checkLinkStatus(storage.LinkStatusBroken, []int{b[2]}); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := checkToCheck(now.Add(-time.Hour), 100, []int{b[1], b[4]}); err != nil {
+			return errors.Trace(err)
+		}
+
+		got, err = si.GetLinkChecks(tx, []int{b[1]})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if len(got) != 0 {
+			return errors.Errorf("outdated link check should be omitted, got %+v", got)
+		}
+
+		// Checks of deleted bookmarks are ignored
+		if err := si.DeleteTaggable(tx, b[0]); err != nil {
+			return errors.Trace(err)
+		}
+
+		err = si.SetLinkCheck(tx, &storage.LinkCheckData{
+			BookmarkID: b[0], URL: bkms[0].URL, StatusCode: 200,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		got, err = si.GetLinkChecks(tx, []int{b[0]})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if len(got) != 0 {
+			return errors.Errorf("check of the deleted bookmark should be omitted, got %+v", got)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,332 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package storagetest
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/juju/errors"
+)
+
+// makeBrokenData creates tags and bookmarks for a new user, and then breaks
+// the integrity in all the ways RepairIntegrity knows how to fix: children
+// count of tag3 is wrong, the first bookmark misses taggings with tag1 and
+// tag5, and the second one is tagged with the root tag only.
+func makeBrokenData(
+	si storage.Storage,
+) (userID int, ids *tagIDs, bkmIDs []int, err error) {
+	userID, err = createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return 0, nil, nil, errors.Trace(err)
+	}
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		var err error
+		ids, err = makeTagsHierarchy(tx, si, userID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkmIDs, err = makeBookmarks(tx, si, userID, [][]int{
+			{ids.tag6ID, ids.tag4ID},
+			{ids.tag2ID},
+			{ids.tag8ID},
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Ids are formatted right into queries, since backends use different
+		// placeholders.
+		for _, q := range []string{
+			fmt.Sprintf("UPDATE tags SET children_cnt = 42 WHERE id = %d", ids.tag3ID),
+			fmt.Sprintf(
+				"DELETE FROM taggings WHERE taggable_id = %d AND tag_id IN (%d, %d)",
+				bkmIDs[0], ids.tag1ID, ids.tag5ID,
+			),
+			fmt.Sprintf(
+				"DELETE FROM taggings WHERE taggable_id = %d AND tag_id = %d",
+				bkmIDs[1], ids.tag2ID,
+			),
+		} {
+			if _, err := tx.Exec(q); err != nil {
+				return errors.Annotatef(err, "query %q", q)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, nil, errors.Trace(err)
+	}
+
+	return userID, ids, bkmIDs, nil
+}
+
+func testIntegrityReport(t *testing.T, si storage.Storage) error {
+	// Add a user without problems, it should not be in the report
+	if _, err := createUser(si, "test2", "2@2.2"); err != nil {
+		return errors.Trace(err)
+	}
+
+	report, err := si.GetIntegrityReport()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if !report.OK() {
+		return errors.Errorf("expected empty report, got %+v", report)
+	}
+
+	u1ID, ids, bkmIDs, err := makeBrokenData(si)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	report, err = si.GetIntegrityReport()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	expected := &storage.IntegrityReport{
+		Users: []storage.UserIntegrityReport{
+			{
+				UserID: u1ID,
+				BadChildrenCnts: []storage.BadChildrenCnt{
+					{TagID: ids.tag3ID, ChildrenCnt: 42, ActualChildrenCnt: 2},
+				},
+				IncompleteTagPaths: []storage.IncompleteTagPath{
+					{TaggableID: bkmIDs[0], MissingTagIDs: []int{ids.tag1ID, ids.tag5ID}},
+				},
+				RootOnlyTaggableIDs: []int{bkmIDs[1]},
+			},
+		},
+	}
+
+	if len(report.Users) == 1 && len(report.Users[0].IncompleteTagPaths) == 1 {
+		sort.Ints(report.Users[0].IncompleteTagPaths[0].MissingTagIDs)
+	}
+	if !reflect.DeepEqual(report, expected) {
+		return errors.Errorf("wrong report: expected %+v, got %+v", expected, report)
+	}
+
+	// Repair it, so that the test runner's integrity check passes
+	_, err = si.RepairIntegrity()
+	return errors.Trace(err)
+}
+
+func testRepairIntegrity(t *testing.T, si storage.Storage) error {
+	// Nothing to repair yet
+	fixes, err := si.RepairIntegrity()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(fixes) != 0 {
+		return errors.Errorf("expected no fixes, got %+v", fixes)
+	}
+
+	_, ids, bkmIDs, err := makeBrokenData(si)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if err := si.CheckIntegrity(); err == nil {
+		return errors.Errorf("integrity check should fail")
+	}
+
+	fixes, err = si.RepairIntegrity()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Check all fixes, ignoring human-readable descriptions
+	if len(fixes) != 3 {
+		return errors.Errorf("expected 3 fixes, got %+v", fixes)
+	}
+
+	if f := fixes[0]; f.Kind != storage.IntegrityFixKindChildrenCnt ||
+		f.TagID != ids.tag3ID {
+		return errors.Errorf("wrong children count fix: %+v", f)
+	}
+
+	f := fixes[1]
+	if f.Kind != storage.IntegrityFixKindMissingTaggings || f.TaggableID != bkmIDs[0] {
+		return errors.Errorf("wrong missing taggings fix: %+v", f)
+	}
+	if err := checkIDs(f.TagIDs, []int{ids.tag1ID, ids.tag5ID}); err != nil {
+		return errors.Annotatef(err, "missing taggings fix")
+	}
+
+	if f := fixes[2]; f.Kind != storage.IntegrityFixKindRootOnlyTagging ||
+		f.TaggableID != bkmIDs[1] || f.TagID != ids.rootTagID {
+		return errors.Errorf("wrong root-only tagging fix: %+v", f)
+	}
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		if err := expectTaggings(
+			tx, si, bkmIDs[0], storage.TaggingModeAll,
+			[]int{ids.rootTagID, ids.tag1ID, ids.tag3ID, ids.tag4ID, ids.tag5ID, ids.tag6ID},
+		); err != nil {
+			return errors.Trace(err)
+		}
+
+		return errors.Trace(
+			expectTaggings(tx, si, bkmIDs[1], storage.TaggingModeAll, []int{}),
+		)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Everything is fixed now
+	fixes, err = si.RepairIntegrity()
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if len(fixes) != 0 {
+		return errors.Errorf("expected no fixes after repair, got %+v", fixes)
+	}
+
+	return nil
+}
+
+func testIntegrityUnknownTaggings(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	u2ID, err := createUser(si, "test2", "2@2.2")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var u1IDs, u2IDs *tagIDs
+	var bkmIDs []int
+
+	// Tag user1's bookmarks with user2's tags: the first bookmark also has
+	// proper taggings, the second one has only the root tagging besides the
+	// foreign one, and the third one has only the foreign tagging.
+	err = si.Tx(func(tx *sql.Tx) error {
+		var err error
+		u1IDs, err = makeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		u2IDs, err = makeTagsHierarchy(tx, si, u2ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkmIDs, err = makeBookmarks(tx, si, u1ID, [][]int{
+			{u1IDs.tag2ID},
+			{u1IDs.tag8ID},
+			{u1IDs.tag2ID},
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		for _, q := range []string{
+			fmt.Sprintf(
+				"DELETE FROM taggings WHERE taggable_id = %d AND tag_id IN (%d, %d)",
+				bkmIDs[1], u1IDs.tag7ID, u1IDs.tag8ID,
+			),
+			fmt.Sprintf("DELETE FROM taggings WHERE taggable_id = %d", bkmIDs[2]),
+			fmt.Sprintf(
+				"INSERT INTO taggings (taggable_id, tag_id) VALUES (%d, %d)",
+				bkmIDs[0], u2IDs.tag2ID,
+			),
+			fmt.Sprintf(
+				"INSERT INTO taggings (taggable_id, tag_id) VALUES (%d, %d)",
+				bkmIDs[1], u2IDs.tag1ID,
+			),
+			fmt.Sprintf(
+				"INSERT INTO taggings (taggable_id, tag_id) VALUES (%d, %d)",
+				bkmIDs[2], u2IDs.tag1ID,
+			),
+		} {
+			if _, err := tx.Exec(q); err != nil {
+				return errors.Annotatef(err, "query %q", q)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	report, err := si.GetIntegrityReport()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	expected := &storage.IntegrityReport{
+		Users: []storage.UserIntegrityReport{
+			{
+				UserID:              u1ID,
+				RootOnlyTaggableIDs: []int{bkmIDs[1]},
+				UnknownTaggings: []storage.UnknownTagging{
+					{TaggableID: bkmIDs[0], TagIDs: []int{u2IDs.tag2ID}},
+					{TaggableID: bkmIDs[1], TagIDs: []int{u2IDs.tag1ID}},
+					{TaggableID: bkmIDs[2], TagIDs: []int{u2IDs.tag1ID}},
+				},
+			},
+		},
+	}
+
+	if !reflect.DeepEqual(report, expected) {
+		return errors.Errorf("wrong report: expected %+v, got %+v", expected, report)
+	}
+
+	fixes, err := si.RepairIntegrity()
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(fixes) != 4 {
+		return errors.Errorf("expected 4 fixes, got %+v", fixes)
+	}
+
+	for i, ut := range expected.Users[0].UnknownTaggings {
+		if f := fixes[i]; f.Kind != storage.IntegrityFixKindUnknownTagging ||
+			f.TaggableID != ut.TaggableID || f.TagID != ut.TagIDs[0] {
+			return errors.Errorf("wrong unknown tagging fix: %+v", f)
+		}
+	}
+
+	if f := fixes[3]; f.Kind != storage.IntegrityFixKindRootOnlyTagging ||
+		f.TaggableID != bkmIDs[1] || f.TagID != u1IDs.rootTagID {
+		return errors.Errorf("wrong root-only tagging fix: %+v", f)
+	}
+
+	err = si.Tx(func(tx *sql.Tx) error {
+		if err := expectTaggings(
+			tx, si, bkmIDs[0], storage.TaggingModeAll,
+			[]int{u1IDs.rootTagID, u1IDs.tag2ID},
+		); err != nil {
+			return errors.Trace(err)
+		}
+
+		for _, bkmID := range bkmIDs[1:] {
+			if err := expectTaggings(
+				tx, si, bkmID, storage.TaggingModeAll, []int{},
+			); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return nil
+}
@@ -0,0 +1,165 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package storagetest
+
+import (
+	"database/sql"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/juju/errors"
+)
+
+func testNotes(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return si.Tx(func(tx *sql.Tx) error {
+		ids, err := makeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		note1ID, err := si.CreateNote(tx, &storage.NoteData{
+			OwnerID: u1ID,
+			Title:   "note1",
+			Body:    "# Note 1\n\nbody",
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := si.SetTaggings(tx, note1ID, []int{ids.tag4ID}, storage.TaggingModeLeafs); err != nil {
+			return errors.Trace(err)
+		}
+
+		note2ID, err := si.CreateNote(tx, &storage.NoteData{
+			OwnerID: u1ID,
+			Title:   "note2",
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := si.SetTaggings(tx, note2ID, []int{ids.tag8ID}, storage.TaggingModeLeafs); err != nil {
+			return errors.Trace(err)
+		}
+
+		// Bookmark with the same tags as the first note
+		bkmID, err := si.CreateBookmark(tx, &storage.BookmarkData{
+			OwnerID: u1ID,
+			URL:     "http://example.com",
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := si.SetTaggings(tx, bkmID, []int{ids.tag4ID}, storage.TaggingModeLeafs); err != nil {
+			return errors.Trace(err)
+		}
+
+		checkNotes := func(args storage.GetNotesArgs, expected []int) error {
+			args.OwnerID = u1ID
+			notes, err := si.GetNotes(tx, &args, nil)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			gotIDs := []int{}
+			for _, note := range notes {
+				gotIDs = append(gotIDs, note.ID)
+			}
+
+			return errors.Annotatef(checkIDs(gotIDs, expected), "args %+v", args)
+		}
+
+		if err := checkNotes(storage.GetNotesArgs{}, []int{note1ID, note2ID}); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := checkNotes(storage.GetNotesArgs{TagIDs: []int{ids.tag3ID}}, []int{note1ID}); err != nil {
+			return errors.Trace(err)
+		}
+
+		err = checkNotes(storage.GetNotesArgs{
+			TagExpr: &storage.TagExpr{
+				Op: storage.TagExprOpNot,
+				Args: []storage.TagExpr{
+					{Op: storage.TagExprOpTag, TagID: ids.tag1ID},
+				},
+			},
+		}, []int{note2ID})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Notes and bookmarks don't get mixed
+		tgbIDs, err := si.GetTaggedTaggableIDs(
+			tx, []int{ids.tag4ID}, &u1ID, []storage.TaggableType{storage.TaggableTypeNote},
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := checkIDs(tgbIDs, []int{note1ID}); err != nil {
+			return errors.Trace(err)
+		}
+
+		bkms, _, err := si.GetBookmarks(tx, &storage.GetBookmarksArgs{
+			OwnerID: u1ID,
+			TagIDs:  []int{ids.tag4ID},
+		}, nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(bkms) != 1 || bkms[0].ID != bkmID {
+			return errors.Errorf("expected bookmark %d only, got %v", bkmID, bkms)
+		}
+
+		if _, err := si.GetNoteByID(tx, bkmID, nil); errors.Cause(err) != storage.ErrNoteDoesNotExist {
+			return errors.Errorf("getting bookmark as a note: expected %q, got %v", storage.ErrNoteDoesNotExist, err)
+		}
+
+		if _, err := si.GetBookmarkByID(tx, note1ID, nil); errors.Cause(err) != storage.ErrBookmarkDoesNotExist {
+			return errors.Errorf("getting note as a bookmark: expected %q, got %v", storage.ErrBookmarkDoesNotExist, err)
+		}
+
+		// Update and get the note
+		err = si.UpdateNote(tx, &storage.NoteData{
+			ID:    note1ID,
+			Title: "note1 updated",
+			Body:  "new body",
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		note, err := si.GetNoteByID(tx, note1ID, nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if note.Title != "note1 updated" || note.Body != "new body" || note.OwnerID != u1ID {
+			return errors.Errorf("unexpected note data: %+v", note.NoteData)
+		}
+		// The tag path starts from the root tag
+		if len(note.Tags) != 1 || len(note.Tags[0].TagItems) != 4 ||
+			note.Tags[0].TagItems[3].ID != ids.tag4ID {
+			return errors.Errorf("unexpected note tags: %+v", note.Tags)
+		}
+
+		// Delete the note
+		if err := si.DeleteTaggable(tx, note1ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		if _, err := si.GetNoteByID(tx, note1ID, nil); errors.Cause(err) != storage.ErrNoteDoesNotExist {
+			return errors.Errorf("getting deleted note: expected %q, got %v", storage.ErrNoteDoesNotExist, err)
+		}
+
+		if err := checkNotes(storage.GetNotesArgs{}, []int{note2ID}); err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
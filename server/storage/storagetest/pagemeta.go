@@ -0,0 +1,170 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package storagetest
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/juju/errors"
+)
+
+func testPageMeta(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	u2ID, err := createUser(si, "test2", "2@2.2")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return si.Tx(func(tx *sql.Tx) error {
+		bkms := []storage.BookmarkData{
+			{OwnerID: u1ID, URL: "http://x.com/a"},
+			{OwnerID: u2ID, URL: "http://x.com/b"},
+			{OwnerID: u1ID, URL: "http://x.com/c"},
+		}
+
+		b := []int{}
+		for _, bkm := range bkms {
+			bkmID, err := si.CreateBookmark(tx, &bkm)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			b = append(b, bkmID)
+		}
+
+		checkPending := func(limit int, expected []int) error {
+			got, err := si.GetPendingPageMeta(tx, limit)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			gotIDs := []int{}
+			for _, bkm := range got {
+				gotIDs = append(gotIDs, bkm.ID)
+			}
+
+			if !reflect.DeepEqual(gotIDs, expected) {
+				return errors.Errorf("pending: expected %v, got %v", expected, gotIDs)
+			}
+			return nil
+		}
+
+		checkPageMeta := func(expected map[int]storage.PageMetaData) error {
+			got, err := si.GetPageMeta(tx, b)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			for id, pm := range got {
+				if pm.FetchedAt == 0 {
+					return errors.Errorf("page meta %+v: FetchedAt is not set", pm)
+				}
+				pm.FetchedAt = 0
+				got[id] = pm
+			}
+
+			if !reflect.DeepEqual(got, expected) {
+				return errors.Errorf("page meta: expected %+v, got %+v", expected, got)
+			}
+			return nil
+		}
+
+		// Nothing is fetched unless requested
+		if err := checkPending(100, []int{}); err != nil {
+			return errors.Trace(err)
+		}
+
+		for _, id := range []int{b[2], b[0], b[1]} {
+			if err := si.RequestPageMeta(tx, id); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		if err := checkPending(100, []int{b[0], b[1], b[2]}); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := checkPending(1, []int{b[0]}); err != nil {
+			return errors.Trace(err)
+		}
+
+		pm0 := storage.PageMetaData{
+			BookmarkID:   b[0],
+			URL:          bkms[0].URL,
+			Title:        "Title A",
+			Description:  "Description A",
+			CanonicalURL: "http://x.com/canonical",
+			FaviconURL:   "http://x.com/favicon.ico",
+		}
+		pm1 := storage.PageMetaData{
+			BookmarkID: b[1],
+			URL:        bkms[1].URL,
+			Error:      "not found",
+		}
+		for _, pm := range []storage.PageMetaData{pm0, pm1} {
+			if err := si.SetPageMeta(tx, &pm); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		if err := checkPending(100, []int{b[2]}); err != nil {
+			return errors.Trace(err)
+		}
+
+		// The pending request is not returned as metadata
+		if err := checkPageMeta(map[int]storage.PageMetaData{
+			b[0]: pm0, b[1]: pm1,
+		}); err != nil {
+			return errors.Trace(err)
+		}
+
+		// Requesting again makes it pending again
+		if err := si.RequestPageMeta(tx, b[1]); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := checkPending(100, []int{b[1], b[2]}); err != nil {
+			return errors.Trace(err)
+		}
+
+		// Once the URL is changed, the metadata is outdated
+		err = si.UpdateBookmark(tx, &storage.BookmarkData{
+			ID:      b[0],
+			OwnerID: u1ID,
+			URL:     "http://x.com/new",
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := checkPageMeta(map[int]storage.PageMetaData{}); err != nil {
+			return errors.Trace(err)
+		}
+
+		// Requests of deleted bookmarks are dropped
+		if err := si.DeleteTaggable(tx, b[2]); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := checkPending(100, []int{b[1]}); err != nil {
+			return errors.Trace(err)
+		}
+
+		err = si.SetPageMeta(tx, &storage.PageMetaData{
+			BookmarkID: b[2], URL: bkms[2].URL, Title: "Title C",
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
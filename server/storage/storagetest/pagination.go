@@ -0,0 +1,198 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package storagetest
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/juju/errors"
+)
+
+func testPaginateBookmarks(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return si.Tx(func(tx *sql.Tx) error {
+		ids, err := makeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkms := []struct {
+			url, title string
+			tagIDs     []int
+		}{
+			{"http://c.com/", "bravo run", []int{ids.tag4ID}},
+			{"http://a.com/", "delta", []int{ids.tag8ID}},
+			{"http://e.com/", "alpha run run", []int{ids.tag4ID}},
+			{"http://b.com/", "echo", nil},
+			{"http://d.com/", "charlie run", nil},
+		}
+
+		bkmIDs := []int{}
+		for i, bkm := range bkms {
+			bkmID, err := si.CreateBookmark(tx, &storage.BookmarkData{
+				OwnerID: u1ID,
+				URL:     bkm.url,
+				Title:   bkm.title,
+			})
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			err = si.SetTaggings(tx, bkmID, bkm.tagIDs, storage.TaggingModeLeafs)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			// Older bookmarks were updated earlier
+			err = si.SetTaggableUpdatedAt(tx, bkmID, uint64(1262304000+i))
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			bkmIDs = append(bkmIDs, bkmID)
+		}
+
+		// check fetches all the pages with the given limit, and checks the ids
+		// of all the fetched bookmarks
+		check := func(args storage.GetBookmarksArgs, limit int, expected []int) error {
+			args.Limit = limit
+			gotIDs := []int{}
+			for {
+				got, next, err := si.GetBookmarks(tx, &args, nil)
+				if err != nil {
+					return errors.Trace(err)
+				}
+
+				if limit > 0 && len(got) > limit {
+					return errors.Errorf("limit %d, got %d bookmarks", limit, len(got))
+				}
+
+				for _, bkm := range got {
+					gotIDs = append(gotIDs, bkm.ID)
+				}
+
+				if next == nil {
+					break
+				}
+
+				if len(gotIDs) > len(expected) {
+					return errors.Errorf("too many pages, got %v so far", gotIDs)
+				}
+
+				args.After = next
+			}
+
+			if !reflect.DeepEqual(gotIDs, expected) {
+				return errors.Errorf(
+					"sort %q, limit %d: expected %v, got %v",
+					args.Sort, limit, expected, gotIDs,
+				)
+			}
+
+			return nil
+		}
+
+		b := bkmIDs
+		cases := []struct {
+			args     storage.GetBookmarksArgs
+			expected []int
+		}{
+			{storage.GetBookmarksArgs{}, []int{b[0], b[1], b[2], b[3], b[4]}},
+			{
+				storage.GetBookmarksArgs{Sort: storage.BookmarksSortTitle},
+				[]int{b[2], b[0], b[4], b[1], b[3]},
+			},
+			{
+				storage.GetBookmarksArgs{Sort: storage.BookmarksSortURL},
+				[]int{b[1], b[3], b[0], b[4], b[2]},
+			},
+			// All the bookmarks are created at the same second, so the newest ids
+			// go first
+			{
+				storage.GetBookmarksArgs{Sort: storage.BookmarksSortCreated},
+				[]int{b[4], b[3], b[2], b[1], b[0]},
+			},
+			{
+				storage.GetBookmarksArgs{Sort: storage.BookmarksSortUpdated},
+				[]int{b[4], b[3], b[2], b[1], b[0]},
+			},
+			{
+				storage.GetBookmarksArgs{Query: "run"},
+				[]int{b[2], b[0], b[4]},
+			},
+			{
+				storage.GetBookmarksArgs{Query: "run", Sort: storage.BookmarksSortTitle},
+				[]int{b[2], b[0], b[4]},
+			},
+			{
+				storage.GetBookmarksArgs{TagIDs: []int{ids.tag4ID}, Sort: storage.BookmarksSortURL},
+				[]int{b[0], b[2]},
+			},
+			{
+				storage.GetBookmarksArgs{Untagged: true, Sort: storage.BookmarksSortTitle},
+				[]int{b[4], b[3]},
+			},
+		}
+
+		for _, c := range cases {
+			c.args.OwnerID = u1ID
+			for _, limit := range []int{0, 1, 2, 5} {
+				if err := check(c.args, limit, c.expected); err != nil {
+					return errors.Trace(err)
+				}
+			}
+		}
+
+		// Updating the bookmark or its taggings moves it to the top of the
+		// recently updated ones; both are updated at the same second (or the
+		// second one later), so the newest id goes first
+		err = si.UpdateBookmark(tx, &storage.BookmarkData{
+			ID:    b[1],
+			URL:   bkms[1].url,
+			Title: bkms[1].title,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = si.SetTaggings(tx, b[3], []int{ids.tag2ID}, storage.TaggingModeLeafs)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		for _, limit := range []int{0, 1, 2, 5} {
+			err := check(
+				storage.GetBookmarksArgs{OwnerID: u1ID, Sort: storage.BookmarksSortUpdated},
+				limit, []int{b[3], b[1], b[4], b[2], b[0]},
+			)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		// Invalid sort orders
+		for _, args := range []storage.GetBookmarksArgs{
+			{OwnerID: u1ID, Sort: "foo"},
+			{OwnerID: u1ID, Sort: storage.BookmarksSortRelevance},
+			{
+				OwnerID: u1ID, Sort: storage.BookmarksSortTitle,
+				After: &storage.BookmarksCursor{Sort: storage.BookmarksSortURL},
+			},
+		} {
+			if _, _, err := si.GetBookmarks(tx, &args, nil); err == nil {
+				return errors.Errorf("sort %q should result in an error", args.Sort)
+			}
+		}
+
+		return nil
+	})
+}
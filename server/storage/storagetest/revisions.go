@@ -0,0 +1,128 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package storagetest
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/juju/errors"
+)
+
+func testBookmarkRevisions(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return si.Tx(func(tx *sql.Tx) error {
+		ids, err := makeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkmIDs, err := makeBookmarks(tx, si, u1ID, [][]int{{ids.tag8ID, ids.tag4ID}})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		revs, err := si.GetBookmarkRevisions(tx, bkmIDs[0])
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(revs) != 0 {
+			return errors.Errorf("should be no revisions, got %+v", revs)
+		}
+
+		rev1ID, err := si.SaveBookmarkRevision(tx, bkmIDs[0])
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = si.UpdateBookmark(tx, &storage.BookmarkData{
+			ID:      bkmIDs[0],
+			OwnerID: u1ID,
+			URL:     "url1_new",
+			Title:   "title1_new",
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = si.SetTaggings(tx, bkmIDs[0], []int{ids.tag2ID}, storage.TaggingModeLeafs)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		rev2ID, err := si.SaveBookmarkRevision(tx, bkmIDs[0])
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		revs, err = si.GetBookmarkRevisions(tx, bkmIDs[0])
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(revs) != 2 || revs[0].CreatedAt == 0 || revs[1].CreatedAt == 0 {
+			return errors.Errorf("should be 2 revisions, got %+v", revs)
+		}
+
+		// The most recent revision goes first; tag ids are sorted
+		expected := []storage.BookmarkRevisionData{
+			{
+				ID:         rev2ID,
+				BookmarkID: bkmIDs[0],
+				CreatedAt:  revs[0].CreatedAt,
+				URL:        "url1_new",
+				Title:      "title1_new",
+				TagIDs:     []int{ids.tag2ID},
+			},
+			{
+				ID:         rev1ID,
+				BookmarkID: bkmIDs[0],
+				CreatedAt:  revs[1].CreatedAt,
+				URL:        "url1",
+				Title:      "title1",
+				Comment:    "comment1",
+				TagIDs:     []int{ids.tag4ID, ids.tag8ID},
+			},
+		}
+		if !reflect.DeepEqual(revs, expected) {
+			return errors.Errorf("revisions: expected %+v, got %+v", expected, revs)
+		}
+
+		rev, err := si.GetBookmarkRevision(tx, rev1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !reflect.DeepEqual(*rev, expected[1]) {
+			return errors.Errorf("revision: expected %+v, got %+v", expected[1], *rev)
+		}
+
+		_, err = si.GetBookmarkRevision(tx, rev2ID+100)
+		if errors.Cause(err) != storage.ErrBookmarkRevisionDoesNotExist {
+			return errors.Errorf("expected ErrBookmarkRevisionDoesNotExist, got %v", err)
+		}
+
+		_, err = si.SaveBookmarkRevision(tx, bkmIDs[0]+100)
+		if errors.Cause(err) != storage.ErrBookmarkDoesNotExist {
+			return errors.Errorf("expected ErrBookmarkDoesNotExist, got %v", err)
+		}
+
+		// Revisions are deleted together with the bookmark
+		if err := si.DeleteTaggable(tx, bkmIDs[0]); err != nil {
+			return errors.Trace(err)
+		}
+
+		_, err = si.GetBookmarkRevision(tx, rev1ID)
+		if errors.Cause(err) != storage.ErrBookmarkRevisionDoesNotExist {
+			return errors.Errorf("expected ErrBookmarkRevisionDoesNotExist, got %v", err)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,165 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package storagetest
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/juju/errors"
+)
+
+func testSearchBookmarks(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	u2ID, err := createUser(si, "test2", "2@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return si.Tx(func(tx *sql.Tx) error {
+		ids, err := makeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkms := []struct {
+			ownerID             int
+			url, title, comment string
+			tagIDs              []int
+		}{
+			{u1ID, "http://a.com/", "Running in Go", "", []int{ids.tag4ID}},
+			{u1ID, "http://b.com/", "Other", "About running fast", []int{ids.tag8ID}},
+			{u1ID, "http://c.com/run", "Third", "", []int{ids.tag4ID}},
+			{u1ID, "http://d.com/", "Nothing", "Here", nil},
+			{u2ID, "http://e.com/", "Running too", "", nil},
+		}
+
+		bkmIDs := []int{}
+		for _, bkm := range bkms {
+			bkmID, err := si.CreateBookmark(tx, &storage.BookmarkData{
+				OwnerID: bkm.ownerID,
+				URL:     bkm.url,
+				Title:   bkm.title,
+				Comment: bkm.comment,
+			})
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			err = si.SetTaggings(tx, bkmID, bkm.tagIDs, storage.TaggingModeLeafs)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			bkmIDs = append(bkmIDs, bkmID)
+		}
+
+		check := func(args *storage.GetBookmarksArgs, expected []int) error {
+			got, _, err := si.GetBookmarks(tx, args, nil)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			gotIDs := []int{}
+			for _, bkm := range got {
+				gotIDs = append(gotIDs, bkm.ID)
+			}
+
+			if !reflect.DeepEqual(gotIDs, expected) {
+				return errors.Errorf(
+					"query %q, tags %v: expected %v, got %v",
+					args.Query, args.TagIDs, expected, gotIDs,
+				)
+			}
+
+			return nil
+		}
+
+		// Without a query, all bookmarks of the user are returned
+		if err := check(&storage.GetBookmarksArgs{OwnerID: u1ID}, bkmIDs[:4]); err != nil {
+			return errors.Trace(err)
+		}
+
+		// Words are stemmed; matches in titles go first, and in URLs go last
+		err = check(
+			&storage.GetBookmarksArgs{OwnerID: u1ID, Query: "runs"},
+			[]int{bkmIDs[0], bkmIDs[1], bkmIDs[2]},
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// All the words should match
+		err = check(
+			&storage.GetBookmarksArgs{OwnerID: u1ID, Query: "RUNNING, fast!"},
+			[]int{bkmIDs[1]},
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Query is combined with tags
+		err = check(
+			&storage.GetBookmarksArgs{OwnerID: u1ID, Query: "run", TagIDs: []int{ids.tag3ID}},
+			[]int{bkmIDs[0], bkmIDs[2]},
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = check(
+			&storage.GetBookmarksArgs{OwnerID: u1ID, TagIDs: []int{ids.tag7ID}},
+			[]int{bkmIDs[1]},
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Nothing to look for
+		if err := check(&storage.GetBookmarksArgs{OwnerID: u1ID, Query: "!!!"}, []int{}); err != nil {
+			return errors.Trace(err)
+		}
+
+		// The index is kept up to date on updates and deletions
+		err = si.UpdateBookmark(tx, &storage.BookmarkData{
+			ID:      bkmIDs[3],
+			OwnerID: u1ID,
+			URL:     "http://d.com/",
+			Title:   "Nothing",
+			Comment: "They run",
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := si.DeleteTaggable(tx, bkmIDs[0]); err != nil {
+			return errors.Trace(err)
+		}
+
+		err = check(
+			&storage.GetBookmarksArgs{OwnerID: u1ID, Query: "run"},
+			[]int{bkmIDs[1], bkmIDs[3], bkmIDs[2]},
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = check(
+			&storage.GetBookmarksArgs{OwnerID: u2ID, Query: "run"},
+			[]int{bkmIDs[4]},
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,138 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// Package storagetest is a conformance test suite for storage.Storage
+// implementations. Every backend runs it against itself, so that all of them
+// behave the same way as far as the rest of geekmarks is concerned:
+//
+//	func TestStorageConformance(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) (storage.Storage, func()) {
+//			si := ... // Create a connected storage, with migrations applied
+//			return si, func() { ... }
+//		})
+//	}
+package storagetest // import "dmitryfrank.com/geekmarks/server/storage/storagetest"
+
+import (
+	"database/sql"
+	"reflect"
+	"sort"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+	"github.com/dimonomid/interrors"
+
+	"github.com/juju/errors"
+)
+
+// NewStorageFunc should return a connected storage with all migrations
+// applied and no data in it, and a function which will be called when the
+// test is done with the storage.
+type NewStorageFunc func(t *testing.T) (si storage.Storage, cleanup func())
+
+type testFunc func(t *testing.T, si storage.Storage) error
+
+var tests = []struct {
+	name string
+	f    testFunc
+}{
+	{"TransactionRollback", testTransactionRollback},
+	{"TransactionContext", testTransactionContext},
+	{"Users", testUsers},
+	{"DeleteUser", testDeleteUser},
+	{"GetTagIDByPath", testGetTagIDByPath},
+	{"GetTags", testGetTags},
+	{"InvalidTagNames", testInvalidTagNames},
+	{"DuplicateTagNames", testDuplicateTagNames},
+	{"PrimaryTagNames", testPrimaryTagNames},
+	{"Taggings", testTaggings},
+	{"TaggedTaggableIDs", testTaggedTaggableIDs},
+	{"BookmarkTagPaths", testBookmarkTagPaths},
+	{"UpdateBookmark", testUpdateBookmark},
+	{"MoveTagLeafPolicyKeep", testMoveTagLeafPolicyKeep},
+	{"MoveTagLeafPolicyDel", testMoveTagLeafPolicyDel},
+	{"MoveTagUnderItself", testMoveTagUnderItself},
+	{"DeleteTag", testDeleteTag},
+	{"DeleteRootTag", testDeleteRootTag},
+	{"IntegrityReport", testIntegrityReport},
+	{"RepairIntegrity", testRepairIntegrity},
+	{"IntegrityUnknownTaggings", testIntegrityUnknownTaggings},
+	{"Trash", testTrash},
+	{"BookmarkRevisions", testBookmarkRevisions},
+	{"TagOperations", testTagOperations},
+	{"RestoreTag", testRestoreTag},
+	{"SearchBookmarks", testSearchBookmarks},
+	{"PaginateBookmarks", testPaginateBookmarks},
+	{"TagExprBookmarks", testTagExprBookmarks},
+	{"BookmarkViews", testBookmarkViews},
+	{"CanonicalURLs", testCanonicalURLs},
+	{"BookmarkCreatedAt", testBookmarkCreatedAt},
+	{"TagBookmarkCounts", testTagBookmarkCounts},
+	{"Notes", testNotes},
+	{"LinkChecks", testLinkChecks},
+	{"PageMeta", testPageMeta},
+}
+
+// Run runs the whole suite; every test gets a fresh storage from newStorage,
+// and the integrity of the storage is checked after each test.
+func Run(t *testing.T, newStorage NewStorageFunc) {
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			si, cleanup := newStorage(t)
+			defer cleanup()
+
+			if err := test.f(t, si); err != nil {
+				t.Errorf("%s", interrors.ErrorStack(err))
+				return
+			}
+
+			if err := si.CheckIntegrity(); err != nil {
+				t.Errorf("%s", interrors.ErrorStack(err))
+			}
+		})
+	}
+}
+
+func createUser(si storage.Storage, username, email string) (userID int, err error) {
+	err = si.Tx(func(tx *sql.Tx) error {
+		var err error
+		userID, err = si.CreateUser(tx, &storage.UserData{
+			Username: username,
+			Email:    email,
+		})
+		return errors.Annotatef(
+			err, "creating test user: username %q, email %q", username, email,
+		)
+	})
+	return userID, errors.Trace(err)
+}
+
+// checkIDs checks that got and expected contain the same ids, regardless of
+// the order.
+func checkIDs(got, expected []int) error {
+	got = append([]int{}, got...)
+	expected = append([]int{}, expected...)
+
+	sort.Ints(expected)
+	sort.Ints(got)
+
+	if !reflect.DeepEqual(got, expected) {
+		return errors.Errorf("ids mismatch: expected %v, got %v", expected, got)
+	}
+
+	return nil
+}
+
+func expectTaggings(
+	tx *sql.Tx, si storage.Storage, taggableID int, tm storage.TaggingMode, expected []int,
+) error {
+	tagIDs, err := si.GetTaggings(tx, taggableID, tm)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return errors.Annotatef(
+		checkIDs(tagIDs, expected), "taggings of taggable %d", taggableID,
+	)
+}
@@ -0,0 +1,93 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package storagetest
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/juju/errors"
+)
+
+func testTagBookmarkCounts(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	u2ID, err := createUser(si, "test2", "2@2.2")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return si.Tx(func(tx *sql.Tx) error {
+		ids, err := makeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Without bookmarks, there are no counts at all
+		counts, err := si.GetTagBookmarkCounts(tx, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(counts) != 0 {
+			return errors.Errorf("expected no counts, got %v", counts)
+		}
+
+		bkmsTagIDs := [][]int{
+			{ids.tag4ID},
+			{ids.tag3ID},
+			{ids.tag6ID, ids.tag8ID},
+			nil,
+		}
+
+		for i, tagIDs := range bkmsTagIDs {
+			bkmID, err := si.CreateBookmark(tx, &storage.BookmarkData{
+				OwnerID: u1ID,
+				URL:     "http://example.com/" + string(rune('a'+i)),
+			})
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			err = si.SetTaggings(tx, bkmID, tagIDs, storage.TaggingModeLeafs)
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		// Bookmarks of another user should not be counted
+		if _, err := si.CreateBookmark(tx, &storage.BookmarkData{
+			OwnerID: u2ID,
+			URL:     "http://example.com/a",
+		}); err != nil {
+			return errors.Trace(err)
+		}
+
+		counts, err = si.GetTagBookmarkCounts(tx, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		expected := map[int]storage.TagBookmarkCounts{
+			ids.rootTagID: {Direct: 1, Total: 4},
+			ids.tag1ID:    {Direct: 0, Total: 3},
+			ids.tag3ID:    {Direct: 1, Total: 3},
+			ids.tag4ID:    {Direct: 1, Total: 1},
+			ids.tag5ID:    {Direct: 0, Total: 1},
+			ids.tag6ID:    {Direct: 1, Total: 1},
+			ids.tag7ID:    {Direct: 0, Total: 1},
+			ids.tag8ID:    {Direct: 1, Total: 1},
+		}
+		if !reflect.DeepEqual(counts, expected) {
+			return errors.Errorf("expected counts %v, got %v", expected, counts)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,126 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package storagetest
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/juju/errors"
+)
+
+func testTagExprBookmarks(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return si.Tx(func(tx *sql.Tx) error {
+		ids, err := makeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkmsTagIDs := [][]int{
+			{ids.tag4ID},
+			{ids.tag6ID},
+			{ids.tag8ID},
+			{ids.tag2ID, ids.tag4ID},
+			nil,
+		}
+
+		bkmIDs := []int{}
+		for i, tagIDs := range bkmsTagIDs {
+			bkmID, err := si.CreateBookmark(tx, &storage.BookmarkData{
+				OwnerID: u1ID,
+				URL:     "http://example.com/" + string(rune('a'+i)),
+			})
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			err = si.SetTaggings(tx, bkmID, tagIDs, storage.TaggingModeLeafs)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			bkmIDs = append(bkmIDs, bkmID)
+		}
+
+		tag := func(tagID int) storage.TagExpr {
+			return storage.TagExpr{Op: storage.TagExprOpTag, TagID: tagID}
+		}
+		not := func(arg storage.TagExpr) storage.TagExpr {
+			return storage.TagExpr{Op: storage.TagExprOpNot, Args: []storage.TagExpr{arg}}
+		}
+		and := func(args ...storage.TagExpr) storage.TagExpr {
+			return storage.TagExpr{Op: storage.TagExprOpAnd, Args: args}
+		}
+		or := func(args ...storage.TagExpr) storage.TagExpr {
+			return storage.TagExpr{Op: storage.TagExprOpOr, Args: args}
+		}
+
+		b := bkmIDs
+		cases := []struct {
+			tagIDs   []int
+			expr     storage.TagExpr
+			expected []int
+		}{
+			{nil, or(tag(ids.tag4ID), tag(ids.tag8ID)), []int{b[0], b[2], b[3]}},
+			// Subtags match too
+			{nil, and(tag(ids.tag3ID), not(tag(ids.tag4ID))), []int{b[1]}},
+			// Untagged bookmarks match negations
+			{nil, not(tag(ids.tag1ID)), []int{b[2], b[4]}},
+			{
+				nil, and(or(tag(ids.tag4ID), tag(ids.tag8ID)), not(tag(ids.tag2ID))),
+				[]int{b[0], b[2]},
+			},
+			{[]int{ids.tag1ID}, not(tag(ids.tag6ID)), []int{b[0], b[3]}},
+		}
+
+		for _, c := range cases {
+			expr := c.expr
+			got, _, err := si.GetBookmarks(tx, &storage.GetBookmarksArgs{
+				OwnerID: u1ID,
+				TagIDs:  c.tagIDs,
+				TagExpr: &expr,
+			}, nil)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			gotIDs := []int{}
+			for _, bkm := range got {
+				gotIDs = append(gotIDs, bkm.ID)
+			}
+
+			if !reflect.DeepEqual(gotIDs, c.expected) {
+				return errors.Errorf(
+					"tags %v, expr %+v: expected %v, got %v",
+					c.tagIDs, c.expr, c.expected, gotIDs,
+				)
+			}
+		}
+
+		// Invalid expressions
+		for _, expr := range []storage.TagExpr{
+			{Op: storage.TagExprOpNot},
+			{Op: storage.TagExprOpAnd},
+			{Op: "xor", Args: []storage.TagExpr{tag(ids.tag1ID)}},
+		} {
+			_, _, err := si.GetBookmarks(tx, &storage.GetBookmarksArgs{
+				OwnerID: u1ID,
+				TagExpr: &expr,
+			}, nil)
+			if err == nil {
+				return errors.Errorf("expr %+v should result in an error", expr)
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,388 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package storagetest
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/juju/errors"
+)
+
+// makeBookmarks creates a bookmark per each item of leafTagIDs, tagged with
+// the given leaf tags. Bookmarks get URLs "url1", "url2", etc.
+func makeBookmarks(
+	tx *sql.Tx, si storage.Storage, ownerID int, leafTagIDs [][]int,
+) (bkmIDs []int, err error) {
+	for i, tagIDs := range leafTagIDs {
+		bkmID, err := si.CreateBookmark(tx, &storage.BookmarkData{
+			OwnerID: ownerID,
+			URL:     fmt.Sprintf("url%d", i+1),
+			Title:   fmt.Sprintf("title%d", i+1),
+			Comment: fmt.Sprintf("comment%d", i+1),
+		})
+		if err != nil {
+			return nil, errors.Annotatef(err, "creating bookmark")
+		}
+
+		err = si.SetTaggings(tx, bkmID, tagIDs, storage.TaggingModeLeafs)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+
+		bkmIDs = append(bkmIDs, bkmID)
+	}
+
+	return bkmIDs, nil
+}
+
+func testTaggings(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return si.Tx(func(tx *sql.Tx) error {
+		ids, err := makeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkmIDs, err := makeBookmarks(tx, si, u1ID, [][]int{{ids.tag6ID, ids.tag4ID}})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		bkmID := bkmIDs[0]
+
+		// All supertags are tagged as well
+		if err := expectTaggings(
+			tx, si, bkmID, storage.TaggingModeAll,
+			[]int{ids.rootTagID, ids.tag1ID, ids.tag3ID, ids.tag4ID, ids.tag5ID, ids.tag6ID},
+		); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectTaggings(
+			tx, si, bkmID, storage.TaggingModeLeafs, []int{ids.tag4ID, ids.tag6ID},
+		); err != nil {
+			return errors.Trace(err)
+		}
+
+		// Leafs mode: supertags given explicitly are just ignored
+		err = si.SetTaggings(
+			tx, bkmID, []int{ids.tag1ID, ids.tag3ID, ids.tag8ID}, storage.TaggingModeLeafs,
+		)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectTaggings(
+			tx, si, bkmID, storage.TaggingModeAll,
+			[]int{ids.rootTagID, ids.tag1ID, ids.tag3ID, ids.tag7ID, ids.tag8ID},
+		); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectTaggings(
+			tx, si, bkmID, storage.TaggingModeLeafs, []int{ids.tag3ID, ids.tag8ID},
+		); err != nil {
+			return errors.Trace(err)
+		}
+
+		// Untag completely
+		if err := si.SetTaggings(tx, bkmID, []int{}, storage.TaggingModeLeafs); err != nil {
+			return errors.Trace(err)
+		}
+
+		return errors.Trace(expectTaggings(tx, si, bkmID, storage.TaggingModeAll, []int{}))
+	})
+}
+
+func testTaggedTaggableIDs(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	u2ID, err := createUser(si, "test2", "2@2.2")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return si.Tx(func(tx *sql.Tx) error {
+		ids, err := makeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		u2IDs, err := makeTagsHierarchy(tx, si, u2ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkmIDs, err := makeBookmarks(tx, si, u1ID, [][]int{
+			{ids.tag3ID, ids.tag8ID},
+			{ids.tag1ID},
+			{},
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		u2BkmIDs, err := makeBookmarks(tx, si, u2ID, [][]int{{u2IDs.tag3ID}})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// A note sharing tag7 with the first bookmark
+		noteID, err := si.CreateNote(tx, &storage.NoteData{
+			OwnerID: u1ID,
+			Title:   "note1",
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = si.SetTaggings(tx, noteID, []int{ids.tag7ID}, storage.TaggingModeLeafs)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		cases := []struct {
+			tagIDs   []int
+			ownerID  *int
+			ttypes   []storage.TaggableType
+			expected []int
+		}{
+			{[]int{ids.tag3ID}, nil, nil, []int{bkmIDs[0]}},
+			{[]int{ids.tag1ID}, nil, nil, []int{bkmIDs[0], bkmIDs[1]}},
+			{[]int{ids.tag1ID, ids.tag3ID}, &u1ID, nil, []int{bkmIDs[0]}},
+			{
+				[]int{ids.tag1ID, ids.tag3ID}, nil,
+				[]storage.TaggableType{storage.TaggableTypeBookmark}, []int{bkmIDs[0]},
+			},
+			{[]int{ids.tag1ID, ids.tag3ID, ids.tag8ID}, nil, nil, []int{bkmIDs[0]}},
+			{[]int{ids.tag1ID, ids.tag2ID}, nil, nil, []int{}},
+			{[]int{ids.rootTagID}, nil, nil, []int{bkmIDs[0], bkmIDs[1], noteID}},
+			{[]int{ids.tag7ID}, nil, nil, []int{bkmIDs[0], noteID}},
+			{
+				[]int{ids.tag7ID}, nil,
+				[]storage.TaggableType{storage.TaggableTypeBookmark}, []int{bkmIDs[0]},
+			},
+			{
+				[]int{ids.tag7ID}, &u1ID,
+				[]storage.TaggableType{storage.TaggableTypeNote}, []int{noteID},
+			},
+			{
+				[]int{ids.tag7ID}, nil,
+				[]storage.TaggableType{storage.TaggableTypeBookmark, storage.TaggableTypeNote},
+				[]int{bkmIDs[0], noteID},
+			},
+			{[]int{u2IDs.tag3ID}, &u2ID, nil, u2BkmIDs},
+			// No tags at all: untagged taggables of the owner
+			{[]int{}, &u1ID, nil, []int{bkmIDs[2]}},
+		}
+
+		for i, c := range cases {
+			got, err := si.GetTaggedTaggableIDs(tx, c.tagIDs, c.ownerID, c.ttypes)
+			if err != nil {
+				return errors.Trace(err)
+			}
+			if err := checkIDs(got, c.expected); err != nil {
+				return errors.Annotatef(err, "case #%d (tags %v)", i, c.tagIDs)
+			}
+		}
+
+		return nil
+	})
+}
+
+// tagPaths returns tag paths of the bookmark as ids, sorted by the last id
+func tagPaths(bkm *storage.BookmarkDataWTags) [][]int {
+	ret := [][]int{}
+	for _, tp := range bkm.Tags {
+		path := []int{}
+		for _, item := range tp.TagItems {
+			path = append(path, item.ID)
+		}
+		ret = append(ret, path)
+	}
+
+	sort.Slice(ret, func(i, j int) bool {
+		if len(ret[i]) == 0 || len(ret[j]) == 0 {
+			return len(ret[i]) < len(ret[j])
+		}
+		return ret[i][len(ret[i])-1] < ret[j][len(ret[j])-1]
+	})
+
+	return ret
+}
+
+func testBookmarkTagPaths(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return si.Tx(func(tx *sql.Tx) error {
+		ids, err := makeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkmIDs, err := makeBookmarks(tx, si, u1ID, [][]int{{ids.tag4ID, ids.tag8ID}})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkms, err := si.GetTaggedBookmarks(tx, []int{ids.tag3ID}, &u1ID, nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(bkms) != 1 {
+			return errors.Errorf("should get 1 bookmark, got %d", len(bkms))
+		}
+
+		bkm := &bkms[0]
+		if bkm.ID != bkmIDs[0] || bkm.OwnerID != u1ID || bkm.URL != "url1" ||
+			bkm.Title != "title1" || bkm.Comment != "comment1" {
+			return errors.Errorf("unexpected bookmark data: %+v", bkm.BookmarkData)
+		}
+
+		// By default, only leaf tags are fetched, and every path goes from the
+		// root tag (with an empty name) down to the leaf, with primary names.
+		item := func(id int, name string) storage.BookmarkTagPathItem {
+			return storage.BookmarkTagPathItem{ID: id, Name: name}
+		}
+		expectedItems := [][]storage.BookmarkTagPathItem{
+			{item(ids.rootTagID, ""), item(ids.tag1ID, "tag1"), item(ids.tag3ID, "tag3"), item(ids.tag4ID, "tag4_alias")},
+			{item(ids.rootTagID, ""), item(ids.tag7ID, "tag7"), item(ids.tag8ID, "tag8")},
+		}
+		gotItems := [][]storage.BookmarkTagPathItem{}
+		for _, tp := range bkm.Tags {
+			gotItems = append(gotItems, tp.TagItems)
+		}
+		sort.Slice(gotItems, func(i, j int) bool {
+			return gotItems[i][len(gotItems[i])-1].ID < gotItems[j][len(gotItems[j])-1].ID
+		})
+		if !reflect.DeepEqual(gotItems, expectedItems) {
+			return errors.Errorf("tag paths: expected %v, got %v", expectedItems, gotItems)
+		}
+
+		// All tags
+		bkm, err = si.GetBookmarkByID(tx, bkmIDs[0], &storage.TagsFetchOpts{
+			TagsFetchMode:     storage.TagsFetchModeAll,
+			TagNamesFetchMode: storage.TagNamesFetchModeFull,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		expectedPaths := [][]int{
+			{ids.rootTagID},
+			{ids.rootTagID, ids.tag1ID},
+			{ids.rootTagID, ids.tag1ID, ids.tag3ID},
+			{ids.rootTagID, ids.tag1ID, ids.tag3ID, ids.tag4ID},
+			{ids.rootTagID, ids.tag7ID},
+			{ids.rootTagID, ids.tag7ID, ids.tag8ID},
+		}
+		if got := tagPaths(bkm); !reflect.DeepEqual(got, expectedPaths) {
+			return errors.Errorf("all tag paths: expected %v, got %v", expectedPaths, got)
+		}
+
+		// No names: paths are there, but empty
+		bkms, err = si.GetBookmarksByURL(tx, "url1", u1ID, &storage.TagsFetchOpts{
+			TagsFetchMode:     storage.TagsFetchModeLeafs,
+			TagNamesFetchMode: storage.TagNamesFetchModeNone,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(bkms) != 1 || len(bkms[0].Tags) != 2 ||
+			len(bkms[0].Tags[0].TagItems) != 0 || len(bkms[0].Tags[1].TagItems) != 0 {
+			return errors.Errorf("unexpected bookmarks: %+v", bkms)
+		}
+
+		// No tags
+		bkm, err = si.GetBookmarkByID(tx, bkmIDs[0], &storage.TagsFetchOpts{
+			TagsFetchMode: storage.TagsFetchModeNone,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(bkm.Tags) != 0 {
+			return errors.Errorf("should get no tags, got %+v", bkm.Tags)
+		}
+
+		_, err = si.GetBookmarkByID(tx, bkmIDs[0]+100, nil)
+		if errors.Cause(err) != storage.ErrBookmarkDoesNotExist {
+			return errors.Errorf("expected ErrBookmarkDoesNotExist, got %v", err)
+		}
+
+		return nil
+	})
+}
+
+func testUpdateBookmark(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return si.Tx(func(tx *sql.Tx) error {
+		ids, err := makeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkmIDs, err := makeBookmarks(tx, si, u1ID, [][]int{{ids.tag2ID}, {}})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = si.UpdateBookmark(tx, &storage.BookmarkData{
+			ID:      bkmIDs[0],
+			URL:     "url1_new",
+			Title:   "title1_new",
+			Comment: "comment1_new",
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkm, err := si.GetBookmarkByID(tx, bkmIDs[0], nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if bkm.URL != "url1_new" || bkm.Title != "title1_new" || bkm.Comment != "comment1_new" {
+			return errors.Errorf("bookmark was not updated: %+v", bkm.BookmarkData)
+		}
+		if bkm.UpdatedAt < bkm.CreatedAt {
+			return errors.Errorf("updated_at (%d) is before created_at (%d)", bkm.UpdatedAt, bkm.CreatedAt)
+		}
+
+		// Deleting a bookmark deletes its taggings as well
+		if err := si.DeleteTaggable(tx, bkmIDs[0]); err != nil {
+			return errors.Trace(err)
+		}
+
+		tgbIDs, err := si.GetTaggedTaggableIDs(tx, []int{ids.rootTagID}, &u1ID, nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if err := checkIDs(tgbIDs, []int{}); err != nil {
+			return errors.Trace(err)
+		}
+
+		_, err = si.GetBookmarkByID(tx, bkmIDs[0], nil)
+		if errors.Cause(err) != storage.ErrBookmarkDoesNotExist {
+			return errors.Errorf("expected ErrBookmarkDoesNotExist, got %v", err)
+		}
+
+		return nil
+	})
+}
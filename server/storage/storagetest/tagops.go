@@ -0,0 +1,166 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package storagetest
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/juju/errors"
+)
+
+func testTagOperations(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	u2ID, err := createUser(si, "test2", "2@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return si.Tx(func(tx *sql.Tx) error {
+		ids, err := makeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		tag, err := si.GetTag(tx, ids.tag3ID, &storage.GetTagOpts{
+			GetNames:   true,
+			GetSubtags: true,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		ops := []storage.TagOperationData{
+			{
+				OwnerID: u1ID,
+				Kind:    storage.TagOperationCreate,
+				TagID:   ids.tag3ID,
+			},
+			{
+				OwnerID:  u1ID,
+				Kind:     storage.TagOperationDelete,
+				TagID:    ids.tag3ID,
+				Tag:      tag,
+				Taggings: map[int][]int{10: {ids.tag1ID, ids.tag3ID}, 11: {}},
+			},
+			{
+				OwnerID: u1ID,
+				Kind:    storage.TagOperationUpdate,
+				TagID:   ids.tag2ID,
+				Tag:     &storage.TagData{ID: ids.tag2ID, Names: []string{"foo"}},
+			},
+		}
+
+		for i := range ops {
+			ops[i].ID, err = si.SaveTagOperation(tx, &ops[i])
+			if err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		// Operations of another user are not returned
+		_, err = si.SaveTagOperation(tx, &storage.TagOperationData{
+			OwnerID: u2ID,
+			Kind:    storage.TagOperationCreate,
+			TagID:   ids.tag1ID,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// The most recent operation goes first
+		got, err := si.GetTagOperations(tx, u1ID, 2)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		for i := range got {
+			if got[i].CreatedAt == 0 {
+				return errors.Errorf("creation time is not set: %+v", got[i])
+			}
+			got[i].CreatedAt = 0
+		}
+		expected := []storage.TagOperationData{ops[2], ops[1]}
+		if !reflect.DeepEqual(got, expected) {
+			return errors.Errorf("tag operations: expected %+v, got %+v", expected, got)
+		}
+
+		// Purge all but the latest two operations
+		purgedCnt, err := si.PurgeTagOperations(tx, u1ID, 2)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if purgedCnt != 1 {
+			return errors.Errorf("purged count: expected 1, got %d", purgedCnt)
+		}
+
+		if err := si.DeleteTagOperation(tx, ops[2].ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		got, err = si.GetTagOperations(tx, u1ID, 10)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(got) != 1 || got[0].ID != ops[1].ID {
+			return errors.Errorf("should be only operation %d, got %+v", ops[1].ID, got)
+		}
+
+		got, err = si.GetTagOperations(tx, u2ID, 10)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(got) != 1 {
+			return errors.Errorf("user2 should have 1 operation, got %+v", got)
+		}
+
+		return nil
+	})
+}
+
+func testRestoreTag(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return si.Tx(func(tx *sql.Tx) error {
+		ids, err := makeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		opts := &storage.GetTagOpts{GetNames: true, GetSubtags: true}
+
+		tag3, err := si.GetTag(tx, ids.tag3ID, opts)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := si.DeleteTag(tx, ids.tag3ID, storage.TaggableLeafPolicyKeep); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := si.RestoreTag(tx, tag3); err != nil {
+			return errors.Trace(err)
+		}
+
+		// The whole subtree is restored, with the same ids
+		restored, err := si.GetTag(tx, ids.tag3ID, opts)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if !reflect.DeepEqual(restored, tag3) {
+			return errors.Errorf("restored tag: expected %+v, got %+v", tag3, restored)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,582 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package storagetest
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/juju/errors"
+)
+
+type tagIDs struct {
+	rootTagID, tag1ID, tag2ID, tag3ID, tag4ID, tag5ID, tag6ID, tag7ID, tag8ID int
+}
+
+// makeTagsHierarchy creates the following tag hierarchy for the given user:
+// /
+// ├── tag1
+// │   └── tag3
+// │       ├── tag4
+// │       └── tag5
+// │           └── tag6
+// ├── tag2
+// └── tag7
+//     └── tag8
+func makeTagsHierarchy(tx *sql.Tx, si storage.Storage, ownerID int) (ids *tagIDs, err error) {
+	ids = &tagIDs{}
+
+	ids.rootTagID, err = si.GetRootTagID(tx, ownerID)
+	if err != nil {
+		return nil, errors.Annotatef(err, "getting root tag for user %d", ownerID)
+	}
+
+	tags := []struct {
+		id       *int
+		parentID *int
+		names    []string
+	}{
+		{&ids.tag1ID, &ids.rootTagID, []string{"tag1", "tag1_alias"}},
+		{&ids.tag2ID, &ids.rootTagID, []string{"tag2", "tag2_alias"}},
+		{&ids.tag3ID, &ids.tag1ID, []string{"tag3", "tag3_alias"}},
+		{&ids.tag4ID, &ids.tag3ID, []string{"tag4_alias", "tag4"}},
+		{&ids.tag5ID, &ids.tag3ID, []string{"tag5", "tag5_alias"}},
+		{&ids.tag6ID, &ids.tag5ID, []string{"tag6", "tag6_alias"}},
+		{&ids.tag7ID, &ids.rootTagID, []string{"tag7", "tag7_alias"}},
+		{&ids.tag8ID, &ids.tag7ID, []string{"tag8", "tag8_alias"}},
+	}
+
+	for _, tag := range tags {
+		*tag.id, err = si.CreateTag(tx, &storage.TagData{
+			OwnerID:     ownerID,
+			ParentTagID: cptr.Int(*tag.parentID),
+			Description: cptr.String("test tag"),
+			Names:       tag.names,
+		})
+		if err != nil {
+			return nil, errors.Annotatef(err, "creating %s for user %d", tag.names[0], ownerID)
+		}
+	}
+
+	return ids, nil
+}
+
+func expectPath(tx *sql.Tx, si storage.Storage, userID int, path string, expectedID int) error {
+	tagID, err := si.GetTagIDByPath(tx, userID, path)
+	if err != nil {
+		return errors.Annotatef(err, "getting tag id by path %q for user %d", path, userID)
+	}
+	if tagID != expectedID {
+		return errors.Errorf(
+			"GetTagIDByPath(%d, %q) should return %d, but got %d",
+			userID, path, expectedID, tagID,
+		)
+	}
+	return nil
+}
+
+func expectPathNotFound(tx *sql.Tx, si storage.Storage, userID int, path string) error {
+	tagID, err := si.GetTagIDByPath(tx, userID, path)
+	if errors.Cause(err) != storage.ErrTagDoesNotExist {
+		return errors.Errorf(
+			"cause of the error returned by GetTagIDByPath(%d, %q) should be ErrTagDoesNotExist, but got %v, and returned id %d",
+			userID, path, errors.Cause(err), tagID,
+		)
+	}
+	return nil
+}
+
+func testGetTagIDByPath(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+	u2ID, err := createUser(si, "test2", "2@2.2")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return si.Tx(func(tx *sql.Tx) error {
+		u1TagIDs, err := makeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Annotatef(err, "creating test tags hierarchy for user1")
+		}
+
+		u2TagIDs, err := makeTagsHierarchy(tx, si, u2ID)
+		if err != nil {
+			return errors.Annotatef(err, "creating test tags hierarchy for user2")
+		}
+
+		paths := []struct {
+			path string
+			id   int
+		}{
+			{"/tag1/tag3/tag5/tag6", u1TagIDs.tag6ID},
+			{"tag1/tag3/tag5/tag6", u1TagIDs.tag6ID},
+			{"tag1/tag3_alias/tag5/tag6_alias", u1TagIDs.tag6ID},
+			{"/tag1/tag3/tag5", u1TagIDs.tag5ID},
+			{"/tag1/tag3/", u1TagIDs.tag3ID},
+			{"tag1", u1TagIDs.tag1ID},
+			{"", u1TagIDs.rootTagID},
+			{"/", u1TagIDs.rootTagID},
+		}
+
+		for _, p := range paths {
+			if err := expectPath(tx, si, u1ID, p.path, p.id); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		if err := expectPathNotFound(tx, si, u1ID, "/tag2/tag3"); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectPath(tx, si, u2ID, "/tag1/tag3/tag5/tag6", u2TagIDs.tag6ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		id, err := si.GetTagIDByName(tx, u1TagIDs.tag3ID, "tag5_alias")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if id != u1TagIDs.tag5ID {
+			return errors.Errorf("GetTagIDByName: expected %d, got %d", u1TagIDs.tag5ID, id)
+		}
+
+		return nil
+	})
+}
+
+func testGetTags(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return si.Tx(func(tx *sql.Tx) error {
+		ids, err := makeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Annotatef(err, "creating test tags hierarchy for user1")
+		}
+
+		mkTag := func(id, parentID int, names []string, subtags []storage.TagData) storage.TagData {
+			return storage.TagData{
+				ID:          id,
+				OwnerID:     u1ID,
+				ParentTagID: cptr.Int(parentID),
+				Description: cptr.String("test tag"),
+				Names:       names,
+				Subtags:     subtags,
+			}
+		}
+
+		// Subtags are ordered by the primary name, and the names of every tag
+		// go in the order they were given, i.e. the primary name first.
+		expected := []storage.TagData{
+			mkTag(ids.tag1ID, ids.rootTagID, []string{"tag1", "tag1_alias"}, []storage.TagData{
+				mkTag(ids.tag3ID, ids.tag1ID, []string{"tag3", "tag3_alias"}, []storage.TagData{
+					mkTag(ids.tag4ID, ids.tag3ID, []string{"tag4_alias", "tag4"}, nil),
+					mkTag(ids.tag5ID, ids.tag3ID, []string{"tag5", "tag5_alias"}, []storage.TagData{
+						mkTag(ids.tag6ID, ids.tag5ID, []string{"tag6", "tag6_alias"}, nil),
+					}),
+				}),
+			}),
+			mkTag(ids.tag2ID, ids.rootTagID, []string{"tag2", "tag2_alias"}, nil),
+			mkTag(ids.tag7ID, ids.rootTagID, []string{"tag7", "tag7_alias"}, []storage.TagData{
+				mkTag(ids.tag8ID, ids.tag7ID, []string{"tag8", "tag8_alias"}, nil),
+			}),
+		}
+
+		tagsData, err := si.GetTags(tx, ids.rootTagID, &storage.GetTagOpts{
+			GetNames:   true,
+			GetSubtags: true,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if !reflect.DeepEqual(tagsData, expected) {
+			return errors.Errorf("GetTags: expected %+v, got %+v", expected, tagsData)
+		}
+
+		// Root tag: no parent, one empty name
+		root, err := si.GetTag(tx, ids.rootTagID, &storage.GetTagOpts{GetNames: true})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if root.ParentTagID == nil || *root.ParentTagID != 0 ||
+			!reflect.DeepEqual(root.Names, []string{""}) || root.Subtags != nil {
+			return errors.Errorf("unexpected root tag: %+v", root)
+		}
+
+		_, err = si.GetTag(tx, ids.tag8ID+100, &storage.GetTagOpts{})
+		if errors.Cause(err) != storage.ErrTagDoesNotExist {
+			return errors.Errorf("expected ErrTagDoesNotExist, got %v", err)
+		}
+
+		return nil
+	})
+}
+
+func testInvalidTagNames(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var rootTagID int
+	err = si.Tx(func(tx *sql.Tx) error {
+		var err error
+		rootTagID, err = si.GetRootTagID(tx, u1ID)
+		return errors.Annotatef(err, "getting root tag for user %d", u1ID)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	invalidNames := []string{
+		"123", "foo bar", "foo\tbar", "foo,bar", "foo/bar", "-foo", "",
+		string([]byte{'a', 0x01, 'b', 'c'}),
+	}
+
+	for _, name := range invalidNames {
+		err = si.Tx(func(tx *sql.Tx) error {
+			_, err = si.CreateTag(tx, &storage.TagData{
+				OwnerID:     u1ID,
+				ParentTagID: cptr.Int(rootTagID),
+				Names:       []string{name},
+			})
+			return errors.Trace(err)
+		})
+		if err == nil || errors.Cause(err) != storage.ErrTagNameInvalid {
+			return errors.Errorf("should not be able to create tag with the name %q", name)
+		}
+	}
+
+	return nil
+}
+
+func testDuplicateTagNames(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var ids *tagIDs
+	err = si.Tx(func(tx *sql.Tx) error {
+		var err error
+		ids, err = makeTagsHierarchy(tx, si, u1ID)
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// Either the primary name or an alias of the existing sibling
+	for _, name := range []string{"tag4", "tag4_alias"} {
+		err = si.Tx(func(tx *sql.Tx) error {
+			_, err := si.CreateTag(tx, &storage.TagData{
+				OwnerID:     u1ID,
+				ParentTagID: cptr.Int(ids.tag3ID),
+				Names:       []string{"foo", name},
+			})
+			return errors.Trace(err)
+		})
+		if err == nil {
+			return errors.Errorf("should not be able to create two tags named %q under the same parent", name)
+		}
+	}
+
+	// Adding a sibling's name to an existing tag
+	err = si.Tx(func(tx *sql.Tx) error {
+		return si.UpdateTag(tx, &storage.TagData{
+			ID:    ids.tag5ID,
+			Names: []string{"tag5", "tag4"},
+		}, storage.TaggableLeafPolicyKeep)
+	})
+	if err == nil {
+		return errors.Errorf("should not be able to add a name of the sibling tag")
+	}
+
+	// Under a different parent, the same name is fine
+	return si.Tx(func(tx *sql.Tx) error {
+		_, err := si.CreateTag(tx, &storage.TagData{
+			OwnerID:     u1ID,
+			ParentTagID: cptr.Int(ids.tag2ID),
+			Names:       []string{"tag1", "tag3"},
+		})
+		return errors.Trace(err)
+	})
+}
+
+func testPrimaryTagNames(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return si.Tx(func(tx *sql.Tx) error {
+		ids, err := makeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		steps := [][]string{
+			// Make an alias primary
+			{"tag3_alias", "tag3"},
+			// Add a new primary name
+			{"tag3_new", "tag3_alias", "tag3"},
+			// Delete the current primary name
+			{"tag3"},
+			// Replace all names
+			{"tag3_foo", "tag3_bar"},
+		}
+
+		for _, names := range steps {
+			err := si.UpdateTag(tx, &storage.TagData{
+				ID:    ids.tag3ID,
+				Names: names,
+			}, storage.TaggableLeafPolicyKeep)
+			if err != nil {
+				return errors.Annotatef(err, "setting names %v", names)
+			}
+
+			got, err := si.GetTagNames(tx, ids.tag3ID)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			// Only the primary name is guaranteed to be the first one
+			if len(got) != len(names) || got[0] != names[0] {
+				return errors.Errorf("names: expected %v, got %v", names, got)
+			}
+			if err := expectPath(tx, si, u1ID, "/tag1/"+names[len(names)-1], ids.tag3ID); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		if err := expectPathNotFound(tx, si, u1ID, "/tag1/tag3"); err != nil {
+			return errors.Trace(err)
+		}
+
+		err = si.UpdateTag(tx, &storage.TagData{
+			ID:    ids.tag3ID,
+			Names: []string{},
+		}, storage.TaggableLeafPolicyKeep)
+		if err == nil {
+			return errors.Errorf("should not be able to delete all names of a tag")
+		}
+
+		// Description only: names should be left intact
+		err = si.UpdateTag(tx, &storage.TagData{
+			ID:          ids.tag3ID,
+			Description: cptr.String("new descr"),
+		}, storage.TaggableLeafPolicyKeep)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		td, err := si.GetTag(tx, ids.tag3ID, &storage.GetTagOpts{GetNames: true})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if *td.Description != "new descr" || td.Names[0] != "tag3_foo" {
+			return errors.Errorf("unexpected tag data: %+v", td)
+		}
+
+		return nil
+	})
+}
+
+func testMoveTagLeafPolicyKeep(t *testing.T, si storage.Storage) error {
+	return testMoveTag(si, storage.TaggableLeafPolicyKeep)
+}
+
+func testMoveTagLeafPolicyDel(t *testing.T, si storage.Storage) error {
+	return testMoveTag(si, storage.TaggableLeafPolicyDel)
+}
+
+// testMoveTag tags bookmarks, moves tag3 (with all its subtags) under tag2,
+// and checks how the taggings changed.
+func testMoveTag(si storage.Storage, leafPolicy storage.TaggableLeafPolicy) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return si.Tx(func(tx *sql.Tx) error {
+		ids, err := makeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkmIDs, err := makeBookmarks(tx, si, u1ID, [][]int{
+			// bkm1: tag1 becomes a new leaf after the move
+			{ids.tag6ID},
+			// bkm2: tag1 becomes a new leaf as well, even though it was tagged
+			// explicitly: taggings don't keep track of that
+			{ids.tag1ID, ids.tag4ID},
+			// bkm3: not affected
+			{ids.tag8ID},
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = si.UpdateTag(tx, &storage.TagData{
+			ID:          ids.tag3ID,
+			ParentTagID: cptr.Int(ids.tag2ID),
+		}, leafPolicy)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectPath(tx, si, u1ID, "/tag2/tag3/tag5/tag6", ids.tag6ID); err != nil {
+			return errors.Trace(err)
+		}
+		if err := expectPathNotFound(tx, si, u1ID, "/tag1/tag3"); err != nil {
+			return errors.Trace(err)
+		}
+
+		expected := [][]int{
+			{ids.rootTagID, ids.tag2ID, ids.tag3ID, ids.tag5ID, ids.tag6ID},
+			{ids.rootTagID, ids.tag2ID, ids.tag3ID, ids.tag4ID},
+			{ids.rootTagID, ids.tag7ID, ids.tag8ID},
+		}
+		if leafPolicy == storage.TaggableLeafPolicyKeep {
+			expected[0] = append(expected[0], ids.tag1ID)
+			expected[1] = append(expected[1], ids.tag1ID)
+		}
+
+		for i, bkmID := range bkmIDs {
+			if err := expectTaggings(tx, si, bkmID, storage.TaggingModeAll, expected[i]); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		return nil
+	})
+}
+
+func testMoveTagUnderItself(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var ids *tagIDs
+	err = si.Tx(func(tx *sql.Tx) error {
+		var err error
+		ids, err = makeTagsHierarchy(tx, si, u1ID)
+		return errors.Trace(err)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	for _, parentID := range []int{ids.tag3ID, ids.tag6ID} {
+		err = si.Tx(func(tx *sql.Tx) error {
+			return si.UpdateTag(tx, &storage.TagData{
+				ID:          ids.tag3ID,
+				ParentTagID: cptr.Int(parentID),
+			}, storage.TaggableLeafPolicyKeep)
+		})
+		if err == nil {
+			return errors.Errorf("should not be able to move tag %d under %d", ids.tag3ID, parentID)
+		}
+	}
+
+	return nil
+}
+
+func testDeleteTag(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return si.Tx(func(tx *sql.Tx) error {
+		ids, err := makeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkmIDs, err := makeBookmarks(tx, si, u1ID, [][]int{
+			{ids.tag6ID},
+			{ids.tag6ID, ids.tag8ID},
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// Delete tag3 with all its subtags: tag1 becomes a leaf, and it's kept
+		if err := si.DeleteTag(tx, ids.tag3ID, storage.TaggableLeafPolicyKeep); err != nil {
+			return errors.Trace(err)
+		}
+
+		for _, path := range []string{"/tag1/tag3", "/tag1/tag3/tag5/tag6"} {
+			if err := expectPathNotFound(tx, si, u1ID, path); err != nil {
+				return errors.Trace(err)
+			}
+		}
+
+		if err := expectTaggings(
+			tx, si, bkmIDs[0], storage.TaggingModeAll, []int{ids.rootTagID, ids.tag1ID},
+		); err != nil {
+			return errors.Trace(err)
+		}
+
+		// Delete tag1: bkm1 was tagged with tag1 only, so it becomes untagged
+		if err := si.DeleteTag(tx, ids.tag1ID, storage.TaggableLeafPolicyKeep); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectTaggings(tx, si, bkmIDs[0], storage.TaggingModeAll, []int{}); err != nil {
+			return errors.Trace(err)
+		}
+
+		if err := expectTaggings(
+			tx, si, bkmIDs[1], storage.TaggingModeAll, []int{ids.rootTagID, ids.tag7ID, ids.tag8ID},
+		); err != nil {
+			return errors.Trace(err)
+		}
+
+		root, err := si.GetTag(tx, ids.rootTagID, &storage.GetTagOpts{
+			GetNames: true, GetSubtags: true,
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(root.Subtags) != 2 {
+			return errors.Errorf("root tag should have 2 subtags, got %+v", root.Subtags)
+		}
+
+		return nil
+	})
+}
+
+func testDeleteRootTag(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return si.Tx(func(tx *sql.Tx) error {
+		rootTagID, err := si.GetRootTagID(tx, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		err = si.DeleteTag(tx, rootTagID, storage.TaggableLeafPolicyKeep)
+		if err == nil {
+			return errors.Errorf("should not be able to delete the root tag")
+		}
+
+		return nil
+	})
+}
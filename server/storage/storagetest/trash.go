@@ -0,0 +1,153 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package storagetest
+
+import (
+	"database/sql"
+	"reflect"
+	"testing"
+	"time"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/juju/errors"
+)
+
+func testTrash(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	u2ID, err := createUser(si, "test2", "2@2.2")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return si.Tx(func(tx *sql.Tx) error {
+		ids, err := makeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkmIDs, err := makeBookmarks(tx, si, u1ID, [][]int{
+			{ids.tag8ID, ids.tag4ID},
+			{},
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkm, err := si.GetBookmarkByID(tx, bkmIDs[0], nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		trashedID1, err := si.TrashBookmark(tx, bkmIDs[0])
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		trashedID2, err := si.TrashBookmark(tx, bkmIDs[1])
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		// The bookmark itself should be deleted
+		_, err = si.GetBookmarkByID(tx, bkmIDs[0], nil)
+		if errors.Cause(err) != storage.ErrBookmarkDoesNotExist {
+			return errors.Errorf("expected ErrBookmarkDoesNotExist, got %v", err)
+		}
+
+		tbkm, err := si.GetTrashedBookmark(tx, trashedID1)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if tbkm.DeletedAt == 0 {
+			return errors.Errorf("deletion time is not set")
+		}
+
+		expected := storage.TrashedBookmarkData{
+			ID:         trashedID1,
+			OwnerID:    u1ID,
+			BookmarkID: bkmIDs[0],
+			CreatedAt:  bkm.CreatedAt,
+			UpdatedAt:  bkm.UpdatedAt,
+			DeletedAt:  tbkm.DeletedAt,
+			URL:        "url1",
+			Title:      "title1",
+			Comment:    "comment1",
+			// Tag paths are sorted, and use primary names
+			TagPaths: []string{"/tag1/tag3/tag4_alias", "/tag7/tag8"},
+		}
+		if !reflect.DeepEqual(*tbkm, expected) {
+			return errors.Errorf("trashed bookmark: expected %+v, got %+v", expected, *tbkm)
+		}
+
+		tbkms, err := si.GetTrashedBookmarks(tx, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		gotIDs := []int{}
+		for _, tb := range tbkms {
+			gotIDs = append(gotIDs, tb.ID)
+		}
+		if err := checkIDs(gotIDs, []int{trashedID1, trashedID2}); err != nil {
+			return errors.Trace(err)
+		}
+
+		if len(tbkms[0].TagPaths) != 0 && len(tbkms[1].TagPaths) != 0 {
+			return errors.Errorf("untagged bookmark should have no tag paths: %+v", tbkms)
+		}
+
+		// Another user's trash is empty
+		tbkms, err = si.GetTrashedBookmarks(tx, u2ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(tbkms) != 0 {
+			return errors.Errorf("trash of user2 should be empty, got %+v", tbkms)
+		}
+
+		// Nothing was deleted before an hour ago
+		n, err := si.PurgeTrash(tx, nil, time.Now().Add(-time.Hour))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if n != 0 {
+			return errors.Errorf("should purge 0 bookmarks, purged %d", n)
+		}
+
+		// Purging another user's trash doesn't affect user1
+		n, err = si.PurgeTrash(tx, cptr.Int(u2ID), time.Now().Add(time.Hour))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if n != 0 {
+			return errors.Errorf("should purge 0 bookmarks, purged %d", n)
+		}
+
+		if err := si.DeleteTrashedBookmark(tx, trashedID2); err != nil {
+			return errors.Trace(err)
+		}
+
+		n, err = si.PurgeTrash(tx, cptr.Int(u1ID), time.Now().Add(time.Hour))
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if n != 1 {
+			return errors.Errorf("should purge 1 bookmark, purged %d", n)
+		}
+
+		_, err = si.GetTrashedBookmark(tx, trashedID1)
+		if errors.Cause(err) != storage.ErrTrashedBookmarkDoesNotExist {
+			return errors.Errorf("expected ErrTrashedBookmarkDoesNotExist, got %v", err)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,248 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package storagetest
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/cptr"
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/juju/errors"
+)
+
+func testTransactionRollback(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	// The first name is fine, but the second one is invalid, so the whole
+	// transaction should be rolled back.
+	err = si.Tx(func(tx *sql.Tx) error {
+		rootTagID, err := si.GetRootTagID(tx, u1ID)
+		if err != nil {
+			return errors.Annotatef(err, "getting root tag for user %d", u1ID)
+		}
+
+		_, err = si.CreateTag(tx, &storage.TagData{
+			OwnerID:     u1ID,
+			ParentTagID: cptr.Int(rootTagID),
+			Description: cptr.String("test tag2"),
+			Names:       []string{"normal_name", "123"},
+		})
+		return errors.Trace(err)
+	})
+	if err == nil || errors.Cause(err) != storage.ErrTagNameInvalid {
+		return errors.Errorf("should not be able to create tag with the name 123")
+	}
+
+	// An error returned from the callback should roll back as well
+	errTest := errors.New("test error")
+	err = si.Tx(func(tx *sql.Tx) error {
+		if _, err := si.CreateUser(tx, &storage.UserData{Username: "test2"}); err != nil {
+			return errors.Trace(err)
+		}
+		return errTest
+	})
+	if errors.Cause(err) != errTest {
+		return errors.Errorf("Tx should return the error from the callback, got %v", err)
+	}
+
+	return si.Tx(func(tx *sql.Tx) error {
+		_, err := si.GetTagIDByPath(tx, u1ID, "normal_name")
+		if errors.Cause(err) != storage.ErrTagDoesNotExist {
+			return errors.Errorf("tag normal_name should not exist, got err: %v", err)
+		}
+
+		_, err = si.GetUser(tx, &storage.GetUserArgs{Username: cptr.String("test2")})
+		if errors.Cause(err) != storage.ErrUserDoesNotExist {
+			return errors.Errorf("user test2 should not exist, got err: %v", err)
+		}
+
+		return nil
+	})
+}
+
+func testTransactionContext(t *testing.T, si storage.Storage) error {
+	// Context which is done from the beginning: the transaction should not
+	// even start
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	called := false
+	err := si.TxCtx(ctx, func(tx *sql.Tx) error {
+		called = true
+		return nil
+	})
+	if err == nil || called {
+		return errors.Errorf("transaction with cancelled context should fail")
+	}
+
+	// Context which is cancelled in the middle of the transaction: further
+	// queries should fail, and the transaction should be rolled back
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	err = si.TxCtx(ctx, func(tx *sql.Tx) error {
+		if _, err := si.CreateUser(tx, &storage.UserData{Username: "test1"}); err != nil {
+			return errors.Trace(err)
+		}
+
+		cancel()
+
+		_, err := si.CreateUser(tx, &storage.UserData{Username: "test2"})
+		return errors.Trace(err)
+	})
+	if err == nil {
+		return errors.Errorf("queries should fail after the context is cancelled")
+	}
+
+	return si.TxCtx(context.Background(), func(tx *sql.Tx) error {
+		users, err := si.GetUsers(tx)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(users) != 0 {
+			return errors.Errorf("expected no users, got %+v", users)
+		}
+
+		return nil
+	})
+}
+
+func testUsers(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if _, err := createUser(si, "test1", "2@2.2"); err == nil {
+		return errors.Errorf("should not be able to create two users with the same username")
+	}
+
+	return si.Tx(func(tx *sql.Tx) error {
+		ud, err := si.GetUser(tx, &storage.GetUserArgs{ID: cptr.Int(u1ID)})
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if ud.ID != u1ID || ud.Username != "test1" || ud.Email != "1@1.1" {
+			return errors.Errorf("unexpected user data: %+v", ud)
+		}
+
+		_, err = si.GetUser(tx, &storage.GetUserArgs{Username: cptr.String("nobody")})
+		if errors.Cause(err) != storage.ErrUserDoesNotExist {
+			return errors.Errorf("expected ErrUserDoesNotExist, got %v", err)
+		}
+
+		// Without createIfNotExist, there should be no token yet
+		if _, err := si.GetAccessToken(tx, u1ID, "test token", false); err == nil {
+			return errors.Errorf("token should not exist yet")
+		}
+
+		token, err := si.GetAccessToken(tx, u1ID, "test token", true)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if token == "" {
+			return errors.Errorf("token should have been created")
+		}
+
+		token2, err := si.GetAccessToken(tx, u1ID, "test token", true)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if token2 != token {
+			return errors.Errorf("existing token %q should be returned, got %q", token, token2)
+		}
+
+		ud, err = si.GetUserByAccessToken(tx, token)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if ud.ID != u1ID {
+			return errors.Errorf("token %q: expected user %d, got %d", token, u1ID, ud.ID)
+		}
+
+		if err := si.CreateGoogleUser(tx, u1ID, "google-id-1", "1@1.1"); err != nil {
+			return errors.Trace(err)
+		}
+
+		ud, err = si.GetUserByGoogleUserID(tx, "google-id-1")
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if ud.ID != u1ID {
+			return errors.Errorf("google user: expected user %d, got %d", u1ID, ud.ID)
+		}
+
+		users, err := si.GetUsers(tx)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(users) != 1 || users[0].ID != u1ID {
+			return errors.Errorf("unexpected users: %+v", users)
+		}
+
+		return nil
+	})
+}
+
+func testDeleteUser(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	u2ID, err := createUser(si, "test2", "2@2.2")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	var u2Tags *tagIDs
+	err = si.Tx(func(tx *sql.Tx) error {
+		if _, err := makeTagsHierarchy(tx, si, u1ID); err != nil {
+			return errors.Trace(err)
+		}
+
+		u2Tags, err = makeTagsHierarchy(tx, si, u2ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		if _, err := si.CreateBookmark(tx, &storage.BookmarkData{
+			OwnerID: u1ID,
+			URL:     "url1",
+		}); err != nil {
+			return errors.Trace(err)
+		}
+
+		return si.DeleteUser(tx, u1ID)
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return si.Tx(func(tx *sql.Tx) error {
+		_, err := si.GetUser(tx, &storage.GetUserArgs{ID: cptr.Int(u1ID)})
+		if errors.Cause(err) != storage.ErrUserDoesNotExist {
+			return errors.Errorf("expected ErrUserDoesNotExist, got %v", err)
+		}
+
+		bkms, err := si.GetBookmarksByURL(tx, "url1", u1ID, nil)
+		if err != nil {
+			return errors.Trace(err)
+		}
+		if len(bkms) != 0 {
+			return errors.Errorf("bookmarks of the deleted user should be deleted, got %+v", bkms)
+		}
+
+		// Other user's data should be intact
+		return errors.Trace(
+			expectPath(tx, si, u2ID, "/tag1/tag3/tag5/tag6", u2Tags.tag6ID),
+		)
+	})
+}
@@ -0,0 +1,117 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+package storagetest
+
+import (
+	"database/sql"
+	"testing"
+
+	"dmitryfrank.com/geekmarks/server/storage"
+
+	"github.com/juju/errors"
+)
+
+func testBookmarkViews(t *testing.T, si storage.Storage) error {
+	u1ID, err := createUser(si, "test1", "1@1.1")
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	return si.Tx(func(tx *sql.Tx) error {
+		ids, err := makeTagsHierarchy(tx, si, u1ID)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		bkmsTagIDs := [][]int{
+			{ids.tag3ID},
+			{ids.tag4ID},
+			{ids.tag3ID, ids.tag8ID},
+			{ids.tag1ID, ids.tag7ID},
+			nil,
+			// Will be tagged with the root tag only
+			nil,
+		}
+
+		bkmIDs := []int{}
+		for i, tagIDs := range bkmsTagIDs {
+			bkmID, err := si.CreateBookmark(tx, &storage.BookmarkData{
+				OwnerID: u1ID,
+				URL:     "http://example.com/" + string(rune('a'+i)),
+			})
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			err = si.SetTaggings(tx, bkmID, tagIDs, storage.TaggingModeLeafs)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			bkmIDs = append(bkmIDs, bkmID)
+		}
+
+		// Tagging with the root tag only is an integrity violation, but such
+		// bookmarks should still be considered untagged
+		err = si.SetTaggings(tx, bkmIDs[5], []int{ids.rootTagID}, storage.TaggingModeAll)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		b := bkmIDs
+		cases := []struct {
+			args     storage.GetBookmarksArgs
+			expected []int
+		}{
+			{
+				storage.GetBookmarksArgs{TagIDs: []int{ids.tag3ID}},
+				[]int{b[0], b[1], b[2]},
+			},
+			{
+				storage.GetBookmarksArgs{TagIDs: []int{ids.tag3ID}, DirectlyTagged: true},
+				[]int{b[0], b[2]},
+			},
+			{
+				storage.GetBookmarksArgs{TagIDs: []int{ids.tag1ID}, DirectlyTagged: true},
+				[]int{b[3]},
+			},
+			{
+				storage.GetBookmarksArgs{
+					TagIDs: []int{ids.tag3ID, ids.tag7ID}, DirectlyTagged: true,
+				},
+				[]int{},
+			},
+			{
+				storage.GetBookmarksArgs{Untagged: true},
+				[]int{b[4], b[5]},
+			},
+		}
+
+		for _, c := range cases {
+			args := c.args
+			args.OwnerID = u1ID
+			got, _, err := si.GetBookmarks(tx, &args, nil)
+			if err != nil {
+				return errors.Trace(err)
+			}
+
+			gotIDs := []int{}
+			for _, bkm := range got {
+				gotIDs = append(gotIDs, bkm.ID)
+			}
+
+			if err := checkIDs(gotIDs, c.expected); err != nil {
+				return errors.Annotatef(err, "args %+v", c.args)
+			}
+		}
+
+		// Fix the integrity violation made above
+		err = si.SetTaggings(tx, bkmIDs[5], nil, storage.TaggingModeAll)
+		if err != nil {
+			return errors.Trace(err)
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,235 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// Package tagexpr parses boolean expressions over tags, like
+// "(work/go | personal/go) & !archived".
+//
+// Operators are "!" (not), "&" (and) and "|" (or), in the order of
+// decreasing precedence; parentheses can be used for grouping. Operands are
+// tag paths or names; an operand which contains spaces or operator
+// characters should be quoted with double quotes.
+package tagexpr // import "dmitryfrank.com/geekmarks/server/tagexpr"
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/juju/errors"
+)
+
+const (
+	// Max length of the expression string
+	maxExprLen = 1000
+)
+
+type Op string
+
+const (
+	OpTag Op = "tag"
+	OpAnd Op = "and"
+	OpOr  Op = "or"
+	OpNot Op = "not"
+)
+
+// Expr is a node of the parsed expression.
+type Expr struct {
+	Op Op
+	// Tag is a tag path or name, for OpTag only
+	Tag string
+	// Args are the operands: one for OpNot, two or more for OpAnd and OpOr
+	Args []*Expr
+}
+
+// String returns the expression with all the operations parenthesized,
+// mostly for testing and error messages.
+func (e *Expr) String() string {
+	switch e.Op {
+	case OpTag:
+		if strings.IndexFunc(e.Tag, isSpecial) >= 0 {
+			return `"` + e.Tag + `"`
+		}
+		return e.Tag
+	case OpNot:
+		return "!" + e.Args[0].String()
+	}
+
+	sep := " & "
+	if e.Op == OpOr {
+		sep = " | "
+	}
+
+	parts := []string{}
+	for _, arg := range e.Args {
+		parts = append(parts, arg.String())
+	}
+
+	return "(" + strings.Join(parts, sep) + ")"
+}
+
+// Tags returns all the distinct tag operands of the expression, in the order
+// of appearance.
+func (e *Expr) Tags() []string {
+	tags := []string{}
+	seen := map[string]bool{}
+
+	var walk func(e *Expr)
+	walk = func(e *Expr) {
+		if e.Op == OpTag {
+			if !seen[e.Tag] {
+				seen[e.Tag] = true
+				tags = append(tags, e.Tag)
+			}
+			return
+		}
+		for _, arg := range e.Args {
+			walk(arg)
+		}
+	}
+	walk(e)
+
+	return tags
+}
+
+// Parse parses the expression string.
+func Parse(s string) (*Expr, error) {
+	if len(s) > maxExprLen {
+		return nil, errors.Errorf("tag expression is too long")
+	}
+
+	p := parser{s: s}
+
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	p.skipSpaces()
+	if p.pos < len(p.s) {
+		return nil, p.errorf("unexpected %q", p.s[p.pos])
+	}
+
+	return e, nil
+}
+
+func isSpecial(r rune) bool {
+	return r == '(' || r == ')' || r == '&' || r == '|' || r == '!' ||
+		r == '"' || unicode.IsSpace(r)
+}
+
+// isSpecialByte is like isSpecial, but for the byte of UTF-8 string: bytes of
+// multibyte characters are never special, since all the operators and
+// spaces of interest are ASCII.
+func isSpecialByte(c byte) bool {
+	return c < utf8.RuneSelf && isSpecial(rune(c))
+}
+
+type parser struct {
+	s   string
+	pos int
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return errors.Annotatef(
+		errors.Errorf(format, args...), "tag expression %q, position %d", p.s, p.pos,
+	)
+}
+
+func (p *parser) skipSpaces() {
+	for p.pos < len(p.s) && p.s[p.pos] < utf8.RuneSelf && unicode.IsSpace(rune(p.s[p.pos])) {
+		p.pos++
+	}
+}
+
+// peek skips spaces and returns the next byte, or 0 at the end of the string.
+func (p *parser) peek() byte {
+	p.skipSpaces()
+	if p.pos >= len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+// parseBinary parses the sequence of operands separated by the operator
+// character opChar; operands are parsed by parseOperand.
+func (p *parser) parseBinary(
+	op Op, opChar byte, parseOperand func() (*Expr, error),
+) (*Expr, error) {
+	e, err := parseOperand()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	args := []*Expr{e}
+	for p.peek() == opChar {
+		p.pos++
+		e, err := parseOperand()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		args = append(args, e)
+	}
+
+	if len(args) == 1 {
+		return args[0], nil
+	}
+
+	return &Expr{Op: op, Args: args}, nil
+}
+
+func (p *parser) parseOr() (*Expr, error) {
+	return p.parseBinary(OpOr, '|', p.parseAnd)
+}
+
+func (p *parser) parseAnd() (*Expr, error) {
+	return p.parseBinary(OpAnd, '&', p.parseUnary)
+}
+
+func (p *parser) parseUnary() (*Expr, error) {
+	switch p.peek() {
+	case 0:
+		return nil, p.errorf("unexpected end of expression")
+
+	case '!':
+		p.pos++
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return &Expr{Op: OpNot, Args: []*Expr{e}}, nil
+
+	case '(':
+		p.pos++
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf("missing closing parenthesis")
+		}
+		p.pos++
+		return e, nil
+
+	case '"':
+		end := strings.IndexByte(p.s[p.pos+1:], '"')
+		if end < 0 {
+			return nil, p.errorf("missing closing quote")
+		}
+		tag := p.s[p.pos+1 : p.pos+1+end]
+		p.pos += end + 2
+		if tag == "" {
+			return nil, p.errorf("empty tag")
+		}
+		return &Expr{Op: OpTag, Tag: tag}, nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.s) && !isSpecialByte(p.s[p.pos]) {
+		p.pos++
+	}
+	if p.pos == start {
+		return nil, p.errorf("unexpected %q", p.s[p.pos])
+	}
+
+	return &Expr{Op: OpTag, Tag: p.s[start:p.pos]}, nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests
+
+package tagexpr
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		in, expected string
+	}{
+		{"foo", "foo"},
+		{"  /work/go ", "/work/go"},
+		{"a & b & c", "(a & b & c)"},
+		{"a | b & c", "(a | (b & c))"},
+		{"(a | b) & c", "((a | b) & c)"},
+		{"(work/go | personal/go) & !archived", "((work/go | personal/go) & !archived)"},
+		{"!!a", "!!a"},
+		{"!(a|b)", "!(a | b)"},
+		{`"c++ & co" | d`, `("c++ & co" | d)`},
+		{"тег&foo", "(тег & foo)"},
+	}
+
+	for _, c := range cases {
+		e, err := Parse(c.in)
+		if err != nil {
+			t.Errorf("%q: %s", c.in, err)
+			continue
+		}
+
+		if got := e.String(); got != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.in, c.expected, got)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, in := range []string{
+		"", " ", "a &", "& a", "a b", "(a | b", "a)", "!", `"a`, `""`, "a | | b",
+	} {
+		if e, err := Parse(in); err == nil {
+			t.Errorf("%q: error expected, got %s", in, e)
+		}
+	}
+}
+
+func TestTags(t *testing.T) {
+	e, err := Parse("(b | a) & !b & c")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"b", "a", "c"}
+	if got := e.Tags(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
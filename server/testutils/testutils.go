@@ -14,7 +14,36 @@ import (
 	"github.com/juju/errors"
 )
 
+// resetter is implemented by storages which are able to drop all the data
+// by themselves, like the in-memory one.
+type resetter interface {
+	Reset() error
+}
+
 func PrepareTestDB(t *testing.T, si storage.Storage) error {
+	if r, ok := si.(resetter); ok {
+		t.Logf("Resetting storage...")
+		if err := r.Reset(); err != nil {
+			return errors.Annotatef(err, "resetting storage")
+		}
+	} else {
+		if err := dropAll(t, si); err != nil {
+			return errors.Trace(err)
+		}
+	}
+
+	// Init schema (apply all migrations)
+	t.Logf("Applying migrations...")
+	err := si.ApplyMigrations()
+	if err != nil {
+		return errors.Annotatef(err, "applying migrations")
+	}
+
+	return nil
+}
+
+// dropAll drops all tables and types from the Postgres database.
+func dropAll(t *testing.T, si storage.Storage) error {
 	// Drop all existing tables
 	tables, err := getAllTables(t, si)
 	if err != nil {
@@ -69,13 +98,6 @@ func PrepareTestDB(t *testing.T, si storage.Storage) error {
 		return nil
 	})
 
-	// Init schema (apply all migrations)
-	t.Logf("Applying migrations...")
-	err = si.ApplyMigrations()
-	if err != nil {
-		return errors.Annotatef(err, "applying migrations")
-	}
-
 	return nil
 }
 
@@ -0,0 +1,109 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// Package urlcanon converts URLs to the canonical form, which is used to find
+// bookmarks of the same page saved with slightly different URLs, like
+// "http://x.com/a", "https://X.com/a/" and "http://x.com/a?utm_source=foo".
+package urlcanon // import "dmitryfrank.com/geekmarks/server/urlcanon"
+
+import (
+	"net/url"
+	"strings"
+)
+
+// Rules specify which differences between URLs are not significant. The
+// scheme and host are always lowercased, default ports and the trailing
+// slash of the path are always removed, and the query parameters are sorted.
+type Rules struct {
+	// IgnoreScheme makes https URLs equal to http ones.
+	IgnoreScheme bool
+	// StripWWW removes the leading "www." from the host.
+	StripWWW bool
+	// StripFragment removes the fragment (the part after "#").
+	StripFragment bool
+	// StripParams are the names of query parameters to remove, like trackers
+	// ones. A trailing "*" matches any suffix: "utm_*" matches "utm_source".
+	StripParams []string
+}
+
+// DefaultRules returns the rules used unless configured otherwise.
+func DefaultRules() *Rules {
+	return &Rules{
+		IgnoreScheme: true,
+		StripParams: []string{
+			"utm_*", "fbclid", "gclid", "yclid", "mc_cid", "mc_eid",
+		},
+	}
+}
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// Canonicalize returns the canonical form of the URL. URLs which can't be
+// parsed are returned as they are.
+func Canonicalize(rawURL string, rules *Rules) string {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil || u.Opaque != "" {
+		return rawURL
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+
+	if u.Host != "" {
+		host := strings.ToLower(u.Hostname())
+		if rules.StripWWW {
+			host = strings.TrimPrefix(host, "www.")
+		}
+		if strings.Contains(host, ":") {
+			// IPv6 address
+			host = "[" + host + "]"
+		}
+		if port := u.Port(); port != "" && port != defaultPorts[u.Scheme] {
+			host += ":" + port
+		}
+		u.Host = host
+	}
+
+	if rules.IgnoreScheme && u.Scheme == "https" {
+		u.Scheme = "http"
+	}
+
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = strings.TrimRight(u.RawPath, "/")
+
+	if u.RawQuery != "" {
+		vals, err := url.ParseQuery(u.RawQuery)
+		if err == nil {
+			for name := range vals {
+				if matchParam(name, rules.StripParams) {
+					delete(vals, name)
+				}
+			}
+			// Encode sorts the parameters by name
+			u.RawQuery = vals.Encode()
+		}
+	}
+	u.ForceQuery = false
+
+	if rules.StripFragment {
+		u.Fragment = ""
+		u.RawFragment = ""
+	}
+
+	return u.String()
+}
+
+func matchParam(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(name, pattern[:len(pattern)-1]) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+// Copyright 2017 Dmitry Frank <mail@dmitryfrank.com>
+// Licensed under the BSD, see LICENSE file for details.
+
+// +build all_tests unit_tests
+
+package urlcanon
+
+import (
+	"testing"
+)
+
+func TestCanonicalize(t *testing.T) {
+	cases := []struct {
+		in, expected string
+	}{
+		{"http://x.com/a", "http://x.com/a"},
+		{"https://X.com/a/", "http://x.com/a"},
+		{"HTTP://x.com:80/a?utm_source=foo&utm_medium=bar", "http://x.com/a"},
+		{"https://x.com:443/", "http://x.com"},
+		{"http://x.com:8080/a//", "http://x.com:8080/a"},
+		{"http://x.com/a?b=2&a=1&fbclid=3", "http://x.com/a?a=1&b=2"},
+		{"http://x.com/a?", "http://x.com/a"},
+		{"http://x.com/A#Section", "http://x.com/A#Section"},
+		{"http://www.x.com/", "http://www.x.com"},
+		{"http://[::1]:80/a/", "http://[::1]/a"},
+		{"url_tag_1", "url_tag_1"},
+		{"mailto:foo@x.com", "mailto:foo@x.com"},
+	}
+
+	for _, c := range cases {
+		if got := Canonicalize(c.in, DefaultRules()); got != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.in, c.expected, got)
+		}
+	}
+}
+
+func TestCanonicalizeCustomRules(t *testing.T) {
+	rules := &Rules{
+		StripWWW:      true,
+		StripFragment: true,
+		StripParams:   []string{"ref"},
+	}
+
+	cases := []struct {
+		in, expected string
+	}{
+		{"https://www.x.com/a/#top", "https://x.com/a"},
+		{"http://x.com/?ref=foo&utm_source=bar", "http://x.com?utm_source=bar"},
+	}
+
+	for _, c := range cases {
+		if got := Canonicalize(c.in, rules); got != c.expected {
+			t.Errorf("%q: expected %q, got %q", c.in, c.expected, got)
+		}
+	}
+}